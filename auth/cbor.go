@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"github.com/pkg/errors"
+)
+
+// maxCborDepth limits the nesting of decoded items, the structures sent by authenticators are only a few levels deep.
+const maxCborDepth = 8
+
+var ErrInvalidCbor = errors.New("invalid cbor")
+
+// decodeCbor decodes the first item of the data and returns it along with the remaining bytes. Only the subset of CBOR
+// used by WebAuthn is supported: integers as int64, byte and text strings, arrays, maps with integer or text keys,
+// booleans and null, all with definite lengths.
+func decodeCbor(data []byte) (interface{}, []byte, error) {
+	return decodeCborItem(data, 0)
+}
+
+func decodeCborItem(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > maxCborDepth {
+		return nil, nil, errors.Wrap(ErrInvalidCbor, "nested too deeply")
+	}
+	if len(data) == 0 {
+		return nil, nil, errors.Wrap(ErrInvalidCbor, "unexpected end")
+	}
+
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+	data = data[1:]
+
+	// simple values do not have an argument
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22:
+			return nil, data, nil
+		}
+		return nil, nil, errors.Wrapf(ErrInvalidCbor, "unsupported simple value %d", info)
+	}
+
+	var argument uint64
+	switch {
+	case info < 24:
+		argument = uint64(info)
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(data) < size {
+			return nil, nil, errors.Wrap(ErrInvalidCbor, "unexpected end")
+		}
+		for _, b := range data[:size] {
+			argument = argument<<8 | uint64(b)
+		}
+		data = data[size:]
+	default:
+		return nil, nil, errors.Wrap(ErrInvalidCbor, "indefinite lengths are not supported")
+	}
+
+	switch major {
+	case 0, 1:
+		if argument > 1<<63-1 {
+			return nil, nil, errors.Wrap(ErrInvalidCbor, "integer overflow")
+		}
+		if major == 1 {
+			return -1 - int64(argument), data, nil
+		}
+		return int64(argument), data, nil
+
+	case 2, 3:
+		if argument > uint64(len(data)) {
+			return nil, nil, errors.Wrap(ErrInvalidCbor, "unexpected end")
+		}
+		value := make([]byte, argument)
+		copy(value, data[:argument])
+		if major == 3 {
+			return string(value), data[argument:], nil
+		}
+		return value, data[argument:], nil
+
+	case 4:
+		// every item takes at least one byte
+		if argument > uint64(len(data)) {
+			return nil, nil, errors.Wrap(ErrInvalidCbor, "unexpected end")
+		}
+		items := make([]interface{}, 0, argument)
+		for i := uint64(0); i < argument; i++ {
+			item, rest, err := decodeCborItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+			data = rest
+		}
+		return items, data, nil
+
+	case 5:
+		if argument > uint64(len(data))/2 {
+			return nil, nil, errors.Wrap(ErrInvalidCbor, "unexpected end")
+		}
+		items := make(map[interface{}]interface{}, argument)
+		for i := uint64(0); i < argument; i++ {
+			key, rest, err := decodeCborItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errors.Wrap(ErrInvalidCbor, "unsupported map key")
+			}
+			value, rest, err := decodeCborItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items[key] = value
+			data = rest
+		}
+		return items, data, nil
+	}
+
+	return nil, nil, errors.Wrapf(ErrInvalidCbor, "unsupported major type %d", major)
+}
+
+// decodeCborMap decodes data which has to consist of a single map.
+func decodeCborMap(data []byte) (map[interface{}]interface{}, error) {
+	item, rest, err := decodeCbor(data)
+	if err != nil {
+		return nil, err
+	}
+	result, ok := item.(map[interface{}]interface{})
+	if !ok || len(rest) > 0 {
+		return nil, errors.Wrap(ErrInvalidCbor, "expected a single map")
+	}
+	return result, nil
+}
@@ -0,0 +1,233 @@
+package auth
+
+import (
+	"github.com/dgrijalva/jwt-go"
+	"github.com/iridiumdev/webwallet-core/config"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"time"
+)
+
+var (
+	ErrInsecureSecret = errors.New("jwt secret is empty or the default one, set auth.secret or WEBWALLET_AUTH_SECRET")
+	ErrUnknownKid     = errors.New("token signed with unknown key")
+	ErrUnexpectedAlg  = errors.New("token signed with unexpected algorithm")
+	ErrInvalidPurpose = errors.New("token issued for another purpose")
+)
+
+// secrets which were shipped with the configuration or code at some point and must never be used
+var defaultSecrets = []string{"secret key", "secret", "changeme"}
+
+type signingKey struct {
+	kid       string
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// Keyring signs tokens with the active key and verifies them with the key referenced by their kid header, which may
+// also be one of the retired keys.
+type Keyring struct {
+	active *signingKey
+	keys   map[string]*signingKey
+}
+
+// InitKeyring panics if the configured keys can not be loaded, which includes a missing or default secret.
+func InitKeyring() *Keyring {
+	keyring, err := NewKeyring(config.Get().Auth)
+	if err != nil {
+		panic(err)
+	}
+	return keyring
+}
+
+func NewKeyring(settings config.Auth) (*Keyring, error) {
+	active, err := loadSigningKey(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	keyring := &Keyring{
+		active: active,
+		keys:   map[string]*signingKey{active.kid: active},
+	}
+
+	for _, retired := range settings.RetiredKeys {
+		if retired.Kid == "" {
+			return nil, errors.New("retired jwt keys need a kid")
+		}
+		if _, exists := keyring.keys[retired.Kid]; exists {
+			return nil, errors.Errorf("duplicate jwt kid '%s'", retired.Kid)
+		}
+		key, err := loadVerificationKey(retired)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not load retired jwt key '%s'", retired.Kid)
+		}
+		keyring.keys[retired.Kid] = key
+	}
+
+	if len(keyring.keys) > 1 && active.kid == "" {
+		return nil, errors.New("the active jwt key needs a kid when retired keys are configured")
+	}
+
+	return keyring, nil
+}
+
+// Sign returns the signed token for the given claims, with the kid header set if the active key has one.
+func (k *Keyring) Sign(claims jwt.MapClaims) (string, error) {
+	token := jwt.NewWithClaims(k.active.method, claims)
+	if k.active.kid != "" {
+		token.Header["kid"] = k.active.kid
+	}
+	return token.SignedString(k.active.signKey)
+}
+
+// Parse verifies the signature and expiry of the given token and returns its claims. Tokens without a kid header are
+// verified with the key without kid, which is the active key as long as no rotation happened.
+func (k *Keyring) Parse(tokenString string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := k.keys[kid]
+		if !ok {
+			return nil, ErrUnknownKid
+		}
+		if token.Method.Alg() != key.method.Alg() {
+			return nil, ErrUnexpectedAlg
+		}
+		return key.verifyKey, nil
+	})
+	if err != nil {
+		if validationErr, ok := err.(*jwt.ValidationError); ok && validationErr.Inner != nil {
+			return nil, validationErr.Inner
+		}
+		return nil, err
+	}
+
+	return token.Claims.(jwt.MapClaims), nil
+}
+
+// SignToken issues an expiring token for the given purpose, which is put in the scope claim, so it can never be used
+// as access token. It implements user.TokenSigner.
+func (k *Keyring) SignToken(purpose string, subject string, fingerprint string, ttl time.Duration) (string, error) {
+	return k.Sign(jwt.MapClaims{
+		"scope": purpose,
+		"sub":   subject,
+		"fpr":   fingerprint,
+		"exp":   time.Now().Add(ttl).Unix(),
+	})
+}
+
+// VerifyToken returns the subject and fingerprint of a token issued by SignToken for the given purpose.
+func (k *Keyring) VerifyToken(purpose string, token string) (string, string, error) {
+	claims, err := k.Parse(token)
+	if err != nil {
+		return "", "", err
+	}
+	if claims["scope"] != purpose {
+		return "", "", ErrInvalidPurpose
+	}
+
+	subject, _ := claims["sub"].(string)
+	fingerprint, _ := claims["fpr"].(string)
+	return subject, fingerprint, nil
+}
+
+func loadSigningKey(settings config.Auth) (*signingKey, error) {
+	algorithm := settings.Algorithm
+	if algorithm == "" {
+		algorithm = "HS256"
+	}
+
+	key := &signingKey{kid: settings.Kid}
+
+	switch algorithm {
+	case "HS256":
+		if !isSecure(settings.Secret) {
+			return nil, ErrInsecureSecret
+		}
+		key.method = jwt.SigningMethodHS256
+		key.signKey = []byte(settings.Secret)
+		key.verifyKey = key.signKey
+
+	case "RS256":
+		pem, err := ioutil.ReadFile(settings.PrivateKeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read jwt private key")
+		}
+		privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(pem)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not parse jwt private key")
+		}
+		key.method = jwt.SigningMethodRS256
+		key.signKey = privateKey
+		key.verifyKey = &privateKey.PublicKey
+
+	case "ES256":
+		pem, err := ioutil.ReadFile(settings.PrivateKeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read jwt private key")
+		}
+		privateKey, err := jwt.ParseECPrivateKeyFromPEM(pem)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not parse jwt private key")
+		}
+		key.method = jwt.SigningMethodES256
+		key.signKey = privateKey
+		key.verifyKey = &privateKey.PublicKey
+
+	default:
+		return nil, errors.Errorf("unsupported jwt algorithm '%s'", algorithm)
+	}
+
+	return key, nil
+}
+
+func loadVerificationKey(retired config.RetiredKey) (*signingKey, error) {
+	key := &signingKey{kid: retired.Kid}
+
+	switch retired.Algorithm {
+	case "", "HS256":
+		if !isSecure(retired.Secret) {
+			return nil, ErrInsecureSecret
+		}
+		key.method = jwt.SigningMethodHS256
+		key.verifyKey = []byte(retired.Secret)
+
+	case "RS256":
+		pem, err := ioutil.ReadFile(retired.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if key.verifyKey, err = jwt.ParseRSAPublicKeyFromPEM(pem); err != nil {
+			return nil, err
+		}
+		key.method = jwt.SigningMethodRS256
+
+	case "ES256":
+		pem, err := ioutil.ReadFile(retired.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if key.verifyKey, err = jwt.ParseECPublicKeyFromPEM(pem); err != nil {
+			return nil, err
+		}
+		key.method = jwt.SigningMethodES256
+
+	default:
+		return nil, errors.Errorf("unsupported jwt algorithm '%s'", retired.Algorithm)
+	}
+
+	return key, nil
+}
+
+func isSecure(secret string) bool {
+	if secret == "" {
+		return false
+	}
+	for _, defaultSecret := range defaultSecrets {
+		if secret == defaultSecret {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,189 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/iridiumdev/webwallet-core/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writePem(t *testing.T, dir string, name string, blockType string, der []byte) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// rsaKeyFiles returns the paths of a freshly generated RSA private and public key.
+func rsaKeyFiles(t *testing.T, dir string) (string, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writePem(t, dir, "rsa.key", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key)),
+		writePem(t, dir, "rsa.pub", "PUBLIC KEY", public)
+}
+
+func ecKeyFile(t *testing.T, dir string) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writePem(t, dir, "ec.key", "EC PRIVATE KEY", der)
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func validClaims() jwt.MapClaims {
+	return jwt.MapClaims{IdentityKey: "5c0a7f1e2b3d4e5f6a7b8c9d", "exp": time.Now().Add(time.Minute).Unix()}
+}
+
+func TestKeyringRefusesInsecureSecret(t *testing.T) {
+	for _, secret := range []string{"", "secret key"} {
+		if _, err := NewKeyring(config.Auth{Secret: secret}); err != ErrInsecureSecret {
+			t.Errorf("expected %v for secret '%s', got %v", ErrInsecureSecret, secret, err)
+		}
+	}
+}
+
+func TestKeyringSignsAndVerifiesAsymmetricKeys(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	rsaKey, _ := rsaKeyFiles(t, dir)
+
+	for _, settings := range []config.Auth{
+		{Algorithm: "RS256", PrivateKeyFile: rsaKey},
+		{Algorithm: "ES256", PrivateKeyFile: ecKeyFile(t, dir)},
+	} {
+		keyring, err := NewKeyring(settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		token, err := keyring.Sign(validClaims())
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims, err := keyring.Parse(token)
+		if err != nil {
+			t.Fatalf("expected %s token to be valid, got %v", settings.Algorithm, err)
+		}
+		if claims[IdentityKey] != validClaims()[IdentityKey] {
+			t.Errorf("expected identity to be kept, got %v", claims)
+		}
+	}
+}
+
+func TestKeyringVerifiesRetiredKeys(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	rsaKey, rsaPub := rsaKeyFiles(t, dir)
+
+	old, err := NewKeyring(config.Auth{Algorithm: "RS256", PrivateKeyFile: rsaKey, Kid: "2018-11"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldToken, _ := old.Sign(validClaims())
+
+	rotated, err := NewKeyring(config.Auth{
+		Secret: "n3w-s3cr3t",
+		Kid:    "2018-12",
+		RetiredKeys: []config.RetiredKey{
+			{Kid: "2018-11", Algorithm: "RS256", PublicKeyFile: rsaPub},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := rotated.Parse(oldToken); err != nil {
+		t.Errorf("expected token of retired key to be valid, got %v", err)
+	}
+
+	newToken, _ := rotated.Sign(validClaims())
+	parsed, _, _ := new(jwt.Parser).ParseUnverified(newToken, jwt.MapClaims{})
+	if parsed.Header["kid"] != "2018-12" {
+		t.Errorf("expected token to be signed with the active key, got kid %v", parsed.Header["kid"])
+	}
+	if _, err := old.Parse(newToken); err != ErrUnknownKid {
+		t.Errorf("expected %v, got %v", ErrUnknownKid, err)
+	}
+
+	expired := validClaims()
+	expired["exp"] = time.Now().Add(-time.Minute).Unix()
+	expiredToken, _ := old.Sign(expired)
+	if _, err := rotated.Parse(expiredToken); err == nil {
+		t.Error("expected expired token of retired key to be rejected")
+	}
+}
+
+func TestKeyringRejectsAlgorithmMismatch(t *testing.T) {
+	keyring, err := NewKeyring(config.Auth{Secret: "s3cr3t"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS512, validClaims()).SignedString([]byte("s3cr3t"))
+	if _, err := keyring.Parse(token); err != ErrUnexpectedAlg {
+		t.Errorf("expected %v, got %v", ErrUnexpectedAlg, err)
+	}
+}
+
+func TestKeyringRequiresKidForRotation(t *testing.T) {
+	_, err := NewKeyring(config.Auth{
+		Secret:      "n3w-s3cr3t",
+		RetiredKeys: []config.RetiredKey{{Kid: "old", Secret: "0ld-s3cr3t"}},
+	})
+	if err == nil {
+		t.Error("expected active key without kid to be refused")
+	}
+}
+
+func TestKeyringTokensAreBoundToPurpose(t *testing.T) {
+	keyring, err := NewKeyring(config.Auth{Secret: "s3cr3t"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := keyring.SignToken("reset-password", "5c0a7f1e2b3d4e5f6a7b8c9d", "abc", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subject, fingerprint, err := keyring.VerifyToken("reset-password", token)
+	if err != nil || subject != "5c0a7f1e2b3d4e5f6a7b8c9d" || fingerprint != "abc" {
+		t.Errorf("expected subject and fingerprint to be kept, got %s, %s (%v)", subject, fingerprint, err)
+	}
+	if _, _, err := keyring.VerifyToken("verify-email", token); err != ErrInvalidPurpose {
+		t.Errorf("expected %v, got %v", ErrInvalidPurpose, err)
+	}
+
+	expired, _ := keyring.SignToken("reset-password", "5c0a7f1e2b3d4e5f6a7b8c9d", "abc", -time.Minute)
+	if _, _, err := keyring.VerifyToken("reset-password", expired); err == nil {
+		t.Error("expected expired token to be rejected")
+	}
+}
@@ -1,88 +1,455 @@
 package auth
 
 import (
+	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
-	"github.com/iridiumdev/gin-jwt"
+	"github.com/iridiumdev/webwallet-core/config"
 	"github.com/iridiumdev/webwallet-core/user"
 	"github.com/iridiumdev/webwallet-core/util"
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
 const (
 	IdentityKey = "id"
+	SessionKey  = "sid"
+
+	ScopeAccess  = "access"
+	ScopeRefresh = "refresh"
+	// scope of the token returned by the first login step of users with mfa, it only allows the second step
+	ScopeMfa = "mfa"
+	// time of the first login step of an mfa token in nanoseconds, a failed code invalidates all earlier mfa tokens
+	FirstStepKey = "first_step"
+
+	mfaTimeout = 5 * time.Minute
+
+	claimsKey = "JWT_PAYLOAD"
+)
+
+var (
+	ErrFailedAuthentication = errors.New("incorrect Username or Password")
+	ErrMissingLoginValues   = errors.New("missing Username or Password")
+	ErrMissingToken         = errors.New("auth token is missing")
+	ErrInvalidScope         = errors.New("token has an invalid scope")
+	ErrSessionRevoked       = errors.New("session has been revoked")
+	ErrInvalidMfaCode       = errors.New("invalid mfa code")
+	ErrMissingRole          = errors.New("user does not have the required role")
 )
 
+// Middleware issues access and refresh tokens on login and authenticates the api requests with the access token
+// passed in the Authorization header or the token query parameter.
+type Middleware struct {
+	keyring     *Keyring
+	userService user.Service
+	timeout     time.Duration
+	maxRefresh  time.Duration
+
+	logoutAllHooks []func(userId string)
+
+	// login through an OpenID Connect provider, nil if not configured
+	oidc *OidcProvider
+	// page of the webapp the user is redirected to after the oidc login, with the tokens in the fragment
+	oidcLandingUrl string
+	// relying party of the passkeys, disabled without rpId
+	webauthn config.Webauthn
+}
+
+func ExtractClaims(c *gin.Context) jwt.MapClaims {
+	claims, exists := c.Get(claimsKey)
+	if !exists {
+		return jwt.MapClaims{}
+	}
+	return claims.(jwt.MapClaims)
+}
+
 func ExtractUserId(c *gin.Context) string {
-	userIdRaw := jwt.ExtractClaims(c)[IdentityKey]
-	if userIdRaw != nil && userIdRaw.(string) != "" {
-		return userIdRaw.(string)
+	userIdRaw := ExtractClaims(c)[IdentityKey]
+	if userId, ok := userIdRaw.(string); ok && userId != "" {
+		return userId
 	} else {
-		e := jwt.ErrFailedAuthentication
+		e := ErrFailedAuthentication
 		util.HandleError(c, e, http.StatusUnauthorized)
 		panic(e)
 	}
 
 }
 
-func InitMiddleware(userService user.Service) *jwt.GinJWTMiddleware {
-
-	// the jwt middleware
-
-	authMiddleware, err := jwt.New(&jwt.GinJWTMiddleware{
-		Realm:            "IRD WebWallet",
-		SigningAlgorithm: "HS256",
-		Key:              []byte("secret key"), // TODO: daniel 18.11.18 - change it to be really secret ;)
-		Timeout:          30 * time.Minute,
-		MaxRefresh:       24 * time.Hour,
-		PayloadFunc: func(data interface{}) jwt.MapClaims {
-			if v, ok := data.(*user.User); ok {
-				return jwt.MapClaims{
-					IdentityKey: v.Id,
-					"username":  v.Username,
-				}
-			}
-			return data.(jwt.MapClaims)
-		},
-		Authenticator: func(c *gin.Context) (interface{}, error) {
-
-			var login user.Login
-			if err := c.Bind(&login); err != nil {
-				return nil, jwt.ErrMissingLoginValues
-			}
-			authUser, err := userService.AuthenticateUser(login)
-			if err != nil {
-				return nil, jwt.ErrFailedAuthentication
-			}
-			return authUser, nil
-
-		},
-		IdentityKey: IdentityKey,
-		Unauthorized: func(c *gin.Context, code int, message string) {
-			util.HandleError(c, errors.New(message), code)
-		},
-		// TokenLookup is a string in the form of "<source>:<name>" that is used
-		// to extract token from the request.
-		// Optional. Default value "header:Authorization".
-		// Possible values:
-		// - "header:<name>"
-		// - "query:<name>"
-		// - "cookie:<name>"
-		TokenLookup: "header:Authorization,query:token",
-		// TokenLookup: "query:token",
-		// TokenLookup: "cookie:token",
-
-		// TokenHeadName is a string in the header. Default value is "Bearer"
-		TokenHeadName: "Bearer",
-
-		// TimeFunc provides the current time. You can override it to use another time value. This is useful for testing or if your server uses a different time zone than your tokens.
-		TimeFunc: time.Now,
+func InitMiddleware(keyring *Keyring, userService user.Service) *Middleware {
+	return NewMiddleware(keyring, config.Get().Auth, userService)
+}
+
+func NewMiddleware(keyring *Keyring, settings config.Auth, userService user.Service) *Middleware {
+	timeout := settings.TimeoutMinutes * time.Minute
+	if timeout <= 0 {
+		timeout = 30 * time.Minute
+	}
+	maxRefresh := settings.MaxRefreshHours * time.Hour
+	if maxRefresh <= 0 {
+		maxRefresh = 24 * time.Hour
+	}
+
+	return &Middleware{
+		keyring:     keyring,
+		userService: userService,
+		timeout:     timeout,
+		maxRefresh:  maxRefresh,
+		webauthn:    settings.Webauthn,
+	}
+}
+
+// TokenGenerator signs the given claims, setting the expiry according to their scope.
+func (m *Middleware) TokenGenerator(claims jwt.MapClaims) (string, time.Time, error) {
+	now := time.Now()
+
+	expire := now.Add(m.timeout)
+	switch claims["scope"] {
+	case ScopeRefresh:
+		expire = now.Add(m.maxRefresh)
+	case ScopeMfa:
+		expire = now.Add(mfaTimeout)
+	}
+
+	signed := jwt.MapClaims{}
+	for k, v := range claims {
+		signed[k] = v
+	}
+	signed["exp"] = expire.Unix()
+	signed["orig_iat"] = now.Unix()
+
+	token, err := m.keyring.Sign(signed)
+	return token, expire, err
+}
+
+// OnLogoutAll registers a hook called after all sessions of a user have been revoked, e.g. to close connections which
+// were authenticated with one of them.
+func (m *Middleware) OnLogoutAll(hook func(userId string)) {
+	m.logoutAllHooks = append(m.logoutAllHooks, hook)
+}
+
+// CreateSession starts a new session for the user, which expires together with the refresh token issued for it.
+func (m *Middleware) CreateSession(userId string) (string, error) {
+	now := time.Now()
+	session := &Session{
+		Id:        bson.NewObjectId(),
+		Owner:     bson.ObjectIdHex(userId),
+		Created:   now,
+		Refreshed: now,
+		Expires:   now.Add(m.maxRefresh),
+	}
+
+	if err := store.InsertSession(session); err != nil {
+		log.Errorf("Could not store session for user with id='%s': %s", userId, err.Error())
+		return "", err
+	}
+	return session.Id.Hex(), nil
+}
+
+func (m *Middleware) LoginHandler(c *gin.Context) {
+	var login user.Login
+	if err := c.Bind(&login); err != nil {
+		m.unauthorized(c, ErrMissingLoginValues)
+		return
+	}
+
+	authUser, err := m.userService.AuthenticateUser(login, c.ClientIP())
+	if throttledErr, ok := err.(*user.ThrottledError); ok {
+		m.throttled(c, throttledErr)
+		return
+	}
+	if err != nil {
+		m.unauthorized(c, ErrFailedAuthentication)
+		return
+	}
+
+	if authUser.MfaEnabled() {
+		m.respondWithMfaToken(c, authUser)
+		return
+	}
+
+	m.login(c, authUser.Id.Hex(), authUser.Username)
+}
+
+// LoginMfaHandler completes the login of users with mfa, given the mfa token of the first step and a TOTP or recovery
+// code. After a wrong code, the login has to start over with the first step.
+func (m *Middleware) LoginMfaHandler(c *gin.Context) {
+	var body struct {
+		MfaToken string `json:"mfa_token" binding:"required"`
+		Code     string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		m.unauthorized(c, ErrInvalidMfaCode)
+		return
+	}
+
+	claims, err := m.parse(body.MfaToken, ScopeMfa)
+	if err != nil {
+		m.unauthorized(c, err)
+		return
+	}
+
+	userId, _ := claims[IdentityKey].(string)
+	firstStep, _ := claims[FirstStepKey].(string)
+	nanos, err := strconv.ParseInt(firstStep, 10, 64)
+	if err != nil {
+		m.unauthorized(c, ErrInvalidScope)
+		return
+	}
+
+	err = m.userService.VerifyMfa(userId, body.Code, time.Unix(0, nanos))
+	if throttledErr, ok := err.(*user.ThrottledError); ok {
+		m.throttled(c, throttledErr)
+		return
+	}
+	if err == user.ErrLoginExpired {
+		m.unauthorized(c, err)
+		return
+	}
+	if err != nil {
+		m.unauthorized(c, ErrInvalidMfaCode)
+		return
+	}
+
+	username, _ := claims["username"].(string)
+	m.login(c, userId, username)
+}
+
+// login starts a new session for the user and responds with its tokens.
+func (m *Middleware) login(c *gin.Context, userId string, username string) {
+	tokens, err := m.startSession(userId, username)
+	if util.HandleError(c, err, http.StatusInternalServerError) {
+		return
+	}
+	c.JSON(http.StatusOK, tokens)
+}
+
+// startSession creates a new session for the user and issues its tokens.
+func (m *Middleware) startSession(userId string, username string) (gin.H, error) {
+	sessionId, err := m.CreateSession(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.issueTokens(jwt.MapClaims{
+		IdentityKey: userId,
+		SessionKey:  sessionId,
+		"username":  username,
+	}, "")
+}
+
+// RefreshHandler issues a new access token for the refresh token passed in the Authorization header or as
+// refresh_token in the body. The refresh token itself is handed back unchanged, so a login expires after maxRefresh.
+func (m *Middleware) RefreshHandler(c *gin.Context) {
+	token := m.lookupToken(c)
+	if token == "" {
+		var body struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		c.ShouldBindJSON(&body)
+		token = body.RefreshToken
+	}
+
+	claims, err := m.parse(token, ScopeRefresh)
+	if err != nil {
+		m.unauthorized(c, err)
+		return
+	}
+
+	if err := store.TouchSession(bson.ObjectIdHex(claims[SessionKey].(string))); err != nil {
+		log.Warnf("Could not update session '%s': %s", claims[SessionKey], err.Error())
+	}
+
+	m.respondWithTokens(c, jwt.MapClaims{
+		IdentityKey: claims[IdentityKey],
+		SessionKey:  claims[SessionKey],
+		"username":  claims["username"],
+	}, token)
+}
+
+// LogoutHandler revokes the session of the access token the request was authenticated with.
+func (m *Middleware) LogoutHandler(c *gin.Context) {
+	userId := ExtractUserId(c)
+	sessionId := ExtractClaims(c)[SessionKey].(string)
+
+	err := store.RevokeSession(bson.ObjectIdHex(sessionId), bson.ObjectIdHex(userId))
+	if util.HandleError(c, err, http.StatusInternalServerError) {
+		return
+	}
+
+	log.Infof("Revoked session '%s' of user with id='%s'", sessionId, userId)
+	c.Status(http.StatusNoContent)
+}
+
+// LogoutAllHandler logs the user out of all sessions.
+func (m *Middleware) LogoutAllHandler(c *gin.Context) {
+	err := m.LogoutAll(ExtractUserId(c))
+	if !util.HandleError(c, err, http.StatusInternalServerError) {
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// LogoutAll revokes all sessions of the user and runs the registered logout-all hooks.
+func (m *Middleware) LogoutAll(userId string) error {
+	revoked, err := store.RevokeSessions(bson.ObjectIdHex(userId))
+	if err != nil {
+		log.Errorf("Could not revoke sessions of user with id='%s': %s", userId, err.Error())
+		return err
+	}
+
+	log.Infof("Revoked %d sessions of user with id='%s'", revoked, userId)
+	for _, hook := range m.logoutAllHooks {
+		hook(userId)
+	}
+	return nil
+}
+
+// MiddlewareFunc authenticates requests with the access token of a login session, personal access tokens are only
+// accepted by TokenMiddlewareFunc.
+func (m *Middleware) MiddlewareFunc() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		m.authenticate(c, m.lookupToken(c))
+	}
+}
+
+func (m *Middleware) authenticate(c *gin.Context, token string) {
+	claims, err := m.parse(token, ScopeAccess)
+	if err != nil {
+		m.unauthorized(c, err)
+		return
+	}
+
+	c.Set(claimsKey, claims)
+	c.Set(IdentityKey, claims[IdentityKey])
+	c.Next()
+}
+
+// RequireRole rejects requests of users without the role. The roles are looked up on every request, so a revoked role
+// takes effect immediately.
+func (m *Middleware) RequireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		authUser, err := m.userService.GetUser(ExtractUserId(c))
+		if err != nil || !authUser.HasRole(role) {
+			util.HandleError(c, ErrMissingRole, http.StatusForbidden)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// respondWithTokens issues an access token for the given claims and a refresh token, unless one is given.
+func (m *Middleware) respondWithTokens(c *gin.Context, claims jwt.MapClaims, refreshToken string) {
+	tokens, err := m.issueTokens(claims, refreshToken)
+	if err != nil {
+		m.unauthorized(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, tokens)
+}
+
+func (m *Middleware) issueTokens(claims jwt.MapClaims, refreshToken string) (gin.H, error) {
+	claims["scope"] = ScopeAccess
+	accessToken, expire, err := m.TokenGenerator(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	if refreshToken == "" {
+		claims["scope"] = ScopeRefresh
+		if refreshToken, _, err = m.TokenGenerator(claims); err != nil {
+			return nil, err
+		}
+	}
+
+	return gin.H{
+		"code":          http.StatusOK,
+		"access_token":  accessToken,
+		"refresh_token": refreshToken,
+		"expire":        expire.Format(time.RFC3339),
+	}, nil
+}
+
+func (m *Middleware) respondWithMfaToken(c *gin.Context, authUser *user.User) {
+	mfaToken, err := m.issueMfaToken(authUser)
+	if err != nil {
+		m.unauthorized(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, mfaToken)
+}
+
+// issueMfaToken issues the token of the first login step of users with mfa, which only allows the second step.
+func (m *Middleware) issueMfaToken(authUser *user.User) (gin.H, error) {
+	mfaToken, expire, err := m.TokenGenerator(jwt.MapClaims{
+		IdentityKey:  authUser.Id.Hex(),
+		FirstStepKey: strconv.FormatInt(time.Now().UnixNano(), 10),
+		"username":   authUser.Username,
+		"scope":      ScopeMfa,
 	})
+	if err != nil {
+		return nil, err
+	}
 
+	return gin.H{
+		"code":         http.StatusOK,
+		"mfa_required": true,
+		"mfa_token":    mfaToken,
+		"expire":       expire.Format(time.RFC3339),
+	}, nil
+}
+
+// parse verifies the token, its scope and that the session it was issued for is still active. Mfa tokens are issued
+// before the session is created.
+func (m *Middleware) parse(token string, scope string) (jwt.MapClaims, error) {
+	if token == "" {
+		return nil, ErrMissingToken
+	}
+
+	claims, err := m.keyring.Parse(token)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+
+	if claims["scope"] != scope {
+		return nil, ErrInvalidScope
+	}
+	if scope == ScopeMfa {
+		return claims, nil
+	}
+
+	userId, _ := claims[IdentityKey].(string)
+	sessionId, _ := claims[SessionKey].(string)
+	if !bson.IsObjectIdHex(userId) || !bson.IsObjectIdHex(sessionId) {
+		return nil, ErrSessionRevoked
 	}
+	session, err := store.FindSession(bson.ObjectIdHex(sessionId))
+	if err != nil || session.Owner.Hex() != userId || !session.IsActive() {
+		return nil, ErrSessionRevoked
+	}
+
+	return claims, nil
+}
+
+func (m *Middleware) lookupToken(c *gin.Context) string {
+	header := c.GetHeader("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+	return c.Query("token")
+}
+
+// throttled answers with 429 and tells the client how long to wait before the next attempt.
+func (m *Middleware) throttled(c *gin.Context, err *user.ThrottledError) {
+	c.Header("Retry-After", strconv.Itoa(int(err.RetryAfter.Seconds())+1))
+	util.HandleError(c, err, http.StatusTooManyRequests)
+	c.Abort()
+}
 
-	return authMiddleware
+func (m *Middleware) unauthorized(c *gin.Context, err error) {
+	util.HandleError(c, err, http.StatusUnauthorized)
+	c.Abort()
 }
@@ -0,0 +1,146 @@
+package auth
+
+import (
+	"bytes"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/iridiumdev/webwallet-core/user"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// fakeUserService only implements the methods used by the middleware, all others panic.
+type fakeUserService struct {
+	user.Service
+	users map[string]*user.User
+}
+
+func (s *fakeUserService) GetUser(userId string) (*user.User, error) {
+	if u, ok := s.users[userId]; ok {
+		return u, nil
+	}
+	return nil, user.ErrUserNotFound
+}
+
+// fakeStore keeps the oidc states, passkeys and sessions in memory, all other methods panic.
+type fakeStore struct {
+	Store
+	states     map[string]*OidcState
+	sessions   []*Session
+	passkeys   []*Passkey
+	challenges map[string]*WebauthnChallenge
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{states: map[string]*OidcState{}, challenges: map[string]*WebauthnChallenge{}}
+}
+
+func (s *fakeStore) InsertOidcState(state *OidcState) error {
+	s.states[state.Id] = state
+	return nil
+}
+
+func (s *fakeStore) ConsumeOidcState(stateId string) (*OidcState, error) {
+	state, ok := s.states[stateId]
+	if !ok {
+		return nil, mgo.ErrNotFound
+	}
+	delete(s.states, stateId)
+	return state, nil
+}
+
+func (s *fakeStore) InsertSession(session *Session) error {
+	s.sessions = append(s.sessions, session)
+	return nil
+}
+
+func (s *fakeStore) InsertPasskey(passkey *Passkey) error {
+	for _, p := range s.passkeys {
+		if bytes.Equal(p.CredentialId, passkey.CredentialId) {
+			return &mgo.LastError{Code: 11000}
+		}
+	}
+	s.passkeys = append(s.passkeys, passkey)
+	return nil
+}
+
+func (s *fakeStore) FindPasskey(credentialId []byte) (*Passkey, error) {
+	for _, p := range s.passkeys {
+		if bytes.Equal(p.CredentialId, credentialId) {
+			stored := *p
+			return &stored, nil
+		}
+	}
+	return nil, mgo.ErrNotFound
+}
+
+func (s *fakeStore) FindPasskeysByOwner(userId bson.ObjectId) ([]*Passkey, error) {
+	result := []*Passkey{}
+	for _, p := range s.passkeys {
+		if p.Owner == userId {
+			result = append(result, p)
+		}
+	}
+	return result, nil
+}
+
+func (s *fakeStore) UpdatePasskeySignCount(passkeyId bson.ObjectId, current uint32, signCount uint32) error {
+	for _, p := range s.passkeys {
+		if p.Id == passkeyId && p.SignCount == current {
+			p.SignCount = signCount
+			return nil
+		}
+	}
+	return mgo.ErrNotFound
+}
+
+func (s *fakeStore) InsertChallenge(challenge *WebauthnChallenge) error {
+	s.challenges[challenge.Id] = challenge
+	return nil
+}
+
+func (s *fakeStore) ConsumeChallenge(challengeId string) (*WebauthnChallenge, error) {
+	challenge, ok := s.challenges[challengeId]
+	if !ok {
+		return nil, mgo.ErrNotFound
+	}
+	delete(s.challenges, challengeId)
+	return challenge, nil
+}
+
+func TestRequireRole(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	admin := &user.User{Id: bson.NewObjectId(), Roles: []string{user.RoleAdmin}}
+	regular := &user.User{Id: bson.NewObjectId()}
+	m := &Middleware{userService: &fakeUserService{users: map[string]*user.User{
+		admin.Id.Hex():   admin,
+		regular.Id.Hex(): regular,
+	}}}
+
+	serve := func(userId string) int {
+		engine := gin.New()
+		engine.GET("/admin", func(c *gin.Context) {
+			c.Set(claimsKey, jwt.MapClaims{IdentityKey: userId})
+		}, m.RequireRole(user.RoleAdmin), func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/admin", nil))
+		return recorder.Code
+	}
+
+	if status := serve(admin.Id.Hex()); status != http.StatusOK {
+		t.Errorf("expected admin to pass, got %d", status)
+	}
+	if status := serve(regular.Id.Hex()); status != http.StatusForbidden {
+		t.Errorf("expected regular user to be forbidden, got %d", status)
+	}
+	if status := serve(bson.NewObjectId().Hex()); status != http.StatusForbidden {
+		t.Errorf("expected unknown user to be forbidden, got %d", status)
+	}
+}
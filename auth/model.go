@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"github.com/iridiumdev/webwallet-core/user"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+// Session is created on login and referenced by the sid claim of all tokens issued for that login. Revoking it
+// invalidates the refresh token as well as all access tokens, which would otherwise stay valid until they expire.
+type Session struct {
+	Id        bson.ObjectId `json:"id" bson:"_id,omitempty"`
+	Owner     bson.ObjectId `json:"-" bson:"owner"`
+	Created   time.Time     `json:"created" bson:"created"`
+	Refreshed time.Time     `json:"refreshed" bson:"refreshed"`
+	Expires   time.Time     `json:"expires" bson:"expires"`
+	Revoked   bool          `json:"revoked" bson:"revoked"`
+}
+
+func (s *Session) IsActive() bool {
+	return !s.Revoked && time.Now().Before(s.Expires)
+}
+
+// AccessToken is a personal access token for programmatic access to the wallet and event api. Only the sha256 hash of
+// the token is stored, the token itself is handed out once on creation.
+type AccessToken struct {
+	Id     bson.ObjectId `json:"id" bson:"_id,omitempty"`
+	Owner  bson.ObjectId `json:"-" bson:"owner"`
+	Name   string        `json:"name" bson:"name"`
+	Hash   string        `json:"-" bson:"hash"`
+	Scopes []string      `json:"scopes" bson:"scopes"`
+	// ids of the wallets the token is restricted to, all wallets of the owner if empty
+	Wallets  []string   `json:"wallets,omitempty" bson:"wallets,omitempty"`
+	Created  time.Time  `json:"created" bson:"created"`
+	LastUsed *time.Time `json:"lastUsed,omitempty" bson:"lastUsed,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty" bson:"expires,omitempty"`
+}
+
+func (t *AccessToken) IsActive() bool {
+	return t.Expires == nil || time.Now().Before(*t.Expires)
+}
+
+func (t *AccessToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *AccessToken) PermitsWallet(walletId string) bool {
+	if len(t.Wallets) == 0 {
+		return true
+	}
+	for _, w := range t.Wallets {
+		if w == walletId {
+			return true
+		}
+	}
+	return false
+}
+
+type AccessTokenDTO struct {
+	Name    string   `json:"name" binding:"required"`
+	Scopes  []string `json:"scopes" binding:"required"`
+	Wallets []string `json:"wallets"`
+	// the token never expires if not set
+	ExpiresInDays int `json:"expiresInDays"`
+}
+
+// CreatedAccessToken is the response on creation, the only time the token itself is returned.
+type CreatedAccessToken struct {
+	*AccessToken
+	Token string `json:"token"`
+}
+
+// OidcState is kept between redirecting the user to the OpenID Connect provider and its callback. Its id is passed as
+// state parameter, the verifier is the PKCE secret for the code exchange and the nonce has to be in the id token.
+type OidcState struct {
+	Id       string    `bson:"_id"`
+	Nonce    string    `bson:"nonce"`
+	Verifier string    `bson:"verifier"`
+	Expires  time.Time `bson:"expires"`
+}
+
+// Passkey is a WebAuthn credential registered by a user. The public key is kept in its COSE encoding as received from
+// the authenticator.
+type Passkey struct {
+	Id           bson.ObjectId `json:"id" bson:"_id,omitempty"`
+	Owner        bson.ObjectId `json:"-" bson:"owner"`
+	Name         string        `json:"name" bson:"name"`
+	CredentialId []byte        `json:"-" bson:"credentialId"`
+	PublicKey    []byte        `json:"-" bson:"publicKey"`
+	// signature counter of the authenticator, which never decreases unless the credential was cloned
+	SignCount uint32     `json:"-" bson:"signCount"`
+	Created   time.Time  `json:"created" bson:"created"`
+	LastUsed  *time.Time `json:"lastUsed,omitempty" bson:"lastUsed,omitempty"`
+}
+
+// WebauthnChallenge is issued for a single registration or assertion. Its id is the challenge itself, the user is
+// only known for registrations and step-ups, a login finds the user through the credential.
+type WebauthnChallenge struct {
+	Id      string        `bson:"_id"`
+	Purpose string        `bson:"purpose"`
+	UserId  bson.ObjectId `bson:"userId,omitempty"`
+	Expires time.Time     `bson:"expires"`
+}
+
+// PasskeyDTO registers a passkey, confirmed like any change of the credentials with the current password, a TOTP code
+// or the step-up token of another passkey.
+type PasskeyDTO struct {
+	user.Reauthentication
+	Name string `json:"name" binding:"required,max=255"`
+	// base64url encoded fields of the PublicKeyCredential returned by navigator.credentials.create
+	ClientDataJSON    string `json:"clientDataJSON" binding:"required"`
+	AttestationObject string `json:"attestationObject" binding:"required"`
+}
+
+// AssertionDTO holds the base64url encoded fields of the PublicKeyCredential returned by navigator.credentials.get.
+type AssertionDTO struct {
+	Id                string `json:"id" binding:"required"`
+	ClientDataJSON    string `json:"clientDataJSON" binding:"required"`
+	AuthenticatorData string `json:"authenticatorData" binding:"required"`
+	Signature         string `json:"signature" binding:"required"`
+	UserHandle        string `json:"userHandle"`
+}
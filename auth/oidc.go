@@ -0,0 +1,472 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/iridiumdev/webwallet-core/config"
+	"github.com/iridiumdev/webwallet-core/user"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oidcStateTimeout = 10 * time.Minute
+	// the state is also kept in this cookie, so the callback only completes logins started by the same browser
+	oidcStateCookie = "oidc_state"
+	oidcCookiePath  = "/auth/oidc"
+	// the keys of the provider are fetched again on an unknown kid, but not more often than this
+	oidcKeysMinAge = time.Minute
+)
+
+var (
+	ErrOidcDisabled     = errors.New("oidc login is not configured")
+	ErrOidcInvalidState = errors.New("invalid or expired oidc state")
+	ErrOidcExchange     = errors.New("oidc code exchange failed")
+	ErrOidcInvalidToken = errors.New("invalid oidc id token")
+)
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+type oidcJwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// OidcProvider implements the authorization code flow with PKCE against an OpenID Connect provider. The discovery
+// document and the signing keys of the provider are fetched on first use and cached.
+type OidcProvider struct {
+	settings config.Oidc
+	client   *http.Client
+
+	mx          sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]interface{}
+	keysFetched time.Time
+}
+
+func NewOidcProvider(settings config.Oidc) *OidcProvider {
+	settings.Issuer = strings.TrimSuffix(settings.Issuer, "/")
+	return &OidcProvider{
+		settings: settings,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// EnableOidc enables the login through the provider. After the login, the user is redirected to the landing url with
+// the tokens in its fragment, which is never sent to any server.
+func (m *Middleware) EnableOidc(provider *OidcProvider, landingUrl string) {
+	m.oidc = provider
+	m.oidcLandingUrl = landingUrl
+}
+
+// OidcLoginHandler redirects the user to the provider.
+func (m *Middleware) OidcLoginHandler(c *gin.Context) {
+	if m.oidc == nil {
+		m.unauthorized(c, ErrOidcDisabled)
+		return
+	}
+
+	state := &OidcState{Expires: time.Now().Add(oidcStateTimeout)}
+	for _, value := range []*string{&state.Id, &state.Nonce, &state.Verifier} {
+		random, err := randomString()
+		if err != nil {
+			m.unauthorized(c, err)
+			return
+		}
+		*value = random
+	}
+
+	authUrl, err := m.oidc.authCodeUrl(state)
+	if err != nil {
+		log.Errorf("Could not discover oidc provider %s: %s", m.oidc.settings.Issuer, err.Error())
+		m.unauthorized(c, err)
+		return
+	}
+	if err := store.InsertOidcState(state); err != nil {
+		log.Errorf("Could not store oidc state: %s", err.Error())
+		m.unauthorized(c, err)
+		return
+	}
+
+	m.setOidcStateCookie(c, state.Id, int(oidcStateTimeout.Seconds()))
+	c.Redirect(http.StatusFound, authUrl)
+}
+
+// OidcCallbackHandler completes the login with the authorization code the provider redirected the user back with.
+func (m *Middleware) OidcCallbackHandler(c *gin.Context) {
+	if m.oidc == nil {
+		m.unauthorized(c, ErrOidcDisabled)
+		return
+	}
+
+	browserState, _ := c.Cookie(oidcStateCookie)
+	m.setOidcStateCookie(c, "", -1)
+
+	tokens, err := m.oidcLogin(c.Query("state"), browserState, c.Query("code"), c.Query("error"))
+	if err != nil {
+		log.Warnf("Failed oidc login: %s", err.Error())
+		m.redirectToLanding(c, url.Values{"error": {err.Error()}})
+		return
+	}
+
+	fragment := url.Values{}
+	for key, value := range tokens {
+		fragment.Set(key, fmt.Sprint(value))
+	}
+	m.redirectToLanding(c, fragment)
+}
+
+func (m *Middleware) oidcLogin(stateId string, browserState string, code string, providerErr string) (gin.H, error) {
+	// a callback without the cookie of the login may have been forged to log the browser into another account
+	if stateId == "" || subtle.ConstantTimeCompare([]byte(stateId), []byte(browserState)) != 1 {
+		return nil, ErrOidcInvalidState
+	}
+	// the state is consumed even if the provider reports an error, so it can not be used again
+	state, err := store.ConsumeOidcState(stateId)
+	if err != nil || state == nil || time.Now().After(state.Expires) {
+		return nil, ErrOidcInvalidState
+	}
+	if providerErr != "" {
+		return nil, errors.Errorf("oidc provider returned %s", providerErr)
+	}
+
+	idToken, err := m.oidc.exchange(code, state.Verifier)
+	if err != nil {
+		return nil, err
+	}
+	login, err := m.oidc.verify(idToken, state.Nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	authUser, err := m.userService.AuthenticateExternal(*login)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("User with id='%s' logged in through %s", authUser.Id.Hex(), login.Issuer)
+	if authUser.MfaEnabled() {
+		return m.issueMfaToken(authUser)
+	}
+	return m.startSession(authUser.Id.Hex(), authUser.Username)
+}
+
+// setOidcStateCookie sets the state cookie, which has to be sent along with the redirect of the provider and therefore
+// only uses the lax same site mode. A negative max age deletes it.
+func (m *Middleware) setOidcStateCookie(c *gin.Context, state string, maxAge int) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     oidcCookiePath,
+		MaxAge:   maxAge,
+		Secure:   strings.HasPrefix(m.oidcLandingUrl, "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (m *Middleware) redirectToLanding(c *gin.Context, fragment url.Values) {
+	c.Redirect(http.StatusFound, m.oidcLandingUrl+"#"+fragment.Encode())
+}
+
+func (p *OidcProvider) authCodeUrl(state *OidcState) (string, error) {
+	discovery, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(state.Verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.settings.ClientId},
+		"redirect_uri":          {p.settings.RedirectUrl},
+		"scope":                 {strings.Join(append([]string{"openid", "email", "profile"}, p.settings.Scopes...), " ")},
+		"state":                 {state.Id},
+		"nonce":                 {state.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + params.Encode(), nil
+}
+
+// exchange redeems the authorization code for the id token.
+func (p *OidcProvider) exchange(code string, verifier string) (string, error) {
+	discovery, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.settings.RedirectUrl},
+		"client_id":     {p.settings.ClientId},
+		"code_verifier": {verifier},
+	}
+	request, err := http.NewRequest(http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	if p.settings.ClientSecret != "" {
+		request.SetBasicAuth(url.QueryEscape(p.settings.ClientId), url.QueryEscape(p.settings.ClientSecret))
+	}
+
+	response, err := p.client.Do(request)
+	if err != nil {
+		return "", errors.Wrap(ErrOidcExchange, err.Error())
+	}
+	defer response.Body.Close()
+
+	var body struct {
+		IdToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil || response.StatusCode != http.StatusOK {
+		return "", errors.Wrapf(ErrOidcExchange, "status %d %s", response.StatusCode, body.Error)
+	}
+	if body.IdToken == "" {
+		return "", errors.Wrap(ErrOidcExchange, "no id token")
+	}
+	return body.IdToken, nil
+}
+
+// verify checks the signature, issuer, audience, expiry and nonce of the id token and returns the login it proves.
+func (p *OidcProvider) verify(idToken string, nonce string) (*user.ExternalLogin, error) {
+	token, err := jwt.Parse(idToken, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, err := p.key(kid)
+		if err != nil {
+			return nil, err
+		}
+
+		switch key.(type) {
+		case *rsa.PublicKey:
+			if token.Method != jwt.SigningMethodRS256 {
+				return nil, ErrUnexpectedAlg
+			}
+		case *ecdsa.PublicKey:
+			if token.Method != jwt.SigningMethodES256 {
+				return nil, ErrUnexpectedAlg
+			}
+		}
+		return key, nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(ErrOidcInvalidToken, err.Error())
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	if claims["iss"] != p.settings.Issuer {
+		return nil, errors.Wrap(ErrOidcInvalidToken, "issuer")
+	}
+	if !p.hasAudience(claims) {
+		return nil, errors.Wrap(ErrOidcInvalidToken, "audience")
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, errors.Wrap(ErrOidcInvalidToken, "expiry")
+	}
+	if claims["nonce"] != nonce {
+		return nil, errors.Wrap(ErrOidcInvalidToken, "nonce")
+	}
+
+	login := &user.ExternalLogin{Issuer: p.settings.Issuer}
+	login.Subject, _ = claims["sub"].(string)
+	login.Email, _ = claims["email"].(string)
+	// some providers send the flag as string
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		login.EmailVerified = verified
+	case string:
+		login.EmailVerified = verified == "true"
+	}
+	if login.Subject == "" {
+		return nil, errors.Wrap(ErrOidcInvalidToken, "subject")
+	}
+	return login, nil
+}
+
+// hasAudience reports whether the token was issued for this client. Tokens for several audiences have to name this
+// client as authorized party.
+func (p *OidcProvider) hasAudience(claims jwt.MapClaims) bool {
+	var audiences []string
+	switch aud := claims["aud"].(type) {
+	case string:
+		audiences = []string{aud}
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				audiences = append(audiences, s)
+			}
+		}
+	}
+
+	found := false
+	for _, audience := range audiences {
+		found = found || audience == p.settings.ClientId
+	}
+	if len(audiences) > 1 && claims["azp"] != p.settings.ClientId {
+		return false
+	}
+	return found
+}
+
+func (p *OidcProvider) discover() (*oidcDiscovery, error) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	discovery := &oidcDiscovery{}
+	if err := p.getJson(p.settings.Issuer+"/.well-known/openid-configuration", discovery); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != p.settings.Issuer {
+		return nil, errors.Errorf("oidc provider claims to be issuer %s", discovery.Issuer)
+	}
+
+	p.discovery = discovery
+	return discovery, nil
+}
+
+// key returns the signing key with the given kid, fetching the keys of the provider again if it is unknown as the
+// provider may have rotated its keys.
+func (p *OidcProvider) key(kid string) (interface{}, error) {
+	discovery, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetched) < oidcKeysMinAge {
+		return nil, ErrUnknownKid
+	}
+
+	var jwks struct {
+		Keys []oidcJwk `json:"keys"`
+	}
+	if err := p.getJson(discovery.JwksUri, &jwks); err != nil {
+		return nil, err
+	}
+
+	p.keys = make(map[string]interface{})
+	p.keysFetched = time.Now()
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			log.Warnf("Skipping key '%s' of oidc provider: %s", jwk.Kid, err.Error())
+			continue
+		}
+		p.keys[jwk.Kid] = key
+	}
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, ErrUnknownKid
+}
+
+func (p *OidcProvider) getJson(location string, result interface{}) error {
+	response, err := p.client.Get(location)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return errors.Errorf("%s responded with status %d", location, response.StatusCode)
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+func (jwk *oidcJwk) publicKey() (interface{}, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, errors.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, errors.Errorf("unsupported key type %s", jwk.Kty)
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	bytes, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(bytes), nil
+}
+
+// randomString returns 32 random bytes, base64url encoded.
+func randomString() (string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(random), nil
+}
@@ -0,0 +1,222 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/iridiumdev/webwallet-core/config"
+	"github.com/iridiumdev/webwallet-core/user"
+	"gopkg.in/mgo.v2/bson"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func (s *fakeUserService) AuthenticateExternal(login user.ExternalLogin) (*user.User, error) {
+	for _, u := range s.users {
+		if login.EmailVerified && u.Email == login.Email {
+			return u, nil
+		}
+	}
+	return nil, user.ErrUserNotFound
+}
+
+// mockOidcProvider is a minimal OpenID Connect provider, which issues an id token for a single authorization code
+// once the PKCE verifier matches the challenge of the authorization request.
+type mockOidcProvider struct {
+	*httptest.Server
+	code      string
+	challenge string
+	claims    jwt.MapClaims
+}
+
+func newMockOidcProvider(t *testing.T) *mockOidcProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &mockOidcProvider{code: "c0de"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                p.URL,
+			AuthorizationEndpoint: p.URL + "/authorize",
+			TokenEndpoint:         p.URL + "/token",
+			JwksUri:               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string][]oidcJwk{"keys": {{
+			Kty: "RSA",
+			Kid: "k1",
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if r.PostFormValue("code") != p.code || base64.RawURLEncoding.EncodeToString(verifier[:]) != p.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, p.claims)
+		token.Header["kid"] = "k1"
+		idToken, err := token.SignedString(key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idToken, "token_type": "Bearer"})
+	})
+	p.Server = httptest.NewServer(mux)
+	return p
+}
+
+func TestOidcLogin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	provider := newMockOidcProvider(t)
+	defer provider.Close()
+
+	authStore := newFakeStore()
+	store = authStore
+
+	keyring, err := NewKeyring(config.Auth{Secret: "s3cr3t"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := &user.User{Id: bson.NewObjectId(), Username: "alice", Email: "alice@ird.cash"}
+	m := NewMiddleware(keyring, config.Auth{}, &fakeUserService{users: map[string]*user.User{alice.Id.Hex(): alice}})
+	m.EnableOidc(NewOidcProvider(config.Oidc{
+		Issuer:      provider.URL + "/",
+		ClientId:    "webwallet",
+		RedirectUrl: "http://localhost/auth/oidc/callback",
+	}), "http://localhost/login/oidc")
+
+	engine := gin.New()
+	engine.GET("/auth/oidc/login", m.OidcLoginHandler)
+	engine.GET("/auth/oidc/callback", m.OidcCallbackHandler)
+
+	redirect := func(path string, cookies ...*http.Cookie) (*url.URL, []*http.Cookie) {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, path, nil)
+		for _, cookie := range cookies {
+			request.AddCookie(cookie)
+		}
+		engine.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusFound {
+			t.Fatalf("expected a redirect from %s, got %d", path, recorder.Code)
+		}
+		location, err := url.Parse(recorder.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return location, recorder.Result().Cookies()
+	}
+	callbackFragment := func(callback string, cookies ...*http.Cookie) url.Values {
+		landing, _ := redirect(callback, cookies...)
+		fragment, err := url.ParseQuery(landing.Fragment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fragment
+	}
+
+	// authorize starts the authorization request and returns the callback the provider would redirect to along with
+	// the state cookie of the browser
+	authorize := func(claims func(nonce string) jwt.MapClaims) (string, *http.Cookie) {
+		location, cookies := redirect("/auth/oidc/login")
+		params := location.Query()
+		if params.Get("code_challenge_method") != "S256" || params.Get("client_id") != "webwallet" {
+			t.Fatalf("expected an authorization request with PKCE, got %v", params)
+		}
+		if len(cookies) != 1 || cookies[0].Value != params.Get("state") || !cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteLaxMode {
+			t.Fatalf("expected an http only state cookie, got %v", cookies)
+		}
+		provider.challenge = params.Get("code_challenge")
+		provider.claims = claims(params.Get("nonce"))
+
+		return "/auth/oidc/callback?" + url.Values{"code": {provider.code}, "state": {params.Get("state")}}.Encode(), cookies[0]
+	}
+	login := func(claims func(nonce string) jwt.MapClaims) url.Values {
+		callback, cookie := authorize(claims)
+		return callbackFragment(callback, cookie)
+	}
+
+	validClaims := func(nonce string) jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss":            provider.URL,
+			"aud":            "webwallet",
+			"sub":            "ext-1",
+			"exp":            time.Now().Add(time.Minute).Unix(),
+			"nonce":          nonce,
+			"email":          alice.Email,
+			"email_verified": true,
+		}
+	}
+
+	// the callback is refused without the state cookie, e.g. if an attacker sends the victim their own callback
+	_, otherCookie := authorize(validClaims)
+	callback, cookie := authorize(validClaims)
+	if forged := callbackFragment(callback); forged.Get("error") != ErrOidcInvalidState.Error() {
+		t.Errorf("expected a callback without the state cookie to fail, got %v", forged)
+	}
+	if forged := callbackFragment(callback, otherCookie); forged.Get("error") != ErrOidcInvalidState.Error() {
+		t.Errorf("expected a callback with the cookie of another login to fail, got %v", forged)
+	}
+
+	fragment := callbackFragment(callback, cookie)
+	if fragment.Get("access_token") == "" || fragment.Get("refresh_token") == "" {
+		t.Fatalf("expected tokens in the fragment, got %v", fragment)
+	}
+	claims, err := keyring.Parse(fragment.Get("access_token"))
+	if err != nil || claims[IdentityKey] != alice.Id.Hex() || len(authStore.sessions) != 1 {
+		t.Errorf("expected a session of alice, got %v %v", claims, err)
+	}
+
+	// the state is consumed by the first callback
+	if replayed := callbackFragment(callback, cookie); replayed.Get("error") != ErrOidcInvalidState.Error() {
+		t.Errorf("expected a replayed callback to fail, got %v", replayed)
+	}
+
+	invalid := map[string]func(nonce string) jwt.MapClaims{
+		"wrong nonce": func(nonce string) jwt.MapClaims {
+			claims := validClaims(nonce)
+			claims["nonce"] = "other"
+			return claims
+		},
+		"wrong audience": func(nonce string) jwt.MapClaims {
+			claims := validClaims(nonce)
+			claims["aud"] = "other"
+			return claims
+		},
+		"expired": func(nonce string) jwt.MapClaims {
+			claims := validClaims(nonce)
+			claims["exp"] = time.Now().Add(-time.Minute).Unix()
+			return claims
+		},
+		"unverified email": func(nonce string) jwt.MapClaims {
+			claims := validClaims(nonce)
+			claims["email_verified"] = "false"
+			return claims
+		},
+	}
+	for name, claims := range invalid {
+		if fragment := login(claims); fragment.Get("access_token") != "" || fragment.Get("error") == "" {
+			t.Errorf("expected the login with %s to fail, got %v", name, fragment)
+		}
+	}
+	if len(authStore.sessions) != 1 {
+		t.Errorf("expected no further sessions, got %d", len(authStore.sessions))
+	}
+}
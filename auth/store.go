@@ -0,0 +1,193 @@
+package auth
+
+import (
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+type mongoDb struct {
+	db           *mgo.Database
+	sessions     *mgo.Collection
+	accessTokens *mgo.Collection
+	oidcStates   *mgo.Collection
+	passkeys     *mgo.Collection
+	challenges   *mgo.Collection
+}
+
+type Store interface {
+	InsertSession(session *Session) error
+	FindSession(sessionId bson.ObjectId) (*Session, error)
+	TouchSession(sessionId bson.ObjectId) error
+	RevokeSession(sessionId bson.ObjectId, userId bson.ObjectId) error
+	RevokeSessions(userId bson.ObjectId) (int, error)
+
+	InsertAccessToken(token *AccessToken) error
+	FindAccessTokenByHash(hash string) (*AccessToken, error)
+	FindAccessTokensByOwner(userId bson.ObjectId) ([]*AccessToken, error)
+	TouchAccessToken(tokenId bson.ObjectId) error
+	DeleteAccessToken(tokenId bson.ObjectId, userId bson.ObjectId) error
+	DeleteAccessTokens(userId bson.ObjectId) (int, error)
+
+	InsertOidcState(state *OidcState) error
+	// ConsumeOidcState removes and returns the state, so every authorization response can only be used once.
+	ConsumeOidcState(stateId string) (*OidcState, error)
+
+	InsertPasskey(passkey *Passkey) error
+	FindPasskey(credentialId []byte) (*Passkey, error)
+	FindPasskeysByOwner(userId bson.ObjectId) ([]*Passkey, error)
+	// UpdatePasskeySignCount only updates the counter if it is still the given one, so an assertion can not be counted
+	// twice.
+	UpdatePasskeySignCount(passkeyId bson.ObjectId, current uint32, signCount uint32) error
+	DeletePasskey(passkeyId bson.ObjectId, userId bson.ObjectId) error
+	DeletePasskeys(userId bson.ObjectId) (int, error)
+
+	InsertChallenge(challenge *WebauthnChallenge) error
+	// ConsumeChallenge removes and returns the challenge, so every challenge can only be answered once.
+	ConsumeChallenge(challengeId string) (*WebauthnChallenge, error)
+}
+
+var store Store
+
+func (db *mongoDb) InsertSession(session *Session) error {
+	err := db.sessions.Insert(session)
+	return err
+}
+
+func (db *mongoDb) FindSession(sessionId bson.ObjectId) (*Session, error) {
+	var result *Session
+	err := db.sessions.FindId(sessionId).One(&result)
+	return result, err
+}
+
+func (db *mongoDb) TouchSession(sessionId bson.ObjectId) error {
+	return db.sessions.UpdateId(sessionId, bson.M{"$set": bson.M{"refreshed": time.Now()}})
+}
+
+func (db *mongoDb) RevokeSession(sessionId bson.ObjectId, userId bson.ObjectId) error {
+	return db.sessions.Update(bson.M{"_id": sessionId, "owner": userId}, bson.M{"$set": bson.M{"revoked": true}})
+}
+
+func (db *mongoDb) RevokeSessions(userId bson.ObjectId) (int, error) {
+	info, err := db.sessions.UpdateAll(
+		bson.M{"owner": userId, "revoked": false},
+		bson.M{"$set": bson.M{"revoked": true}},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return info.Updated, nil
+}
+
+func (db *mongoDb) InsertAccessToken(token *AccessToken) error {
+	return db.accessTokens.Insert(token)
+}
+
+func (db *mongoDb) FindAccessTokenByHash(hash string) (*AccessToken, error) {
+	var result *AccessToken
+	err := db.accessTokens.Find(bson.M{"hash": hash}).One(&result)
+	return result, err
+}
+
+func (db *mongoDb) FindAccessTokensByOwner(userId bson.ObjectId) ([]*AccessToken, error) {
+	result := []*AccessToken{}
+	err := db.accessTokens.Find(bson.M{"owner": userId}).Sort("created").All(&result)
+	return result, err
+}
+
+func (db *mongoDb) TouchAccessToken(tokenId bson.ObjectId) error {
+	return db.accessTokens.UpdateId(tokenId, bson.M{"$set": bson.M{"lastUsed": time.Now()}})
+}
+
+func (db *mongoDb) DeleteAccessToken(tokenId bson.ObjectId, userId bson.ObjectId) error {
+	return db.accessTokens.Remove(bson.M{"_id": tokenId, "owner": userId})
+}
+
+func (db *mongoDb) DeleteAccessTokens(userId bson.ObjectId) (int, error) {
+	info, err := db.accessTokens.RemoveAll(bson.M{"owner": userId})
+	if err != nil {
+		return 0, err
+	}
+	return info.Removed, nil
+}
+
+func (db *mongoDb) InsertOidcState(state *OidcState) error {
+	return db.oidcStates.Insert(state)
+}
+
+func (db *mongoDb) ConsumeOidcState(stateId string) (*OidcState, error) {
+	var result *OidcState
+	_, err := db.oidcStates.FindId(stateId).Apply(mgo.Change{Remove: true}, &result)
+	return result, err
+}
+
+func (db *mongoDb) InsertPasskey(passkey *Passkey) error {
+	return db.passkeys.Insert(passkey)
+}
+
+func (db *mongoDb) FindPasskey(credentialId []byte) (*Passkey, error) {
+	var result *Passkey
+	err := db.passkeys.Find(bson.M{"credentialId": credentialId}).One(&result)
+	return result, err
+}
+
+func (db *mongoDb) FindPasskeysByOwner(userId bson.ObjectId) ([]*Passkey, error) {
+	result := []*Passkey{}
+	err := db.passkeys.Find(bson.M{"owner": userId}).Sort("created").All(&result)
+	return result, err
+}
+
+func (db *mongoDb) UpdatePasskeySignCount(passkeyId bson.ObjectId, current uint32, signCount uint32) error {
+	return db.passkeys.Update(
+		bson.M{"_id": passkeyId, "signCount": current},
+		bson.M{"$set": bson.M{"signCount": signCount, "lastUsed": time.Now()}},
+	)
+}
+
+func (db *mongoDb) DeletePasskey(passkeyId bson.ObjectId, userId bson.ObjectId) error {
+	return db.passkeys.Remove(bson.M{"_id": passkeyId, "owner": userId})
+}
+
+func (db *mongoDb) DeletePasskeys(userId bson.ObjectId) (int, error) {
+	info, err := db.passkeys.RemoveAll(bson.M{"owner": userId})
+	if err != nil {
+		return 0, err
+	}
+	return info.Removed, nil
+}
+
+func (db *mongoDb) InsertChallenge(challenge *WebauthnChallenge) error {
+	return db.challenges.Insert(challenge)
+}
+
+func (db *mongoDb) ConsumeChallenge(challengeId string) (*WebauthnChallenge, error) {
+	var result *WebauthnChallenge
+	_, err := db.challenges.FindId(challengeId).Apply(mgo.Change{Remove: true}, &result)
+	return result, err
+}
+
+func InitStore(db *mgo.Database) {
+	sessionsCollection := db.C("sessions")
+	sessionsCollection.EnsureIndex(mgo.Index{Key: []string{"owner"}})
+	// sessions are of no use once expired, let mongo remove them
+	sessionsCollection.EnsureIndex(mgo.Index{Key: []string{"expires"}, ExpireAfter: time.Second})
+	accessTokensCollection := db.C("access_tokens")
+	accessTokensCollection.EnsureIndex(mgo.Index{Key: []string{"hash"}, Unique: true})
+	accessTokensCollection.EnsureIndex(mgo.Index{Key: []string{"owner"}})
+	accessTokensCollection.EnsureIndex(mgo.Index{Key: []string{"expires"}, ExpireAfter: time.Second})
+	oidcStatesCollection := db.C("oidc_states")
+	oidcStatesCollection.EnsureIndex(mgo.Index{Key: []string{"expires"}, ExpireAfter: time.Second})
+	passkeysCollection := db.C("passkeys")
+	passkeysCollection.EnsureIndex(mgo.Index{Key: []string{"credentialId"}, Unique: true})
+	passkeysCollection.EnsureIndex(mgo.Index{Key: []string{"owner"}})
+	challengesCollection := db.C("webauthn_challenges")
+	challengesCollection.EnsureIndex(mgo.Index{Key: []string{"expires"}, ExpireAfter: time.Second})
+	store = &mongoDb{
+		db:           db,
+		sessions:     sessionsCollection,
+		accessTokens: accessTokensCollection,
+		oidcStates:   oidcStatesCollection,
+		passkeys:     passkeysCollection,
+		challenges:   challengesCollection,
+	}
+}
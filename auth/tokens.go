@@ -0,0 +1,252 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/iridiumdev/webwallet-core/util"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	ScopeWalletsRead     = "wallets:read"
+	ScopeWalletsWrite    = "wallets:write"
+	ScopeWalletsSend     = "wallets:send"
+	ScopeEventsSubscribe = "events:subscribe"
+
+	// prefix of all personal access tokens, which tells them apart from jwts
+	accessTokenPrefix = "iwt_"
+
+	accessTokenKey = "ACCESS_TOKEN"
+)
+
+var scopes = []string{ScopeWalletsRead, ScopeWalletsWrite, ScopeWalletsSend, ScopeEventsSubscribe}
+
+var (
+	ErrAccessTokenNotFound = errors.New("access token not found")
+	ErrInvalidAccessToken  = errors.New("invalid or expired access token")
+	ErrUnknownScope        = errors.New("unknown scope")
+	ErrMissingScope        = errors.New("access token requires at least one scope")
+	ErrInvalidWalletId     = errors.New("invalid wallet id")
+	ErrInsufficientScope   = errors.New("access token does not have the required scope")
+	ErrWalletNotPermitted  = errors.New("access token is restricted to other wallets")
+	ErrTokenRestricted     = errors.New("access token is restricted to wallets")
+)
+
+// ExtractAccessToken returns the personal access token the request was authenticated with, nil for a login session.
+func ExtractAccessToken(c *gin.Context) *AccessToken {
+	token, exists := c.Get(accessTokenKey)
+	if !exists {
+		return nil
+	}
+	return token.(*AccessToken)
+}
+
+// RequireScope rejects requests authenticated with an access token lacking the scope. Login sessions have all scopes.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token := ExtractAccessToken(c); token != nil && !token.HasScope(scope) {
+			util.HandleError(c, ErrInsufficientScope, http.StatusForbidden)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// RestrictWallet rejects requests authenticated with an access token which is restricted to other wallets than the one
+// in the given path parameter.
+func RestrictWallet(param string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !PermitsWallet(c, c.Param(param)) {
+			util.HandleError(c, ErrWalletNotPermitted, http.StatusForbidden)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireUnrestricted rejects requests authenticated with an access token which is restricted to wallets, for the
+// routes which are not tied to a single wallet.
+func RequireUnrestricted() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token := ExtractAccessToken(c); token != nil && len(token.Wallets) > 0 {
+			util.HandleError(c, ErrTokenRestricted, http.StatusForbidden)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// PermitsWallet reports whether the request may access the wallet, which is only ever false for restricted access
+// tokens.
+func PermitsWallet(c *gin.Context, walletId string) bool {
+	token := ExtractAccessToken(c)
+	return token == nil || token.PermitsWallet(walletId)
+}
+
+// TokenMiddlewareFunc authenticates requests like MiddlewareFunc, but also accepts personal access tokens. All routes
+// behind it have to check the scope of the token with RequireScope.
+func (m *Middleware) TokenMiddlewareFunc() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := m.lookupToken(c)
+		if !strings.HasPrefix(token, accessTokenPrefix) {
+			m.authenticate(c, token)
+			return
+		}
+
+		accessToken, err := findAccessToken(token)
+		if err != nil {
+			m.unauthorized(c, err)
+			return
+		}
+		// sessions are revoked when a user is disabled, access tokens are kept in case the user is enabled again
+		if owner, err := m.userService.GetUser(accessToken.Owner.Hex()); err != nil || owner.Disabled {
+			m.unauthorized(c, ErrInvalidAccessToken)
+			return
+		}
+		if err := store.TouchAccessToken(accessToken.Id); err != nil {
+			log.Warnf("Could not update access token '%s': %s", accessToken.Id.Hex(), err.Error())
+		}
+
+		c.Set(accessTokenKey, accessToken)
+		c.Set(claimsKey, jwt.MapClaims{IdentityKey: accessToken.Owner.Hex()})
+		c.Set(IdentityKey, accessToken.Owner.Hex())
+		c.Next()
+	}
+}
+
+func (m *Middleware) CreateAccessTokenHandler(c *gin.Context) {
+	dto := AccessTokenDTO{}
+	if util.BindAndHandleError(c, &dto, http.StatusBadRequest) {
+		return
+	}
+
+	accessToken, token, err := newAccessToken(ExtractUserId(c), dto)
+	if util.HandleError(c, err, http.StatusBadRequest) {
+		return
+	}
+
+	if err := store.InsertAccessToken(accessToken); err != nil {
+		log.Errorf("Could not store access token for user with id='%s': %s", accessToken.Owner.Hex(), err.Error())
+		util.HandleError(c, err, http.StatusInternalServerError)
+		return
+	}
+
+	log.Infof("Created access token '%s' for user with id='%s'", accessToken.Id.Hex(), accessToken.Owner.Hex())
+	c.JSON(http.StatusCreated, CreatedAccessToken{AccessToken: accessToken, Token: token})
+}
+
+func (m *Middleware) ListAccessTokensHandler(c *gin.Context) {
+	tokens, err := store.FindAccessTokensByOwner(bson.ObjectIdHex(ExtractUserId(c)))
+	if !util.HandleError(c, err, http.StatusInternalServerError) {
+		c.JSON(http.StatusOK, tokens)
+	}
+}
+
+func (m *Middleware) RevokeAccessTokenHandler(c *gin.Context) {
+	userId := ExtractUserId(c)
+	tokenId := c.Param("id")
+	if !bson.IsObjectIdHex(tokenId) {
+		util.HandleError(c, ErrAccessTokenNotFound, http.StatusNotFound)
+		return
+	}
+
+	err := store.DeleteAccessToken(bson.ObjectIdHex(tokenId), bson.ObjectIdHex(userId))
+	if err == mgo.ErrNotFound {
+		util.HandleError(c, ErrAccessTokenNotFound, http.StatusNotFound)
+		return
+	}
+	if util.HandleError(c, err, http.StatusInternalServerError) {
+		return
+	}
+
+	log.Infof("Revoked access token '%s' of user with id='%s'", tokenId, userId)
+	c.Status(http.StatusNoContent)
+}
+
+// RevokeAccessTokens deletes all access tokens of the user, e.g. when the account is deleted.
+func (m *Middleware) RevokeAccessTokens(userId string) error {
+	revoked, err := store.DeleteAccessTokens(bson.ObjectIdHex(userId))
+	if err != nil {
+		log.Errorf("Could not revoke access tokens of user with id='%s': %s", userId, err.Error())
+		return err
+	}
+
+	log.Infof("Revoked %d access tokens of user with id='%s'", revoked, userId)
+	return nil
+}
+
+// newAccessToken validates the requested scopes and wallets and generates a new token, which is returned along with
+// the model holding its hash.
+func newAccessToken(userId string, dto AccessTokenDTO) (*AccessToken, string, error) {
+	if len(dto.Scopes) == 0 {
+		return nil, "", ErrMissingScope
+	}
+	for _, scope := range dto.Scopes {
+		if !isKnownScope(scope) {
+			return nil, "", errors.Wrap(ErrUnknownScope, scope)
+		}
+	}
+	for _, walletId := range dto.Wallets {
+		if !bson.IsObjectIdHex(walletId) {
+			return nil, "", ErrInvalidWalletId
+		}
+	}
+
+	accessToken := &AccessToken{
+		Id:      bson.NewObjectId(),
+		Owner:   bson.ObjectIdHex(userId),
+		Name:    dto.Name,
+		Scopes:  dto.Scopes,
+		Wallets: dto.Wallets,
+		Created: time.Now(),
+	}
+	if dto.ExpiresInDays > 0 {
+		expires := accessToken.Created.AddDate(0, 0, dto.ExpiresInDays)
+		accessToken.Expires = &expires
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	token := accessTokenPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	accessToken.Hash = hashAccessToken(token)
+
+	return accessToken, token, nil
+}
+
+func findAccessToken(token string) (*AccessToken, error) {
+	accessToken, err := store.FindAccessTokenByHash(hashAccessToken(token))
+	if err != nil || accessToken == nil || !accessToken.IsActive() {
+		return nil, ErrInvalidAccessToken
+	}
+	return accessToken, nil
+}
+
+// hashAccessToken returns the sha256 of the token, a slow hash is not needed as the token is random.
+func hashAccessToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func isKnownScope(scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"github.com/gin-gonic/gin"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNewAccessTokenIsStoredHashed(t *testing.T) {
+	userId := bson.NewObjectId().Hex()
+
+	accessToken, token, err := newAccessToken(userId, AccessTokenDTO{Name: "bot", Scopes: []string{ScopeWalletsRead}, ExpiresInDays: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(token, accessTokenPrefix) || strings.Contains(accessToken.Hash, token) {
+		t.Errorf("expected token to be prefixed and only its hash to be kept, got %s", token)
+	}
+	if accessToken.Hash != hashAccessToken(token) {
+		t.Error("expected the hash of the token to be kept")
+	}
+	if accessToken.Owner.Hex() != userId || accessToken.Expires == nil || !accessToken.IsActive() {
+		t.Errorf("expected an active token of user %s expiring in 30 days, got %+v", userId, accessToken)
+	}
+
+	_, another, _ := newAccessToken(userId, AccessTokenDTO{Name: "bot", Scopes: []string{ScopeWalletsRead}})
+	if another == token {
+		t.Error("expected tokens to be random")
+	}
+}
+
+func TestNewAccessTokenValidatesScopesAndWallets(t *testing.T) {
+	userId := bson.NewObjectId().Hex()
+	walletId := bson.NewObjectId().Hex()
+
+	invalid := map[string]AccessTokenDTO{
+		"no scope":       {Name: "bot"},
+		"unknown scope":  {Name: "bot", Scopes: []string{"wallets:delete"}},
+		"invalid wallet": {Name: "bot", Scopes: []string{ScopeWalletsRead}, Wallets: []string{"foo"}},
+	}
+	for name, dto := range invalid {
+		if _, _, err := newAccessToken(userId, dto); err == nil {
+			t.Errorf("expected token with %s to be refused", name)
+		}
+	}
+
+	accessToken, _, err := newAccessToken(userId, AccessTokenDTO{Name: "bot", Scopes: []string{ScopeWalletsSend, ScopeEventsSubscribe}, Wallets: []string{walletId}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !accessToken.PermitsWallet(walletId) || accessToken.PermitsWallet(bson.NewObjectId().Hex()) {
+		t.Errorf("expected token to be restricted to wallet %s, got %v", walletId, accessToken.Wallets)
+	}
+}
+
+func TestRequireScopeAndRestrictWallet(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	walletId := bson.NewObjectId().Hex()
+
+	serve := func(accessToken *AccessToken, path string) int {
+		engine := gin.New()
+		engine.GET("/wallets/:id", func(c *gin.Context) {
+			if accessToken != nil {
+				c.Set(accessTokenKey, accessToken)
+			}
+		}, RequireScope(ScopeWalletsRead), RestrictWallet("id"), func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder.Code
+	}
+
+	cases := []struct {
+		name        string
+		accessToken *AccessToken
+		walletId    string
+		status      int
+	}{
+		{"login session", nil, walletId, http.StatusOK},
+		{"scope", &AccessToken{Scopes: []string{ScopeWalletsRead}}, walletId, http.StatusOK},
+		{"missing scope", &AccessToken{Scopes: []string{ScopeWalletsSend}}, walletId, http.StatusForbidden},
+		{"permitted wallet", &AccessToken{Scopes: []string{ScopeWalletsRead}, Wallets: []string{walletId}}, walletId, http.StatusOK},
+		{"other wallet", &AccessToken{Scopes: []string{ScopeWalletsRead}, Wallets: []string{walletId}}, bson.NewObjectId().Hex(), http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		if status := serve(tc.accessToken, "/wallets/"+tc.walletId); status != tc.status {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.status, status)
+		}
+	}
+}
+
+func TestRequireUnrestricted(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	serve := func(accessToken *AccessToken) int {
+		engine := gin.New()
+		engine.POST("/wallets", func(c *gin.Context) {
+			if accessToken != nil {
+				c.Set(accessTokenKey, accessToken)
+			}
+		}, RequireScope(ScopeWalletsWrite), RequireUnrestricted(), func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/wallets", nil))
+		return recorder.Code
+	}
+
+	cases := []struct {
+		name        string
+		accessToken *AccessToken
+		status      int
+	}{
+		{"login session", nil, http.StatusOK},
+		{"unrestricted", &AccessToken{Scopes: []string{ScopeWalletsWrite}}, http.StatusOK},
+		{"restricted", &AccessToken{Scopes: []string{ScopeWalletsWrite}, Wallets: []string{bson.NewObjectId().Hex()}}, http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		if status := serve(tc.accessToken); status != tc.status {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.status, status)
+		}
+	}
+}
@@ -0,0 +1,575 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/iridiumdev/webwallet-core/user"
+	"github.com/iridiumdev/webwallet-core/util"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	purposeRegisterPasskey = "register"
+	purposeLoginPasskey    = "login"
+	purposeStepUp          = "step-up"
+
+	webauthnTimeout = 5 * time.Minute
+
+	coseAlgES256 = -7
+	coseAlgRS256 = -257
+
+	flagUserPresent   = 0x01
+	flagUserVerified  = 0x04
+	flagAttestedData  = 0x40
+	authDataMinLength = 37
+)
+
+var (
+	ErrWebauthnDisabled = errors.New("passkeys are not configured")
+	ErrInvalidChallenge = errors.New("invalid or expired passkey challenge")
+	ErrInvalidPasskey   = errors.New("invalid passkey response")
+	ErrPasskeyNotFound  = errors.New("passkey not found")
+	ErrPasskeyExists    = errors.New("passkey is already registered")
+	ErrPasskeyCloned    = errors.New("signature counter of the passkey did not increase, it may have been cloned")
+	ErrUnsupportedKey   = errors.New("unsupported passkey algorithm")
+)
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type authenticatorData struct {
+	flags     byte
+	signCount uint32
+	// only set on registration
+	credentialId []byte
+	publicKey    []byte
+}
+
+// BeginPasskeyRegistrationHandler responds with the options for navigator.credentials.create. A discoverable
+// credential with user verification is required, so the passkey alone is enough to log in.
+func (m *Middleware) BeginPasskeyRegistrationHandler(c *gin.Context) {
+	userId := ExtractUserId(c)
+	username, _ := ExtractClaims(c)["username"].(string)
+
+	challenge, err := m.newChallenge(purposeRegisterPasskey, userId)
+	if handlePasskeyErrors(c, err) {
+		return
+	}
+	passkeys, err := store.FindPasskeysByOwner(bson.ObjectIdHex(userId))
+	if util.HandleError(c, err, http.StatusInternalServerError) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"publicKey": gin.H{
+		"challenge": challenge.Id,
+		"rp":        gin.H{"id": m.webauthn.RpId, "name": m.webauthn.RpName},
+		"user": gin.H{
+			"id":          base64.RawURLEncoding.EncodeToString([]byte(bson.ObjectIdHex(userId))),
+			"name":        username,
+			"displayName": username,
+		},
+		"pubKeyCredParams": []gin.H{
+			{"type": "public-key", "alg": coseAlgES256},
+			{"type": "public-key", "alg": coseAlgRS256},
+		},
+		"timeout":     int64(webauthnTimeout / time.Millisecond),
+		"attestation": "none",
+		"authenticatorSelection": gin.H{
+			"residentKey":        "required",
+			"requireResidentKey": true,
+			"userVerification":   "required",
+		},
+		"excludeCredentials": credentialDescriptors(passkeys),
+	}})
+}
+
+// FinishPasskeyRegistrationHandler stores the passkey created with the options of BeginPasskeyRegistrationHandler.
+func (m *Middleware) FinishPasskeyRegistrationHandler(c *gin.Context) {
+	userId := ExtractUserId(c)
+	dto := PasskeyDTO{}
+	if util.BindAndHandleError(c, &dto, http.StatusBadRequest) {
+		return
+	}
+	if !m.reauthenticate(c, userId, dto.Reauthentication) {
+		return
+	}
+
+	passkey, err := m.registerPasskey(userId, dto)
+	if handlePasskeyErrors(c, err) {
+		return
+	}
+	c.JSON(http.StatusCreated, passkey)
+}
+
+// BeginPasskeyLoginHandler responds with the options for navigator.credentials.get. No credentials are listed, the
+// authenticator offers the discoverable credentials it holds for the relying party.
+func (m *Middleware) BeginPasskeyLoginHandler(c *gin.Context) {
+	challenge, err := m.newChallenge(purposeLoginPasskey, "")
+	if err != nil {
+		m.unauthorized(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"publicKey": m.requestOptions(challenge, []*Passkey{})})
+}
+
+// FinishPasskeyLoginHandler logs in the owner of the passkey. The passkey verified the user, so no further mfa step is
+// needed.
+func (m *Middleware) FinishPasskeyLoginHandler(c *gin.Context) {
+	dto := AssertionDTO{}
+	if err := c.ShouldBindJSON(&dto); err != nil {
+		m.unauthorized(c, ErrInvalidPasskey)
+		return
+	}
+
+	passkey, err := m.verifyAssertion(purposeLoginPasskey, "", dto)
+	if err != nil {
+		log.Warnf("Failed passkey login: %s", err.Error())
+		m.unauthorized(c, errors.Cause(err))
+		return
+	}
+
+	authUser, err := m.userService.GetUser(passkey.Owner.Hex())
+	if err != nil || authUser.Disabled {
+		m.unauthorized(c, user.ErrUserDisabled)
+		return
+	}
+
+	log.Infof("User with id='%s' logged in with passkey '%s'", authUser.Id.Hex(), passkey.Id.Hex())
+	m.login(c, authUser.Id.Hex(), authUser.Username)
+}
+
+// BeginStepUpHandler responds with the options to confirm a sensitive action, like sending funds, with one of the
+// passkeys of the user.
+func (m *Middleware) BeginStepUpHandler(c *gin.Context) {
+	userId := ExtractUserId(c)
+	passkeys, err := store.FindPasskeysByOwner(bson.ObjectIdHex(userId))
+	if util.HandleError(c, err, http.StatusInternalServerError) {
+		return
+	}
+	if len(passkeys) == 0 {
+		util.HandleError(c, ErrPasskeyNotFound, http.StatusNotFound)
+		return
+	}
+
+	challenge, err := m.newChallenge(purposeStepUp, userId)
+	if handlePasskeyErrors(c, err) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"publicKey": m.requestOptions(challenge, passkeys)})
+}
+
+// FinishStepUpHandler responds with a step-up token, which is accepted instead of a TOTP code for a single action.
+func (m *Middleware) FinishStepUpHandler(c *gin.Context) {
+	userId := ExtractUserId(c)
+	dto := AssertionDTO{}
+	if util.BindAndHandleError(c, &dto, http.StatusBadRequest) {
+		return
+	}
+
+	if _, err := m.verifyAssertion(purposeStepUp, userId, dto); err != nil {
+		log.Warnf("Failed passkey step-up of user with id='%s': %s", userId, err.Error())
+		util.HandleError(c, errors.Cause(err), http.StatusForbidden)
+		return
+	}
+
+	token, err := m.userService.IssueStepUpToken(userId)
+	if util.HandleError(c, err, http.StatusInternalServerError) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"step_up_token": token})
+}
+
+func (m *Middleware) ListPasskeysHandler(c *gin.Context) {
+	passkeys, err := store.FindPasskeysByOwner(bson.ObjectIdHex(ExtractUserId(c)))
+	if !util.HandleError(c, err, http.StatusInternalServerError) {
+		c.JSON(http.StatusOK, passkeys)
+	}
+}
+
+// DeletePasskeyHandler deletes a passkey of the user. As the passkeys are a step-up factor, the deletion has to be
+// confirmed with the reauthentication in the body.
+func (m *Middleware) DeletePasskeyHandler(c *gin.Context) {
+	userId := ExtractUserId(c)
+	passkeyId := c.Param("id")
+	if !bson.IsObjectIdHex(passkeyId) {
+		util.HandleError(c, ErrPasskeyNotFound, http.StatusNotFound)
+		return
+	}
+	// an empty body is refused by Reauthenticate
+	proof := user.Reauthentication{}
+	c.ShouldBindJSON(&proof)
+	if !m.reauthenticate(c, userId, proof) {
+		return
+	}
+
+	err := store.DeletePasskey(bson.ObjectIdHex(passkeyId), bson.ObjectIdHex(userId))
+	if err == mgo.ErrNotFound {
+		util.HandleError(c, ErrPasskeyNotFound, http.StatusNotFound)
+		return
+	}
+	if util.HandleError(c, err, http.StatusInternalServerError) {
+		return
+	}
+
+	log.Infof("Deleted passkey '%s' of user with id='%s'", passkeyId, userId)
+	c.Status(http.StatusNoContent)
+}
+
+// DeletePasskeys deletes all passkeys of the user, e.g. when the account is deleted.
+func (m *Middleware) DeletePasskeys(userId string) error {
+	deleted, err := store.DeletePasskeys(bson.ObjectIdHex(userId))
+	if err != nil {
+		log.Errorf("Could not delete passkeys of user with id='%s': %s", userId, err.Error())
+		return err
+	}
+	log.Infof("Deleted %d passkeys of user with id='%s'", deleted, userId)
+	return nil
+}
+
+// HasPasskeys reports whether the user registered a passkey, which makes step-ups mandatory like an enabled TOTP.
+func (m *Middleware) HasPasskeys(userId string) (bool, error) {
+	passkeys, err := store.FindPasskeysByOwner(bson.ObjectIdHex(userId))
+	if err != nil {
+		return false, err
+	}
+	return len(passkeys) > 0, nil
+}
+
+// reauthenticate responds with an error and returns false unless the proof confirms the user.
+func (m *Middleware) reauthenticate(c *gin.Context, userId string, proof user.Reauthentication) bool {
+	err := m.userService.Reauthenticate(userId, proof)
+	if err == nil {
+		return true
+	}
+	if throttledErr, ok := err.(*user.ThrottledError); ok {
+		m.throttled(c, throttledErr)
+		return false
+	}
+	switch err {
+	case user.ErrReauthRequired, user.ErrInvalidPassword, user.ErrInvalidTotp, user.ErrTotpRequired, user.ErrInvalidStepUp:
+		util.HandleError(c, err, http.StatusForbidden)
+	default:
+		util.HandleError(c, err, http.StatusInternalServerError)
+	}
+	return false
+}
+
+func handlePasskeyErrors(c *gin.Context, err error) bool {
+	switch errors.Cause(err) {
+	case nil:
+		return false
+	case ErrWebauthnDisabled:
+		return util.HandleError(c, ErrWebauthnDisabled, http.StatusNotFound)
+	case ErrInvalidChallenge, ErrInvalidPasskey, ErrUnsupportedKey, ErrInvalidCbor:
+		return util.HandleError(c, err, http.StatusBadRequest)
+	case ErrPasskeyExists:
+		return util.HandleError(c, err, http.StatusConflict)
+	}
+	return util.HandleError(c, err, http.StatusInternalServerError)
+}
+
+func (m *Middleware) newChallenge(purpose string, userId string) (*WebauthnChallenge, error) {
+	if m.webauthn.RpId == "" {
+		return nil, ErrWebauthnDisabled
+	}
+
+	id, err := randomString()
+	if err != nil {
+		return nil, err
+	}
+	challenge := &WebauthnChallenge{Id: id, Purpose: purpose, Expires: time.Now().Add(webauthnTimeout)}
+	if userId != "" {
+		challenge.UserId = bson.ObjectIdHex(userId)
+	}
+
+	if err := store.InsertChallenge(challenge); err != nil {
+		log.Errorf("Could not store passkey challenge: %s", err.Error())
+		return nil, err
+	}
+	return challenge, nil
+}
+
+func (m *Middleware) requestOptions(challenge *WebauthnChallenge, passkeys []*Passkey) gin.H {
+	return gin.H{
+		"challenge":        challenge.Id,
+		"rpId":             m.webauthn.RpId,
+		"timeout":          int64(webauthnTimeout / time.Millisecond),
+		"userVerification": "required",
+		"allowCredentials": credentialDescriptors(passkeys),
+	}
+}
+
+func credentialDescriptors(passkeys []*Passkey) []gin.H {
+	descriptors := []gin.H{}
+	for _, passkey := range passkeys {
+		descriptors = append(descriptors, gin.H{
+			"type": "public-key",
+			"id":   base64.RawURLEncoding.EncodeToString(passkey.CredentialId),
+		})
+	}
+	return descriptors
+}
+
+// registerPasskey verifies the response of the authenticator to the registration challenge and stores the created
+// credential. The attestation statement is not verified, as no authenticator models are trusted or excluded.
+func (m *Middleware) registerPasskey(userId string, dto PasskeyDTO) (*Passkey, error) {
+	clientDataJson, err := decodeBase64Url(dto.ClientDataJSON)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidPasskey, "client data")
+	}
+	attestationObject, err := decodeBase64Url(dto.AttestationObject)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidPasskey, "attestation object")
+	}
+
+	if err := m.verifyClientData(clientDataJson, "webauthn.create", purposeRegisterPasskey, userId); err != nil {
+		return nil, err
+	}
+
+	attestation, err := decodeCborMap(attestationObject)
+	if err != nil {
+		return nil, err
+	}
+	rawAuthData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return nil, errors.Wrap(ErrInvalidPasskey, "authenticator data")
+	}
+	authData, err := m.parseAuthenticatorData(rawAuthData, true)
+	if err != nil {
+		return nil, err
+	}
+
+	passkey := &Passkey{
+		Id:           bson.NewObjectId(),
+		Owner:        bson.ObjectIdHex(userId),
+		Name:         dto.Name,
+		CredentialId: authData.credentialId,
+		PublicKey:    authData.publicKey,
+		SignCount:    authData.signCount,
+		Created:      time.Now(),
+	}
+	if err := store.InsertPasskey(passkey); err != nil {
+		if mgo.IsDup(err) {
+			return nil, ErrPasskeyExists
+		}
+		log.Errorf("Could not store passkey of user with id='%s': %s", userId, err.Error())
+		return nil, err
+	}
+
+	log.Infof("Registered passkey '%s' for user with id='%s'", passkey.Id.Hex(), userId)
+	return passkey, nil
+}
+
+// verifyAssertion verifies the response of the authenticator to a login or step-up challenge and returns the passkey
+// it was signed with. For a step-up, the passkey has to belong to the given user.
+func (m *Middleware) verifyAssertion(purpose string, userId string, dto AssertionDTO) (*Passkey, error) {
+	credentialId, err := decodeBase64Url(dto.Id)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidPasskey, "credential id")
+	}
+	clientDataJson, err := decodeBase64Url(dto.ClientDataJSON)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidPasskey, "client data")
+	}
+	rawAuthData, err := decodeBase64Url(dto.AuthenticatorData)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidPasskey, "authenticator data")
+	}
+	signature, err := decodeBase64Url(dto.Signature)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidPasskey, "signature")
+	}
+
+	passkey, err := store.FindPasskey(credentialId)
+	if err != nil || passkey == nil || (userId != "" && passkey.Owner.Hex() != userId) {
+		return nil, ErrPasskeyNotFound
+	}
+	if dto.UserHandle != "" {
+		if handle, err := decodeBase64Url(dto.UserHandle); err != nil || !bytes.Equal(handle, []byte(passkey.Owner)) {
+			return nil, errors.Wrap(ErrInvalidPasskey, "user handle")
+		}
+	}
+
+	if err := m.verifyClientData(clientDataJson, "webauthn.get", purpose, userId); err != nil {
+		return nil, err
+	}
+	authData, err := m.parseAuthenticatorData(rawAuthData, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyPasskeySignature(passkey.PublicKey, rawAuthData, clientDataJson, signature); err != nil {
+		return nil, err
+	}
+
+	// authenticators without a counter, like most synced passkeys, always send 0
+	if (authData.signCount != 0 || passkey.SignCount != 0) && authData.signCount <= passkey.SignCount {
+		log.Warnf("Signature counter of passkey '%s' went from %d to %d", passkey.Id.Hex(), passkey.SignCount, authData.signCount)
+		return nil, ErrPasskeyCloned
+	}
+	if err := store.UpdatePasskeySignCount(passkey.Id, passkey.SignCount, authData.signCount); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, ErrPasskeyCloned
+		}
+		return nil, err
+	}
+	return passkey, nil
+}
+
+// verifyClientData checks the client data of the response and consumes the challenge it answers.
+func (m *Middleware) verifyClientData(raw []byte, ceremony string, purpose string, userId string) error {
+	var data clientData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return errors.Wrap(ErrInvalidPasskey, "client data")
+	}
+	if data.Type != ceremony {
+		return errors.Wrap(ErrInvalidPasskey, "type")
+	}
+	if !m.isAllowedOrigin(data.Origin) {
+		return errors.Wrapf(ErrInvalidPasskey, "origin %s", data.Origin)
+	}
+
+	challenge, err := store.ConsumeChallenge(data.Challenge)
+	if err != nil || challenge == nil || challenge.Purpose != purpose || time.Now().After(challenge.Expires) {
+		return ErrInvalidChallenge
+	}
+	if userId != "" && challenge.UserId.Hex() != userId {
+		return ErrInvalidChallenge
+	}
+	return nil
+}
+
+func (m *Middleware) isAllowedOrigin(origin string) bool {
+	for _, allowed := range m.webauthn.Origins {
+		if origin == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAuthenticatorData checks the relying party and flags of the authenticator data. On registration, it also
+// contains the created credential.
+func (m *Middleware) parseAuthenticatorData(data []byte, attested bool) (*authenticatorData, error) {
+	if len(data) < authDataMinLength {
+		return nil, errors.Wrap(ErrInvalidPasskey, "authenticator data too short")
+	}
+
+	rpIdHash := sha256.Sum256([]byte(m.webauthn.RpId))
+	if !bytes.Equal(data[:32], rpIdHash[:]) {
+		return nil, errors.Wrap(ErrInvalidPasskey, "relying party")
+	}
+	result := &authenticatorData{flags: data[32], signCount: binary.BigEndian.Uint32(data[33:37])}
+	// passkeys replace the password as well as the second factor, so the authenticator has to verify the user
+	if result.flags&flagUserPresent == 0 || result.flags&flagUserVerified == 0 {
+		return nil, errors.Wrap(ErrInvalidPasskey, "user not verified")
+	}
+	if !attested {
+		return result, nil
+	}
+
+	// the attested credential data follows the 16 bytes aaguid
+	if result.flags&flagAttestedData == 0 || len(data) < authDataMinLength+18 {
+		return nil, errors.Wrap(ErrInvalidPasskey, "no attested credential")
+	}
+	offset := authDataMinLength + 16
+	length := int(binary.BigEndian.Uint16(data[offset : offset+2]))
+	offset += 2
+	if length == 0 || len(data) < offset+length {
+		return nil, errors.Wrap(ErrInvalidPasskey, "credential id")
+	}
+	result.credentialId = data[offset : offset+length]
+
+	// the public key may be followed by extensions
+	keyData := data[offset+length:]
+	_, rest, err := decodeCbor(keyData)
+	if err != nil {
+		return nil, err
+	}
+	result.publicKey = keyData[:len(keyData)-len(rest)]
+	if _, err := parseCoseKey(result.publicKey); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// parseCoseKey returns the ES256 or RS256 public key of the COSE encoded key.
+func parseCoseKey(data []byte) (crypto.PublicKey, error) {
+	key, err := decodeCborMap(data)
+	if err != nil {
+		return nil, err
+	}
+
+	kty, alg := key[int64(1)], key[int64(3)]
+	switch {
+	case kty == int64(2) && alg == int64(coseAlgES256):
+		x, _ := key[int64(-2)].([]byte)
+		y, _ := key[int64(-3)].([]byte)
+		if key[int64(-1)] != int64(1) || len(x) != 32 || len(y) != 32 {
+			return nil, errors.Wrap(ErrUnsupportedKey, "curve")
+		}
+		publicKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !publicKey.Curve.IsOnCurve(publicKey.X, publicKey.Y) {
+			return nil, errors.Wrap(ErrUnsupportedKey, "point is not on the curve")
+		}
+		return publicKey, nil
+
+	case kty == int64(3) && alg == int64(coseAlgRS256):
+		n, _ := key[int64(-1)].([]byte)
+		e, _ := key[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.Wrap(ErrUnsupportedKey, "rsa key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	}
+	return nil, ErrUnsupportedKey
+}
+
+// verifyPasskeySignature checks the signature over the authenticator data and the hash of the client data.
+func verifyPasskeySignature(coseKey []byte, authData []byte, clientDataJson []byte, signature []byte) error {
+	publicKey, err := parseCoseKey(coseKey)
+	if err != nil {
+		return err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJson)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+
+	valid := false
+	switch publicKey := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		var parsed struct{ R, S *big.Int }
+		if rest, err := asn1.Unmarshal(signature, &parsed); err == nil && len(rest) == 0 {
+			valid = ecdsa.Verify(publicKey, digest[:], parsed.R, parsed.S)
+		}
+	case *rsa.PublicKey:
+		valid = rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature) == nil
+	}
+	if !valid {
+		return errors.Wrap(ErrInvalidPasskey, "signature")
+	}
+	return nil
+}
+
+// decodeBase64Url decodes base64url with or without padding, as browsers and libraries differ in that.
+func decodeBase64Url(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
@@ -0,0 +1,307 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/iridiumdev/webwallet-core/config"
+	"github.com/iridiumdev/webwallet-core/user"
+	"gopkg.in/mgo.v2/bson"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func (s *fakeUserService) IssueStepUpToken(userId string) (string, error) {
+	return "step-up|" + userId, nil
+}
+
+func (s *fakeUserService) Reauthenticate(userId string, proof user.Reauthentication) error {
+	if proof.CurrentPassword == "" {
+		return user.ErrReauthRequired
+	}
+	if proof.CurrentPassword != "secr3tPw" {
+		return user.ErrInvalidPassword
+	}
+	return nil
+}
+
+// encodeCbor encodes the subset of CBOR decodeCbor supports, map keys have to be int or string.
+func encodeCbor(value interface{}) []byte {
+	head := func(major byte, argument uint64) []byte {
+		switch {
+		case argument < 24:
+			return []byte{major<<5 | byte(argument)}
+		case argument < 1<<8:
+			return []byte{major<<5 | 24, byte(argument)}
+		case argument < 1<<16:
+			return append([]byte{major<<5 | 25}, byte(argument>>8), byte(argument))
+		}
+		result := make([]byte, 5)
+		result[0] = major<<5 | 26
+		binary.BigEndian.PutUint32(result[1:], uint32(argument))
+		return result
+	}
+
+	switch v := value.(type) {
+	case int:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case map[interface{}]interface{}:
+		result := head(5, uint64(len(v)))
+		for key, item := range v {
+			result = append(result, encodeCbor(key)...)
+			result = append(result, encodeCbor(item)...)
+		}
+		return result
+	}
+	panic("unsupported cbor value")
+}
+
+// softAuthenticator is a software WebAuthn authenticator holding a single ES256 passkey.
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialId []byte
+	signCount    uint32
+	rpId         string
+	origin       string
+}
+
+func newSoftAuthenticator(t *testing.T, rpId string, origin string) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentialId := make([]byte, 16)
+	rand.Read(credentialId)
+	return &softAuthenticator{key: key, credentialId: credentialId, rpId: rpId, origin: origin}
+}
+
+func (a *softAuthenticator) clientData(ceremony string, challenge string) []byte {
+	data, _ := json.Marshal(clientData{Type: ceremony, Challenge: challenge, Origin: a.origin})
+	return data
+}
+
+// authData returns the authenticator data with user presence and verification, along with the credential if attested.
+func (a *softAuthenticator) authData(attested bool) []byte {
+	rpIdHash := sha256.Sum256([]byte(a.rpId))
+	data := append(rpIdHash[:], flagUserPresent|flagUserVerified)
+	data = append(data, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], a.signCount)
+	if !attested {
+		return data
+	}
+
+	pad := func(b []byte) []byte {
+		return append(make([]byte, 32-len(b)), b...)
+	}
+	coseKey := encodeCbor(map[interface{}]interface{}{
+		1:  2,
+		3:  coseAlgES256,
+		-1: 1,
+		-2: pad(a.key.X.Bytes()),
+		-3: pad(a.key.Y.Bytes()),
+	})
+
+	data[32] |= flagAttestedData
+	data = append(data, make([]byte, 16)...)
+	data = append(data, byte(len(a.credentialId)>>8), byte(len(a.credentialId)))
+	data = append(data, a.credentialId...)
+	return append(data, coseKey...)
+}
+
+func (a *softAuthenticator) register(challenge string) PasskeyDTO {
+	return PasskeyDTO{
+		Name:           "soft",
+		ClientDataJSON: base64.RawURLEncoding.EncodeToString(a.clientData("webauthn.create", challenge)),
+		AttestationObject: base64.RawURLEncoding.EncodeToString(encodeCbor(map[interface{}]interface{}{
+			"fmt":      "none",
+			"attStmt":  map[interface{}]interface{}{},
+			"authData": a.authData(true),
+		})),
+	}
+}
+
+func (a *softAuthenticator) assert(challenge string, userHandle []byte) AssertionDTO {
+	a.signCount++
+	authData := a.authData(false)
+	clientData := a.clientData("webauthn.get", challenge)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	r, s, _ := ecdsa.Sign(rand.Reader, a.key, digest[:])
+	signature, _ := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+
+	return AssertionDTO{
+		Id:                base64.RawURLEncoding.EncodeToString(a.credentialId),
+		ClientDataJSON:    base64.RawURLEncoding.EncodeToString(clientData),
+		AuthenticatorData: base64.RawURLEncoding.EncodeToString(authData),
+		Signature:         base64.RawURLEncoding.EncodeToString(signature),
+		UserHandle:        base64.RawURLEncoding.EncodeToString(userHandle),
+	}
+}
+
+func TestPasskeyRegistrationLoginAndStepUp(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	authStore := newFakeStore()
+	store = authStore
+
+	keyring, err := NewKeyring(config.Auth{Secret: "s3cr3t"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := &user.User{Id: bson.NewObjectId(), Username: "alice"}
+	m := NewMiddleware(keyring, config.Auth{Webauthn: config.Webauthn{
+		RpId:    "wallet.ird.cash",
+		RpName:  "Iridium Webwallet",
+		Origins: []string{"https://wallet.ird.cash"},
+	}}, &fakeUserService{users: map[string]*user.User{alice.Id.Hex(): alice}})
+
+	asAlice := func(c *gin.Context) {
+		c.Set(claimsKey, jwt.MapClaims{IdentityKey: alice.Id.Hex(), "username": alice.Username})
+	}
+	engine := gin.New()
+	engine.POST("/passkeys/options", asAlice, m.BeginPasskeyRegistrationHandler)
+	engine.POST("/passkeys", asAlice, m.FinishPasskeyRegistrationHandler)
+	engine.POST("/auth/passkey/options", m.BeginPasskeyLoginHandler)
+	engine.POST("/auth/passkey/login", m.FinishPasskeyLoginHandler)
+	engine.POST("/auth/passkey/step-up/options", asAlice, m.BeginStepUpHandler)
+	engine.POST("/auth/passkey/step-up", asAlice, m.FinishStepUpHandler)
+
+	post := func(path string, body interface{}, result interface{}) int {
+		payload, _ := json.Marshal(body)
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(payload))
+		request.Header.Set("Content-Type", "application/json")
+		engine.ServeHTTP(recorder, request)
+		if result != nil {
+			json.Unmarshal(recorder.Body.Bytes(), result)
+		}
+		return recorder.Code
+	}
+	var options struct {
+		PublicKey struct {
+			Challenge string
+			User      struct{ Id string }
+		}
+	}
+	challenge := func(path string) string {
+		if status := post(path, nil, &options); status != http.StatusOK {
+			t.Fatalf("expected options from %s, got %d", path, status)
+		}
+		return options.PublicKey.Challenge
+	}
+
+	authenticator := newSoftAuthenticator(t, "wallet.ird.cash", "https://wallet.ird.cash")
+	registration := authenticator.register(challenge("/passkeys/options"))
+	userHandle, _ := base64.RawURLEncoding.DecodeString(options.PublicKey.User.Id)
+	if status := post("/passkeys", registration, nil); status != http.StatusForbidden {
+		t.Errorf("expected a registration without the password to be refused, got %d", status)
+	}
+	registration.CurrentPassword = "wrong"
+	if status := post("/passkeys", registration, nil); status != http.StatusForbidden {
+		t.Errorf("expected a registration with a wrong password to be refused, got %d", status)
+	}
+	registration.CurrentPassword = "secr3tPw"
+	if status := post("/passkeys", registration, nil); status != http.StatusCreated {
+		t.Fatalf("expected passkey to be registered, got %d", status)
+	}
+	if len(authStore.passkeys) != 1 || authStore.passkeys[0].Owner != alice.Id {
+		t.Fatalf("expected a passkey of alice, got %+v", authStore.passkeys)
+	}
+	if has, err := m.HasPasskeys(alice.Id.Hex()); !has || err != nil {
+		t.Errorf("expected alice to need a step-up now, got %v %v", has, err)
+	}
+	if status := post("/passkeys", registration, nil); status != http.StatusBadRequest {
+		t.Errorf("expected a replayed registration to be refused, got %d", status)
+	}
+
+	assertion := authenticator.assert(challenge("/auth/passkey/options"), userHandle)
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+	}
+	if status := post("/auth/passkey/login", assertion, &tokens); status != http.StatusOK {
+		t.Fatalf("expected login with the passkey, got %d", status)
+	}
+	if claims, err := keyring.Parse(tokens.AccessToken); err != nil || claims[IdentityKey] != alice.Id.Hex() {
+		t.Errorf("expected an access token of alice, got %v %v", claims, err)
+	}
+	if status := post("/auth/passkey/login", assertion, nil); status != http.StatusUnauthorized {
+		t.Errorf("expected a replayed assertion to be refused, got %d", status)
+	}
+
+	invalid := map[string]func() AssertionDTO{
+		"tampered signature": func() AssertionDTO {
+			dto := authenticator.assert(challenge("/auth/passkey/options"), userHandle)
+			dto.ClientDataJSON = base64.RawURLEncoding.EncodeToString(authenticator.clientData("webauthn.get", challenge("/auth/passkey/options")))
+			return dto
+		},
+		"other origin": func() AssertionDTO {
+			authenticator.origin = "https://evil.example"
+			defer func() { authenticator.origin = "https://wallet.ird.cash" }()
+			return authenticator.assert(challenge("/auth/passkey/options"), userHandle)
+		},
+		"decreased counter": func() AssertionDTO {
+			authenticator.signCount = 0
+			return authenticator.assert(challenge("/auth/passkey/options"), userHandle)
+		},
+		"other user handle": func() AssertionDTO {
+			return authenticator.assert(challenge("/auth/passkey/options"), []byte(bson.NewObjectId()))
+		},
+	}
+	for name, build := range invalid {
+		if status := post("/auth/passkey/login", build(), nil); status != http.StatusUnauthorized {
+			t.Errorf("expected login with %s to be refused, got %d", name, status)
+		}
+	}
+
+	authenticator.signCount = 100
+	var stepUp struct {
+		StepUpToken string `json:"step_up_token"`
+	}
+	stepUpAssertion := authenticator.assert(challenge("/auth/passkey/step-up/options"), userHandle)
+	if status := post("/auth/passkey/step-up", stepUpAssertion, &stepUp); status != http.StatusOK || stepUp.StepUpToken != "step-up|"+alice.Id.Hex() {
+		t.Errorf("expected a step-up token, got %d %+v", status, stepUp)
+	}
+	// a login challenge can not be used for a step-up
+	loginAssertion := authenticator.assert(challenge("/auth/passkey/options"), userHandle)
+	if status := post("/auth/passkey/step-up", loginAssertion, nil); status != http.StatusForbidden {
+		t.Errorf("expected a login assertion to be refused for a step-up, got %d", status)
+	}
+}
+
+func TestDecodeCborRejectsMalformedInput(t *testing.T) {
+	malformed := map[string][]byte{
+		"empty":                   {},
+		"truncated string":        {0x45, 0x01, 0x02},
+		"truncated map":           {0xa2, 0x01, 0x02},
+		"indefinite length":       {0x5f, 0x41, 0x00, 0xff},
+		"array longer than input": {0x9a, 0xff, 0xff, 0xff, 0xff},
+		"float":                   {0xf9, 0x3c, 0x00},
+	}
+	for name, data := range malformed {
+		if _, _, err := decodeCbor(data); err == nil {
+			t.Errorf("expected %s to be refused", name)
+		}
+	}
+
+	nested := bytes.Repeat([]byte{0x81}, maxCborDepth+2)
+	if _, _, err := decodeCbor(append(nested, 0x00)); err == nil {
+		t.Error("expected deeply nested items to be refused")
+	}
+}
@@ -12,12 +12,16 @@ import (
 type Config struct {
 	Server    Server    `json:"server"`
 	Mongo     Mongo     `json:"mongo"`
+	Auth      Auth      `json:"auth"`
+	Mail      Mail      `json:"mail"`
 	Webwallet Webwallet `json:"webwallet"`
 }
 
 type Server struct {
 	Address        string `json:"address"`
 	StaticLocation string `json:"staticLocation"`
+	// url the webapp is reachable at, used for the links in the mails
+	PublicUrl string `json:"publicUrl"`
 }
 
 type Mongo struct {
@@ -25,22 +29,185 @@ type Mongo struct {
 	Database string `json:"database"`
 }
 
+// Auth configures the signing of the issued JWTs. HS256 tokens are signed with the secret, RS256 and ES256 tokens with
+// the private key file. The secret can be overridden with the WEBWALLET_AUTH_SECRET environment variable.
+type Auth struct {
+	Algorithm      string `json:"algorithm"`
+	Secret         string `json:"secret"`
+	PrivateKeyFile string `json:"privateKeyFile"`
+	// key id put into the kid header of issued tokens, required as soon as retired keys are configured
+	Kid string `json:"kid"`
+	// previously active keys, tokens signed with them stay valid until they expire
+	RetiredKeys     []RetiredKey  `json:"retiredKeys"`
+	TimeoutMinutes  time.Duration `json:"timeoutMinutes"`
+	MaxRefreshHours time.Duration `json:"maxRefreshHours"`
+	Lockout         Lockout       `json:"lockout"`
+	// usernames of the users which are granted the admin role on startup
+	Admins   []string `json:"admins"`
+	Oidc     Oidc     `json:"oidc"`
+	Webauthn Webauthn `json:"webauthn"`
+}
+
+// Webauthn configures the login with passkeys, which is disabled without rpId. The rpId is the domain of the webapp,
+// passkeys are bound to it and can not be used on any other domain.
+type Webauthn struct {
+	RpId   string `json:"rpId"`
+	RpName string `json:"rpName"`
+	// origins of the webapp allowed to use the passkeys, e.g. https://wallet.ird.cash
+	Origins []string `json:"origins"`
+}
+
+// Oidc configures the login through an OpenID Connect provider, which is disabled without issuer. Users are linked to
+// their provider account by their verified email.
+type Oidc struct {
+	Issuer       string `json:"issuer"`
+	ClientId     string `json:"clientId"`
+	ClientSecret string `json:"clientSecret"`
+	// url of the callback as registered at the provider, i.e. the public url of the core followed by /auth/oidc/callback
+	RedirectUrl string `json:"redirectUrl"`
+	// requested in addition to openid, email and profile
+	Scopes []string `json:"scopes"`
+}
+
+// Lockout configures the login brute-force protection. Failed logins are counted per username and per client ip, once
+// the free attempts are used up each further attempt has to wait for an exponentially growing backoff. After
+// MaxFailures failures for a username the account is locked, it can be unlocked with the link sent by mail. Failed
+// TOTP and recovery codes are counted per user the same way.
+type Lockout struct {
+	FreeAttempts      int           `json:"freeAttempts"`
+	IpFreeAttempts    int           `json:"ipFreeAttempts"`
+	BackoffSeconds    time.Duration `json:"backoffSeconds"`
+	MaxBackoffSeconds time.Duration `json:"maxBackoffSeconds"`
+	// a value <= 0 disables the lockout
+	MaxFailures    int           `json:"maxFailures"`
+	LockoutMinutes time.Duration `json:"lockoutMinutes"`
+	// failure counters are reset after this time without failures
+	WindowMinutes time.Duration `json:"windowMinutes"`
+}
+
+// RetiredKey is only used to verify tokens, HS256 keys need the secret and RS256/ES256 keys the public key file.
+type RetiredKey struct {
+	Kid           string `json:"kid"`
+	Algorithm     string `json:"algorithm"`
+	Secret        string `json:"secret"`
+	PublicKeyFile string `json:"publicKeyFile"`
+}
+
+// Mail configures the SMTP server used to send the verification and password reset mails. Without a host the mails
+// are only logged.
+type Mail struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	From     string `json:"from"`
+}
+
 type Webwallet struct {
-	Network          string    `json:"network"`
-	InternalResolver bool      `json:"internalResolver"`
-	Satellite        Satellite `json:"satellite"`
-	Watcher          Watcher   `json:"watcher"`
+	Runtime          string     `json:"runtime"`
+	Network          string     `json:"network"`
+	InternalResolver bool       `json:"internalResolver"`
+	Kubernetes       Kubernetes `json:"kubernetes"`
+	Daemons          Daemons    `json:"daemons"`
+	Satellite        Satellite  `json:"satellite"`
+	Watcher          Watcher    `json:"watcher"`
+	Quota            Quota      `json:"quota"`
+	Jobs             Jobs       `json:"jobs"`
+	Limits           Limits     `json:"limits"`
+	Events           Events     `json:"events"`
+	// whether users have to verify their email address before creating or importing a wallet
+	RequireVerifiedEmail bool `json:"requireVerifiedEmail"`
+}
+
+// Kubernetes configures the kubernetes runtime, which runs each satellite in a pod with a persistent volume claim.
+type Kubernetes struct {
+	// path to a kubeconfig file, the in-cluster config is used if empty
+	Kubeconfig          string        `json:"kubeconfig"`
+	Namespace           string        `json:"namespace"`
+	StorageClass        string        `json:"storageClass"`
+	StorageSize         string        `json:"storageSize"`
+	StartTimeoutSeconds time.Duration `json:"startTimeoutSeconds"`
+}
+
+// Daemons configures the iridiumd nodes the satellites connect to. The healthiest node is passed to each satellite on
+// start, without any node the satellite command is used as is.
+type Daemons struct {
+	Nodes          []DaemonNode  `json:"nodes"`
+	CheckSeconds   time.Duration `json:"checkSeconds"`
+	TimeoutSeconds time.Duration `json:"timeoutSeconds"`
+	// number of blocks a node may lag behind the highest known node to still be considered
+	MaxLag uint64 `json:"maxLag"`
+}
+
+type DaemonNode struct {
+	Address string `json:"address"`
+	Port    int    `json:"port"`
 }
 
 type Satellite struct {
-	Image   string            `json:"image"`
-	Command []string          `json:"command"`
-	RpcPort string            `json:"rpcPort"`
-	Labels  map[string]string `json:"labels"`
+	Image       string            `json:"image"`
+	Command     []string          `json:"command"`
+	RpcPort     string            `json:"rpcPort"`
+	Labels      map[string]string `json:"labels"`
+	Pool        Pool              `json:"pool"`
+	HealthCheck HealthCheck       `json:"healthCheck"`
+}
+
+// HealthCheck configures the docker HEALTHCHECK of the satellite containers, an empty command disables it.
+type HealthCheck struct {
+	Command         []string      `json:"command"`
+	IntervalSeconds time.Duration `json:"intervalSeconds"`
+	TimeoutSeconds  time.Duration `json:"timeoutSeconds"`
+	Retries         int           `json:"retries"`
+}
+
+type Pool struct {
+	Size          int           `json:"size"`
+	RefillRate    int           `json:"refillRate"`
+	RefillSeconds time.Duration `json:"refillSeconds"`
+	MaxAgeMinutes time.Duration `json:"maxAgeMinutes"`
 }
 
 type Watcher struct {
 	TickSeconds time.Duration `json:"tickSeconds"`
+	Recovery    Recovery      `json:"recovery"`
+}
+
+type Recovery struct {
+	MaxFailures       int           `json:"maxFailures"`
+	MaxRestarts       int           `json:"maxRestarts"`
+	BackoffSeconds    time.Duration `json:"backoffSeconds"`
+	MaxBackoffSeconds time.Duration `json:"maxBackoffSeconds"`
+}
+
+type Jobs struct {
+	Workers   int `json:"workers"`
+	QueueSize int `json:"queueSize"`
+}
+
+// Quota holds the default limits applied to every user, a value <= 0 disables the respective limit.
+type Quota struct {
+	MaxWallets        int `json:"maxWallets"`
+	MaxRunningWallets int `json:"maxRunningWallets"`
+	CreationRate      int `json:"creationRate"`
+	// window the creation rate applies to, defaults to 60 minutes
+	CreationWindowMinutes time.Duration `json:"creationWindowMinutes"`
+}
+
+// Limits configures the spending limits of the wallets.
+type Limits struct {
+	// time after which a newly allowlisted address may be sent to
+	CoolingOffHours time.Duration `json:"coolingOffHours"`
+}
+
+// Events configures the log of the recent events of each user, which reconnecting clients replay. The log is kept in
+// memory unless it is backed by mongo, which keeps it across restarts.
+type Events struct {
+	// "memory" (default) or "mongo"
+	Log string `json:"log"`
+	// number of events kept per user
+	LogSize          int           `json:"logSize"`
+	RetentionMinutes time.Duration `json:"retentionMinutes"`
 }
 
 var singleton *Config
@@ -67,6 +234,8 @@ func initConfig() *Config {
 	viper.AddConfigPath(".")              // optionally look for conf in the working directory
 	err := viper.ReadInConfig()           // Find and read the conf file
 
+	viper.BindEnv("auth.secret", "WEBWALLET_AUTH_SECRET")
+
 	if err != nil { // Handle errors reading the conf file
 		panic(fmt.Errorf("Fatal error conf file: %s \n", err))
 	}
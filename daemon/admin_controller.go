@@ -0,0 +1,25 @@
+package daemon
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+type AdminController struct {
+	adminRouter *gin.RouterGroup
+}
+
+func NewAdminController(adminRouter *gin.RouterGroup) AdminController {
+	return AdminController{adminRouter: adminRouter}
+}
+
+// Routes registers the state of the configured daemon nodes in the adminRouter, which only admins may access.
+func (controller *AdminController) Routes() {
+	controller.adminRouter.GET("/nodes", controller.getNodesHandler())
+}
+
+func (controller *AdminController) getNodesHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, service.Nodes())
+	}
+}
@@ -0,0 +1,33 @@
+package daemon
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/iridiumdev/webwallet-core/util"
+	"net/http"
+)
+
+type Controller struct {
+	apiRouter *gin.RouterGroup
+}
+
+func NewController(apiRouter *gin.RouterGroup) Controller {
+	return Controller{apiRouter: apiRouter}
+}
+
+// Routes registers this controllers sub-routing in the main apiRouter. It returns a RouterGroup containing only the
+// routes for the information about the iridium network.
+func (controller *Controller) Routes() {
+	api := controller.apiRouter.Group("/network")
+	{
+		api.GET("", controller.getHandler())
+	}
+}
+
+func (controller *Controller) getHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		network, err := service.Network()
+		if !util.HandleError(c, err, http.StatusServiceUnavailable) {
+			c.JSON(http.StatusOK, network)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package daemon
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Node is the state of a configured iridiumd node as seen by the last health check.
+type Node struct {
+	Address   string        `json:"address"`
+	Port      int           `json:"port"`
+	Healthy   bool          `json:"healthy"`
+	Height    uint64        `json:"height"`
+	Peers     uint64        `json:"peers"`
+	Latency   time.Duration `json:"latency"`
+	LastError string        `json:"lastError,omitempty"`
+	LastCheck time.Time     `json:"lastCheck"`
+}
+
+// Endpoint returns the host:port of the node, which also identifies the node.
+func (n *Node) Endpoint() string {
+	return net.JoinHostPort(n.Address, strconv.Itoa(n.Port))
+}
+
+// SatelliteArgs returns the walletd arguments connecting a satellite to the node.
+func (n *Node) SatelliteArgs() []string {
+	return []string{
+		fmt.Sprintf("--daemon-address=%s", n.Address),
+		fmt.Sprintf("--daemon-port=%d", n.Port),
+	}
+}
+
+const NETWORK_UPDATED = "network.updated"
+
+// Network summarizes the state of the blockchain as seen by the healthiest daemon node. The hashrate (in hashes per
+// second) is estimated from the difficulty and the average time between the recent blocks.
+type Network struct {
+	Height     uint64    `json:"height"`
+	Difficulty uint64    `json:"difficulty"`
+	Hashrate   uint64    `json:"hashrate"`
+	TxPoolSize uint64    `json:"txPoolSize"`
+	LastBlock  Block     `json:"lastBlock"`
+	Updated    time.Time `json:"updated"`
+}
+
+type Block struct {
+	Height     uint64    `json:"height"`
+	Hash       string    `json:"hash"`
+	Time       time.Time `json:"time"`
+	Difficulty uint64    `json:"difficulty"`
+	Reward     uint64    `json:"reward"`
+	Size       uint64    `json:"size"`
+	TxCount    int       `json:"txCount"`
+}
+
+// NetworkEvent is broadcast to all connected clients whenever a new block was found.
+type NetworkEvent struct {
+	Type    string   `json:"type"`
+	Network *Network `json:"network"`
+}
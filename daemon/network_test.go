@@ -0,0 +1,48 @@
+package daemon
+
+import (
+	"github.com/iridiumdev/webwallet-core/config"
+	"testing"
+	"time"
+)
+
+func TestRefreshNetwork(t *testing.T) {
+	server, node := fakeDaemon(t, 1000, 8)
+	defer server.Close()
+
+	s := newService(config.Daemons{Nodes: []config.DaemonNode{node}})
+	s.check()
+
+	network, err := s.RefreshNetwork()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if network.Height != 1000 || network.Difficulty != difficulty || network.TxPoolSize != 3 {
+		t.Errorf("unexpected network info %+v", network)
+	}
+	if network.Hashrate != difficulty/blockTime {
+		t.Errorf("expected hashrate %d, got %d", difficulty/blockTime, network.Hashrate)
+	}
+
+	lastBlock := network.LastBlock
+	if lastBlock.Height != 999 || lastBlock.Hash != "hash999" || lastBlock.TxCount != 2 || lastBlock.Size != 1024 {
+		t.Errorf("unexpected last block %+v", lastBlock)
+	}
+	if !lastBlock.Time.Equal(time.Unix(genesisTime+999*blockTime, 0)) {
+		t.Errorf("unexpected last block time %s", lastBlock.Time)
+	}
+
+	cached, err := s.Network()
+	if err != nil || cached != network {
+		t.Errorf("expected cached network state, got %v (%v)", cached, err)
+	}
+}
+
+func TestNetworkWithoutDaemon(t *testing.T) {
+	s := newService(config.Daemons{})
+
+	if _, err := s.Network(); err != ErrNoDaemon {
+		t.Errorf("expected %v, got %v", ErrNoDaemon, err)
+	}
+}
@@ -0,0 +1,302 @@
+package daemon
+
+import (
+	"fmt"
+	"github.com/iridiumdev/webwallet-core/config"
+	"github.com/iridiumdev/webwallet-core/iridium"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+type Service interface {
+	Run()
+	Close()
+	// Select returns the healthiest node or nil if no nodes are configured.
+	Select() *Node
+	// IsHealthy reports whether the node with the given endpoint passed its last health check. Endpoints which are not
+	// managed by this service are considered healthy.
+	IsHealthy(endpoint string) bool
+	Nodes() []Node
+
+	// Network returns the cached network state, fetching it on first use.
+	Network() (*Network, error)
+	// RefreshNetwork fetches the network state from the healthiest node and updates the cache.
+	RefreshNetwork() (*Network, error)
+}
+
+// number of blocks the average block time for the hashrate estimation is computed over
+const hashrateWindow = 30
+
+var (
+	ErrNoPeers  = errors.New("daemon has no peers")
+	ErrNoDaemon = errors.New("no daemon node configured")
+)
+
+var service Service
+
+type serviceImpl struct {
+	settings config.Daemons
+	dial     func(address string, timeout time.Duration) (iridium.DaemonRPC, error)
+	quit     chan struct{}
+
+	mx    sync.RWMutex
+	nodes []*Node
+
+	networkMx sync.RWMutex
+	network   *Network
+}
+
+func InitService() Service {
+	service = newService(config.Get().Webwallet.Daemons)
+	return service
+}
+
+func newService(settings config.Daemons) *serviceImpl {
+	nodes := make([]*Node, 0, len(settings.Nodes))
+	for _, node := range settings.Nodes {
+		nodes = append(nodes, &Node{Address: node.Address, Port: node.Port})
+	}
+
+	return &serviceImpl{
+		settings: settings,
+		dial:     iridium.Daemon,
+		quit:     make(chan struct{}),
+		nodes:    nodes,
+	}
+}
+
+// Run checks all nodes once before returning, so satellites started afterwards already get a healthy node, and keeps
+// checking them in the background.
+func (s *serviceImpl) Run() {
+	if len(s.nodes) == 0 {
+		log.Info("No daemon nodes configured, satellites use the daemon of their command")
+		return
+	}
+
+	s.check()
+
+	interval := s.settings.CheckSeconds * time.Second
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	go func() {
+		for {
+			select {
+			case <-s.quit:
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				s.check()
+			}
+		}
+	}()
+}
+
+func (s *serviceImpl) Close() {
+	close(s.quit)
+}
+
+func (s *serviceImpl) Select() *Node {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	if len(s.nodes) == 0 {
+		return nil
+	}
+
+	var maxHeight uint64
+	for _, node := range s.nodes {
+		if node.Healthy && node.Height > maxHeight {
+			maxHeight = node.Height
+		}
+	}
+
+	var best *Node
+	for _, node := range s.nodes {
+		if !node.Healthy || node.Height+s.settings.MaxLag < maxHeight {
+			continue
+		}
+		if best == nil || node.Latency < best.Latency {
+			best = node
+		}
+	}
+
+	if best == nil {
+		best = s.nodes[0]
+		log.Warnf("No healthy daemon node available, falling back to %s", best.Endpoint())
+	}
+
+	selected := *best
+	return &selected
+}
+
+func (s *serviceImpl) IsHealthy(endpoint string) bool {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	for _, node := range s.nodes {
+		if node.Endpoint() == endpoint {
+			return node.Healthy
+		}
+	}
+	return true
+}
+
+func (s *serviceImpl) Nodes() []Node {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	nodes := make([]Node, 0, len(s.nodes))
+	for _, node := range s.nodes {
+		nodes = append(nodes, *node)
+	}
+	return nodes
+}
+
+func (s *serviceImpl) Network() (*Network, error) {
+	s.networkMx.RLock()
+	network := s.network
+	s.networkMx.RUnlock()
+
+	if network != nil {
+		return network, nil
+	}
+	return s.RefreshNetwork()
+}
+
+func (s *serviceImpl) RefreshNetwork() (*Network, error) {
+	node := s.Select()
+	if node == nil {
+		return nil, ErrNoDaemon
+	}
+
+	rpc, err := s.dial(fmt.Sprintf("http://%s", node.Endpoint()), s.timeout())
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := rpc.GetInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := rpc.GetLastBlockHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := rpc.GetBlock(header.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	network := &Network{
+		Height:     info.Height,
+		Difficulty: info.Difficulty,
+		TxPoolSize: info.TxPoolSize,
+		LastBlock: Block{
+			Height:     header.Height,
+			Hash:       header.Hash,
+			Time:       time.Unix(int64(header.Timestamp), 0).UTC(),
+			Difficulty: header.Difficulty,
+			Reward:     header.Reward,
+			Size:       block.BlockSize,
+			TxCount:    len(block.Transactions),
+		},
+		Updated: time.Now(),
+	}
+
+	if header.Height > hashrateWindow {
+		older, err := rpc.GetBlockHeaderByHeight(header.Height - hashrateWindow)
+		if err != nil {
+			return nil, err
+		}
+		if header.Timestamp > older.Timestamp {
+			blockTime := (header.Timestamp - older.Timestamp) / hashrateWindow
+			if blockTime > 0 {
+				network.Hashrate = info.Difficulty / blockTime
+			}
+		}
+	}
+
+	s.networkMx.Lock()
+	s.network = network
+	s.networkMx.Unlock()
+
+	return network, nil
+}
+
+// check probes all nodes in parallel and replaces their state once all probes are done.
+func (s *serviceImpl) check() {
+	nodes := s.Nodes()
+
+	var wg sync.WaitGroup
+	for i := range nodes {
+		wg.Add(1)
+		go func(node *Node) {
+			defer wg.Done()
+			s.probe(node)
+		}(&nodes[i])
+	}
+	wg.Wait()
+
+	s.mx.Lock()
+	for i, node := range nodes {
+		if node.Healthy != s.nodes[i].Healthy || s.nodes[i].LastCheck.IsZero() {
+			if node.Healthy {
+				log.Infof("Daemon node %s is healthy at height %d", node.Endpoint(), node.Height)
+			} else {
+				log.Warnf("Daemon node %s is unhealthy: %s", node.Endpoint(), node.LastError)
+			}
+		}
+		*s.nodes[i] = node
+	}
+	s.mx.Unlock()
+}
+
+func (s *serviceImpl) probe(node *Node) {
+	node.LastCheck = time.Now()
+
+	height, info, latency, err := s.query(node)
+	if err == nil && info.OutgoingConnectionsCount+info.IncomingConnectionsCount == 0 {
+		err = ErrNoPeers
+	}
+	if err != nil {
+		node.Healthy = false
+		node.LastError = err.Error()
+		return
+	}
+
+	node.Healthy = true
+	node.LastError = ""
+	node.Height = height.Height
+	node.Peers = info.OutgoingConnectionsCount + info.IncomingConnectionsCount
+	node.Latency = latency
+}
+
+func (s *serviceImpl) query(node *Node) (height iridium.GetHeightResponse, info iridium.GetInfoResponse, latency time.Duration, err error) {
+	rpc, err := s.dial(fmt.Sprintf("http://%s", node.Endpoint()), s.timeout())
+	if err != nil {
+		return
+	}
+
+	start := time.Now()
+	if height, err = rpc.GetHeight(); err != nil {
+		return
+	}
+	latency = time.Since(start)
+
+	info, err = rpc.GetInfo()
+	return
+}
+
+func (s *serviceImpl) timeout() time.Duration {
+	if s.settings.TimeoutSeconds <= 0 {
+		return 5 * time.Second
+	}
+	return s.settings.TimeoutSeconds * time.Second
+}
@@ -0,0 +1,159 @@
+package daemon
+
+import (
+	"encoding/json"
+	"github.com/iridiumdev/webwallet-core/config"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+const (
+	genesisTime = 1546300800
+	blockTime   = 120
+	difficulty  = 240000
+	reward      = 1000000000
+)
+
+// fakeDaemon serves the getinfo/getheight endpoints and the block related JSON-RPC methods of an iridiumd node at the
+// given height, with a block found every blockTime seconds.
+func fakeDaemon(t *testing.T, height uint64, peers uint64) (*httptest.Server, config.DaemonNode) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/getheight", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "OK", "height": height})
+	})
+	mux.HandleFunc("/getinfo", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":                     "OK",
+			"height":                     height,
+			"difficulty":                 difficulty,
+			"tx_pool_size":               3,
+			"outgoing_connections_count": peers,
+		})
+	})
+	mux.HandleFunc("/json_rpc", func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Id     interface{} `json:"id"`
+			Method string      `json:"method"`
+			Params struct {
+				Height uint64 `json:"height"`
+				Hash   string `json:"hash"`
+			} `json:"params"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+
+		header := func(height uint64) map[string]interface{} {
+			return map[string]interface{}{
+				"height":     height,
+				"hash":       "hash" + strconv.FormatUint(height, 10),
+				"timestamp":  genesisTime + height*blockTime,
+				"difficulty": difficulty,
+				"reward":     reward,
+			}
+		}
+
+		var result interface{}
+		switch request.Method {
+		case "getlastblockheader":
+			result = map[string]interface{}{"status": "OK", "block_header": header(height - 1)}
+		case "getblockheaderbyheight":
+			result = map[string]interface{}{"status": "OK", "block_header": header(request.Params.Height)}
+		case "f_block_json":
+			result = map[string]interface{}{"status": "OK", "block": map[string]interface{}{
+				"hash":         request.Params.Hash,
+				"blockSize":    1024,
+				"transactions": []map[string]interface{}{{"hash": "tx1"}, {"hash": "tx2"}},
+			}}
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{"jsonrpc": "2.0", "id": request.Id, "result": result})
+	})
+	server := httptest.NewServer(mux)
+
+	serverUrl, _ := url.Parse(server.URL)
+	host, port, err := net.SplitHostPort(serverUrl.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	portNumber, _ := strconv.Atoi(port)
+
+	return server, config.DaemonNode{Address: host, Port: portNumber}
+}
+
+func TestSelectSkipsUnhealthyAndLaggingNodes(t *testing.T) {
+	lagging, laggingNode := fakeDaemon(t, 900, 8)
+	defer lagging.Close()
+	current, currentNode := fakeDaemon(t, 1000, 8)
+	defer current.Close()
+	isolated, isolatedNode := fakeDaemon(t, 1000, 0)
+	defer isolated.Close()
+	down, downNode := fakeDaemon(t, 1000, 8)
+	down.Close()
+
+	s := newService(config.Daemons{
+		Nodes:  []config.DaemonNode{downNode, laggingNode, isolatedNode, currentNode},
+		MaxLag: 10,
+	})
+	s.check()
+
+	selected := s.Select()
+	if selected.Port != currentNode.Port {
+		t.Errorf("expected node %d to be selected, got %d", currentNode.Port, selected.Port)
+	}
+	if selected.Height != 1000 || selected.Peers != 8 {
+		t.Errorf("expected height 1000 with 8 peers, got %d with %d", selected.Height, selected.Peers)
+	}
+
+	nodes := s.Nodes()
+	if nodes[0].Healthy || nodes[0].LastError == "" {
+		t.Error("expected unreachable node to be unhealthy")
+	}
+	if nodes[2].Healthy || nodes[2].LastError != ErrNoPeers.Error() {
+		t.Errorf("expected node without peers to be unhealthy, got %s", nodes[2].LastError)
+	}
+	if !s.IsHealthy(nodes[1].Endpoint()) || s.IsHealthy(nodes[0].Endpoint()) {
+		t.Error("expected health to be reported per endpoint")
+	}
+}
+
+func TestSelectFailsOverWhenNodeGoesDown(t *testing.T) {
+	first, firstNode := fakeDaemon(t, 1000, 8)
+	second, secondNode := fakeDaemon(t, 1000, 8)
+	defer second.Close()
+
+	s := newService(config.Daemons{Nodes: []config.DaemonNode{firstNode, secondNode}})
+	s.check()
+
+	first.Close()
+	s.check()
+
+	if selected := s.Select(); selected.Port != secondNode.Port {
+		t.Errorf("expected failover to node %d, got %d", secondNode.Port, selected.Port)
+	}
+}
+
+func TestSelectFallsBackToFirstNode(t *testing.T) {
+	down, downNode := fakeDaemon(t, 1000, 8)
+	down.Close()
+
+	s := newService(config.Daemons{Nodes: []config.DaemonNode{downNode}})
+	s.check()
+
+	if selected := s.Select(); selected == nil || selected.Port != downNode.Port {
+		t.Errorf("expected fallback to the first node, got %v", selected)
+	}
+}
+
+func TestSelectWithoutNodes(t *testing.T) {
+	s := newService(config.Daemons{})
+
+	if selected := s.Select(); selected != nil {
+		t.Errorf("expected no node, got %v", selected)
+	}
+	if !s.IsHealthy("127.0.0.1:13100") {
+		t.Error("expected unmanaged endpoint to be healthy")
+	}
+}
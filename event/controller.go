@@ -3,16 +3,22 @@ package event
 import (
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
-	"github.com/iridiumdev/gin-jwt"
 	"github.com/iridiumdev/webwallet-core/auth"
 	"github.com/iridiumdev/webwallet-core/event/ws"
+	"github.com/iridiumdev/webwallet-core/util"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"net/http"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidLastSeq = errors.New("invalid lastSeq")
 )
 
 type Controller struct {
 	apiRouter *gin.RouterGroup
-	auth      *jwt.GinJWTMiddleware
 }
 
 var upgrader = &websocket.Upgrader{
@@ -30,12 +36,14 @@ func NewController(apiRouter *gin.RouterGroup) Controller {
 }
 
 // Routes registers this controllers sub-routing in the main apiRouter. It returns a RouterGroup containing only the
-// routes for the HTTP upgrade operations required for the websocket eventing.
+// routes for the HTTP upgrade operations required for the websocket eventing. The apiRouter accepts personal access
+// tokens, so every route has to require a scope.
 func (controller *Controller) Routes() {
 
 	api := controller.apiRouter.Group("/events")
 	{
-		api.GET("/connect", controller.websocketUpgradeHandler())
+		api.GET("/connect", auth.RequireScope(auth.ScopeEventsSubscribe), controller.websocketUpgradeHandler())
+		api.GET("/stream", auth.RequireScope(auth.ScopeEventsSubscribe), controller.streamHandler())
 	}
 
 }
@@ -44,6 +52,12 @@ func (controller *Controller) websocketUpgradeHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userId := auth.ExtractUserId(c)
 
+		// clients which reconnect pass the seq of the last event they received, to replay the ones they missed
+		lastSeq, ok := parseLastSeq(c, c.Query("lastSeq"))
+		if !ok {
+			return
+		}
+
 		wsConn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 		if err != nil {
 			log.Printf("error upgrading %s", err)
@@ -51,12 +65,67 @@ func (controller *Controller) websocketUpgradeHandler() gin.HandlerFunc {
 		}
 
 		conn := ws.NewConnection(wsConn)
+		subscribe(c, conn)
 
 		wg := service.WSHub().AddConnection(userId, conn)
 		defer service.WSHub().CloseConnection(userId, conn)
 
+		if lastSeq != nil {
+			resume(conn, userId, *lastSeq)
+		}
+
 		go conn.Writer()
-		go conn.Reader()
+		go conn.Reader(func(message []byte) {
+			handleCommand(conn, message)
+		})
 		wg.Wait()
 	}
 }
+
+// resume replays the events the client missed since the last seq it received, or tells it to resync if they are not
+// kept anymore. The connection has to be added to the hub already, so that no event is lost in between.
+func resume(conn *ws.Connection, userId string, lastSeq uint64) {
+	messages, complete := service.Replay(userId, lastSeq)
+	if !complete {
+		reply(conn, TypeResync, &ResyncPayload{LastSeq: lastSeq})
+		return
+	}
+	if err := conn.Replay(messages); err != nil {
+		log.Debugf("Could not replay the events of user %s: %s", userId, err)
+	}
+}
+
+// parseLastSeq parses the seq a reconnecting client passed, which is nil for new clients. It answers with 400 and
+// reports false if the seq is invalid.
+func parseLastSeq(c *gin.Context, value string) (*uint64, bool) {
+	if value == "" {
+		return nil, true
+	}
+	seq, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		util.HandleError(c, errors.Wrap(ErrInvalidLastSeq, value), http.StatusBadRequest)
+		return nil, false
+	}
+	return &seq, true
+}
+
+// subscribe sets up the initial subscription of the connection from the query parameters. Access tokens restricted
+// to some wallets only receive the events of those.
+func subscribe(c *gin.Context, conn *ws.Connection) {
+	if token := auth.ExtractAccessToken(c); token != nil && len(token.Wallets) > 0 {
+		conn.Restrict(token.Wallets)
+	}
+	conn.Subscribe(queryList(c, "wallets"), queryList(c, "types"))
+}
+
+// queryList returns the comma separated values of the query parameter, which give the initial subscription of a
+// connection.
+func queryList(c *gin.Context, key string) []string {
+	var values []string
+	for _, value := range strings.Split(c.Query(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
@@ -0,0 +1,130 @@
+package event
+
+import (
+	"encoding/json"
+	"github.com/iridiumdev/webwallet-core/event/ws"
+	"sync"
+	"time"
+)
+
+// Log keeps the recent events of each user, so that a client which lost its connection can replay the ones it missed.
+type Log interface {
+	// Append numbers the envelope with the next seq of the user and keeps it.
+	Append(userId string, envelope *Envelope) (*Record, error)
+	// Since returns the events of the user after the given seq, oldest first. It reports false if some of them are not
+	// kept anymore, the client has to resync then.
+	Since(userId string, seq uint64) ([]*Record, bool, error)
+}
+
+// Record is an event as kept in the log, with its envelope already converted to []byte.
+type Record struct {
+	UserId   string    `bson:"userId"`
+	Seq      uint64    `bson:"seq"`
+	Type     string    `bson:"type"`
+	WalletId string    `bson:"walletId,omitempty"`
+	Ts       time.Time `bson:"ts"`
+	Data     []byte    `bson:"data"`
+}
+
+func newRecord(userId string, envelope *Envelope) (*Record, error) {
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return nil, err
+	}
+	return &Record{
+		UserId:   userId,
+		Seq:      envelope.Seq,
+		Type:     envelope.Type,
+		WalletId: envelope.WalletId,
+		Ts:       envelope.Ts,
+		Data:     data,
+	}, nil
+}
+
+func (r *Record) message() *ws.Message {
+	return &ws.Message{Type: r.Type, WalletId: r.WalletId, Seq: r.Seq, Data: r.Data}
+}
+
+type memoryLog struct {
+	mx        sync.Mutex
+	size      int
+	retention time.Duration
+	users     map[string]*userLog
+}
+
+type userLog struct {
+	// last seq handed out to the user
+	seq uint64
+	// at most size records, oldest first
+	records []*Record
+}
+
+// NewMemoryLog keeps up to size events per user for the retention. The seqs start over after a restart, so clients
+// which reconnect with a seq of before have to resync.
+func NewMemoryLog(size int, retention time.Duration) Log {
+	if size <= 0 {
+		size = 1
+	}
+	return &memoryLog{size: size, retention: retention, users: make(map[string]*userLog)}
+}
+
+func (l *memoryLog) Append(userId string, envelope *Envelope) (*Record, error) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	user, ok := l.users[userId]
+	if !ok {
+		user = &userLog{}
+		l.users[userId] = user
+	}
+
+	envelope.Seq = user.seq + 1
+	record, err := newRecord(userId, envelope)
+	if err != nil {
+		return nil, err
+	}
+	user.seq = record.Seq
+
+	user.records = append(user.records, record)
+	if len(user.records) > l.size {
+		user.records = append([]*Record(nil), user.records[len(user.records)-l.size:]...)
+	}
+	l.expire(user)
+	return record, nil
+}
+
+func (l *memoryLog) Since(userId string, seq uint64) ([]*Record, bool, error) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	user, ok := l.users[userId]
+	if !ok {
+		return nil, seq == 0, nil
+	}
+	if seq > user.seq {
+		return nil, false, nil
+	}
+	l.expire(user)
+	if seq == user.seq {
+		return nil, true, nil
+	}
+	if len(user.records) == 0 || user.records[0].Seq > seq+1 {
+		return nil, false, nil
+	}
+
+	first := int(seq + 1 - user.records[0].Seq)
+	return append([]*Record(nil), user.records[first:]...), true, nil
+}
+
+// expire drops the records older than the retention.
+func (l *memoryLog) expire(user *userLog) {
+	if l.retention <= 0 {
+		return
+	}
+	threshold := time.Now().Add(-l.retention)
+	expired := 0
+	for expired < len(user.records) && user.records[expired].Ts.Before(threshold) {
+		expired++
+	}
+	user.records = user.records[expired:]
+}
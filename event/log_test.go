@@ -0,0 +1,57 @@
+package event
+
+import (
+	"testing"
+	"time"
+)
+
+func seqs(records []*Record) []uint64 {
+	result := make([]uint64, 0, len(records))
+	for _, record := range records {
+		result = append(result, record.Seq)
+	}
+	return result
+}
+
+func TestMemoryLogReplaysMissedEvents(t *testing.T) {
+	history := NewMemoryLog(3, time.Hour)
+	for i := 0; i < 5; i++ {
+		if _, err := history.Append("alice", &Envelope{Type: "job.updated", Ts: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	record, _ := history.Append("bob", &Envelope{Type: "job.updated", Ts: time.Now()})
+	if record.Seq != 1 {
+		t.Errorf("expected the seqs to be counted per user, got %d for bob", record.Seq)
+	}
+
+	records, complete, _ := history.Since("alice", 3)
+	if !complete || len(records) != 2 || records[0].Seq != 4 || records[1].Seq != 5 {
+		t.Errorf("expected events 4 and 5, got %v %v", seqs(records), complete)
+	}
+	if records, complete, _ := history.Since("alice", 5); !complete || len(records) != 0 {
+		t.Errorf("expected nothing to replay for an up to date client, got %v %v", seqs(records), complete)
+	}
+	if _, complete, _ := history.Since("alice", 1); complete {
+		t.Error("expected a resync once the missed events were dropped from the log")
+	}
+	if _, complete, _ := history.Since("alice", 9); complete {
+		t.Error("expected a resync for a seq which was never handed out, e.g. before a restart")
+	}
+	if records, complete, _ := history.Since("carol", 0); !complete || len(records) != 0 {
+		t.Errorf("expected nothing to replay for a user without events, got %v %v", seqs(records), complete)
+	}
+}
+
+func TestMemoryLogDropsExpiredEvents(t *testing.T) {
+	history := NewMemoryLog(10, time.Minute)
+	history.Append("alice", &Envelope{Type: "job.updated", Ts: time.Now().Add(-2 * time.Minute)})
+	history.Append("alice", &Envelope{Type: "job.updated", Ts: time.Now()})
+
+	if _, complete, _ := history.Since("alice", 0); complete {
+		t.Error("expected a resync if the missed events expired")
+	}
+	if records, complete, _ := history.Since("alice", 1); !complete || len(records) != 1 || records[0].Seq != 2 {
+		t.Errorf("expected the recent event to be replayed, got %v %v", seqs(records), complete)
+	}
+}
@@ -0,0 +1,91 @@
+package event
+
+import (
+	"encoding/json"
+	"github.com/iridiumdev/webwallet-core/event/ws"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// Types of the control messages, which answer the commands of a client and are not part of its event stream.
+const (
+	TypeSubscription = "subscription"
+	TypeError        = "error"
+	// the client missed events which are not kept anymore and has to reload its state
+	TypeResync = "resync"
+
+	ActionSubscribe   = "subscribe"
+	ActionUnsubscribe = "unsubscribe"
+)
+
+var (
+	ErrInvalidCommand = errors.New("invalid command")
+	ErrUnknownAction  = errors.New("unknown action")
+)
+
+// Envelope wraps every message sent to the clients. The events sent to a user are numbered by seq, broadcasts and
+// control messages have none.
+type Envelope struct {
+	Type     string      `json:"type"`
+	WalletId string      `json:"walletId,omitempty"`
+	Seq      uint64      `json:"seq,omitempty"`
+	Ts       time.Time   `json:"ts"`
+	Payload  interface{} `json:"payload,omitempty"`
+}
+
+// Command is sent by a client to change the wallets and event types it receives. The Wildcard "*" stands for all of
+// them.
+type Command struct {
+	Action  string   `json:"action"`
+	Wallets []string `json:"wallets"`
+	Types   []string `json:"types"`
+}
+
+// SubscriptionPayload is the answer to every command, holding the resulting subscription.
+type SubscriptionPayload struct {
+	Wallets []string `json:"wallets"`
+	Types   []string `json:"types"`
+}
+
+// ResyncPayload tells a reconnecting client that the events after its last seq can not be replayed.
+type ResyncPayload struct {
+	LastSeq uint64 `json:"lastSeq"`
+}
+
+type ErrorPayload struct {
+	Error string `json:"error"`
+}
+
+// handleCommand applies the command of the client to its connection and answers with the resulting subscription.
+func handleCommand(conn *ws.Connection, message []byte) {
+	var command Command
+	if err := json.Unmarshal(message, &command); err != nil {
+		reply(conn, TypeError, &ErrorPayload{Error: ErrInvalidCommand.Error()})
+		return
+	}
+
+	switch command.Action {
+	case ActionSubscribe:
+		conn.Subscribe(command.Wallets, command.Types)
+	case ActionUnsubscribe:
+		conn.Unsubscribe(command.Wallets, command.Types)
+	default:
+		reply(conn, TypeError, &ErrorPayload{Error: errors.Wrap(ErrUnknownAction, command.Action).Error()})
+		return
+	}
+
+	wallets, types := conn.Subscription()
+	reply(conn, TypeSubscription, &SubscriptionPayload{Wallets: wallets, Types: types})
+}
+
+func reply(conn *ws.Connection, messageType string, payload interface{}) {
+	bytes, err := json.Marshal(&Envelope{Type: messageType, Ts: time.Now(), Payload: payload})
+	if err != nil {
+		log.Errorf("Could not convert %s reply to []byte!", messageType)
+		return
+	}
+	if !conn.Send(bytes) {
+		log.Debugf("Could not reply %s to a closed connection", messageType)
+	}
+}
@@ -2,13 +2,29 @@ package event
 
 import (
 	"encoding/json"
+	"fmt"
+	"github.com/iridiumdev/webwallet-core/config"
 	"github.com/iridiumdev/webwallet-core/event/ws"
 	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
 )
 
 type Service interface {
 	WSHub() *ws.Hub
-	SendToUser(userId string, message interface{})
+	// SendToUser wraps the payload in an Envelope of the given type and sends it to all connections of the user which
+	// subscribed to it. The wallet id is empty for events which do not belong to a wallet.
+	SendToUser(userId string, eventType string, walletId string, payload interface{})
+	// SendToUsers sends the event to each of the users, e.g. the members of a shared wallet.
+	SendToUsers(userIds []string, eventType string, walletId string, payload interface{})
+	// NotifyUsers sends the event to each of the users without numbering and logging it. It is meant for snapshots which
+	// are sent periodically, as a client which missed one gets the next one anyway.
+	NotifyUsers(userIds []string, eventType string, walletId string, payload interface{})
+	// Broadcast sends the event to all connections. Broadcasts are not numbered, as they are not meant for a user.
+	Broadcast(eventType string, payload interface{})
+	// Replay returns the events sent to the user after the given seq. It reports false if the client missed too many
+	// of them or too old ones and has to resync.
+	Replay(userId string, lastSeq uint64) ([]*ws.Message, bool)
 }
 
 var (
@@ -19,10 +35,30 @@ var service Service
 
 type serviceImpl struct {
 	hub *ws.Hub
+	// recent events of each user, which also hands out their seqs
+	history Log
+	// held from handing out the seq of an event until it is queued, so the events are queued in the order of their seqs
+	sendMx sync.Mutex
 }
 
+// InitService keeps the events in the configured log, the mongo backed one requires InitStore to be called first.
 func InitService() Service {
-	service = &serviceImpl{hub: ws.NewHub()}
+	eventConfig := config.Get().Webwallet.Events
+
+	var history Log
+	switch eventConfig.Log {
+	case "", "memory":
+		history = NewMemoryLog(eventConfig.LogSize, eventConfig.RetentionMinutes*time.Minute)
+	case "mongo":
+		if store == nil {
+			panic(fmt.Errorf("the mongo event log requires the event store"))
+		}
+		history = store
+	default:
+		panic(fmt.Errorf("unknown event log '%s'", eventConfig.Log))
+	}
+
+	service = &serviceImpl{hub: ws.NewHub(), history: history}
 	return service
 }
 
@@ -30,13 +66,60 @@ func (s *serviceImpl) WSHub() *ws.Hub {
 	return s.hub
 }
 
-func (s *serviceImpl) SendToUser(userId string, message interface{}) {
+func (s *serviceImpl) SendToUser(userId string, eventType string, walletId string, payload interface{}) {
+	// a client resumes after the last seq it got, so it would never get an event which overtook an earlier one
+	s.sendMx.Lock()
+	defer s.sendMx.Unlock()
+
+	record, err := s.history.Append(userId, &Envelope{Type: eventType, WalletId: walletId, Ts: time.Now(), Payload: payload})
+	if err != nil {
+		log.Errorf("Could not log %s event for user %s: %s", eventType, userId, err)
+		return
+	}
+
+	s.hub.SendToUser(userId, record.message())
+}
+
+func (s *serviceImpl) SendToUsers(userIds []string, eventType string, walletId string, payload interface{}) {
+	for _, userId := range userIds {
+		s.SendToUser(userId, eventType, walletId, payload)
+	}
+}
+
+func (s *serviceImpl) NotifyUsers(userIds []string, eventType string, walletId string, payload interface{}) {
 
-	bytes, err := json.Marshal(message)
+	bytes, err := json.Marshal(&Envelope{Type: eventType, WalletId: walletId, Ts: time.Now(), Payload: payload})
 	if err != nil {
-		log.Errorf("Could not convert message %s for user %s to []byte!", message, userId)
+		log.Errorf("Could not convert %s event to []byte!", eventType)
 		return
 	}
 
-	s.hub.SendToUser(userId, bytes)
+	for _, userId := range userIds {
+		s.hub.SendToUser(userId, &ws.Message{Type: eventType, WalletId: walletId, Data: bytes})
+	}
+}
+
+func (s *serviceImpl) Broadcast(eventType string, payload interface{}) {
+
+	bytes, err := json.Marshal(&Envelope{Type: eventType, Ts: time.Now(), Payload: payload})
+	if err != nil {
+		log.Errorf("Could not convert broadcast %s event to []byte!", eventType)
+		return
+	}
+
+	s.hub.Broadcast(&ws.Message{Type: eventType, Data: bytes})
+}
+
+func (s *serviceImpl) Replay(userId string, lastSeq uint64) ([]*ws.Message, bool) {
+	records, complete, err := s.history.Since(userId, lastSeq)
+	if err != nil {
+		log.Errorf("Could not read the events of user %s since %d: %s", userId, lastSeq, err)
+		return nil, false
+	}
+
+	messages := make([]*ws.Message, 0, len(records))
+	for _, record := range records {
+		messages = append(messages, record.message())
+	}
+	return messages, complete
 }
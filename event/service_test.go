@@ -0,0 +1,72 @@
+package event
+
+import (
+	"github.com/iridiumdev/webwallet-core/event/ws"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEventsArriveInSeqOrder(t *testing.T) {
+	s := &serviceImpl{hub: ws.NewHub(), history: NewMemoryLog(1000, time.Hour)}
+
+	received := make(chan uint64, 1000)
+	conn := ws.NewStreamConnection(func(message *ws.Message) error {
+		received <- message.Seq
+		return nil
+	})
+	s.hub.AddConnection("alice", conn)
+	go conn.Writer()
+
+	const senders, events = 4, 50
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < events; j++ {
+				s.SendToUser("alice", "job.updated", "", j)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var last uint64
+	for i := 0; i < senders*events; i++ {
+		select {
+		case seq := <-received:
+			if seq != last+1 {
+				t.Fatalf("expected seq %d, got %d", last+1, seq)
+			}
+			last = seq
+		case <-time.After(time.Second):
+			t.Fatalf("expected %d events, got %d", senders*events, i)
+		}
+	}
+}
+
+func TestNotificationsAreNotLogged(t *testing.T) {
+	s := &serviceImpl{hub: ws.NewHub(), history: NewMemoryLog(10, time.Hour)}
+
+	received := make(chan *ws.Message, 10)
+	conn := ws.NewStreamConnection(func(message *ws.Message) error {
+		received <- message
+		return nil
+	})
+	s.hub.AddConnection("alice", conn)
+	go conn.Writer()
+
+	s.NotifyUsers([]string{"alice"}, "wallet.updated", "a", "snapshot")
+	select {
+	case message := <-received:
+		if message.Seq != 0 || message.WalletId != "a" {
+			t.Errorf("expected an unnumbered message of wallet a, got %+v", message)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the notification to be delivered")
+	}
+
+	if records, complete, _ := s.history.Since("alice", 0); len(records) != 0 || !complete {
+		t.Errorf("expected no logged events, got %v", records)
+	}
+}
@@ -0,0 +1,91 @@
+package event
+
+import (
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+// mongoLog keeps the events in mongo, so that the seqs and the recent events survive a restart. Events older than the
+// retention are removed by a TTL index, the ones beyond the size of the log from time to time on append.
+type mongoLog struct {
+	db     *mgo.Database
+	events *mgo.Collection
+	// last seq handed out to each user, by user id
+	seqs *mgo.Collection
+	size int
+}
+
+type seqCounter struct {
+	Seq uint64 `bson:"seq"`
+}
+
+// store is the mongo backed Log, only used if configured.
+var store Log
+
+func (db *mongoLog) Append(userId string, envelope *Envelope) (*Record, error) {
+	var counter seqCounter
+	change := mgo.Change{Update: bson.M{"$inc": bson.M{"seq": 1}}, Upsert: true, ReturnNew: true}
+	if _, err := db.seqs.FindId(userId).Apply(change, &counter); err != nil {
+		return nil, err
+	}
+
+	envelope.Seq = counter.Seq
+	record, err := newRecord(userId, envelope)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.events.Insert(record); err != nil {
+		return nil, err
+	}
+
+	// every size events, drop the ones which are not replayed anymore
+	if record.Seq > uint64(db.size) && record.Seq%uint64(db.size) == 0 {
+		if _, err := db.events.RemoveAll(bson.M{"userId": userId, "seq": bson.M{"$lte": record.Seq - uint64(db.size)}}); err != nil {
+			log.Warnf("Could not trim the events of user %s: %s", userId, err)
+		}
+	}
+	return record, nil
+}
+
+func (db *mongoLog) Since(userId string, seq uint64) ([]*Record, bool, error) {
+	var counter seqCounter
+	if err := db.seqs.FindId(userId).One(&counter); err != nil && err != mgo.ErrNotFound {
+		return nil, false, err
+	}
+	if seq > counter.Seq {
+		return nil, false, nil
+	}
+	if seq == counter.Seq {
+		return nil, true, nil
+	}
+
+	var records []*Record
+	err := db.events.Find(bson.M{"userId": userId, "seq": bson.M{"$gt": seq}}).Sort("seq").Limit(db.size).All(&records)
+	if err != nil {
+		return nil, false, err
+	}
+	// the events up to the seq read before have to be complete, newer ones might have been appended in the meantime
+	if len(records) == 0 || records[0].Seq != seq+1 || records[len(records)-1].Seq < counter.Seq {
+		return nil, false, nil
+	}
+	return records, true, nil
+}
+
+func InitStore(db *mgo.Database, size int, retention time.Duration) {
+	eventsCollection := db.C("events")
+	eventsCollection.EnsureIndex(mgo.Index{Key: []string{"userId", "seq"}, Unique: true})
+	if retention > 0 {
+		eventsCollection.EnsureIndex(mgo.Index{Key: []string{"ts"}, ExpireAfter: retention})
+	}
+	if size <= 0 {
+		size = 1
+	}
+	store = &mongoLog{
+		db:     db,
+		events: eventsCollection,
+		seqs:   db.C("event_seqs"),
+		size:   size,
+	}
+}
@@ -0,0 +1,94 @@
+package event
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/iridiumdev/webwallet-core/auth"
+	"github.com/iridiumdev/webwallet-core/event/ws"
+	"io"
+	"net/http"
+	"time"
+)
+
+// heartbeatInterval is the time between the comments sent on idle event streams, as proxies close connections which
+// stay silent for too long.
+var heartbeatInterval = 15 * time.Second
+
+// streamHandler sends the events as server-sent events, for clients behind proxies which block websockets. Streams
+// get the same events as websockets, but the subscription can only be set with the query parameters. Browsers resume
+// a stream with the Last-Event-ID header, which is the seq of the last event received.
+func (controller *Controller) streamHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userId := auth.ExtractUserId(c)
+
+		value := c.GetHeader("Last-Event-ID")
+		if value == "" {
+			value = c.Query("lastSeq")
+		}
+		lastSeq, ok := parseLastSeq(c, value)
+		if !ok {
+			return
+		}
+
+		stream(c, userId, lastSeq)
+	}
+}
+
+// stream writes the events of the user to the response until the client goes away or the connection is closed by the
+// hub, e.g. after the user logged out everywhere.
+func stream(c *gin.Context, userId string, lastSeq *uint64) {
+	header := c.Writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	// keeps nginx from buffering the stream
+	header.Set("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	conn := ws.NewStreamConnection(func(message *ws.Message) error {
+		return writeEvent(c.Writer, message)
+	})
+	subscribe(c, conn)
+
+	service.WSHub().AddConnection(userId, conn)
+	defer service.WSHub().CloseConnection(userId, conn)
+
+	if lastSeq != nil {
+		resume(conn, userId, *lastSeq)
+	}
+
+	go func() {
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				conn.Heartbeat()
+			case <-c.Request.Context().Done():
+				service.WSHub().CloseConnection(userId, conn)
+				return
+			}
+		}
+	}()
+	conn.Writer()
+}
+
+// writeEvent writes the message as a server-sent event, with the seq as its id so that the browser passes it when it
+// reconnects. Messages without data are written as heartbeat comments.
+func writeEvent(w gin.ResponseWriter, message *ws.Message) error {
+	var err error
+	switch {
+	case len(message.Data) == 0:
+		_, err = io.WriteString(w, ": heartbeat\n\n")
+	case message.Seq != 0:
+		_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", message.Seq, message.Data)
+	default:
+		_, err = fmt.Fprintf(w, "data: %s\n\n", message.Data)
+	}
+	if err != nil {
+		return err
+	}
+	w.Flush()
+	return nil
+}
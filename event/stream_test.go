@@ -0,0 +1,115 @@
+package event
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/iridiumdev/webwallet-core/event/ws"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sseEvent is a server-sent event as read by the test client, heartbeats have neither id nor data.
+type sseEvent struct {
+	id       string
+	envelope Envelope
+}
+
+func readEvent(t *testing.T, reader *bufio.Reader) sseEvent {
+	var event sseEvent
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("expected an event, got %s", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			return event
+		case strings.HasPrefix(line, "id: "):
+			event.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event.envelope); err != nil {
+				t.Fatalf("expected an envelope, got %s", line)
+			}
+		}
+	}
+}
+
+// nextEvent skips heartbeats and reports whether there were any.
+func nextEvent(t *testing.T, reader *bufio.Reader) (sseEvent, bool) {
+	heartbeat := false
+	for {
+		if event := readEvent(t, reader); event.envelope.Type != "" {
+			return event, heartbeat
+		}
+		heartbeat = true
+	}
+}
+
+func TestStreamResumesAndFiltersEvents(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	heartbeatInterval = 20 * time.Millisecond
+	service = &serviceImpl{hub: ws.NewHub(), history: NewMemoryLog(10, time.Hour)}
+
+	engine := gin.New()
+	engine.GET("/stream", func(c *gin.Context) {
+		if lastSeq, ok := parseLastSeq(c, c.GetHeader("Last-Event-ID")); ok {
+			stream(c, "alice", lastSeq)
+		}
+	})
+	server := httptest.NewServer(engine)
+	defer server.Close()
+
+	connect := func(lastEventId string) (*http.Response, context.CancelFunc) {
+		ctx, cancel := context.WithCancel(context.Background())
+		request, _ := http.NewRequest(http.MethodGet, server.URL+"/stream?types=job.updated", nil)
+		request.Header.Set("Last-Event-ID", lastEventId)
+		response, err := http.DefaultClient.Do(request.WithContext(ctx))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response, cancel
+	}
+
+	service.SendToUser("alice", "job.updated", "", "first")
+	service.SendToUser("alice", "job.updated", "", "second")
+
+	response, cancel := connect("1")
+	defer cancel()
+	if contentType := response.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("expected an event stream, got %s", contentType)
+	}
+	reader := bufio.NewReader(response.Body)
+
+	if event, _ := nextEvent(t, reader); event.id != "2" || event.envelope.Payload != "second" {
+		t.Errorf("expected the missed event 2 to be replayed, got %+v", event)
+	}
+
+	service.SendToUser("alice", "wallet.updated", "a", "filtered")
+	time.Sleep(3 * heartbeatInterval)
+	service.SendToUser("alice", "job.updated", "", "live")
+	event, heartbeat := nextEvent(t, reader)
+	if event.id != "4" || event.envelope.Payload != "live" {
+		t.Errorf("expected only the subscribed live event 4, got %+v", event)
+	}
+	if !heartbeat {
+		t.Error("expected heartbeats on the idle stream")
+	}
+
+	resync, cancelResync := connect("99")
+	defer cancelResync()
+	if event, _ := nextEvent(t, bufio.NewReader(resync.Body)); event.envelope.Type != TypeResync || event.id != "" {
+		t.Errorf("expected a resync for an unknown seq, got %+v", event)
+	}
+
+	invalid, cancelInvalid := connect("abc")
+	defer cancelInvalid()
+	if invalid.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected an invalid Last-Event-ID to be refused, got %d", invalid.StatusCode)
+	}
+}
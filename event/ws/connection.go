@@ -3,37 +3,78 @@ package ws
 import (
 	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
+	"sort"
 	"sync"
 )
 
+// Wildcard subscribes a connection to all wallets or event types.
+const Wildcard = "*"
+
 type Connection struct {
 	// Buffered channel of outbound messages.
-	send chan []byte
+	send chan *Message
+
+	// seq of the last replayed message, the writer skips queued messages which were part of the replay
+	replayed uint64
 
 	// The Hub.
 	h *Hub
 
+	// nil for connections which are not backed by a websocket
 	wsConn *websocket.Conn
+	// writes a message to the client
+	write func(message *Message) error
 
 	wg *sync.WaitGroup
 
 	userId string
+
+	filterMx sync.RWMutex
+	// wallets and event types the connection subscribed to, nil for all
+	wallets map[string]struct{}
+	types   map[string]struct{}
+	// wallets an access token is restricted to, nil if unrestricted
+	restriction map[string]struct{}
 }
 
 type AuthenticatedConnection struct {
 	*Connection
 }
 
+// Message is an event as delivered by the hub. The type and wallet id are only used to select the connections which
+// subscribed to it, the data is sent as is. Seq numbers the events of a user, it is 0 for all other messages.
+type Message struct {
+	Type     string
+	WalletId string
+	Seq      uint64
+	Data     []byte
+}
+
 func NewConnection(wsConn *websocket.Conn) *Connection {
-	return &Connection{
-		send:   make(chan []byte, 256),
+	c := &Connection{
+		send:   make(chan *Message, 256),
 		wsConn: wsConn,
 	}
+	c.write = func(message *Message) error {
+		log.Tracef(">>> websocket writer: %s", string(message.Data))
+		return c.wsConn.WriteMessage(websocket.TextMessage, message.Data)
+	}
+	return c
 }
 
-// TODO: daniel 01.12.18 - decide if we actually need to reed from ws
-func (c *Connection) Reader() {
+// NewStreamConnection returns a connection which passes the messages to the write function instead of a websocket,
+// e.g. to send them as server-sent events. It has no Reader, so the client can not send any commands.
+func NewStreamConnection(write func(message *Message) error) *Connection {
+	return &Connection{
+		send:  make(chan *Message, 256),
+		write: write,
+	}
+}
+
+// Reader passes the messages of the client to the handler. Once the client went away, the connection is closed.
+func (c *Connection) Reader(handle func(message []byte)) {
 	defer c.wg.Done()
+	defer c.h.CloseConnection(c.userId, c)
 	for {
 		_, message, err := c.wsConn.ReadMessage()
 		log.Tracef("<<< websocket reader: %s", string(message))
@@ -41,18 +82,173 @@ func (c *Connection) Reader() {
 			break
 		}
 
-		c.h.inbound <- message
-
+		handle(message)
 	}
 }
 
 func (c *Connection) Writer() {
 	defer c.wg.Done()
 	for message := range c.send {
-		err := c.wsConn.WriteMessage(websocket.TextMessage, message)
-		log.Tracef(">>> websocket writer: %s", string(message))
-		if err != nil {
+		if message.Seq != 0 && message.Seq <= c.replayed {
+			continue
+		}
+		if err := c.write(message); err != nil {
 			break
 		}
 	}
 }
+
+// Replay writes the messages the client missed while it was disconnected, as far as it subscribed to them. It has to
+// be called before the Writer is started, which then skips the queued messages that were already replayed.
+func (c *Connection) Replay(messages []*Message) error {
+	for _, message := range messages {
+		if message.Seq > c.replayed {
+			c.replayed = message.Seq
+		}
+		if !c.accepts(message, false) {
+			continue
+		}
+		if err := c.write(message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Send queues the data for this connection only, e.g. the reply to a message of the client. It reports false if the
+// connection has been closed or can not keep up.
+func (c *Connection) Send(data []byte) bool {
+	c.h.connectionsMx.RLock()
+	defer c.h.connectionsMx.RUnlock()
+
+	if _, ok := c.h.clients[c.userId][c]; !ok {
+		return false
+	}
+	select {
+	case c.send <- &Message{Data: data}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Heartbeat queues a message without data, which stream connections write to keep idle connections open through
+// proxies. Like Send, it reports false if the connection has been closed or can not keep up.
+func (c *Connection) Heartbeat() bool {
+	return c.Send(nil)
+}
+
+// close closes the websocket, if any, and stops the Writer. The caller has to hold the hub's lock.
+func (c *Connection) close() {
+	if c.wsConn != nil {
+		c.wsConn.Close()
+	}
+	close(c.send)
+}
+
+// Restrict limits the connection to the events of the given wallets and to broadcasts, e.g. for an access token which
+// is restricted to those wallets. Unlike a subscription, the client can not change it.
+func (c *Connection) Restrict(walletIds []string) {
+	c.filterMx.Lock()
+	defer c.filterMx.Unlock()
+	c.restriction = toSet(walletIds)
+}
+
+// Subscribe adds the wallets and event types to the subscription. A new connection receives all events until it
+// subscribes to specific wallets or types, subscribing to the Wildcard receives all of them again.
+func (c *Connection) Subscribe(walletIds []string, types []string) {
+	c.filterMx.Lock()
+	defer c.filterMx.Unlock()
+	c.wallets = subscribe(c.wallets, walletIds)
+	c.types = subscribe(c.types, types)
+}
+
+// Unsubscribe removes the wallets and event types from the subscription, which has no effect while subscribed to all
+// of them. Unsubscribing from the Wildcard stops all events.
+func (c *Connection) Unsubscribe(walletIds []string, types []string) {
+	c.filterMx.Lock()
+	defer c.filterMx.Unlock()
+	c.wallets = unsubscribe(c.wallets, walletIds)
+	c.types = unsubscribe(c.types, types)
+}
+
+// Subscription returns the subscribed wallets and event types, the Wildcard stands for all of them.
+func (c *Connection) Subscription() ([]string, []string) {
+	c.filterMx.RLock()
+	defer c.filterMx.RUnlock()
+	return fromSet(c.wallets), fromSet(c.types)
+}
+
+// accepts reports whether the connection subscribed to the message. The wallet subscription only applies to
+// messages of a wallet, while a restricted connection does not receive any other messages sent to its user.
+func (c *Connection) accepts(message *Message, broadcast bool) bool {
+	c.filterMx.RLock()
+	defer c.filterMx.RUnlock()
+
+	if !contains(c.types, message.Type) {
+		return false
+	}
+	if message.WalletId == "" {
+		return c.restriction == nil || broadcast
+	}
+	return contains(c.wallets, message.WalletId) && contains(c.restriction, message.WalletId)
+}
+
+func subscribe(set map[string]struct{}, ids []string) map[string]struct{} {
+	if len(ids) == 0 {
+		return set
+	}
+	for _, id := range ids {
+		if id == Wildcard {
+			return nil
+		}
+	}
+	if set == nil {
+		set = make(map[string]struct{})
+	}
+	for _, id := range ids {
+		set[id] = struct{}{}
+	}
+	return set
+}
+
+func unsubscribe(set map[string]struct{}, ids []string) map[string]struct{} {
+	for _, id := range ids {
+		if id == Wildcard {
+			return make(map[string]struct{})
+		}
+	}
+	for _, id := range ids {
+		delete(set, id)
+	}
+	return set
+}
+
+// contains reports whether the id is in the set, a nil set contains everything.
+func contains(set map[string]struct{}, id string) bool {
+	if set == nil {
+		return true
+	}
+	_, ok := set[id]
+	return ok
+}
+
+func toSet(ids []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		set[id] = struct{}{}
+	}
+	return set
+}
+
+func fromSet(set map[string]struct{}) []string {
+	if set == nil {
+		return []string{Wildcard}
+	}
+	ids := make([]string, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
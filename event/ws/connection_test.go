@@ -0,0 +1,91 @@
+package ws
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSubscriptionFiltersMessages(t *testing.T) {
+	conn := NewConnection(nil)
+	walletA := &Message{Type: "wallet.updated", WalletId: "a"}
+	walletB := &Message{Type: "wallet.updated", WalletId: "b"}
+	health := &Message{Type: "wallet.degraded", WalletId: "a"}
+	job := &Message{Type: "job.updated"}
+
+	if !conn.accepts(walletA, false) || !conn.accepts(job, false) {
+		t.Error("expected a new connection to receive all messages")
+	}
+
+	conn.Subscribe([]string{"a"}, nil)
+	if !conn.accepts(walletA, false) || conn.accepts(walletB, false) || !conn.accepts(job, false) {
+		t.Error("expected the wallet subscription to only apply to messages of a wallet")
+	}
+
+	conn.Subscribe(nil, []string{"wallet.updated"})
+	if !conn.accepts(walletA, false) || conn.accepts(health, false) || conn.accepts(job, false) {
+		t.Error("expected only the subscribed types to be received")
+	}
+	if wallets, types := conn.Subscription(); !reflect.DeepEqual(wallets, []string{"a"}) || !reflect.DeepEqual(types, []string{"wallet.updated"}) {
+		t.Errorf("expected subscription to wallet a and wallet.updated, got %v %v", wallets, types)
+	}
+
+	conn.Unsubscribe([]string{"a"}, nil)
+	if conn.accepts(walletA, false) {
+		t.Error("expected no wallet messages after unsubscribing")
+	}
+
+	conn.Subscribe([]string{Wildcard}, []string{Wildcard})
+	if !conn.accepts(walletB, false) || !conn.accepts(job, false) {
+		t.Error("expected the wildcard to subscribe to all messages again")
+	}
+	conn.Unsubscribe(nil, []string{Wildcard})
+	if conn.accepts(walletB, false) || conn.accepts(job, false) {
+		t.Error("expected unsubscribing from the wildcard to stop all messages")
+	}
+}
+
+func TestRestrictedConnection(t *testing.T) {
+	conn := NewConnection(nil)
+	conn.Restrict([]string{"a"})
+	conn.Subscribe([]string{"b"}, nil)
+
+	if conn.accepts(&Message{Type: "wallet.updated", WalletId: "b"}, false) {
+		t.Error("expected the subscription not to lift the restriction")
+	}
+	if conn.accepts(&Message{Type: "job.updated"}, false) {
+		t.Error("expected a restricted connection not to receive messages without wallet")
+	}
+	if !conn.accepts(&Message{Type: "network.updated"}, true) {
+		t.Error("expected a restricted connection to receive broadcasts")
+	}
+
+	conn.Subscribe([]string{Wildcard}, nil)
+	if !conn.accepts(&Message{Type: "wallet.updated", WalletId: "a"}, false) {
+		t.Error("expected the messages of the permitted wallet")
+	}
+}
+
+func TestHubOnlyDeliversSubscribedMessages(t *testing.T) {
+	hub := NewHub()
+	subscribed, other := NewConnection(nil), NewConnection(nil)
+	other.Subscribe([]string{"b"}, nil)
+	hub.AddConnection("user", subscribed)
+	hub.AddConnection("user", other)
+
+	hub.SendToUser("user", &Message{Type: "wallet.updated", WalletId: "a", Data: []byte("a")})
+
+	select {
+	case message := <-subscribed.send:
+		if string(message.Data) != "a" {
+			t.Errorf("expected message a, got %s", message.Data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the message to be delivered")
+	}
+	select {
+	case message := <-other.send:
+		t.Errorf("expected no message for the other wallet, got %s", message.Data)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -3,7 +3,6 @@ package ws
 import (
 	log "github.com/sirupsen/logrus"
 	"sync"
-	"time"
 )
 
 type Hub struct {
@@ -12,42 +11,13 @@ type Hub struct {
 
 	// Registered clients.
 	clients map[string]map[*Connection]struct{}
-
-	// Inbound messages from the clients.
-	inbound chan []byte
 }
 
 func NewHub() *Hub {
-	h := &Hub{
+	return &Hub{
 		connectionsMx: sync.RWMutex{},
-		inbound:       make(chan []byte),
 		clients:       make(map[string]map[*Connection]struct{}),
 	}
-
-	// TODO: daniel 01.12.18 - decide if we actually need to reed from ws
-	// TODO: daniel 01.12.18 - remove that broadcast to all client->connections stuff
-	go func() {
-		for {
-			msg := <-h.inbound
-			h.connectionsMx.RLock()
-			for userId, connections := range h.clients {
-
-				for c := range connections {
-					select {
-					case c.send <- msg:
-						// stop trying to send to this connection after trying for 1 second.
-						// if we have to stop, it means that a reader died so remove the connection also.
-					case <-time.After(1 * time.Second):
-						log.Printf("shutting down connection %v", c)
-						h.CloseConnection(userId, c)
-					}
-				}
-
-			}
-			h.connectionsMx.RUnlock()
-		}
-	}()
-	return h
 }
 
 func (h *Hub) AddConnection(userId string, conn *Connection) *sync.WaitGroup {
@@ -78,34 +48,67 @@ func (h *Hub) CloseConnection(userId string, conn *Connection) {
 	if connections, ok := h.clients[userId]; ok {
 
 		if _, ok := connections[conn]; ok {
-			defer conn.wsConn.Close()
 			delete(connections, conn)
-			close(conn.send)
+			conn.close()
 		}
 
 	}
 }
 
-func (h *Hub) SendToUser(userId string, message []byte) {
-	go func() {
-		h.connectionsMx.RLock()
-		defer h.connectionsMx.RUnlock()
+// CloseUserConnections closes all connections of the given user, e.g. after the user logged out everywhere.
+func (h *Hub) CloseUserConnections(userId string) {
+	h.connectionsMx.Lock()
+	defer h.connectionsMx.Unlock()
 
-		if connections, ok := h.clients[userId]; ok {
+	for conn := range h.clients[userId] {
+		conn.close()
+	}
+	delete(h.clients, userId)
+}
 
-			for c := range connections {
-				select {
-				case c.send <- message:
-					// stop trying to send to this connection after trying for 1 second.
-					// if we have to stop, it means that a reader died so remove the connection also.
-				case <-time.After(1 * time.Second):
-					log.Printf("shutting down connection %v", c)
-					h.CloseConnection(userId, c)
-				}
-			}
+// Broadcast sends the message to all connections of all users which subscribed to it. Connections which can not keep
+// up with the messages are closed.
+func (h *Hub) Broadcast(message *Message) {
+	h.connectionsMx.RLock()
+	var stales []*Connection
+	for _, connections := range h.clients {
+		stales = append(stales, h.deliver(connections, message, true)...)
+	}
+	h.connectionsMx.RUnlock()
 
-		}
+	h.closeStales(stales)
+}
+
+// SendToUser sends the message to all connections of the user which subscribed to it. The message is queued before
+// returning, so the connections receive the messages in the order they were sent.
+func (h *Hub) SendToUser(userId string, message *Message) {
+	h.connectionsMx.RLock()
+	stales := h.deliver(h.clients[userId], message, false)
+	h.connectionsMx.RUnlock()
 
-	}()
+	h.closeStales(stales)
+}
 
+// deliver queues the message for the connections and returns the ones whose queue is full, as their writer died or
+// can not keep up. Their clients catch up through the replay once they reconnect. The caller has to hold the read lock.
+func (h *Hub) deliver(connections map[*Connection]struct{}, message *Message, broadcast bool) []*Connection {
+	var stales []*Connection
+	for c := range connections {
+		if !c.accepts(message, broadcast) {
+			continue
+		}
+		select {
+		case c.send <- message:
+		default:
+			stales = append(stales, c)
+		}
+	}
+	return stales
+}
+
+func (h *Hub) closeStales(stales []*Connection) {
+	for _, c := range stales {
+		log.Printf("shutting down connection %v", c)
+		h.CloseConnection(c.userId, c)
+	}
 }
@@ -0,0 +1,137 @@
+package iridium
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ybbus/jsonrpc"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const daemonStatusOK = "OK"
+
+// DaemonRPC is a client for the RPC interface of an iridiumd node.
+type DaemonRPC interface {
+	GetInfo() (GetInfoResponse, error)
+	GetHeight() (GetHeightResponse, error)
+	GetLastBlockHeader() (BlockHeader, error)
+	GetBlockHeaderByHeight(height uint64) (BlockHeader, error)
+	GetBlock(hash string) (BlockDetails, error)
+}
+
+type daemonClient struct {
+	address *url.URL
+	http    *http.Client
+	rpc     jsonrpc.RPCClient
+}
+
+// Daemon creates a client for the daemon at the given address, e.g. http://127.0.0.1:13101. Unlike the walletd client
+// it does not wait for the daemon to become reachable, as daemons are expected to be up already.
+func Daemon(address string, timeout time.Duration) (DaemonRPC, error) {
+
+	parsedAddress, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient := &http.Client{Timeout: timeout}
+	rpcAddress := parsedAddress.ResolveReference(&url.URL{Path: "/json_rpc"})
+
+	return &daemonClient{
+		address: parsedAddress,
+		http:    httpClient,
+		rpc:     jsonrpc.NewClientWithOpts(rpcAddress.String(), &jsonrpc.RPCClientOpts{HTTPClient: httpClient}),
+	}, nil
+}
+
+func (c *daemonClient) GetInfo() (GetInfoResponse, error) {
+	result := GetInfoResponse{}
+	if err := c.getJSON("/getinfo", &result); err != nil {
+		return result, err
+	}
+	return result, checkDaemonStatus(result.Status)
+}
+
+func (c *daemonClient) GetHeight() (GetHeightResponse, error) {
+	result := GetHeightResponse{}
+	if err := c.getJSON("/getheight", &result); err != nil {
+		return result, err
+	}
+	return result, checkDaemonStatus(result.Status)
+}
+
+func (c *daemonClient) GetLastBlockHeader() (BlockHeader, error) {
+	result := GetBlockHeaderResponse{}
+	if err := c.callJSON("getlastblockheader", nil, &result); err != nil {
+		return result.BlockHeader, err
+	}
+	return result.BlockHeader, checkDaemonStatus(result.Status)
+}
+
+func (c *daemonClient) GetBlockHeaderByHeight(height uint64) (BlockHeader, error) {
+	params := struct {
+		Height uint64 `json:"height"`
+	}{Height: height}
+
+	result := GetBlockHeaderResponse{}
+	if err := c.callJSON("getblockheaderbyheight", params, &result); err != nil {
+		return result.BlockHeader, err
+	}
+	return result.BlockHeader, checkDaemonStatus(result.Status)
+}
+
+func (c *daemonClient) GetBlock(hash string) (BlockDetails, error) {
+	params := struct {
+		Hash string `json:"hash"`
+	}{Hash: hash}
+
+	result := GetBlockResponse{}
+	if err := c.callJSON("f_block_json", params, &result); err != nil {
+		return result.Block, err
+	}
+	return result.Block, checkDaemonStatus(result.Status)
+}
+
+func (c *daemonClient) callJSON(method string, params interface{}, result interface{}) error {
+	var response *jsonrpc.RPCResponse
+	var err error
+
+	if params != nil {
+		response, err = c.rpc.Call(method, params)
+	} else {
+		response, err = c.rpc.Call(method)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := handleRPCError(response); err != nil {
+		return err
+	}
+
+	return response.GetObject(result)
+}
+
+func (c *daemonClient) getJSON(path string, result interface{}) error {
+	endpoint := c.address.ResolveReference(&url.URL{Path: path})
+
+	response, err := c.http.Get(endpoint.String())
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("daemon responded with %s", response.Status)
+	}
+
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+func checkDaemonStatus(status string) error {
+	if status != daemonStatusOK {
+		return fmt.Errorf("daemon status: %s", status)
+	}
+	return nil
+}
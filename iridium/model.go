@@ -19,3 +19,83 @@ type GetBalanceResponse struct {
 	AvailableBalance uint64 `json:"availableBalance"`
 	LockedAmount     uint64 `json:"lockedAmount"`
 }
+
+type Transfer struct {
+	Address string `json:"address"`
+	Amount  uint64 `json:"amount"`
+}
+
+type SendTransactionRequest struct {
+	Transfers  []Transfer `json:"transfers"`
+	Fee        uint64     `json:"fee"`
+	Anonymity  uint32     `json:"anonymity"`
+	PaymentId  string     `json:"paymentId,omitempty"`
+	UnlockTime uint64     `json:"unlockTime,omitempty"`
+}
+
+type SendTransactionResponse struct {
+	TransactionHash string `json:"transactionHash"`
+}
+
+type GetInfoResponse struct {
+	Status                   string `json:"status"`
+	Height                   uint64 `json:"height"`
+	Difficulty               uint64 `json:"difficulty"`
+	TxCount                  uint64 `json:"tx_count"`
+	TxPoolSize               uint64 `json:"tx_pool_size"`
+	AltBlocksCount           uint64 `json:"alt_blocks_count"`
+	OutgoingConnectionsCount uint64 `json:"outgoing_connections_count"`
+	IncomingConnectionsCount uint64 `json:"incoming_connections_count"`
+	WhitePeerlistSize        uint64 `json:"white_peerlist_size"`
+	GreyPeerlistSize         uint64 `json:"grey_peerlist_size"`
+	LastKnownBlockIndex      uint64 `json:"last_known_block_index"`
+}
+
+type GetHeightResponse struct {
+	Status string `json:"status"`
+	Height uint64 `json:"height"`
+}
+
+type BlockHeader struct {
+	MajorVersion uint8  `json:"major_version"`
+	MinorVersion uint8  `json:"minor_version"`
+	Timestamp    uint64 `json:"timestamp"`
+	PrevHash     string `json:"prev_hash"`
+	Nonce        uint32 `json:"nonce"`
+	OrphanStatus bool   `json:"orphan_status"`
+	Height       uint64 `json:"height"`
+	Depth        uint64 `json:"depth"`
+	Hash         string `json:"hash"`
+	Difficulty   uint64 `json:"difficulty"`
+	Reward       uint64 `json:"reward"`
+}
+
+type GetBlockHeaderResponse struct {
+	BlockHeader BlockHeader `json:"block_header"`
+	Status      string      `json:"status"`
+}
+
+type BlockTransaction struct {
+	Hash      string `json:"hash"`
+	Fee       uint64 `json:"fee"`
+	AmountOut uint64 `json:"amount_out"`
+	Size      uint64 `json:"size"`
+}
+
+type BlockDetails struct {
+	Height                     uint64             `json:"height"`
+	Hash                       string             `json:"hash"`
+	Timestamp                  uint64             `json:"timestamp"`
+	Difficulty                 uint64             `json:"difficulty"`
+	Reward                     uint64             `json:"reward"`
+	BaseReward                 uint64             `json:"baseReward"`
+	BlockSize                  uint64             `json:"blockSize"`
+	TransactionsCumulativeSize uint64             `json:"transactionsCumulativeSize"`
+	TotalFeeAmount             uint64             `json:"totalFeeAmount"`
+	Transactions               []BlockTransaction `json:"transactions"`
+}
+
+type GetBlockResponse struct {
+	Block  BlockDetails `json:"block"`
+	Status string       `json:"status"`
+}
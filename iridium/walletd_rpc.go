@@ -16,6 +16,7 @@ type WalletdRPC interface {
 	GetAddresses() ([]string, error)
 	GetStatus() (GetStatusResponse, error)
 	GetBalance() (GetBalanceResponse, error)
+	SendTransaction(request SendTransactionRequest) (string, error)
 }
 
 type client struct {
@@ -125,6 +126,22 @@ func (c *client) GetBalance() (GetBalanceResponse, error) {
 	return result, err
 }
 
+func (c *client) SendTransaction(request SendTransactionRequest) (string, error) {
+	response, err := c.rpc.Call("sendTransaction", request)
+	if err != nil {
+		return "", err
+	}
+
+	if err := handleRPCError(response); err != nil {
+		return "", err
+	}
+
+	result := SendTransactionResponse{}
+	err = response.GetObject(&result)
+
+	return result.TransactionHash, err
+}
+
 func (c *client) callAndUnwrap(method string, result interface{}) error {
 	// TODO: daniel 12.01.19 - handle wallet container not responding, move to new thread with timeout - https://github.com/orgs/iridiumdev/projects/7#card-15104260
 	var response *jsonrpc.RPCResponse
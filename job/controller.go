@@ -0,0 +1,46 @@
+package job
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/iridiumdev/webwallet-core/auth"
+	"github.com/iridiumdev/webwallet-core/util"
+	"net/http"
+)
+
+type Controller struct {
+	apiRouter *gin.RouterGroup
+}
+
+func NewController(apiRouter *gin.RouterGroup) Controller {
+	return Controller{apiRouter: apiRouter}
+}
+
+// Routes registers this controllers sub-routing in the main apiRouter. It returns a RouterGroup containing only the
+// routes for the operations on the Job model. The apiRouter accepts personal access tokens, so every route has to
+// require a scope.
+func (controller *Controller) Routes() {
+	api := controller.apiRouter.Group("/jobs")
+	{
+		api.GET("/:id", auth.RequireScope(auth.ScopeWalletsRead), controller.getHandler())
+	}
+}
+
+func (controller *Controller) getHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userId := auth.ExtractUserId(c)
+		jobId := c.Param("id")
+
+		job, err := service.GetJob(jobId, userId)
+		// a restricted access token does not get to see the jobs of other wallets
+		if err == nil && job.WalletId != "" && !auth.PermitsWallet(c, job.WalletId.Hex()) {
+			err = ErrJobNotFound
+		}
+		if err == ErrJobNotFound {
+			util.HandleError(c, err, http.StatusNotFound)
+			return
+		}
+		if !util.HandleError(c, err, http.StatusBadRequest) {
+			c.JSON(http.StatusOK, job)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package job
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+type Type string
+
+const (
+	CREATE_WALLET Type = "CREATE_WALLET"
+	IMPORT_WALLET Type = "IMPORT_WALLET"
+	START_WALLET  Type = "START_WALLET"
+)
+
+type State string
+
+const (
+	PENDING   State = "PENDING"
+	RUNNING   State = "RUNNING"
+	SUCCEEDED State = "SUCCEEDED"
+	FAILED    State = "FAILED"
+)
+
+// JOB_UPDATED is the type of the event sent to the owner whenever a job progressed.
+const JOB_UPDATED = "job.updated"
+
+type Job struct {
+	Id       bson.ObjectId `json:"id" bson:"_id,omitempty"`
+	Type     Type          `json:"type" bson:"type"`
+	Owner    bson.ObjectId `json:"owner" bson:"owner"`
+	WalletId bson.ObjectId `json:"walletId,omitempty" bson:"walletId,omitempty"`
+	State    State         `json:"state" bson:"state"`
+	Step     string        `json:"step,omitempty" bson:"step,omitempty"`
+	Error    string        `json:"error,omitempty" bson:"error,omitempty"`
+	Created  time.Time     `json:"created" bson:"created"`
+	Updated  time.Time     `json:"updated" bson:"updated"`
+
+	// the steps completed by the task, so that they can be rolled back if the server stopped while running it
+	Completed []Step `json:"-" bson:"completed,omitempty"`
+}
+
+// Step is a step completed by the task of a job, along with the volume of the wallet after the step and the volume
+// it had before the task, as the task may move the wallet to another volume.
+type Step struct {
+	Name           string `bson:"name"`
+	Volume         string `bson:"volume,omitempty"`
+	PreviousVolume string `bson:"previousVolume,omitempty"`
+}
+
+// Task performs the actual work of a job. It may report its progress through the given job using Service.Progress
+// and sets the WalletId of the job as soon as it is known.
+type Task func(job *Job) error
+
+// Rollback reverts the completed steps of a job whose task was interrupted by a server restart.
+type Rollback func(job *Job) error
@@ -0,0 +1,226 @@
+package job
+
+import (
+	"github.com/iridiumdev/webwallet-core/config"
+	"github.com/iridiumdev/webwallet-core/event"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+	"sync"
+	"time"
+)
+
+type Service interface {
+	Submit(jobType Type, userId string, walletId string, task Task) (*Job, error)
+	Progress(job *Job, step string)
+	Complete(job *Job, step Step)
+	OnInterrupted(jobType Type, rollback Rollback)
+	GetJob(jobId string, userId string) (*Job, error)
+	Recover() error
+	Close()
+}
+
+var (
+	ErrJobNotFound    = errors.New("job not found")
+	ErrQueueFull      = errors.New("too many pending jobs")
+	ErrJobInterrupted = errors.New("job interrupted by a server restart")
+	ErrJobFailed      = errors.New("job failed unexpectedly")
+)
+
+var service Service
+
+type queuedJob struct {
+	job  *Job
+	task Task
+}
+
+type serviceImpl struct {
+	eventService event.Service
+
+	rollbacks map[Type]Rollback
+
+	queue chan *queuedJob
+	quit  chan struct{}
+	wg    sync.WaitGroup
+}
+
+func InitService(eventService event.Service) Service {
+	jobConfig := config.Get().Webwallet.Jobs
+
+	workers := jobConfig.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	s := &serviceImpl{
+		eventService: eventService,
+		rollbacks:    make(map[Type]Rollback),
+		queue:        make(chan *queuedJob, jobConfig.QueueSize),
+		quit:         make(chan struct{}),
+	}
+
+	for i := 0; i < workers; i++ {
+		s.wg.Add(1)
+		go s.work()
+	}
+
+	service = s
+	return service
+}
+
+// Submit persists a new PENDING job and queues the task for the workers. The walletId may be empty if the wallet does
+// not exist yet. The returned job is a snapshot of the job at submission time.
+func (s *serviceImpl) Submit(jobType Type, userId string, walletId string, task Task) (*Job, error) {
+	now := time.Now()
+	job := &Job{
+		Id:      bson.NewObjectId(),
+		Type:    jobType,
+		Owner:   bson.ObjectIdHex(userId),
+		State:   PENDING,
+		Created: now,
+		Updated: now,
+	}
+	if bson.IsObjectIdHex(walletId) {
+		job.WalletId = bson.ObjectIdHex(walletId)
+	}
+
+	if err := store.InsertJob(job); err != nil {
+		log.Errorf("Could not store job of type %s for user %s: %s", jobType, userId, err.Error())
+		return nil, err
+	}
+
+	snapshot := *job
+
+	select {
+	case s.queue <- &queuedJob{job: job, task: task}:
+	default:
+		s.finish(job, ErrQueueFull)
+		return nil, ErrQueueFull
+	}
+
+	return &snapshot, nil
+}
+
+func (s *serviceImpl) Progress(job *Job, step string) {
+	job.Step = step
+
+	log.Debugf("Job %s of user %s: %s", job.Id.Hex(), job.Owner.Hex(), step)
+	s.update(job)
+}
+
+// Complete records a completed step of the task on the job. Completed steps are not pushed to the owner, they are
+// only needed to roll back the task after a restart.
+func (s *serviceImpl) Complete(job *Job, step Step) {
+	job.Completed = append(job.Completed, step)
+
+	if err := store.UpdateJob(job); err != nil {
+		log.Errorf("Could not record step %s of job %s: %s", step.Name, job.Id.Hex(), err.Error())
+	}
+}
+
+// OnInterrupted registers the rollback of the completed steps of interrupted jobs of the given type. It must be
+// registered before calling Recover.
+func (s *serviceImpl) OnInterrupted(jobType Type, rollback Rollback) {
+	s.rollbacks[jobType] = rollback
+}
+
+func (s *serviceImpl) GetJob(jobId string, userId string) (*Job, error) {
+	if !bson.IsObjectIdHex(jobId) {
+		return nil, ErrJobNotFound
+	}
+
+	job, err := store.FindJobByOwner(bson.ObjectIdHex(jobId), bson.ObjectIdHex(userId))
+	if err != nil || job == nil {
+		return nil, ErrJobNotFound
+	}
+	return job, nil
+}
+
+// Recover marks all jobs which were still pending or running when the server stopped as failed, as their tasks are
+// gone with the previous process. The steps those tasks already completed are rolled back first.
+func (s *serviceImpl) Recover() error {
+	jobs, err := store.FindUnfinishedJobs()
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		rollback, ok := s.rollbacks[job.Type]
+		if !ok || len(job.Completed) == 0 {
+			continue
+		}
+		if err := rollback(job); err != nil {
+			log.Errorf("Could not roll back interrupted job %s: %s", job.Id.Hex(), err.Error())
+		}
+	}
+
+	count, err := store.FailUnfinishedJobs(ErrJobInterrupted.Error())
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		log.Warnf("Marked %d interrupted jobs as failed", count)
+	}
+	return nil
+}
+
+func (s *serviceImpl) Close() {
+	close(s.quit)
+	s.wg.Wait()
+}
+
+func (s *serviceImpl) work() {
+	defer s.wg.Done()
+	for {
+		select {
+		case <-s.quit:
+			return
+		case queued := <-s.queue:
+			s.run(queued)
+		}
+	}
+}
+
+func (s *serviceImpl) run(queued *queuedJob) {
+	job := queued.job
+
+	job.State = RUNNING
+	s.update(job)
+
+	var err error
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Errorf("Job %s panicked: %v", job.Id.Hex(), r)
+				err = ErrJobFailed
+			}
+		}()
+		err = queued.task(job)
+	}()
+
+	s.finish(job, err)
+}
+
+func (s *serviceImpl) finish(job *Job, err error) {
+	if err != nil {
+		log.Warnf("Job %s of user %s failed: %s", job.Id.Hex(), job.Owner.Hex(), err.Error())
+		job.State = FAILED
+		job.Error = err.Error()
+	} else {
+		job.State = SUCCEEDED
+		job.Step = ""
+	}
+
+	s.update(job)
+}
+
+// update persists the current state of the job and pushes it to the owners websocket connections. Jobs are only
+// modified by the worker processing them, so no further synchronization is required.
+func (s *serviceImpl) update(job *Job) {
+	job.Updated = time.Now()
+
+	if err := store.UpdateJob(job); err != nil {
+		log.Errorf("Could not update job %s: %s", job.Id.Hex(), err.Error())
+	}
+
+	s.eventService.SendToUser(job.Owner.Hex(), JOB_UPDATED, job.WalletId.Hex(), job)
+}
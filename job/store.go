@@ -0,0 +1,61 @@
+package job
+
+import (
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+type mongoDb struct {
+	db   *mgo.Database
+	jobs *mgo.Collection
+}
+
+type Store interface {
+	InsertJob(job *Job) error
+	UpdateJob(job *Job) error
+	FindJobByOwner(jobId bson.ObjectId, userId bson.ObjectId) (*Job, error)
+	FindUnfinishedJobs() ([]*Job, error)
+	FailUnfinishedJobs(reason string) (int, error)
+}
+
+var store Store
+
+func (db *mongoDb) InsertJob(job *Job) error {
+	err := db.jobs.Insert(job)
+	return err
+}
+
+func (db *mongoDb) UpdateJob(job *Job) error {
+	err := db.jobs.UpdateId(job.Id, job)
+	return err
+}
+
+func (db *mongoDb) FindJobByOwner(jobId bson.ObjectId, userId bson.ObjectId) (*Job, error) {
+	var result *Job
+	err := db.jobs.Find(bson.M{"_id": jobId, "owner": userId}).One(&result)
+	return result, err
+}
+
+func (db *mongoDb) FindUnfinishedJobs() ([]*Job, error) {
+	var result []*Job
+	err := db.jobs.Find(bson.M{"state": bson.M{"$in": []State{PENDING, RUNNING}}}).All(&result)
+	return result, err
+}
+
+func (db *mongoDb) FailUnfinishedJobs(reason string) (int, error) {
+	info, err := db.jobs.UpdateAll(
+		bson.M{"state": bson.M{"$in": []State{PENDING, RUNNING}}},
+		bson.M{"$set": bson.M{"state": FAILED, "error": reason, "updated": time.Now()}},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return info.Updated, nil
+}
+
+func InitStore(db *mgo.Database) {
+	jobsCollection := db.C("jobs")
+	jobsCollection.EnsureIndex(mgo.Index{Key: []string{"owner"}})
+	store = &mongoDb{db: db, jobs: jobsCollection}
+}
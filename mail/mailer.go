@@ -0,0 +1,82 @@
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/iridiumdev/webwallet-core/config"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/smtp"
+	"strconv"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	Send(message Message) error
+}
+
+var mailer Mailer
+
+// InitMailer returns an SMTP mailer, or a mailer only logging the messages if no SMTP host is configured.
+func InitMailer() Mailer {
+	settings := config.Get().Mail
+	if settings.Host == "" {
+		log.Warn("No smtp host configured, mails are only logged")
+		mailer = &logMailer{}
+	} else {
+		mailer = NewSmtpMailer(settings)
+	}
+	return mailer
+}
+
+type smtpMailer struct {
+	settings config.Mail
+}
+
+func NewSmtpMailer(settings config.Mail) Mailer {
+	return &smtpMailer{settings: settings}
+}
+
+// Send delivers the message as plain text. STARTTLS is used whenever the server offers it, credentials are only sent
+// over TLS (or to localhost), which is enforced by net/smtp.
+func (m *smtpMailer) Send(message Message) error {
+	var auth smtp.Auth
+	if m.settings.Username != "" {
+		auth = smtp.PlainAuth("", m.settings.Username, m.settings.Password, m.settings.Host)
+	}
+
+	address := net.JoinHostPort(m.settings.Host, strconv.Itoa(m.settings.Port))
+	if err := smtp.SendMail(address, auth, m.settings.From, []string{message.To}, m.render(message)); err != nil {
+		log.Errorf("Could not send mail '%s' to %s: %s", message.Subject, message.To, err.Error())
+		return err
+	}
+
+	log.Infof("Sent mail '%s' to %s", message.Subject, message.To)
+	return nil
+}
+
+func (m *smtpMailer) render(message Message) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", m.settings.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", message.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", message.Subject)
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(message.Body)
+	return buf.Bytes()
+}
+
+type logMailer struct{}
+
+func (m *logMailer) Send(message Message) error {
+	log.Infof("Mail to %s: %s\n%s", message.To, message.Subject, message.Body)
+	return nil
+}
@@ -0,0 +1,130 @@
+package mail
+
+import (
+	"bufio"
+	"github.com/iridiumdev/webwallet-core/config"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeSmtpServer accepts a single mail on a local port and passes the received envelope and data on.
+type fakeSmtpServer struct {
+	listener net.Listener
+	from     string
+	to       []string
+	data     chan string
+}
+
+func newFakeSmtpServer(t *testing.T) *fakeSmtpServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeSmtpServer{listener: listener, data: make(chan string, 1)}
+	go server.serve()
+	return server
+}
+
+func (s *fakeSmtpServer) serve() {
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	reply := func(line string) {
+		conn.Write([]byte(line + "\r\n"))
+	}
+
+	reply("220 localhost ESMTP")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.TrimSpace(line)
+
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(command, "MAIL FROM:"):
+			s.from = strings.Trim(strings.TrimPrefix(command, "MAIL FROM:"), "<>")
+			reply("250 OK")
+		case strings.HasPrefix(command, "RCPT TO:"):
+			s.to = append(s.to, strings.Trim(strings.TrimPrefix(command, "RCPT TO:"), "<>"))
+			reply("250 OK")
+		case command == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data []string
+			for {
+				dataLine, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dataLine == ".\r\n" {
+					break
+				}
+				data = append(data, dataLine)
+			}
+			s.data <- strings.Join(data, "")
+			reply("250 OK")
+		case command == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+func TestSmtpMailerSendsMessage(t *testing.T) {
+	server := newFakeSmtpServer(t)
+	defer server.listener.Close()
+
+	address := server.listener.Addr().(*net.TCPAddr)
+	mailer := NewSmtpMailer(config.Mail{
+		Host: address.IP.String(),
+		Port: address.Port,
+		From: "webwallet@ird.cash",
+	})
+
+	err := mailer.Send(Message{To: "jdoe@foobar.com", Subject: "Verify your email", Body: "Hi jdoe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := <-server.data
+	if server.from != "webwallet@ird.cash" || len(server.to) != 1 || server.to[0] != "jdoe@foobar.com" {
+		t.Errorf("unexpected envelope from %s to %v", server.from, server.to)
+	}
+	for _, expected := range []string{"To: jdoe@foobar.com\r\n", "Subject: Verify your email\r\n", "\r\n\r\nHi jdoe"} {
+		if !strings.Contains(data, expected) {
+			t.Errorf("expected mail to contain %q, got %q", expected, data)
+		}
+	}
+}
+
+func TestSmtpMailerReportsRejection(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("554 No SMTP service here\r\n"))
+		conn.Close()
+	}()
+
+	address := listener.Addr().(*net.TCPAddr)
+	mailer := NewSmtpMailer(config.Mail{Host: address.IP.String(), Port: address.Port, From: "webwallet@ird.cash"})
+
+	if err := mailer.Send(Message{To: "jdoe@foobar.com", Subject: "test"}); err == nil {
+		t.Error("expected rejected mail to fail")
+	}
+}
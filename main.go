@@ -2,21 +2,29 @@ package main
 
 import (
 	"context"
+	"expvar"
+	"fmt"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
 	"github.com/gin-gonic/contrib/static"
 	"github.com/gin-gonic/gin"
-	"github.com/iridiumdev/gin-jwt"
 	"github.com/iridiumdev/webwallet-core/auth"
 	"github.com/iridiumdev/webwallet-core/config"
+	"github.com/iridiumdev/webwallet-core/daemon"
 	"github.com/iridiumdev/webwallet-core/event"
+	"github.com/iridiumdev/webwallet-core/job"
+	"github.com/iridiumdev/webwallet-core/mail"
 	"github.com/iridiumdev/webwallet-core/user"
 	"github.com/iridiumdev/webwallet-core/wallet"
 	log "github.com/sirupsen/logrus"
 	"github.com/toorop/gin-logrus"
 	"gopkg.in/mgo.v2"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 	"net/http"
 	"strings"
+	"time"
 )
 
 func main() {
@@ -25,21 +33,85 @@ func main() {
 	log.SetLevel(log.TraceLevel)
 
 	mongoSession := initMongoClient()
-	dockerClient := initDockerClient()
+
+	daemonService := daemon.InitService()
+	daemonService.Run()
+
+	runtime, dockerClient := initRuntime(daemonService)
+
+	keyring := auth.InitKeyring()
 
 	initStores(mongoSession)
-	userService, _, eventService := initServices(dockerClient)
+	userService, walletService, eventService, jobService := initServices(runtime, keyring)
 
-	statusWatcher := wallet.InitWatcher(dockerClient, eventService)
+	if err := jobService.Recover(); err != nil {
+		log.Errorf("Could not recover interrupted jobs: %s", err.Error())
+	}
+
+	statusWatcher := wallet.InitWatcher(eventService, daemonService)
+	satellitePool := wallet.InitPool(dockerClient, daemonService)
 
-	engine, _, _ := initMainEngine(userService)
+	engine, _, authMiddleware := initMainEngine(userService, keyring)
+	registerHooks(userService, walletService, eventService, authMiddleware)
 
+	for _, admin := range config.Get().Auth.Admins {
+		if err := userService.GrantRole(admin, user.RoleAdmin); err != nil {
+			log.Warnf("Could not grant admin role to user with username='%s': %s", admin, err.Error())
+		}
+	}
+
+	satellitePool.Run()
 	statusWatcher.Run() // TODO: daniel 29.11.18 - do something with the returned chan - e.g. use in a websocket event dispatcher
 	engine.Run(config.Get().Server.Address)
 
 	defer mongoSession.Close()
-	defer dockerClient.Close()
+	if dockerClient != nil {
+		defer dockerClient.Close()
+	}
 	defer statusWatcher.Close()
+	defer satellitePool.Close()
+	defer jobService.Close()
+	defer daemonService.Close()
+}
+
+// initRuntime sets up the configured satellite runtime. The docker client is only returned for the docker runtime, as
+// the satellite pool depends on it.
+func initRuntime(daemonService daemon.Service) (wallet.Runtime, *client.Client) {
+	switch config.Get().Webwallet.Runtime {
+	case "", "docker":
+		dockerClient := initDockerClient()
+		return wallet.NewDockerRuntime(dockerClient, daemonService), dockerClient
+	case "kubernetes":
+		clientset := initKubernetesClient()
+		return wallet.NewKubernetesRuntime(clientset, daemonService, config.Get().Webwallet.Satellite, config.Get().Webwallet.Kubernetes), nil
+	default:
+		panic(fmt.Errorf("unknown satellite runtime '%s'", config.Get().Webwallet.Runtime))
+	}
+}
+
+func initKubernetesClient() kubernetes.Interface {
+
+	log.Info("Initializing kubernetes client")
+
+	var restConfig *rest.Config
+	var err error
+	if kubeconfig := config.Get().Webwallet.Kubernetes.Kubeconfig; kubeconfig != "" {
+		restConfig, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	} else {
+		restConfig, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		panic(err)
+	}
+
+	log.Infof("Initialized kubernetes client for %s", restConfig.Host)
+
+	return clientset
 }
 
 func initDockerClient() *client.Client {
@@ -87,26 +159,51 @@ func initMongoClient() *mgo.Session {
 	return session
 }
 
-func initServices(dockerClient *client.Client) (user.Service, wallet.Service, event.Service) {
+func initServices(runtime wallet.Runtime, keyring *auth.Keyring) (user.Service, wallet.Service, event.Service, job.Service) {
 
-	userService := user.InitService()
+	mailer := mail.InitMailer()
 
-	walletService := wallet.InitService(dockerClient)
+	userService := user.InitService(mailer, keyring)
 
 	eventService := event.InitService()
 
-	return userService, walletService, eventService
+	jobService := job.InitService(eventService)
+
+	walletService := wallet.InitService(runtime, userService, jobService)
 
+	return userService, walletService, eventService, jobService
+
+}
+
+// registerHooks wires up the services which have to react on the changes of users, e.g. by closing their sessions.
+func registerHooks(userService user.Service, walletService wallet.Service, eventService event.Service, authMiddleware *auth.Middleware) {
+	authMiddleware.OnLogoutAll(eventService.WSHub().CloseUserConnections)
+	userService.OnPasswordChanged(func(userId string) {
+		authMiddleware.LogoutAll(userId)
+	})
+	userService.OnDelete(walletService.DeleteWallets)
+	userService.OnDelete(authMiddleware.LogoutAll)
+	userService.OnDelete(authMiddleware.RevokeAccessTokens)
+	userService.OnDelete(authMiddleware.DeletePasskeys)
+	userService.RegisterStepUpFactor(authMiddleware.HasPasskeys)
+	userService.OnDisabled(func(userId string) {
+		authMiddleware.LogoutAll(userId)
+	})
 }
 
 func initStores(session *mgo.Session) {
 
 	wallet.InitStore(session.Clone().DB(config.Get().Mongo.Database))
 	user.InitStore(session.Clone().DB(config.Get().Mongo.Database))
+	job.InitStore(session.Clone().DB(config.Get().Mongo.Database))
+	auth.InitStore(session.Clone().DB(config.Get().Mongo.Database))
+
+	eventConfig := config.Get().Webwallet.Events
+	event.InitStore(session.Clone().DB(config.Get().Mongo.Database), eventConfig.LogSize, eventConfig.RetentionMinutes*time.Minute)
 
 }
 
-func initMainEngine(userService user.Service) (*gin.Engine, *gin.RouterGroup, *jwt.GinJWTMiddleware) {
+func initMainEngine(userService user.Service, keyring *auth.Keyring) (*gin.Engine, *gin.RouterGroup, *auth.Middleware) {
 
 	engine := gin.Default()
 	engine.Use(ginlogrus.Logger(log.StandardLogger()), gin.Recovery())
@@ -124,27 +221,69 @@ func initMainEngine(userService user.Service) (*gin.Engine, *gin.RouterGroup, *j
 		}
 	})
 
-	authMiddleware := auth.InitMiddleware(userService)
+	authMiddleware := auth.InitMiddleware(keyring, userService)
 
 	authApi := engine.Group("/auth")
 	authApi.POST("/login", authMiddleware.LoginHandler)
+	authApi.POST("/login/mfa", authMiddleware.LoginMfaHandler)
 	authApi.POST("/refresh", authMiddleware.RefreshHandler)
+	authApi.POST("/logout", authMiddleware.MiddlewareFunc(), authMiddleware.LogoutHandler)
+	authApi.POST("/logout-all", authMiddleware.MiddlewareFunc(), authMiddleware.LogoutAllHandler)
+
+	if oidc := config.Get().Auth.Oidc; oidc.Issuer != "" {
+		authMiddleware.EnableOidc(auth.NewOidcProvider(oidc), config.Get().Server.PublicUrl+"/login/oidc")
+	}
+	authApi.GET("/oidc/login", authMiddleware.OidcLoginHandler)
+	authApi.GET("/oidc/callback", authMiddleware.OidcCallbackHandler)
+	authApi.POST("/passkey/options", authMiddleware.BeginPasskeyLoginHandler)
+	authApi.POST("/passkey/login", authMiddleware.FinishPasskeyLoginHandler)
+	authApi.POST("/passkey/step-up/options", authMiddleware.MiddlewareFunc(), authMiddleware.BeginStepUpHandler)
+	authApi.POST("/passkey/step-up", authMiddleware.MiddlewareFunc(), authMiddleware.FinishStepUpHandler)
+
+	// personal access tokens are only accepted by the routes registered on the tokenApi, which all require a scope
+	api := engine.Group("/api/v1", authMiddleware.MiddlewareFunc())
+	tokenApi := engine.Group("/api/v1", authMiddleware.TokenMiddlewareFunc())
+
+	api.POST("/tokens", authMiddleware.CreateAccessTokenHandler)
+	api.GET("/tokens", authMiddleware.ListAccessTokensHandler)
+	api.DELETE("/tokens/:id", authMiddleware.RevokeAccessTokenHandler)
+
+	api.POST("/passkeys/options", authMiddleware.BeginPasskeyRegistrationHandler)
+	api.POST("/passkeys", authMiddleware.FinishPasskeyRegistrationHandler)
+	api.GET("/passkeys", authMiddleware.ListPasskeysHandler)
+	api.DELETE("/passkeys/:id", authMiddleware.DeletePasskeyHandler)
 
-	api := engine.Group("/api/v1")
-	api.Use(authMiddleware.MiddlewareFunc())
+	adminApi := api.Group("/admin", authMiddleware.RequireRole(user.RoleAdmin))
+	// the metrics reveal the load of the instance, so only operators may read them
+	adminApi.GET("/debug/vars", gin.WrapH(expvar.Handler()))
 
-	initDependencyTree(api, authApi)
+	initDependencyTree(api, tokenApi, adminApi, authApi)
 
 	return engine, api, authMiddleware
 }
 
-func initDependencyTree(api *gin.RouterGroup, authApi *gin.RouterGroup) {
+func initDependencyTree(api *gin.RouterGroup, tokenApi *gin.RouterGroup, adminApi *gin.RouterGroup, authApi *gin.RouterGroup) {
 	userController := user.NewController(api, authApi)
 	userController.Routes()
 
-	walletController := wallet.NewController(api)
+	walletController := wallet.NewController(tokenApi)
 	walletController.Routes()
 
-	eventController := event.NewController(api)
+	eventController := event.NewController(tokenApi)
 	eventController.Routes()
+
+	jobController := job.NewController(tokenApi)
+	jobController.Routes()
+
+	daemonController := daemon.NewController(api)
+	daemonController.Routes()
+
+	userAdminController := user.NewAdminController(adminApi)
+	userAdminController.Routes()
+
+	walletAdminController := wallet.NewAdminController(adminApi)
+	walletAdminController.Routes()
+
+	daemonAdminController := daemon.NewAdminController(adminApi)
+	daemonAdminController.Routes()
 }
@@ -9,7 +9,9 @@ import (
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
+	"github.com/iridiumdev/webwallet-core/auth"
 	"github.com/iridiumdev/webwallet-core/config"
+	"github.com/iridiumdev/webwallet-core/daemon"
 	"github.com/iridiumdev/webwallet-core/test"
 	"github.com/iridiumdev/webwallet-core/user"
 	"github.com/iridiumdev/webwallet-core/wallet"
@@ -52,25 +54,34 @@ func FeatureContext(s *godog.Suite) {
 	resty.SetHeader("Content-Type", "application/json")
 
 	config.Get().Mongo.Database = "iridium-test"
+	if config.Get().Auth.Secret == "" {
+		config.Get().Auth.Secret = "integration-test-secret"
+	}
 	config.Get().Webwallet.Satellite.Labels["net"] = "testnet"
 	labels := config.Get().Webwallet.Satellite.Labels
 
 	mongoSession := initMongoClient()
 	dockerClient := initDockerClient()
+	daemonService := daemon.InitService()
+
+	keyring := auth.InitKeyring()
 
-	userService, _, eventService := initServices(dockerClient)
+	userService, walletService, eventService, jobService := initServices(wallet.NewDockerRuntime(dockerClient, daemonService), keyring)
 
-	statusWatcher := wallet.InitWatcher(dockerClient, eventService)
+	statusWatcher := wallet.InitWatcher(eventService, daemonService)
 
-	engine, _, authMiddleware := initMainEngine(userService)
+	engine, _, authMiddleware := initMainEngine(userService, keyring)
 
 	ts := httptest.NewServer(engine)
 	apiFeature.BaseUrl = ts.URL
 	apiFeature.AuthMiddleware = authMiddleware
+	registerHooks(userService, walletService, eventService, authMiddleware)
+	apiFeature.UserService = userService
 
 	s.BeforeSuite(func() {
 		pruneTestWallets(dockerClient, labels)
 
+		daemonService.Run()
 		statusWatcher.Run()
 	})
 
@@ -80,7 +91,7 @@ func FeatureContext(s *godog.Suite) {
 
 		initStores(mongoSession)
 
-		testuser, _ := userService.CreateUser(user.User{Username: "testuser", Email: "test@ird.cash", Password: "secr3tPw"})
+		testuser, _ := userService.CreateUser(user.RegistrationDTO{Username: "testuser", Email: "test@ird.cash", Password: "secr3tPw"})
 
 		apiFeature.TestUsers = map[string]*user.User{
 			"testuser": testuser,
@@ -99,14 +110,19 @@ func FeatureContext(s *godog.Suite) {
 		dockerClient.Close()
 		mongoSession.Close()
 		statusWatcher.Close()
+		jobService.Close()
+		daemonService.Close()
 	})
 
 	s.Step(`^I am logged in as "([^"]*)"$`, apiFeature.IAmLoggedInAs)
+	s.Step(`^the user "([^"]*)" has a quota of (\d+) wallets?$`, apiFeature.TheUserHasAWalletQuotaOf)
 	s.Step(`^I create a test wallet with name "([^"]*)" and password "([^"]*)"$`, apiFeature.ICreateATestWalletWithNameAndPassword)
 
+	s.Step(`^I wait for the job to succeed for wallet "([^"]*)"$`, apiFeature.IWaitForTheJobToSucceedForWallet)
+
 	s.Step(`^I send a (GET|DELETE) request to "([^"]*)"$`, apiFeature.IDoARequest)
 	s.Step(`^I reset the last response$`, apiFeature.ResetResponse)
-	s.Step(`^I send a (POST|PUT) request to "([^"]*)" with body:$`, apiFeature.IDoARequestWithBody)
+	s.Step(`^I send a (POST|PUT|PATCH) request to "([^"]*)" with body:$`, apiFeature.IDoARequestWithBody)
 	s.Step(`^the response should be (\d+) and match this json:$`, apiFeature.TheResponseShouldBeAndMatchThisJson)
 	s.Step(`^the response should be (\d+)$`, apiFeature.TheResponseShouldBe)
 
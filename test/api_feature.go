@@ -4,22 +4,28 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/DATA-DOG/godog/gherkin"
-	"github.com/iridiumdev/gin-jwt"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/iridiumdev/webwallet-core/auth"
+	"github.com/iridiumdev/webwallet-core/job"
 	"github.com/iridiumdev/webwallet-core/user"
 	"github.com/iridiumdev/webwallet-core/wallet"
 	"github.com/onsi/gomega"
+	"github.com/tidwall/gjson"
+	"gopkg.in/mgo.v2/bson"
 	"gopkg.in/resty.v1"
 	"net/http"
 	"strings"
+	"time"
 )
 
 type ApiFeature struct {
 	resp           *resty.Response
 	jsonSpec       *JSONSpec
 	BaseUrl        string
-	AuthMiddleware *jwt.GinJWTMiddleware
+	AuthMiddleware *auth.Middleware
 	TestUsers      map[string]*user.User
 	TestWallets    map[string]*wallet.Wallet
+	UserService    user.Service
 	authContext    *user.User
 	accessToken    string
 }
@@ -33,9 +39,14 @@ func (a *ApiFeature) ResetResponse() (err error) {
 func (a *ApiFeature) IAmLoggedInAs(username string) (err error) {
 
 	currentUser := a.TestUsers[username]
+	sessionId, err := a.AuthMiddleware.CreateSession(currentUser.Id.Hex())
+	if err != nil {
+		return
+	}
 	token, _, err := a.AuthMiddleware.TokenGenerator(jwt.MapClaims{
-		"id":    currentUser.Id.Hex(),
-		"scope": "access",
+		auth.IdentityKey: currentUser.Id.Hex(),
+		auth.SessionKey:  sessionId,
+		"scope":          auth.ScopeAccess,
 	})
 	a.accessToken = token
 	a.authContext = currentUser
@@ -43,6 +54,10 @@ func (a *ApiFeature) IAmLoggedInAs(username string) (err error) {
 	return
 }
 
+func (a *ApiFeature) TheUserHasAWalletQuotaOf(username string, maxWallets int) (err error) {
+	return a.UserService.SetQuota(a.TestUsers[username].Id.Hex(), &user.Quota{MaxWallets: &maxWallets})
+}
+
 func (a *ApiFeature) ICreateATestWalletWithNameAndPassword(name string, password string) (err error) {
 
 	c := wallet.CreateDTO{}
@@ -55,14 +70,49 @@ func (a *ApiFeature) ICreateATestWalletWithNameAndPassword(name string, password
 		Content: string(dto),
 	})
 
-	err = a.TheResponseShouldBe(http.StatusCreated)
+	err = a.TheResponseShouldBe(http.StatusAccepted)
+	if err != nil {
+		return
+	}
+
+	return a.IWaitForTheJobToSucceedForWallet(name)
+}
+
+// IWaitForTheJobToSucceedForWallet polls the job of the last response until it is finished and keeps the wallet it
+// provisioned under the given name.
+func (a *ApiFeature) IWaitForTheJobToSucceedForWallet(name string) (err error) {
+	jobId := gjson.GetBytes(a.resp.Body(), "id").String()
+
+	timeout := time.After(60 * time.Second)
+	for {
+		err = a.IDoARequest(http.MethodGet, fmt.Sprintf("/api/v1/jobs/%s", jobId))
+		if err != nil {
+			return
+		}
+
+		state := gjson.GetBytes(a.resp.Body(), "state").String()
+		if state == string(job.SUCCEEDED) {
+			break
+		}
+		if state == string(job.FAILED) {
+			return fmt.Errorf("job %s failed: %s", jobId, gjson.GetBytes(a.resp.Body(), "error").String())
+		}
 
-	testWallet := &wallet.DetailedWallet{}
-	err = json.Unmarshal(a.resp.Body(), testWallet)
+		select {
+		case <-timeout:
+			return fmt.Errorf("job %s did not finish in time, last state: %s", jobId, state)
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+
+	walletId := gjson.GetBytes(a.resp.Body(), "walletId").String()
+	if !bson.IsObjectIdHex(walletId) {
+		return fmt.Errorf("job %s did not provision a wallet", jobId)
+	}
 
-	a.TestWallets[name] = testWallet.Wallet
+	a.TestWallets[name] = &wallet.Wallet{Id: bson.ObjectIdHex(walletId), Name: name}
 
-	return err
+	return nil
 }
 
 func (a *ApiFeature) KeepJSONResponseAt(path string, name string) (err error) {
@@ -145,11 +195,18 @@ func (a *ApiFeature) IDoARequestWithBody(method string, path string, body *gherk
 			Post(a.BaseUrl + path)
 	} else if method == "PUT" {
 		resp, err = resty.R().
+			SetHeader("Content-Type", "application/json").
 			SetHeader("Authorization", "Bearer "+a.accessToken).
 			SetBody(bodyRaw).
 			Put(a.BaseUrl + path)
+	} else if method == "PATCH" {
+		resp, err = resty.R().
+			SetHeader("Content-Type", "application/json").
+			SetHeader("Authorization", "Bearer "+a.accessToken).
+			SetBody(bodyRaw).
+			Patch(a.BaseUrl + path)
 	} else {
-		return fmt.Errorf("unexpected method type %s, can be either POST or PUT", method)
+		return fmt.Errorf("unexpected method type %s, can be either POST, PUT or PATCH", method)
 	}
 
 	if err != nil {
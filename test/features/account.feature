@@ -0,0 +1,77 @@
+Feature: user api - account management
+
+  Scenario: Get the current user without its password
+    Given I am logged in as "testuser"
+    When I send a GET request to "/api/v1/me"
+    Then the response should be 200 and match this json:
+      """
+      {
+          "id": ${testuser.id},
+          "username": ${testuser.username},
+          "email": ${testuser.email},
+          "emailVerified": false
+      }
+      """
+
+  Scenario: Update the display name
+    Given I am logged in as "testuser"
+    When I send a PATCH request to "/api/v1/me" with body:
+      """
+      {
+          "displayName": "Test User"
+      }
+      """
+    Then the response should be 200 and match this json:
+      """
+      {
+          "id": ${testuser.id},
+          "username": ${testuser.username},
+          "email": ${testuser.email},
+          "displayName": "Test User",
+          "emailVerified": false
+      }
+      """
+
+  Scenario: Change the password with a wrong current password
+    Given I am logged in as "testuser"
+    When I send a PUT request to "/api/v1/me/password" with body:
+      """
+      {
+          "currentPassword": "dontknowthatpw",
+          "newPassword": "n3wSecr3tPw"
+      }
+      """
+    Then the response should be 403
+
+  Scenario: Change the password
+    Given I am logged in as "testuser"
+    When I send a PUT request to "/api/v1/me/password" with body:
+      """
+      {
+          "currentPassword": "secr3tPw",
+          "newPassword": "n3wSecr3tPw"
+      }
+      """
+    Then the response should be 204
+    When I send a POST request to "/auth/login" with body:
+      """
+      {
+          "username": "testuser",
+          "password": "n3wSecr3tPw"
+      }
+      """
+    Then the response should be 200
+
+  Scenario: Delete the account together with its wallets
+    Given I am logged in as "testuser"
+    And I create a test wallet with name "testwallet1" and password "s3cr3tpa$$"
+    When I send a DELETE request to "/api/v1/me"
+    Then the response should be 204
+    When I send a POST request to "/auth/login" with body:
+      """
+      {
+          "username": "testuser",
+          "password": "secr3tPw"
+      }
+      """
+    Then the response should be 401
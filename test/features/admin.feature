@@ -0,0 +1,6 @@
+Feature: admin api
+
+  Scenario: Regular users can not access the admin api
+    Given I am logged in as "testuser"
+    When I send a GET request to "/api/v1/admin/users"
+    Then the response should be 403
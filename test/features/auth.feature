@@ -81,4 +81,100 @@ Feature: auth api - register & login
       {
           "error":"incorrect Username or Password"
       }
-      """
\ No newline at end of file
+      """
+
+  Scenario: Logout revokes the session
+    Given I am logged in as "testuser"
+    When I send a GET request to "/api/v1/wallets"
+    Then the response should be 200
+    When I send a POST request to "/auth/logout" with body:
+      """
+      {}
+      """
+    Then the response should be 204
+    When I send a GET request to "/api/v1/wallets"
+    Then the response should be 401 and match this json:
+      """
+      {
+          "error":"session has been revoked"
+      }
+      """
+
+  Scenario: Logout everywhere revokes all sessions
+    Given I am logged in as "testuser"
+    When I send a POST request to "/auth/logout-all" with body:
+      """
+      {}
+      """
+    Then the response should be 204
+    When I send a GET request to "/api/v1/wallets"
+    Then the response should be 401 and match this json:
+      """
+      {
+          "error":"session has been revoked"
+      }
+      """
+
+  Scenario: Password reset with an invalid token
+    When I send a POST request to "/auth/forgot-password" with body:
+      """
+      {
+          "email": "test@ird.cash"
+      }
+      """
+    Then the response should be 202
+    When I send a POST request to "/auth/reset-password" with body:
+      """
+      {
+          "token": "not-a-token",
+          "password": "n3wSecr3tPw"
+      }
+      """
+    Then the response should be 400 and match this json:
+      """
+      {
+          "error":"invalid or expired token"
+      }
+      """
+
+  Scenario: Login is throttled after repeated failures
+    When I send a POST request to "/auth/login" with body:
+      """
+      {
+          "username": "testuser",
+          "password": "dontknowthatpw"
+      }
+      """
+    Then the response should be 401
+    When I send a POST request to "/auth/login" with body:
+      """
+      {
+          "username": "testuser",
+          "password": "dontknowthatpw"
+      }
+      """
+    Then the response should be 401
+    When I send a POST request to "/auth/login" with body:
+      """
+      {
+          "username": "testuser",
+          "password": "dontknowthatpw"
+      }
+      """
+    Then the response should be 401
+    When I send a POST request to "/auth/login" with body:
+      """
+      {
+          "username": "testuser",
+          "password": "dontknowthatpw"
+      }
+      """
+    Then the response should be 401
+    When I send a POST request to "/auth/login" with body:
+      """
+      {
+          "username": "testuser",
+          "password": "secr3tPw"
+      }
+      """
+    Then the response should be 429
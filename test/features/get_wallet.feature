@@ -38,6 +38,8 @@ Feature: wallet api - get wallets
     And I keep the JSON response at "blockHeight.top" as "blockHeightTop"
     And I keep the JSON response at "blockHeight.current" as "blockHeightCurrent"
     And I keep the JSON response at "peerCount" as "peerCount"
+    And I keep the JSON response at "status" as "status"
+    And I keep the JSON response at "sync" as "sync"
     Then the response should be 200 and match this json:
       """
       {
@@ -45,7 +47,7 @@ Feature: wallet api - get wallets
           "name": "testwallet1",
           "address": ${address},
           "owner": ${testuser.id},
-          "status": "RUNNING",
+          "status": ${status},
           "balance": {
             "total": 0,
             "locked": 0
@@ -54,6 +56,7 @@ Feature: wallet api - get wallets
             "current": ${blockHeightCurrent},
             "top": ${blockHeightTop}
           },
+          "sync": ${sync},
           "peerCount": ${peerCount}
       }
       """
@@ -80,19 +83,24 @@ Feature: wallet api - get wallets
           "password": "s3cr3tpa$$"
       }
       """
+    Then the response should be 202
+    When I wait for the job to succeed for wallet "testwallet1"
+    And I send a GET request to "/api/v1/wallets/${testwallet1.id}"
     And I keep the JSON response at "id" as "id"
     And I keep the JSON response at "address" as "address"
     And I keep the JSON response at "blockHeight.current" as "bHeightCurrent"
     And I keep the JSON response at "blockHeight.top" as "bHeightTop"
     And I keep the JSON response at "peerCount" as "peerCount"
-    Then the response should be 201 and match this json:
+    And I keep the JSON response at "status" as "status"
+    And I keep the JSON response at "sync" as "sync"
+    Then the response should be 200 and match this json:
       """
         {
             "id": ${id},
             "name": "testwallet1",
             "address": ${address},
             "owner": ${testuser.id},
-            "status": "RUNNING",
+            "status": ${status},
             "balance": {
               "total": 0,
               "locked": 0
@@ -101,6 +109,7 @@ Feature: wallet api - get wallets
               "current": ${bHeightCurrent},
               "top": ${bHeightTop}
             },
+            "sync": ${sync},
             "peerCount": ${peerCount}
         }
       """
@@ -9,19 +9,37 @@ Feature: wallet api - create/import wallets
           "password": "s3cr3tpa$$"
       }
       """
+    And I keep the JSON response at "id" as "jobId"
+    And I keep the JSON response at "created" as "created"
+    And I keep the JSON response at "updated" as "updated"
+    Then the response should be 202 and match this json:
+      """
+      {
+          "id": ${jobId},
+          "type": "CREATE_WALLET",
+          "owner": ${testuser.id},
+          "state": "PENDING",
+          "created": ${created},
+          "updated": ${updated}
+      }
+      """
+    When I wait for the job to succeed for wallet "FooWallet"
+    And I send a GET request to "/api/v1/wallets/${FooWallet.id}"
     And I keep the JSON response at "id" as "id"
     And I keep the JSON response at "address" as "address"
     And I keep the JSON response at "blockHeight.top" as "blockHeightTop"
     And I keep the JSON response at "blockHeight.current" as "blockHeightCurrent"
     And I keep the JSON response at "peerCount" as "peerCount"
-    Then the response should be 201 and match this json:
+    And I keep the JSON response at "status" as "status"
+    And I keep the JSON response at "sync" as "sync"
+    Then the response should be 200 and match this json:
       """
       {
           "id": ${id},
           "name": "FooWallet",
           "address": ${address},
           "owner": ${testuser.id},
-          "status": "RUNNING",
+          "status": ${status},
           "balance": {
             "total": 0,
             "locked": 0
@@ -30,6 +48,7 @@ Feature: wallet api - create/import wallets
             "current": ${blockHeightCurrent},
             "top": ${blockHeightTop}
           },
+          "sync": ${sync},
           "peerCount": ${peerCount}
       }
       """
@@ -45,18 +64,23 @@ Feature: wallet api - create/import wallets
           "spendSecretKey": "78b4a1e37d40b84a0ae96c60597b0638639e20058f59b5dbc74929294c712002"
       }
       """
+    Then the response should be 202
+    When I wait for the job to succeed for wallet "ImportedWallet"
+    And I send a GET request to "/api/v1/wallets/${ImportedWallet.id}"
     And I keep the JSON response at "id" as "id"
     And I keep the JSON response at "blockHeight.top" as "blockHeightTop"
     And I keep the JSON response at "blockHeight.current" as "blockHeightCurrent"
     And I keep the JSON response at "peerCount" as "peerCount"
-    Then the response should be 201 and match this json:
+    And I keep the JSON response at "status" as "status"
+    And I keep the JSON response at "sync" as "sync"
+    Then the response should be 200 and match this json:
       """
       {
           "id": ${id},
           "name": "Test Wallet ir2ku...",
           "address": "ir2ku6Rgh69WqEfzAnQfBLTSsoYW17bEJbPUptFedjzG6yWu3o4mNNC23zyGS74KWQ92XhLXhm9uTUhrSPbTc5zK1QGSA63rz",
           "owner": ${testuser.id},
-          "status": "RUNNING",
+          "status": ${status},
           "balance": {
             "total": 0,
             "locked": 0
@@ -65,6 +89,7 @@ Feature: wallet api - create/import wallets
             "current": ${blockHeightCurrent},
             "top": ${blockHeightTop}
           },
+          "sync": ${sync},
           "peerCount": ${peerCount}
       }
       """
\ No newline at end of file
@@ -0,0 +1,21 @@
+Feature: wallet api - quotas
+
+  Scenario: Creating more wallets than the quota allows is forbidden
+    Given I am logged in as "testuser"
+    And the user "testuser" has a quota of 1 wallet
+    And I create a test wallet with name "FooWallet" and password "s3cr3tpa$$"
+    When I send a POST request to "/api/v1/wallets" with body:
+      """
+      {
+          "name": "BarWallet",
+          "password": "s3cr3tpa$$"
+      }
+      """
+    Then the response should be 403 and match this json:
+      """
+      {
+          "error": "quota exceeded: maxWallets=1",
+          "quota": "maxWallets",
+          "limit": 1
+      }
+      """
@@ -0,0 +1,86 @@
+package user
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/iridiumdev/webwallet-core/util"
+	"net/http"
+)
+
+type AdminController struct {
+	adminRouter *gin.RouterGroup
+}
+
+func NewAdminController(adminRouter *gin.RouterGroup) AdminController {
+	return AdminController{adminRouter: adminRouter}
+}
+
+// Routes registers the user management operations in the adminRouter, which only admins may access.
+func (controller *AdminController) Routes() {
+	api := controller.adminRouter.Group("/users")
+	{
+		api.GET("", controller.getListHandler())
+		api.GET("/:id", controller.getHandler())
+		api.PUT("/:id/roles", controller.putRolesHandler())
+		api.POST("/:id/disable", controller.postDisableHandler(true))
+		api.POST("/:id/enable", controller.postDisableHandler(false))
+	}
+}
+
+func (controller *AdminController) getListHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		users, err := service.ListUsers()
+		if !handleAdminErrors(c, err) {
+			c.JSON(http.StatusOK, users)
+		}
+	}
+}
+
+func (controller *AdminController) getHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, err := service.GetUser(c.Param("id"))
+		if !handleAdminErrors(c, err) {
+			c.JSON(http.StatusOK, user)
+		}
+	}
+}
+
+func (controller *AdminController) putRolesHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dto := RolesDTO{}
+		if util.BindAndHandleError(c, &dto, http.StatusBadRequest) {
+			return
+		}
+
+		err := service.SetRoles(c.Param("id"), dto.Roles)
+		if !handleAdminErrors(c, err) {
+			c.Status(http.StatusNoContent)
+		}
+	}
+}
+
+// postDisableHandler disables or enables the user, disabling also logs the user out of all sessions.
+func (controller *AdminController) postDisableHandler(disabled bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userId := c.Param("id")
+		if disabled && userId == c.GetString(identityKey) {
+			handleAdminErrors(c, ErrDisableSelf)
+			return
+		}
+
+		err := service.SetDisabled(userId, disabled)
+		if !handleAdminErrors(c, err) {
+			c.Status(http.StatusNoContent)
+		}
+	}
+}
+
+func handleAdminErrors(c *gin.Context, err error) bool {
+	if err == ErrUserNotFound {
+		return util.HandleError(c, err, http.StatusNotFound)
+	}
+	if err == ErrUnknownRole || err == ErrDisableSelf {
+		return util.HandleError(c, err, http.StatusBadRequest)
+	}
+
+	return util.HandleError(c, err, http.StatusInternalServerError)
+}
@@ -4,9 +4,14 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/iridiumdev/webwallet-core/util"
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 	"net/http"
+	"strconv"
 )
 
+// context key of the authenticated user id set by the auth middleware, which depends on this package
+const identityKey = "id"
+
 type Controller struct {
 	apiRouter  *gin.RouterGroup
 	authRouter *gin.RouterGroup
@@ -20,15 +25,34 @@ func NewController(apiRouter *gin.RouterGroup, authRouter *gin.RouterGroup) Cont
 // routes for the operations on the User model.
 func (controller *Controller) Routes() {
 	controller.authRouter.POST("/register", controller.postRegisterHandler())
+	controller.authRouter.POST("/verify-email", controller.postVerifyEmailHandler())
+	controller.authRouter.POST("/forgot-password", controller.postForgotPasswordHandler())
+	controller.authRouter.POST("/reset-password", controller.postResetPasswordHandler())
+	controller.authRouter.POST("/unlock", controller.postUnlockHandler())
+
+	api := controller.apiRouter.Group("/me")
+	{
+		api.GET("", controller.getMeHandler())
+		api.PATCH("", controller.patchMeHandler())
+		api.DELETE("", controller.deleteMeHandler())
+		api.PUT("/password", controller.putPasswordHandler())
+		api.POST("/email/verification", controller.postSendVerificationHandler())
+
+		api.POST("/mfa/totp", controller.postTotpEnrollHandler())
+		api.POST("/mfa/totp/confirm", controller.postTotpConfirmHandler())
+		api.POST("/mfa/totp/disable", controller.postTotpDisableHandler())
+	}
 }
 
 func (controller *Controller) postRegisterHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
 
-		user := User{}
-		util.BindAndHandleError(c, &user, http.StatusBadRequest)
+		dto := RegistrationDTO{}
+		if util.BindAndHandleError(c, &dto, http.StatusBadRequest) {
+			return
+		}
 
-		_, err := service.CreateUser(user)
+		_, err := service.CreateUser(dto)
 		if err != nil {
 			err = errors.New("registration failed")
 		}
@@ -38,3 +62,190 @@ func (controller *Controller) postRegisterHandler() gin.HandlerFunc {
 
 	}
 }
+
+func (controller *Controller) getMeHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, err := service.GetUser(c.GetString(identityKey))
+		if !handleAccountErrors(c, err) {
+			c.JSON(http.StatusOK, user)
+		}
+	}
+}
+
+func (controller *Controller) patchMeHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dto := ProfileDTO{}
+		if util.BindAndHandleError(c, &dto, http.StatusBadRequest) {
+			return
+		}
+
+		user, err := service.UpdateProfile(c.GetString(identityKey), dto)
+		if !handleAccountErrors(c, err) {
+			c.JSON(http.StatusOK, user)
+		}
+	}
+}
+
+// putPasswordHandler changes the password, which revokes all sessions including the current one.
+func (controller *Controller) putPasswordHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dto := ChangePasswordDTO{}
+		if util.BindAndHandleError(c, &dto, http.StatusBadRequest) {
+			return
+		}
+
+		err := service.ChangePassword(c.GetString(identityKey), dto.CurrentPassword, dto.NewPassword)
+		if !handleAccountErrors(c, err) {
+			c.Status(http.StatusNoContent)
+		}
+	}
+}
+
+// deleteMeHandler deletes the account together with all its wallets.
+func (controller *Controller) deleteMeHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := service.DeleteUser(c.GetString(identityKey))
+		if !handleAccountErrors(c, err) {
+			c.Status(http.StatusNoContent)
+		}
+	}
+}
+
+func (controller *Controller) postVerifyEmailHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dto := TokenDTO{}
+		if util.BindAndHandleError(c, &dto, http.StatusBadRequest) {
+			return
+		}
+
+		err := service.VerifyEmail(dto.Token)
+		if !util.HandleError(c, err, http.StatusBadRequest) {
+			c.Status(http.StatusNoContent)
+		}
+	}
+}
+
+func (controller *Controller) postSendVerificationHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := service.SendVerification(c.GetString(identityKey))
+		if !util.HandleError(c, err, http.StatusInternalServerError) {
+			c.Status(http.StatusAccepted)
+		}
+	}
+}
+
+// postForgotPasswordHandler always responds with 202, so it can not be used to find out whether an email is known.
+func (controller *Controller) postForgotPasswordHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dto := ForgotPasswordDTO{}
+		if util.BindAndHandleError(c, &dto, http.StatusBadRequest) {
+			return
+		}
+
+		if err := service.ForgotPassword(dto.Email); err != nil {
+			log.Errorf("Could not send password reset mail: %s", err.Error())
+		}
+		c.Status(http.StatusAccepted)
+	}
+}
+
+func (controller *Controller) postResetPasswordHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dto := ResetPasswordDTO{}
+		if util.BindAndHandleError(c, &dto, http.StatusBadRequest) {
+			return
+		}
+
+		err := service.ResetPassword(dto.Token, dto.Password)
+		if !util.HandleError(c, err, http.StatusBadRequest) {
+			c.Status(http.StatusNoContent)
+		}
+	}
+}
+
+func (controller *Controller) postUnlockHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dto := TokenDTO{}
+		if util.BindAndHandleError(c, &dto, http.StatusBadRequest) {
+			return
+		}
+
+		err := service.UnlockAccount(dto.Token)
+		if !util.HandleError(c, err, http.StatusBadRequest) {
+			c.Status(http.StatusNoContent)
+		}
+	}
+}
+
+func (controller *Controller) postTotpEnrollHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		enrollment, err := service.EnrollTotp(c.GetString(identityKey))
+		if !handleMfaErrors(c, err) {
+			c.JSON(http.StatusOK, enrollment)
+		}
+	}
+}
+
+func (controller *Controller) postTotpConfirmHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dto := TotpDTO{}
+		if util.BindAndHandleError(c, &dto, http.StatusBadRequest) {
+			return
+		}
+
+		recoveryCodes, err := service.ConfirmTotp(c.GetString(identityKey), dto.Code)
+		if !handleMfaErrors(c, err) {
+			c.JSON(http.StatusOK, gin.H{"recoveryCodes": recoveryCodes})
+		}
+	}
+}
+
+func (controller *Controller) postTotpDisableHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dto := TotpDTO{}
+		if util.BindAndHandleError(c, &dto, http.StatusBadRequest) {
+			return
+		}
+
+		err := service.DisableTotp(c.GetString(identityKey), dto.Code)
+		if !handleMfaErrors(c, err) {
+			c.Status(http.StatusNoContent)
+		}
+	}
+}
+
+func handleAccountErrors(c *gin.Context, err error) bool {
+	if throttledErr, ok := err.(*ThrottledError); ok {
+		c.Header("Retry-After", strconv.Itoa(int(throttledErr.RetryAfter.Seconds())+1))
+		return util.HandleError(c, err, http.StatusTooManyRequests)
+	}
+	if err == ErrUserNotFound {
+		return util.HandleError(c, err, http.StatusNotFound)
+	}
+	if err == ErrInvalidPassword || err == ErrReauthRequired || err == ErrTotpRequired || err == ErrInvalidTotp || err == ErrInvalidStepUp {
+		return util.HandleError(c, err, http.StatusForbidden)
+	}
+	if err == ErrEmailRequired {
+		return util.HandleError(c, err, http.StatusBadRequest)
+	}
+
+	return util.HandleError(c, err, http.StatusInternalServerError)
+}
+
+func handleMfaErrors(c *gin.Context, err error) bool {
+	if throttledErr, ok := err.(*ThrottledError); ok {
+		c.Header("Retry-After", strconv.Itoa(int(throttledErr.RetryAfter.Seconds())+1))
+		return util.HandleError(c, err, http.StatusTooManyRequests)
+	}
+	if err == ErrUserNotFound {
+		return util.HandleError(c, err, http.StatusNotFound)
+	}
+	if err == ErrTotpAlreadyEnabled {
+		return util.HandleError(c, err, http.StatusConflict)
+	}
+	if err == ErrInvalidTotp {
+		return util.HandleError(c, err, http.StatusForbidden)
+	}
+
+	return util.HandleError(c, err, http.StatusBadRequest)
+}
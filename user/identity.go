@@ -0,0 +1,60 @@
+package user
+
+import (
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+func (s *serviceImpl) AuthenticateExternal(login ExternalLogin) (*User, error) {
+	user, err := store.FindUserByIdentity(login.Issuer, login.Subject)
+	if err != nil || user == nil {
+		if user, err = s.linkIdentity(login); err != nil {
+			return nil, err
+		}
+	}
+
+	if user.Disabled {
+		log.Warnf("External login of disabled user with id='%s'", user.Id.Hex())
+		return nil, ErrUserDisabled
+	}
+	return user, nil
+}
+
+// linkIdentity links the external identity to the user with the same email. The email has to be verified on both
+// sides, otherwise anyone could take over an account by registering its email at the provider or vice versa.
+func (s *serviceImpl) linkIdentity(login ExternalLogin) (*User, error) {
+	if login.Email == "" || !login.EmailVerified {
+		return nil, ErrEmailNotVerified
+	}
+
+	users, err := store.FindUsersByEmail(login.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	var found *User
+	for _, user := range users {
+		if !user.EmailVerified {
+			continue
+		}
+		if found != nil {
+			log.Warnf("Could not link identity '%s' of %s, several users have its email", login.Subject, login.Issuer)
+			return nil, ErrAmbiguousEmail
+		}
+		found = user
+	}
+	if found == nil {
+		log.Infof("No user with verified email for identity '%s' of %s", login.Subject, login.Issuer)
+		return nil, ErrUserNotFound
+	}
+
+	identity := &Identity{Issuer: login.Issuer, Subject: login.Subject, Linked: time.Now()}
+	if err := store.AddIdentity(found.Id, identity); err != nil {
+		log.Errorf("Could not link identity '%s' of %s to user with id='%s': %s", login.Subject, login.Issuer, found.Id.Hex(), err.Error())
+		return nil, err
+	}
+
+	log.Infof("Linked identity '%s' of %s to user with id='%s'", login.Subject, login.Issuer, found.Id.Hex())
+	found.Identities = append(found.Identities, identity)
+	return found, nil
+}
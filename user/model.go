@@ -1,15 +1,139 @@
 package user
 
-import "gopkg.in/mgo.v2/bson"
+import (
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+const (
+	RoleAdmin = "admin"
+)
+
+var roles = []string{RoleAdmin}
 
 type User struct {
-	Id       bson.ObjectId `json:"id" bson:"_id,omitempty"`
-	Username string        `json:"username" binding:"required" bson:"username"`
-	Email    string        `json:"email" binding:"required" bson:"email"`
-	Password string        `json:"password" binding:"required,min=8" bson:"password"`
+	Id          bson.ObjectId `json:"id" bson:"_id,omitempty"`
+	Username    string        `json:"username" bson:"username"`
+	Email       string        `json:"email" bson:"email"`
+	DisplayName string        `json:"displayName,omitempty" bson:"displayName,omitempty"`
+	// bcrypt hash of the password, never sent to the client
+	Password string   `json:"-" bson:"password"`
+	Quota    *Quota   `json:"quota,omitempty" bson:"quota,omitempty"`
+	Mfa      *Mfa     `json:"-" bson:"mfa,omitempty"`
+	Roles    []string `json:"roles,omitempty" bson:"roles,omitempty"`
+	// accounts at external identity providers the user can log in with
+	Identities []*Identity `json:"identities,omitempty" bson:"identities,omitempty"`
+
+	EmailVerified bool `json:"emailVerified" bson:"emailVerified"`
+	// disabled users can not log in and all their tokens are rejected
+	Disabled bool `json:"disabled" bson:"disabled"`
+	// issue time of the last accepted step-up token in nanoseconds, a token can only be used once
+	LastStepUp int64 `json:"-" bson:"lastStepUp,omitempty"`
+}
+
+func (u *User) HasRole(role string) bool {
+	for _, r := range u.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// MfaEnabled reports whether the user has to provide a TOTP code on login.
+func (u *User) MfaEnabled() bool {
+	return u.Mfa != nil && u.Mfa.TotpEnabled
+}
+
+// Quota holds the per-user overrides of the configured default quota. A nil value falls back to the default, a
+// value <= 0 disables the respective limit for this user.
+type Quota struct {
+	MaxWallets        *int `json:"maxWallets,omitempty" bson:"maxWallets,omitempty"`
+	MaxRunningWallets *int `json:"maxRunningWallets,omitempty" bson:"maxRunningWallets,omitempty"`
+	CreationRate      *int `json:"creationRate,omitempty" bson:"creationRate,omitempty"`
+}
+
+// Mfa holds the second factor of a user. The TOTP secret is only enabled once the enrollment has been confirmed with a
+// valid code.
+type Mfa struct {
+	TotpSecret  string `bson:"totpSecret"`
+	TotpEnabled bool   `bson:"totpEnabled"`
+	// time step of the last accepted code, a code can only be used once
+	LastTotpStep int64 `bson:"lastTotpStep"`
+	// bcrypt hashes of the unused recovery codes
+	RecoveryCodes []string `bson:"recoveryCodes,omitempty"`
+}
+
+type RegistrationDTO struct {
+	Username string `json:"username" binding:"required"`
+	Email    string `json:"email" binding:"required"`
+	Password string `json:"password" binding:"required,min=8"`
+}
+
+// ProfileDTO holds the fields of a profile update, fields which are not set stay unchanged. A new email takes over the
+// password resets, so changing it needs the reauthentication.
+type ProfileDTO struct {
+	Reauthentication
+	Email       *string `json:"email"`
+	DisplayName *string `json:"displayName"`
+}
+
+// Reauthentication confirms a change of the credentials of a user with the current password, a TOTP code or the
+// step-up token of a passkey, only one of them is needed.
+type Reauthentication struct {
+	CurrentPassword string `json:"currentPassword"`
+	Totp            string `json:"totp"`
+	StepUpToken     string `json:"stepUpToken"`
+}
+
+type ChangePasswordDTO struct {
+	CurrentPassword string `json:"currentPassword" binding:"required"`
+	NewPassword     string `json:"newPassword" binding:"required,min=8"`
+}
+
+type RolesDTO struct {
+	Roles []string `json:"roles"`
+}
+
+type TotpEnrollment struct {
+	Secret string `json:"secret"`
+	Uri    string `json:"uri"`
+}
+
+type TotpDTO struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// TokenDTO carries the token of a link sent by mail.
+type TokenDTO struct {
+	Token string `json:"token" binding:"required"`
+}
+
+type ForgotPasswordDTO struct {
+	Email string `json:"email" binding:"required"`
+}
+
+type ResetPasswordDTO struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required,min=8"`
 }
 
 type Login struct {
 	Username string `form:"username" json:"username" binding:"required"`
 	Password string `form:"password" json:"password" binding:"required"`
 }
+
+// Identity links an account at an OpenID Connect provider to the user, the subject is unique per issuer.
+type Identity struct {
+	Issuer  string    `json:"issuer" bson:"issuer"`
+	Subject string    `json:"subject" bson:"subject"`
+	Linked  time.Time `json:"linked" bson:"linked"`
+}
+
+// ExternalLogin holds the claims of an id token the user logged in with.
+type ExternalLogin struct {
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
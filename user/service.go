@@ -1,32 +1,146 @@
 package user
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"github.com/iridiumdev/webwallet-core/config"
+	"github.com/iridiumdev/webwallet-core/mail"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/mgo.v2/bson"
+	"strconv"
+	"time"
+)
+
+// TokenSigner issues the signed, expiring tokens of the links sent by mail. The fingerprint binds a token to the state
+// it was issued for, e.g. the current password hash for a reset token, so it becomes invalid once that state changes.
+type TokenSigner interface {
+	SignToken(purpose string, subject string, fingerprint string, ttl time.Duration) (string, error)
+	VerifyToken(purpose string, token string) (subject string, fingerprint string, err error)
+}
+
+const (
+	purposeVerifyEmail   = "verify-email"
+	purposeResetPassword = "reset-password"
+	purposeUnlockAccount = "unlock-account"
+	purposeStepUp        = "step-up"
+
+	verifyEmailTtl   = 48 * time.Hour
+	resetPasswordTtl = time.Hour
+	stepUpTtl        = 5 * time.Minute
 )
 
 type serviceImpl struct {
+	mailer    mail.Mailer
+	tokens    TokenSigner
+	publicUrl string
+	lockout   config.Lockout
+
+	passwordChangedHooks []func(userId string)
+	deleteHooks          []func(userId string) error
+	disabledHooks        []func(userId string)
+	stepUpFactors        []func(userId string) (bool, error)
 }
 
 type Service interface {
-	CreateUser(user User) (*User, error)
-	AuthenticateUser(login Login) (*User, error)
+	CreateUser(dto RegistrationDTO) (*User, error)
+	// AuthenticateUser returns a ThrottledError while the username or client ip has to wait after failed attempts.
+	AuthenticateUser(login Login, clientIp string) (*User, error)
+	// AuthenticateExternal returns the user linked to the external identity. An identity logging in for the first time
+	// is linked to the user with the same email, if both sides verified it.
+	AuthenticateExternal(login ExternalLogin) (*User, error)
+	GetUser(userId string) (*User, error)
+	GetUserByUsername(username string) (*User, error)
+	SetQuota(userId string, quota *Quota) error
+	// UpdateProfile changes the set fields of the profile, a new email has to be verified again.
+	UpdateProfile(userId string, dto ProfileDTO) (*User, error)
+	ChangePassword(userId string, currentPassword string, newPassword string) error
+	// DeleteUser runs the registered delete hooks and removes the user, unless one of the hooks fails.
+	DeleteUser(userId string) error
+	OnDelete(hook func(userId string) error)
+
+	ListUsers() ([]*User, error)
+	SetRoles(userId string, roles []string) error
+	// GrantRole adds the role to the user with the given username, e.g. to bootstrap the configured admins.
+	GrantRole(username string, role string) error
+	SetDisabled(userId string, disabled bool) error
+	// OnDisabled registers a hook called after a user has been disabled.
+	OnDisabled(hook func(userId string))
+
+	// EnrollTotp generates a new TOTP secret, which is enabled by ConfirmTotp.
+	EnrollTotp(userId string) (*TotpEnrollment, error)
+	// ConfirmTotp enables the enrolled secret if the code is valid and returns the recovery codes.
+	ConfirmTotp(userId string, code string) ([]string, error)
+	DisableTotp(userId string, code string) error
+	// VerifyMfa accepts a TOTP code or one of the recovery codes, which is used up by that, to complete a login whose
+	// first step (the password or an external login) passed at the given time. A failed code also fails all logins
+	// which passed the first step before, so they have to start over.
+	VerifyMfa(userId string, code string, firstStep time.Time) error
+	// RequireTotp verifies the code if the user enabled TOTP, recovery codes are not accepted.
+	RequireTotp(userId string, code string) error
+	// IssueStepUpToken is called once the user confirmed a sensitive action with a passkey. The token is accepted by
+	// RequireStepUp and Reauthenticate instead of a TOTP code or the password.
+	IssueStepUpToken(userId string) (string, error)
+	// RequireStepUp confirms a sensitive action, like sending funds, with the second factor of the user: a TOTP code if
+	// enabled, otherwise a step-up token if the user has a registered step-up factor. A step-up token is always
+	// accepted, but only once.
+	RequireStepUp(userId string, code string, stepUpToken string) error
+	// RegisterStepUpFactor registers a check for second factors besides TOTP, e.g. passkeys. Users which have one need a
+	// step-up token for the actions confirmed by RequireStepUp.
+	RegisterStepUpFactor(hasFactor func(userId string) (bool, error))
+	// Reauthenticate confirms a change of the credentials of the user, so that a stolen session is not enough to take
+	// over the account. Failed passwords count towards the lockout like failed logins.
+	Reauthenticate(userId string, proof Reauthentication) error
+
+	SendVerification(userId string) error
+	VerifyEmail(token string) error
+	// ForgotPassword mails a reset link to all users with the given email, an unknown email is silently ignored.
+	ForgotPassword(email string) error
+	ResetPassword(token string, password string) error
+	// OnPasswordChanged registers a hook called after the password of a user has been changed or reset.
+	OnPasswordChanged(hook func(userId string))
+	// UnlockAccount resets the failed logins of the user the unlock token was mailed to.
+	UnlockAccount(token string) error
 }
 
+var (
+	ErrUserNotFound       = errors.New("user not found")
+	ErrTotpAlreadyEnabled = errors.New("totp is already enabled")
+	ErrTotpNotEnrolled    = errors.New("totp is not enrolled")
+	ErrTotpRequired       = errors.New("totp code required")
+	ErrInvalidTotp        = errors.New("invalid totp code")
+	ErrLoginExpired       = errors.New("login expired, log in again")
+	ErrInvalidStepUp      = errors.New("invalid or expired step-up token")
+	ErrStepUpRequired     = errors.New("step-up token required")
+	ErrReauthRequired     = errors.New("current password, totp code or step-up token required")
+	ErrInvalidToken       = errors.New("invalid or expired token")
+	ErrInvalidPassword    = errors.New("invalid password")
+	ErrEmailRequired      = errors.New("email must not be empty")
+	ErrUserDisabled       = errors.New("user is disabled")
+	ErrUnknownRole        = errors.New("unknown role")
+	ErrDisableSelf        = errors.New("admins can not disable themselves")
+	ErrEmailNotVerified   = errors.New("email address not verified")
+	ErrAmbiguousEmail     = errors.New("several users have the email address")
+)
+
 var service Service
 
-func (s *serviceImpl) CreateUser(user User) (*User, error) {
+func (s *serviceImpl) CreateUser(dto RegistrationDTO) (*User, error) {
 
-	hash, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+	hash, err := bcrypt.GenerateFromPassword([]byte(dto.Password), bcrypt.DefaultCost)
 	if err != nil {
-		log.Errorf("Could not generate password hash for user with username='%s'!", user.Username)
+		log.Errorf("Could not generate password hash for user with username='%s'!", dto.Username)
 		return nil, err
 	}
 
-	user.Password = string(hash)
-	user.Id = bson.NewObjectId()
+	user := User{
+		Id:       bson.NewObjectId(),
+		Username: dto.Username,
+		Email:    dto.Email,
+		Password: string(hash),
+	}
 
 	err = store.InsertUser(&user)
 	if err != nil {
@@ -34,27 +148,781 @@ func (s *serviceImpl) CreateUser(user User) (*User, error) {
 		return nil, err
 	}
 
+	// the user can request another mail if this one fails
+	s.sendVerification(&user)
+
 	return &user, nil
 }
 
-func (s *serviceImpl) AuthenticateUser(login Login) (*User, error) {
+func (s *serviceImpl) AuthenticateUser(login Login, clientIp string) (*User, error) {
+
+	if err := s.checkThrottle(login.Username, clientIp); err != nil {
+		log.Warnf("throttled login attempt for user with username='%s' from %s", login.Username, clientIp)
+		return nil, err
+	}
 
 	user, err := store.FindUserByUsername(login.Username)
 	if err != nil {
 		log.Infof("user with username='%s' not found", login.Username)
-		return nil, errors.New("user not found")
+		s.recordFailure(nil, login.Username, clientIp)
+		return nil, ErrUserNotFound
 	}
 
 	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(login.Password))
 	if err != nil {
 		log.Warnf("invalid password login attempt for user with username='%s'", login.Username)
-		return nil, errors.New("invalid password")
+		s.recordFailure(user, login.Username, clientIp)
+		return nil, ErrInvalidPassword
+	}
+
+	if err := store.ResetLoginAttempts(usernameKey(login.Username)); err != nil {
+		log.Warnf("Could not reset failed logins of user with username='%s': %s", login.Username, err.Error())
+	}
+
+	if user.Disabled {
+		log.Warnf("login attempt for disabled user with username='%s'", login.Username)
+		return nil, ErrUserDisabled
+	}
+
+	return user, nil
+}
+
+func (s *serviceImpl) checkThrottle(username string, clientIp string) error {
+	now := time.Now()
+
+	attempts, err := store.FindLoginAttempts(usernameKey(username))
+	if err != nil {
+		return err
+	}
+	if wait := retryAfter(attempts, s.lockout.FreeAttempts, s.lockout, now); wait > 0 {
+		return &ThrottledError{RetryAfter: wait, Locked: attempts.LockedUntil.After(now)}
+	}
+
+	if clientIp == "" {
+		return nil
+	}
+	attempts, err = store.FindLoginAttempts(ipKey(clientIp))
+	if err != nil {
+		return err
+	}
+	if wait := retryAfter(attempts, s.lockout.IpFreeAttempts, s.lockout, now); wait > 0 {
+		return &ThrottledError{RetryAfter: wait}
+	}
+
+	return nil
+}
+
+// recordFailure counts the failed login for the username and client ip. Once the username reached the maximum number
+// of failures, the account is locked and an unlock link is mailed to the user (if the username exists).
+func (s *serviceImpl) recordFailure(user *User, username string, clientIp string) {
+	expires := time.Now().Add(s.lockout.WindowMinutes * time.Minute)
+
+	if clientIp != "" {
+		if _, err := store.RecordLoginFailure(ipKey(clientIp), expires); err != nil {
+			log.Errorf("Could not record failed login from %s: %s", clientIp, err.Error())
+		}
+	}
+
+	attempts, err := store.RecordLoginFailure(usernameKey(username), expires)
+	if err != nil {
+		log.Errorf("Could not record failed login of user with username='%s': %s", username, err.Error())
+		return
+	}
+
+	if s.lockout.MaxFailures <= 0 || attempts.Failures != s.lockout.MaxFailures {
+		return
+	}
+
+	until := time.Now().Add(s.lockout.LockoutMinutes * time.Minute)
+	if err := store.LockLogin(attempts.Key, until); err != nil {
+		log.Errorf("Could not lock user with username='%s': %s", username, err.Error())
+		return
+	}
+	log.Warnf("Locked user with username='%s' after %d failed logins", username, attempts.Failures)
+
+	if user != nil {
+		s.sendUnlock(user, attempts.Key, "Otherwise someone tries to guess your password, consider changing it once the lock expired.")
+	}
+}
+
+// checkMfaThrottle refuses codes while the second factor of the user has to wait after failed codes, like
+// checkThrottle does for the password. It returns the failed codes of the user, if any.
+func (s *serviceImpl) checkMfaThrottle(user *User) (*LoginAttempts, error) {
+	now := time.Now()
+
+	attempts, err := store.FindLoginAttempts(mfaKey(user.Id.Hex()))
+	if err != nil {
+		return nil, err
+	}
+	if wait := retryAfter(attempts, s.lockout.FreeAttempts, s.lockout, now); wait > 0 {
+		log.Warnf("throttled mfa code of user with id='%s'", user.Id.Hex())
+		return nil, &ThrottledError{RetryAfter: wait, Locked: attempts.LockedUntil.After(now)}
+	}
+	return attempts, nil
+}
+
+// recordMfaFailure counts the failed code of the user. Once the maximum number of failures is reached, the second
+// factor is locked and the user is told by mail that someone knows the password.
+func (s *serviceImpl) recordMfaFailure(user *User) {
+	attempts, err := store.RecordLoginFailure(mfaKey(user.Id.Hex()), time.Now().Add(s.lockout.WindowMinutes*time.Minute))
+	if err != nil {
+		log.Errorf("Could not record failed mfa code of user with id='%s': %s", user.Id.Hex(), err.Error())
+		return
+	}
+
+	if s.lockout.MaxFailures <= 0 || attempts.Failures != s.lockout.MaxFailures {
+		return
+	}
+
+	until := time.Now().Add(s.lockout.LockoutMinutes * time.Minute)
+	if err := store.LockLogin(attempts.Key, until); err != nil {
+		log.Errorf("Could not lock mfa of user with id='%s': %s", user.Id.Hex(), err.Error())
+		return
+	}
+	log.Warnf("Locked mfa of user with id='%s' after %d failed codes", user.Id.Hex(), attempts.Failures)
+
+	s.sendUnlock(user, attempts.Key, "Otherwise someone who knows your password tries to guess your second factor, change your password right away.")
+}
+
+func (s *serviceImpl) resetMfaFailures(user *User) {
+	if err := store.ResetLoginAttempts(mfaKey(user.Id.Hex())); err != nil {
+		log.Warnf("Could not reset failed mfa codes of user with id='%s': %s", user.Id.Hex(), err.Error())
+	}
+}
+
+// sendUnlock mails the link which resets the locked key, the hint tells the user what to do if it was not them.
+func (s *serviceImpl) sendUnlock(user *User, key string, hint string) error {
+	token, err := s.tokens.SignToken(purposeUnlockAccount, user.Id.Hex(), key, s.lockout.LockoutMinutes*time.Minute)
+	if err != nil {
+		log.Errorf("Could not sign unlock token for user with id='%s': %s", user.Id.Hex(), err.Error())
+		return err
+	}
+
+	return s.mailer.Send(mail.Message{
+		To:      user.Email,
+		Subject: "Your account has been locked",
+		Body: fmt.Sprintf("Hi %s,\n\nyour account has been locked after too many failed logins. If it was you, open the following link to unlock it:\n\n%s/unlock?token=%s\n\n%s\n",
+			user.Username, s.publicUrl, token, hint),
+	})
+}
+
+func (s *serviceImpl) UnlockAccount(token string) error {
+	userId, key, err := s.tokens.VerifyToken(purposeUnlockAccount, token)
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	if err := store.ResetLoginAttempts(key); err != nil {
+		log.Errorf("Could not unlock user with id='%s': %s", userId, err.Error())
+		return err
+	}
+
+	log.Infof("Unlocked user with id='%s'", userId)
+	return nil
+}
+
+func (s *serviceImpl) GetUser(userId string) (*User, error) {
+	if !bson.IsObjectIdHex(userId) {
+		return nil, ErrUserNotFound
+	}
+
+	user, err := store.FindUserById(bson.ObjectIdHex(userId))
+	if err != nil || user == nil {
+		log.Infof("user with id='%s' not found", userId)
+		return nil, ErrUserNotFound
+	}
+
+	return user, nil
+}
+
+func (s *serviceImpl) GetUserByUsername(username string) (*User, error) {
+	user, err := store.FindUserByUsername(username)
+	if err != nil || user == nil {
+		log.Infof("user with username='%s' not found", username)
+		return nil, ErrUserNotFound
+	}
+
+	return user, nil
+}
+
+func (s *serviceImpl) SetQuota(userId string, quota *Quota) error {
+	if !bson.IsObjectIdHex(userId) {
+		return ErrUserNotFound
+	}
+
+	if err := store.UpdateQuota(bson.ObjectIdHex(userId), quota); err != nil {
+		log.Errorf("Could not update quota of user with id='%s': %s", userId, err.Error())
+		return err
+	}
+
+	return nil
+}
+
+func (s *serviceImpl) UpdateProfile(userId string, dto ProfileDTO) (*User, error) {
+	user, err := s.GetUser(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	emailChanged := false
+	if dto.Email != nil {
+		if *dto.Email == "" {
+			return nil, ErrEmailRequired
+		}
+		emailChanged = *dto.Email != user.Email
+		user.Email = *dto.Email
+	}
+	if emailChanged {
+		if err := s.reauthenticate(user, dto.Reauthentication); err != nil {
+			log.Warnf("refused email change of user with id='%s': %s", userId, err.Error())
+			return nil, err
+		}
+	}
+	if dto.DisplayName != nil {
+		user.DisplayName = *dto.DisplayName
+	}
+	if emailChanged {
+		user.EmailVerified = false
+	}
+
+	if err := store.UpdateProfile(user); err != nil {
+		log.Errorf("Could not update profile of user with id='%s': %s", userId, err.Error())
+		return nil, err
+	}
+
+	if emailChanged {
+		// the user can request another mail if this one fails
+		s.sendVerification(user)
 	}
 
 	return user, nil
 }
 
-func InitService() Service {
-	service = &serviceImpl{}
+func (s *serviceImpl) ChangePassword(userId string, currentPassword string, newPassword string) error {
+	user, err := s.GetUser(userId)
+	if err != nil {
+		return err
+	}
+
+	if err := s.checkPassword(user, currentPassword); err != nil {
+		return err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	if err := store.UpdatePassword(user.Id, string(hash)); err != nil {
+		log.Errorf("Could not change password of user with id='%s': %s", userId, err.Error())
+		return err
+	}
+
+	log.Infof("Changed password of user with id='%s'", userId)
+	s.passwordChanged(userId)
+	return nil
+}
+
+func (s *serviceImpl) DeleteUser(userId string) error {
+	user, err := s.GetUser(userId)
+	if err != nil {
+		return err
+	}
+
+	for _, hook := range s.deleteHooks {
+		if err := hook(userId); err != nil {
+			log.Errorf("Could not delete user with id='%s': %s", userId, err.Error())
+			return err
+		}
+	}
+
+	if err := store.DeleteUser(user.Id); err != nil {
+		log.Errorf("Could not delete user with id='%s': %s", userId, err.Error())
+		return err
+	}
+	if err := store.ResetLoginAttempts(usernameKey(user.Username)); err != nil {
+		log.Warnf("Could not reset failed logins of user with username='%s': %s", user.Username, err.Error())
+	}
+	s.resetMfaFailures(user)
+
+	log.Infof("Deleted user with id='%s'", userId)
+	return nil
+}
+
+func (s *serviceImpl) OnDelete(hook func(userId string) error) {
+	s.deleteHooks = append(s.deleteHooks, hook)
+}
+
+func (s *serviceImpl) ListUsers() ([]*User, error) {
+	users, err := store.FindUsers()
+	if err != nil {
+		log.Errorf("Could not list users: %s", err.Error())
+	}
+	return users, err
+}
+
+func (s *serviceImpl) SetRoles(userId string, roles []string) error {
+	for _, role := range roles {
+		if !isKnownRole(role) {
+			return ErrUnknownRole
+		}
+	}
+
+	user, err := s.GetUser(userId)
+	if err != nil {
+		return err
+	}
+
+	if err := store.UpdateRoles(user.Id, roles); err != nil {
+		log.Errorf("Could not update roles of user with id='%s': %s", userId, err.Error())
+		return err
+	}
+
+	log.Infof("Set roles of user with id='%s' to %v", userId, roles)
+	return nil
+}
+
+func (s *serviceImpl) GrantRole(username string, role string) error {
+	user, err := store.FindUserByUsername(username)
+	if err != nil || user == nil {
+		return ErrUserNotFound
+	}
+	if user.HasRole(role) {
+		return nil
+	}
+
+	return s.SetRoles(user.Id.Hex(), append(user.Roles, role))
+}
+
+func (s *serviceImpl) SetDisabled(userId string, disabled bool) error {
+	user, err := s.GetUser(userId)
+	if err != nil {
+		return err
+	}
+
+	if err := store.UpdateDisabled(user.Id, disabled); err != nil {
+		log.Errorf("Could not update user with id='%s': %s", userId, err.Error())
+		return err
+	}
+
+	if !disabled {
+		log.Infof("Enabled user with id='%s'", userId)
+		return nil
+	}
+
+	log.Infof("Disabled user with id='%s'", userId)
+	for _, hook := range s.disabledHooks {
+		hook(userId)
+	}
+	return nil
+}
+
+func (s *serviceImpl) OnDisabled(hook func(userId string)) {
+	s.disabledHooks = append(s.disabledHooks, hook)
+}
+
+func isKnownRole(role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *serviceImpl) EnrollTotp(userId string) (*TotpEnrollment, error) {
+	user, err := s.GetUser(userId)
+	if err != nil {
+		return nil, err
+	}
+	if user.MfaEnabled() {
+		return nil, ErrTotpAlreadyEnabled
+	}
+
+	secret, err := newTotpSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := store.UpdateMfa(user.Id, &Mfa{TotpSecret: secret}); err != nil {
+		log.Errorf("Could not store totp secret of user with id='%s': %s", userId, err.Error())
+		return nil, err
+	}
+
+	return &TotpEnrollment{Secret: secret, Uri: totpUri(secret, user.Username)}, nil
+}
+
+func (s *serviceImpl) ConfirmTotp(userId string, code string) ([]string, error) {
+	user, err := s.GetUser(userId)
+	if err != nil {
+		return nil, err
+	}
+	if user.MfaEnabled() {
+		return nil, ErrTotpAlreadyEnabled
+	}
+	if user.Mfa == nil {
+		return nil, ErrTotpNotEnrolled
+	}
+
+	step, ok := matchTotp(user.Mfa.TotpSecret, code, time.Now(), user.Mfa.LastTotpStep)
+	if !ok {
+		return nil, ErrInvalidTotp
+	}
+
+	recoveryCodes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]string, 0, len(recoveryCodes))
+	for _, recoveryCode := range recoveryCodes {
+		hash, err := bcrypt.GenerateFromPassword([]byte(recoveryCode), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, string(hash))
+	}
+
+	user.Mfa.TotpEnabled = true
+	user.Mfa.LastTotpStep = step
+	user.Mfa.RecoveryCodes = hashes
+	if err := store.UpdateMfa(user.Id, user.Mfa); err != nil {
+		log.Errorf("Could not enable totp of user with id='%s': %s", userId, err.Error())
+		return nil, err
+	}
+
+	log.Infof("Enabled totp for user with id='%s'", userId)
+	return recoveryCodes, nil
+}
+
+func (s *serviceImpl) DisableTotp(userId string, code string) error {
+	user, _, err := s.mfaUser(userId)
+	if err != nil {
+		return err
+	}
+	if err := s.verifyMfa(user, code); err != nil {
+		return err
+	}
+
+	if err := store.UpdateMfa(user.Id, nil); err != nil {
+		log.Errorf("Could not disable totp of user with id='%s': %s", userId, err.Error())
+		return err
+	}
+
+	log.Infof("Disabled totp for user with id='%s'", userId)
+	return nil
+}
+
+func (s *serviceImpl) VerifyMfa(userId string, code string, firstStep time.Time) error {
+	user, attempts, err := s.mfaUser(userId)
+	if err != nil {
+		return err
+	}
+	if attempts != nil && !attempts.LastFailure.Before(firstStep) {
+		log.Warnf("mfa code for a failed login of user with id='%s'", userId)
+		return ErrLoginExpired
+	}
+
+	return s.verifyMfa(user, code)
+}
+
+// mfaUser returns the user for a check of the second factor, unless it has to wait after failed codes.
+func (s *serviceImpl) mfaUser(userId string) (*User, *LoginAttempts, error) {
+	user, err := s.GetUser(userId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if user.Disabled {
+		return nil, nil, ErrUserDisabled
+	}
+	if !user.MfaEnabled() {
+		return nil, nil, ErrTotpNotEnrolled
+	}
+
+	attempts, err := s.checkMfaThrottle(user)
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, attempts, nil
+}
+
+// verifyMfa accepts a TOTP code or one of the recovery codes and counts the failed codes.
+func (s *serviceImpl) verifyMfa(user *User, code string) error {
+	if err := s.verifyTotp(user, code); err != ErrInvalidTotp {
+		if err == nil {
+			s.resetMfaFailures(user)
+		}
+		return err
+	}
+
+	for i, hash := range user.Mfa.RecoveryCodes {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(code)) != nil {
+			continue
+		}
+
+		user.Mfa.RecoveryCodes = append(user.Mfa.RecoveryCodes[:i], user.Mfa.RecoveryCodes[i+1:]...)
+		if err := store.UpdateMfa(user.Id, user.Mfa); err != nil {
+			return err
+		}
+		log.Warnf("User with id='%s' used a recovery code, %d left", user.Id.Hex(), len(user.Mfa.RecoveryCodes))
+		s.resetMfaFailures(user)
+		return nil
+	}
+
+	log.Warnf("invalid mfa code for user with id='%s'", user.Id.Hex())
+	s.recordMfaFailure(user)
+	return ErrInvalidTotp
+}
+
+func (s *serviceImpl) RequireTotp(userId string, code string) error {
+	user, err := s.GetUser(userId)
+	if err != nil {
+		return err
+	}
+	if !user.MfaEnabled() {
+		return nil
+	}
+	return s.requireTotp(user, code)
+}
+
+// requireTotp verifies the code against the enabled secret and counts the failed codes.
+func (s *serviceImpl) requireTotp(user *User, code string) error {
+	if code == "" {
+		return ErrTotpRequired
+	}
+	if _, err := s.checkMfaThrottle(user); err != nil {
+		return err
+	}
+
+	if err := s.verifyTotp(user, code); err != nil {
+		if err == ErrInvalidTotp {
+			log.Warnf("invalid totp code for user with id='%s'", user.Id.Hex())
+			s.recordMfaFailure(user)
+		}
+		return err
+	}
+	s.resetMfaFailures(user)
+	return nil
+}
+
+func (s *serviceImpl) IssueStepUpToken(userId string) (string, error) {
+	// the issue time tells the tokens apart, only tokens issued after the last used one are accepted
+	return s.tokens.SignToken(purposeStepUp, userId, strconv.FormatInt(time.Now().UnixNano(), 10), stepUpTtl)
+}
+
+func (s *serviceImpl) RequireStepUp(userId string, code string, stepUpToken string) error {
+	user, err := s.GetUser(userId)
+	if err != nil {
+		return err
+	}
+	if stepUpToken != "" {
+		return s.useStepUpToken(user, stepUpToken)
+	}
+	if user.MfaEnabled() {
+		return s.requireTotp(user, code)
+	}
+
+	for _, hasFactor := range s.stepUpFactors {
+		has, err := hasFactor(userId)
+		if err != nil {
+			return err
+		}
+		if has {
+			return ErrStepUpRequired
+		}
+	}
+	return nil
+}
+
+func (s *serviceImpl) RegisterStepUpFactor(hasFactor func(userId string) (bool, error)) {
+	s.stepUpFactors = append(s.stepUpFactors, hasFactor)
+}
+
+func (s *serviceImpl) Reauthenticate(userId string, proof Reauthentication) error {
+	user, err := s.GetUser(userId)
+	if err != nil {
+		return err
+	}
+	return s.reauthenticate(user, proof)
+}
+
+func (s *serviceImpl) reauthenticate(user *User, proof Reauthentication) error {
+	switch {
+	case proof.StepUpToken != "":
+		return s.useStepUpToken(user, proof.StepUpToken)
+	case proof.Totp != "" && user.MfaEnabled():
+		return s.requireTotp(user, proof.Totp)
+	case proof.CurrentPassword != "":
+		return s.checkPassword(user, proof.CurrentPassword)
+	}
+	return ErrReauthRequired
+}
+
+// useStepUpToken accepts a step-up token of the user, each token only once.
+func (s *serviceImpl) useStepUpToken(user *User, token string) error {
+	subject, fingerprint, err := s.tokens.VerifyToken(purposeStepUp, token)
+	if err != nil || subject != user.Id.Hex() {
+		return ErrInvalidStepUp
+	}
+	issued, err := strconv.ParseInt(fingerprint, 10, 64)
+	if err != nil {
+		return ErrInvalidStepUp
+	}
+
+	if err := store.UseStepUp(user.Id, issued); err != nil {
+		log.Warnf("reused step-up token of user with id='%s': %s", user.Id.Hex(), err.Error())
+		return ErrInvalidStepUp
+	}
+	return nil
+}
+
+// checkPassword verifies the password of a logged in user. Like failed logins, failed passwords are throttled and
+// eventually lock the account.
+func (s *serviceImpl) checkPassword(user *User, password string) error {
+	if err := s.checkThrottle(user.Username, ""); err != nil {
+		return err
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+		log.Warnf("invalid password of logged in user with id='%s'", user.Id.Hex())
+		s.recordFailure(user, user.Username, "")
+		return ErrInvalidPassword
+	}
+	return nil
+}
+
+// verifyTotp checks the code against the enabled secret and remembers its time step to prevent a replay.
+func (s *serviceImpl) verifyTotp(user *User, code string) error {
+	step, ok := matchTotp(user.Mfa.TotpSecret, code, time.Now(), user.Mfa.LastTotpStep)
+	if !ok {
+		return ErrInvalidTotp
+	}
+
+	user.Mfa.LastTotpStep = step
+	return store.UpdateMfa(user.Id, user.Mfa)
+}
+
+func (s *serviceImpl) SendVerification(userId string) error {
+	user, err := s.GetUser(userId)
+	if err != nil {
+		return err
+	}
+	if user.EmailVerified {
+		return nil
+	}
+	return s.sendVerification(user)
+}
+
+func (s *serviceImpl) sendVerification(user *User) error {
+	token, err := s.tokens.SignToken(purposeVerifyEmail, user.Id.Hex(), user.Email, verifyEmailTtl)
+	if err != nil {
+		log.Errorf("Could not sign verification token for user with id='%s': %s", user.Id.Hex(), err.Error())
+		return err
+	}
+
+	return s.mailer.Send(mail.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nplease verify your email address by opening the following link within %s:\n\n%s/verify-email?token=%s\n",
+			user.Username, verifyEmailTtl, s.publicUrl, token),
+	})
+}
+
+func (s *serviceImpl) VerifyEmail(token string) error {
+	userId, email, err := s.tokens.VerifyToken(purposeVerifyEmail, token)
+	if err != nil || !bson.IsObjectIdHex(userId) {
+		return ErrInvalidToken
+	}
+
+	if err := store.SetEmailVerified(bson.ObjectIdHex(userId), email); err != nil {
+		log.Infof("Could not verify email of user with id='%s': %s", userId, err.Error())
+		return ErrInvalidToken
+	}
+
+	log.Infof("Verified email of user with id='%s'", userId)
+	return nil
+}
+
+func (s *serviceImpl) ForgotPassword(email string) error {
+	users, err := store.FindUsersByEmail(email)
+	if err != nil {
+		return err
+	}
+	if len(users) == 0 {
+		log.Info("Password reset requested for unknown email")
+	}
+
+	for _, user := range users {
+		// the address might belong to someone else, e.g. after a typo or if it was changed to take over the account
+		if !user.EmailVerified {
+			log.Infof("Password reset not sent to the unverified email of user with id='%s'", user.Id.Hex())
+			continue
+		}
+		token, err := s.tokens.SignToken(purposeResetPassword, user.Id.Hex(), passwordFingerprint(user), resetPasswordTtl)
+		if err != nil {
+			return err
+		}
+
+		err = s.mailer.Send(mail.Message{
+			To:      user.Email,
+			Subject: "Reset your password",
+			Body: fmt.Sprintf("Hi %s,\n\na password reset was requested for your account. Open the following link within %s to choose a new password:\n\n%s/reset-password?token=%s\n\nIf you did not request it, just ignore this mail.\n",
+				user.Username, resetPasswordTtl, s.publicUrl, token),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *serviceImpl) ResetPassword(token string, password string) error {
+	userId, fingerprint, err := s.tokens.VerifyToken(purposeResetPassword, token)
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	user, err := s.GetUser(userId)
+	if err != nil || passwordFingerprint(user) != fingerprint {
+		// the password has been changed since the token was issued, so it has already been used
+		return ErrInvalidToken
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	if err := store.UpdatePassword(user.Id, string(hash)); err != nil {
+		log.Errorf("Could not reset password of user with id='%s': %s", userId, err.Error())
+		return err
+	}
+
+	log.Infof("Reset password of user with id='%s'", userId)
+	s.passwordChanged(userId)
+	return nil
+}
+
+func (s *serviceImpl) OnPasswordChanged(hook func(userId string)) {
+	s.passwordChangedHooks = append(s.passwordChangedHooks, hook)
+}
+
+func (s *serviceImpl) passwordChanged(userId string) {
+	for _, hook := range s.passwordChangedHooks {
+		hook(userId)
+	}
+}
+
+// passwordFingerprint identifies the current password hash without revealing it.
+func passwordFingerprint(user *User) string {
+	sum := sha256.Sum256([]byte(user.Password))
+	return hex.EncodeToString(sum[:8])
+}
+
+func InitService(mailer mail.Mailer, tokens TokenSigner) Service {
+	service = &serviceImpl{
+		mailer:    mailer,
+		tokens:    tokens,
+		publicUrl: config.Get().Server.PublicUrl,
+		lockout:   config.Get().Auth.Lockout,
+	}
 	return service
 }
@@ -0,0 +1,671 @@
+package user
+
+import (
+	"errors"
+	"fmt"
+	"github.com/iridiumdev/webwallet-core/config"
+	"github.com/iridiumdev/webwallet-core/mail"
+	"gopkg.in/mgo.v2/bson"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeStore keeps the users in memory.
+type fakeStore struct {
+	users    map[bson.ObjectId]*User
+	attempts map[string]*LoginAttempts
+}
+
+func (s *fakeStore) InsertUser(user *User) error {
+	for _, existing := range s.users {
+		if existing.Username == user.Username {
+			return errors.New("duplicate username")
+		}
+	}
+	stored := *user
+	s.users[user.Id] = &stored
+	return nil
+}
+
+func (s *fakeStore) FindUserByUsername(username string) (*User, error) {
+	for _, user := range s.users {
+		if user.Username == username {
+			found := *user
+			return &found, nil
+		}
+	}
+	return nil, errors.New("not found")
+}
+
+func (s *fakeStore) FindUserById(userId bson.ObjectId) (*User, error) {
+	user, ok := s.users[userId]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	found := *user
+	return &found, nil
+}
+
+func (s *fakeStore) UpdateQuota(userId bson.ObjectId, quota *Quota) error {
+	s.users[userId].Quota = quota
+	return nil
+}
+
+func (s *fakeStore) UpdateMfa(userId bson.ObjectId, mfa *Mfa) error {
+	s.users[userId].Mfa = mfa
+	return nil
+}
+
+func (s *fakeStore) UseStepUp(userId bson.ObjectId, issued int64) error {
+	user := s.users[userId]
+	if issued <= user.LastStepUp {
+		return errors.New("not found")
+	}
+	user.LastStepUp = issued
+	return nil
+}
+
+func (s *fakeStore) FindUsersByEmail(email string) ([]*User, error) {
+	var result []*User
+	for _, user := range s.users {
+		if user.Email == email {
+			found := *user
+			result = append(result, &found)
+		}
+	}
+	return result, nil
+}
+
+func (s *fakeStore) SetEmailVerified(userId bson.ObjectId, email string) error {
+	user, ok := s.users[userId]
+	if !ok || user.Email != email {
+		return errors.New("not found")
+	}
+	user.EmailVerified = true
+	return nil
+}
+
+func (s *fakeStore) UpdatePassword(userId bson.ObjectId, hash string) error {
+	s.users[userId].Password = hash
+	return nil
+}
+
+func (s *fakeStore) UpdateProfile(user *User) error {
+	stored := *user
+	s.users[user.Id] = &stored
+	return nil
+}
+
+func (s *fakeStore) DeleteUser(userId bson.ObjectId) error {
+	delete(s.users, userId)
+	return nil
+}
+
+func (s *fakeStore) FindUsers() ([]*User, error) {
+	var result []*User
+	for _, user := range s.users {
+		found := *user
+		result = append(result, &found)
+	}
+	return result, nil
+}
+
+func (s *fakeStore) UpdateRoles(userId bson.ObjectId, roles []string) error {
+	s.users[userId].Roles = roles
+	return nil
+}
+
+func (s *fakeStore) UpdateDisabled(userId bson.ObjectId, disabled bool) error {
+	s.users[userId].Disabled = disabled
+	return nil
+}
+
+func (s *fakeStore) FindUserByIdentity(issuer string, subject string) (*User, error) {
+	for _, user := range s.users {
+		for _, identity := range user.Identities {
+			if identity.Issuer == issuer && identity.Subject == subject {
+				found := *user
+				return &found, nil
+			}
+		}
+	}
+	return nil, errors.New("not found")
+}
+
+func (s *fakeStore) AddIdentity(userId bson.ObjectId, identity *Identity) error {
+	s.users[userId].Identities = append(s.users[userId].Identities, identity)
+	return nil
+}
+
+func (s *fakeStore) FindLoginAttempts(key string) (*LoginAttempts, error) {
+	return s.attempts[key], nil
+}
+
+func (s *fakeStore) RecordLoginFailure(key string, expires time.Time) (*LoginAttempts, error) {
+	attempts, ok := s.attempts[key]
+	if !ok {
+		attempts = &LoginAttempts{Key: key}
+		s.attempts[key] = attempts
+	}
+	attempts.Failures++
+	attempts.LastFailure = time.Now()
+	attempts.Expires = expires
+	found := *attempts
+	return &found, nil
+}
+
+func (s *fakeStore) LockLogin(key string, until time.Time) error {
+	s.attempts[key].LockedUntil = until
+	return nil
+}
+
+func (s *fakeStore) ResetLoginAttempts(key string) error {
+	delete(s.attempts, key)
+	return nil
+}
+
+type fakeMailer struct {
+	sent []mail.Message
+}
+
+func (m *fakeMailer) Send(message mail.Message) error {
+	m.sent = append(m.sent, message)
+	return nil
+}
+
+// token of the last mail sent
+func (m *fakeMailer) token() string {
+	body := m.sent[len(m.sent)-1].Body
+	return strings.Fields(body[strings.Index(body, "token=")+len("token="):])[0]
+}
+
+// fakeTokens issues unsigned tokens in the form purpose|subject|fingerprint.
+type fakeTokens struct{}
+
+func (t *fakeTokens) SignToken(purpose string, subject string, fingerprint string, ttl time.Duration) (string, error) {
+	return strings.Join([]string{purpose, subject, fingerprint}, "|"), nil
+}
+
+func (t *fakeTokens) VerifyToken(purpose string, token string) (string, string, error) {
+	parts := strings.Split(token, "|")
+	if len(parts) != 3 || parts[0] != purpose {
+		return "", "", errors.New("invalid token")
+	}
+	return parts[1], parts[2], nil
+}
+
+func newTestService() (*serviceImpl, *fakeMailer) {
+	store = &fakeStore{users: make(map[bson.ObjectId]*User), attempts: make(map[string]*LoginAttempts)}
+	mailer := &fakeMailer{}
+	return &serviceImpl{
+		mailer:    mailer,
+		tokens:    &fakeTokens{},
+		publicUrl: "https://wallet.ird.cash",
+		lockout: config.Lockout{
+			FreeAttempts:      3,
+			IpFreeAttempts:    5,
+			BackoffSeconds:    1,
+			MaxBackoffSeconds: 60,
+			MaxFailures:       3,
+			LockoutMinutes:    30,
+			WindowMinutes:     60,
+		},
+	}, mailer
+}
+
+func TestCreateUserSendsVerificationMail(t *testing.T) {
+	s, mailer := newTestService()
+
+	user, err := s.CreateUser(RegistrationDTO{Username: "jdoe", Email: "jdoe@foobar.com", Password: "secr3tPw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.EmailVerified {
+		t.Error("expected email of a new user to be unverified")
+	}
+
+	if len(mailer.sent) != 1 || mailer.sent[0].To != "jdoe@foobar.com" {
+		t.Fatalf("expected verification mail to jdoe@foobar.com, got %v", mailer.sent)
+	}
+	if !strings.Contains(mailer.sent[0].Body, "https://wallet.ird.cash/verify-email?token=") {
+		t.Errorf("expected verification link, got %s", mailer.sent[0].Body)
+	}
+
+	if err := s.VerifyEmail(mailer.token()); err != nil {
+		t.Fatal(err)
+	}
+	if verified, _ := s.GetUser(user.Id.Hex()); !verified.EmailVerified {
+		t.Error("expected email to be verified")
+	}
+
+	if err := s.VerifyEmail("reset-password|" + user.Id.Hex() + "|jdoe@foobar.com"); err != ErrInvalidToken {
+		t.Errorf("expected %v for a token of another purpose, got %v", ErrInvalidToken, err)
+	}
+}
+
+func TestResetPasswordOnlyOnce(t *testing.T) {
+	s, mailer := newTestService()
+	user, _ := s.CreateUser(RegistrationDTO{Username: "jdoe", Email: "jdoe@foobar.com", Password: "secr3tPw"})
+	s.VerifyEmail(mailer.token())
+
+	var changed []string
+	s.OnPasswordChanged(func(userId string) {
+		changed = append(changed, userId)
+	})
+
+	if err := s.ForgotPassword("jdoe@foobar.com"); err != nil {
+		t.Fatal(err)
+	}
+	token := mailer.token()
+
+	if err := s.ResetPassword(token, "n3wSecr3tPw"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AuthenticateUser(Login{Username: "jdoe", Password: "n3wSecr3tPw"}, ""); err != nil {
+		t.Errorf("expected new password to be valid, got %v", err)
+	}
+	if len(changed) != 1 || changed[0] != user.Id.Hex() {
+		t.Errorf("expected password changed hook to be called for %s, got %v", user.Id.Hex(), changed)
+	}
+
+	if err := s.ResetPassword(token, "an0therPw"); err != ErrInvalidToken {
+		t.Errorf("expected used token to be rejected, got %v", err)
+	}
+}
+
+func TestChangePasswordChecksCurrentPassword(t *testing.T) {
+	s, _ := newTestService()
+	user, _ := s.CreateUser(RegistrationDTO{Username: "jdoe", Email: "jdoe@foobar.com", Password: "secr3tPw"})
+
+	changed := 0
+	s.OnPasswordChanged(func(userId string) {
+		changed++
+	})
+
+	if err := s.ChangePassword(user.Id.Hex(), "wrong", "n3wSecr3tPw"); err != ErrInvalidPassword {
+		t.Errorf("expected %v, got %v", ErrInvalidPassword, err)
+	}
+	if err := s.ChangePassword(user.Id.Hex(), "secr3tPw", "n3wSecr3tPw"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.AuthenticateUser(Login{Username: "jdoe", Password: "n3wSecr3tPw"}, ""); err != nil {
+		t.Errorf("expected new password to be valid, got %v", err)
+	}
+	if changed != 1 {
+		t.Errorf("expected password changed hook to be called once, got %d", changed)
+	}
+}
+
+func TestUpdateProfileResetsVerifiedEmail(t *testing.T) {
+	s, mailer := newTestService()
+	user, _ := s.CreateUser(RegistrationDTO{Username: "jdoe", Email: "jdoe@foobar.com", Password: "secr3tPw"})
+	s.VerifyEmail(mailer.token())
+
+	displayName := "John Doe"
+	updated, err := s.UpdateProfile(user.Id.Hex(), ProfileDTO{DisplayName: &displayName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.DisplayName != displayName || !updated.EmailVerified || len(mailer.sent) != 1 {
+		t.Errorf("expected only the display name to change, got %+v", updated)
+	}
+
+	email := "john@foobar.com"
+	if _, err := s.UpdateProfile(user.Id.Hex(), ProfileDTO{Email: &email}); err != ErrReauthRequired {
+		t.Errorf("expected the email change to need the password, got %v", err)
+	}
+	wrong := Reauthentication{CurrentPassword: "wrong"}
+	if _, err := s.UpdateProfile(user.Id.Hex(), ProfileDTO{Reauthentication: wrong, Email: &email}); err != ErrInvalidPassword {
+		t.Errorf("expected %v, got %v", ErrInvalidPassword, err)
+	}
+	proof := Reauthentication{CurrentPassword: "secr3tPw"}
+	updated, err = s.UpdateProfile(user.Id.Hex(), ProfileDTO{Reauthentication: proof, Email: &email})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Email != email || updated.EmailVerified || updated.DisplayName != displayName {
+		t.Errorf("expected new email to be unverified, got %+v", updated)
+	}
+	if len(mailer.sent) != 2 || mailer.sent[1].To != email {
+		t.Errorf("expected verification mail to %s, got %v", email, mailer.sent)
+	}
+
+	empty := ""
+	if _, err := s.UpdateProfile(user.Id.Hex(), ProfileDTO{Email: &empty}); err != ErrEmailRequired {
+		t.Errorf("expected %v, got %v", ErrEmailRequired, err)
+	}
+}
+
+func TestDeleteUserAbortsOnFailingHook(t *testing.T) {
+	s, _ := newTestService()
+	user, _ := s.CreateUser(RegistrationDTO{Username: "jdoe", Email: "jdoe@foobar.com", Password: "secr3tPw"})
+
+	hookErr := errors.New("wallet is busy")
+	s.OnDelete(func(userId string) error {
+		return hookErr
+	})
+
+	if err := s.DeleteUser(user.Id.Hex()); err != hookErr {
+		t.Errorf("expected %v, got %v", hookErr, err)
+	}
+	if _, err := s.GetUser(user.Id.Hex()); err != nil {
+		t.Errorf("expected user to be kept, got %v", err)
+	}
+
+	s.deleteHooks = nil
+	if err := s.DeleteUser(user.Id.Hex()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetUser(user.Id.Hex()); err != ErrUserNotFound {
+		t.Errorf("expected user to be deleted, got %v", err)
+	}
+}
+
+func TestDisabledUserCanNotLogIn(t *testing.T) {
+	s, _ := newTestService()
+	user, _ := s.CreateUser(RegistrationDTO{Username: "jdoe", Email: "jdoe@foobar.com", Password: "secr3tPw"})
+
+	var disabled []string
+	s.OnDisabled(func(userId string) {
+		disabled = append(disabled, userId)
+	})
+
+	if err := s.SetDisabled(user.Id.Hex(), true); err != nil {
+		t.Fatal(err)
+	}
+	if len(disabled) != 1 || disabled[0] != user.Id.Hex() {
+		t.Errorf("expected disabled hook to be called for %s, got %v", user.Id.Hex(), disabled)
+	}
+	if _, err := s.AuthenticateUser(Login{Username: "jdoe", Password: "secr3tPw"}, ""); err != ErrUserDisabled {
+		t.Errorf("expected %v, got %v", ErrUserDisabled, err)
+	}
+
+	if err := s.SetDisabled(user.Id.Hex(), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AuthenticateUser(Login{Username: "jdoe", Password: "secr3tPw"}, ""); err != nil {
+		t.Errorf("expected enabled user to log in, got %v", err)
+	}
+	if len(disabled) != 1 {
+		t.Errorf("expected disabled hook not to be called on enable, got %v", disabled)
+	}
+}
+
+func TestGrantRole(t *testing.T) {
+	s, _ := newTestService()
+	user, _ := s.CreateUser(RegistrationDTO{Username: "jdoe", Email: "jdoe@foobar.com", Password: "secr3tPw"})
+
+	for i := 0; i < 2; i++ {
+		if err := s.GrantRole("jdoe", RoleAdmin); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if admin, _ := s.GetUser(user.Id.Hex()); len(admin.Roles) != 1 || !admin.HasRole(RoleAdmin) {
+		t.Errorf("expected user to be admin once, got %v", admin.Roles)
+	}
+
+	if err := s.GrantRole("nobody", RoleAdmin); err != ErrUserNotFound {
+		t.Errorf("expected %v, got %v", ErrUserNotFound, err)
+	}
+	if err := s.SetRoles(user.Id.Hex(), []string{"superuser"}); err != ErrUnknownRole {
+		t.Errorf("expected %v, got %v", ErrUnknownRole, err)
+	}
+}
+
+func TestAuthenticateExternalLinksVerifiedEmail(t *testing.T) {
+	s, _ := newTestService()
+	user, _ := s.CreateUser(RegistrationDTO{Username: "jdoe", Email: "jdoe@foobar.com", Password: "secr3tPw"})
+	login := ExternalLogin{Issuer: "https://idp.foobar.com", Subject: "248289761001", Email: "jdoe@foobar.com", EmailVerified: true}
+
+	if _, err := s.AuthenticateExternal(login); err != ErrUserNotFound {
+		t.Errorf("expected unverified local email not to be linked, got %v", err)
+	}
+	store.SetEmailVerified(user.Id, user.Email)
+
+	unverified := login
+	unverified.EmailVerified = false
+	if _, err := s.AuthenticateExternal(unverified); err != ErrEmailNotVerified {
+		t.Errorf("expected %v, got %v", ErrEmailNotVerified, err)
+	}
+
+	linked, err := s.AuthenticateExternal(login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if linked.Id != user.Id || len(linked.Identities) != 1 {
+		t.Errorf("expected identity to be linked to %s, got %+v", user.Id.Hex(), linked)
+	}
+
+	// once linked, the email of the identity does not matter anymore
+	login.Email = "john@other.com"
+	if again, err := s.AuthenticateExternal(login); err != nil || again.Id != user.Id {
+		t.Errorf("expected linked identity to log in as %s, got %v, %v", user.Id.Hex(), again, err)
+	}
+
+	s.SetDisabled(user.Id.Hex(), true)
+	if _, err := s.AuthenticateExternal(login); err != ErrUserDisabled {
+		t.Errorf("expected %v, got %v", ErrUserDisabled, err)
+	}
+}
+
+func TestRequireStepUpAcceptsTokenOnce(t *testing.T) {
+	s, _ := newTestService()
+	user, _ := s.CreateUser(RegistrationDTO{Username: "jdoe", Email: "jdoe@foobar.com", Password: "secr3tPw"})
+	store.UpdateMfa(user.Id, &Mfa{TotpSecret: "JBSWY3DPEHPK3PXP", TotpEnabled: true})
+
+	if err := s.RequireStepUp(user.Id.Hex(), "", ""); err != ErrTotpRequired {
+		t.Errorf("expected %v, got %v", ErrTotpRequired, err)
+	}
+
+	first, _ := s.IssueStepUpToken(user.Id.Hex())
+	second, _ := s.IssueStepUpToken(user.Id.Hex())
+	if err := s.RequireStepUp(user.Id.Hex(), "", second); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RequireStepUp(user.Id.Hex(), "", second); err != ErrInvalidStepUp {
+		t.Errorf("expected a used token to be refused, got %v", err)
+	}
+	if err := s.RequireStepUp(user.Id.Hex(), "", first); err != ErrInvalidStepUp {
+		t.Errorf("expected a token issued before the used one to be refused, got %v", err)
+	}
+
+	other, _ := s.IssueStepUpToken(bson.NewObjectId().Hex())
+	if err := s.RequireStepUp(user.Id.Hex(), "", other); err != ErrInvalidStepUp {
+		t.Errorf("expected the token of another user to be refused, got %v", err)
+	}
+}
+
+func TestRequireStepUpWithPasskeysButNoTotp(t *testing.T) {
+	s, _ := newTestService()
+	user, _ := s.CreateUser(RegistrationDTO{Username: "jdoe", Email: "jdoe@foobar.com", Password: "secr3tPw"})
+	if err := s.RequireStepUp(user.Id.Hex(), "", ""); err != nil {
+		t.Errorf("expected no step-up without a second factor, got %v", err)
+	}
+
+	s.RegisterStepUpFactor(func(userId string) (bool, error) {
+		return userId == user.Id.Hex(), nil
+	})
+	if err := s.RequireStepUp(user.Id.Hex(), "", ""); err != ErrStepUpRequired {
+		t.Errorf("expected %v, got %v", ErrStepUpRequired, err)
+	}
+	token, _ := s.IssueStepUpToken(user.Id.Hex())
+	if err := s.RequireStepUp(user.Id.Hex(), "", token); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RequireStepUp(user.Id.Hex(), "", token); err != ErrInvalidStepUp {
+		t.Errorf("expected a used token to be refused, got %v", err)
+	}
+}
+
+func TestReauthenticate(t *testing.T) {
+	s, _ := newTestService()
+	user, _ := s.CreateUser(RegistrationDTO{Username: "jdoe", Email: "jdoe@foobar.com", Password: "secr3tPw"})
+	userId := user.Id.Hex()
+
+	if err := s.Reauthenticate(userId, Reauthentication{}); err != ErrReauthRequired {
+		t.Errorf("expected %v, got %v", ErrReauthRequired, err)
+	}
+	if err := s.Reauthenticate(userId, Reauthentication{CurrentPassword: "secr3tPw"}); err != nil {
+		t.Errorf("expected the password to be accepted, got %v", err)
+	}
+	// a code is only accepted with TOTP enabled
+	if err := s.Reauthenticate(userId, Reauthentication{Totp: "123456"}); err != ErrReauthRequired {
+		t.Errorf("expected %v, got %v", ErrReauthRequired, err)
+	}
+	token, _ := s.IssueStepUpToken(userId)
+	if err := s.Reauthenticate(userId, Reauthentication{StepUpToken: token}); err != nil {
+		t.Errorf("expected the step-up token to be accepted, got %v", err)
+	}
+	if err := s.Reauthenticate(userId, Reauthentication{StepUpToken: token}); err != ErrInvalidStepUp {
+		t.Errorf("expected a used token to be refused, got %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := s.Reauthenticate(userId, Reauthentication{CurrentPassword: "wrong"}); err != ErrInvalidPassword {
+			t.Fatalf("expected %v, got %v", ErrInvalidPassword, err)
+		}
+	}
+	if _, ok := s.Reauthenticate(userId, Reauthentication{CurrentPassword: "secr3tPw"}).(*ThrottledError); !ok {
+		t.Error("expected failed passwords to be throttled like failed logins")
+	}
+}
+
+func TestFailedMfaCodesExpireLoginAndLockSecondFactor(t *testing.T) {
+	s, mailer := newTestService()
+	user, _ := s.CreateUser(RegistrationDTO{Username: "jdoe", Email: "jdoe@foobar.com", Password: "secr3tPw"})
+	secret := "JBSWY3DPEHPK3PXP"
+	store.UpdateMfa(user.Id, &Mfa{TotpSecret: secret, TotpEnabled: true})
+
+	login := time.Now()
+	if err := s.VerifyMfa(user.Id.Hex(), "wrong", login); err != ErrInvalidTotp {
+		t.Fatalf("expected %v, got %v", ErrInvalidTotp, err)
+	}
+	code, _ := totpCode(secret, totpStep(time.Now()))
+	if err := s.VerifyMfa(user.Id.Hex(), code, login); err != ErrLoginExpired {
+		t.Errorf("expected the login to expire after a wrong code, got %v", err)
+	}
+	if err := s.VerifyMfa(user.Id.Hex(), code, time.Now()); err != nil {
+		t.Errorf("expected a new login to succeed, got %v", err)
+	}
+
+	// failed codes on sends count as well, the password does not reset them
+	for i := 0; i < 3; i++ {
+		if err := s.RequireTotp(user.Id.Hex(), "wrong"); err != ErrInvalidTotp {
+			t.Fatalf("expected %v, got %v", ErrInvalidTotp, err)
+		}
+	}
+	if _, err := s.AuthenticateUser(Login{Username: "jdoe", Password: "secr3tPw"}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	err := s.VerifyMfa(user.Id.Hex(), code, time.Now())
+	if throttledErr, ok := err.(*ThrottledError); !ok || !throttledErr.Locked {
+		t.Fatalf("expected the second factor to be locked, got %v", err)
+	}
+	if _, ok := s.RequireTotp(user.Id.Hex(), code).(*ThrottledError); !ok {
+		t.Error("expected codes on sends to be refused while locked")
+	}
+	if last := mailer.sent[len(mailer.sent)-1]; last.Subject != "Your account has been locked" || !strings.Contains(last.Body, "knows your password") {
+		t.Fatalf("expected a lock mail, got %v", last)
+	}
+
+	if err := s.UnlockAccount(mailer.token()); err != nil {
+		t.Fatal(err)
+	}
+	code, _ = totpCode(secret, totpStep(time.Now())+1)
+	if err := s.VerifyMfa(user.Id.Hex(), code, time.Now()); err != nil {
+		t.Errorf("expected the unlocked second factor to accept codes, got %v", err)
+	}
+}
+
+func TestForgotPasswordIgnoresUnknownAndUnverifiedEmail(t *testing.T) {
+	s, mailer := newTestService()
+
+	if err := s.ForgotPassword("nobody@foobar.com"); err != nil {
+		t.Fatal(err)
+	}
+	if len(mailer.sent) != 0 {
+		t.Errorf("expected no mail, got %v", mailer.sent)
+	}
+
+	s.CreateUser(RegistrationDTO{Username: "jdoe", Email: "jdoe@foobar.com", Password: "secr3tPw"})
+	if err := s.ForgotPassword("jdoe@foobar.com"); err != nil {
+		t.Fatal(err)
+	}
+	if len(mailer.sent) != 1 {
+		t.Errorf("expected only the verification mail, got %v", mailer.sent)
+	}
+}
+
+func TestLockoutAfterMaxFailuresAndUnlockByMail(t *testing.T) {
+	s, mailer := newTestService()
+	s.CreateUser(RegistrationDTO{Username: "jdoe", Email: "jdoe@foobar.com", Password: "secr3tPw"})
+
+	for i := 0; i < 3; i++ {
+		if _, err := s.AuthenticateUser(Login{Username: "jdoe", Password: "wrong"}, "10.0.0.1"); err == nil {
+			t.Fatal("expected wrong password to fail")
+		}
+	}
+
+	_, err := s.AuthenticateUser(Login{Username: "jdoe", Password: "secr3tPw"}, "10.0.0.2")
+	throttledErr, ok := err.(*ThrottledError)
+	if !ok || !throttledErr.Locked || throttledErr.RetryAfter < 29*time.Minute {
+		t.Fatalf("expected account to be locked for 30 minutes, got %v", err)
+	}
+
+	if len(mailer.sent) != 2 || mailer.sent[1].Subject != "Your account has been locked" {
+		t.Fatalf("expected unlock mail, got %v", mailer.sent)
+	}
+	if err := s.UnlockAccount(mailer.token()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.AuthenticateUser(Login{Username: "jdoe", Password: "secr3tPw"}, "10.0.0.2"); err != nil {
+		t.Errorf("expected unlocked user to log in, got %v", err)
+	}
+}
+
+func TestIpIsThrottledAcrossUsernames(t *testing.T) {
+	s, _ := newTestService()
+
+	for i := 0; i < 6; i++ {
+		s.AuthenticateUser(Login{Username: fmt.Sprintf("user%d", i), Password: "wrong"}, "10.0.0.1")
+	}
+
+	if _, err := s.AuthenticateUser(Login{Username: "another", Password: "wrong"}, "10.0.0.1"); err == nil {
+		t.Fatal("expected login to fail")
+	} else if _, ok := err.(*ThrottledError); !ok {
+		t.Errorf("expected ip to be throttled, got %v", err)
+	}
+
+	if _, err := s.AuthenticateUser(Login{Username: "another", Password: "wrong"}, "10.0.0.2"); err != ErrUserNotFound {
+		t.Errorf("expected other ip not to be throttled, got %v", err)
+	}
+}
+
+func TestRetryAfterDoublesBackoff(t *testing.T) {
+	settings := config.Lockout{BackoffSeconds: 2, MaxBackoffSeconds: 10}
+	now := time.Now()
+
+	expected := map[int]time.Duration{
+		3: 0,
+		4: 2 * time.Second,
+		5: 4 * time.Second,
+		6: 8 * time.Second,
+		7: 10 * time.Second,
+		9: 10 * time.Second,
+	}
+	for failures, wait := range expected {
+		attempts := &LoginAttempts{Failures: failures, LastFailure: now}
+		if actual := retryAfter(attempts, 3, settings, now); actual != wait {
+			t.Errorf("expected to wait %s after %d failures, got %s", wait, failures, actual)
+		}
+	}
+
+	attempts := &LoginAttempts{Failures: 5, LastFailure: now.Add(-time.Minute)}
+	if actual := retryAfter(attempts, 3, settings, now); actual != 0 {
+		t.Errorf("expected backoff to be over, got %s", actual)
+	}
+}
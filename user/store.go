@@ -3,16 +3,40 @@ package user
 import (
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
+	"time"
 )
 
 type mongoDb struct {
-	db    *mgo.Database
-	users *mgo.Collection
+	db       *mgo.Database
+	users    *mgo.Collection
+	attempts *mgo.Collection
 }
 
 type Store interface {
 	InsertUser(user *User) error
 	FindUserByUsername(username string) (*User, error)
+	FindUserById(userId bson.ObjectId) (*User, error)
+	UpdateQuota(userId bson.ObjectId, quota *Quota) error
+	UpdateMfa(userId bson.ObjectId, mfa *Mfa) error
+	// UseStepUp remembers the issue time of a step-up token, unless a token issued at the same time or later has
+	// already been used.
+	UseStepUp(userId bson.ObjectId, issued int64) error
+	FindUsersByEmail(email string) ([]*User, error)
+	SetEmailVerified(userId bson.ObjectId, email string) error
+	UpdatePassword(userId bson.ObjectId, hash string) error
+	UpdateProfile(user *User) error
+	DeleteUser(userId bson.ObjectId) error
+	FindUsers() ([]*User, error)
+	UpdateRoles(userId bson.ObjectId, roles []string) error
+	UpdateDisabled(userId bson.ObjectId, disabled bool) error
+	FindUserByIdentity(issuer string, subject string) (*User, error)
+	AddIdentity(userId bson.ObjectId, identity *Identity) error
+
+	FindLoginAttempts(key string) (*LoginAttempts, error)
+	// RecordLoginFailure increments the failures of the key and returns the updated counter.
+	RecordLoginFailure(key string, expires time.Time) (*LoginAttempts, error)
+	LockLogin(key string, until time.Time) error
+	ResetLoginAttempts(key string) error
 }
 
 var store Store
@@ -28,8 +52,131 @@ func (db *mongoDb) FindUserByUsername(username string) (*User, error) {
 	return result, err
 }
 
+func (db *mongoDb) FindUserById(userId bson.ObjectId) (*User, error) {
+	var result *User
+	err := db.users.FindId(userId).One(&result)
+	return result, err
+}
+
+func (db *mongoDb) UpdateQuota(userId bson.ObjectId, quota *Quota) error {
+	if quota == nil {
+		return db.users.UpdateId(userId, bson.M{"$unset": bson.M{"quota": ""}})
+	}
+	return db.users.UpdateId(userId, bson.M{"$set": bson.M{"quota": quota}})
+}
+
+func (db *mongoDb) UpdateMfa(userId bson.ObjectId, mfa *Mfa) error {
+	if mfa == nil {
+		return db.users.UpdateId(userId, bson.M{"$unset": bson.M{"mfa": ""}})
+	}
+	return db.users.UpdateId(userId, bson.M{"$set": bson.M{"mfa": mfa}})
+}
+
+func (db *mongoDb) UseStepUp(userId bson.ObjectId, issued int64) error {
+	return db.users.Update(bson.M{
+		"_id": userId,
+		"$or": []bson.M{
+			{"lastStepUp": bson.M{"$lt": issued}},
+			{"lastStepUp": bson.M{"$exists": false}},
+		},
+	}, bson.M{"$set": bson.M{"lastStepUp": issued}})
+}
+
+func (db *mongoDb) FindUsersByEmail(email string) ([]*User, error) {
+	var result []*User
+	err := db.users.Find(bson.M{"email": email}).All(&result)
+	return result, err
+}
+
+// SetEmailVerified marks the email as verified, unless it has been changed in the meantime.
+func (db *mongoDb) SetEmailVerified(userId bson.ObjectId, email string) error {
+	return db.users.Update(bson.M{"_id": userId, "email": email}, bson.M{"$set": bson.M{"emailVerified": true}})
+}
+
+func (db *mongoDb) UpdatePassword(userId bson.ObjectId, hash string) error {
+	return db.users.UpdateId(userId, bson.M{"$set": bson.M{"password": hash}})
+}
+
+func (db *mongoDb) UpdateProfile(user *User) error {
+	return db.users.UpdateId(user.Id, bson.M{"$set": bson.M{
+		"email":         user.Email,
+		"displayName":   user.DisplayName,
+		"emailVerified": user.EmailVerified,
+	}})
+}
+
+func (db *mongoDb) DeleteUser(userId bson.ObjectId) error {
+	return db.users.RemoveId(userId)
+}
+
+func (db *mongoDb) FindUsers() ([]*User, error) {
+	result := []*User{}
+	err := db.users.Find(nil).Sort("username").All(&result)
+	return result, err
+}
+
+func (db *mongoDb) UpdateRoles(userId bson.ObjectId, roles []string) error {
+	return db.users.UpdateId(userId, bson.M{"$set": bson.M{"roles": roles}})
+}
+
+func (db *mongoDb) UpdateDisabled(userId bson.ObjectId, disabled bool) error {
+	return db.users.UpdateId(userId, bson.M{"$set": bson.M{"disabled": disabled}})
+}
+
+func (db *mongoDb) FindUserByIdentity(issuer string, subject string) (*User, error) {
+	var result *User
+	err := db.users.Find(bson.M{"identities": bson.M{"$elemMatch": bson.M{"issuer": issuer, "subject": subject}}}).One(&result)
+	return result, err
+}
+
+func (db *mongoDb) AddIdentity(userId bson.ObjectId, identity *Identity) error {
+	return db.users.UpdateId(userId, bson.M{"$push": bson.M{"identities": identity}})
+}
+
+func (db *mongoDb) FindLoginAttempts(key string) (*LoginAttempts, error) {
+	var result *LoginAttempts
+	err := db.attempts.FindId(key).One(&result)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	return result, err
+}
+
+func (db *mongoDb) RecordLoginFailure(key string, expires time.Time) (*LoginAttempts, error) {
+	var result *LoginAttempts
+	_, err := db.attempts.FindId(key).Apply(mgo.Change{
+		Update: bson.M{
+			"$inc": bson.M{"failures": 1},
+			"$set": bson.M{"lastFailure": time.Now()},
+			"$max": bson.M{"expires": expires},
+		},
+		Upsert:    true,
+		ReturnNew: true,
+	}, &result)
+	return result, err
+}
+
+func (db *mongoDb) LockLogin(key string, until time.Time) error {
+	return db.attempts.UpdateId(key, bson.M{
+		"$set": bson.M{"lockedUntil": until},
+		"$max": bson.M{"expires": until},
+	})
+}
+
+func (db *mongoDb) ResetLoginAttempts(key string) error {
+	err := db.attempts.RemoveId(key)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
 func InitStore(db *mgo.Database) {
 	usersCollection := db.C("users")
 	usersCollection.EnsureIndex(mgo.Index{Key: []string{"username"}, Unique: true})
-	store = &mongoDb{db: db, users: usersCollection}
+	usersCollection.EnsureIndex(mgo.Index{Key: []string{"email"}})
+	usersCollection.EnsureIndex(mgo.Index{Key: []string{"identities.issuer", "identities.subject"}, Unique: true, Sparse: true})
+	attemptsCollection := db.C("login_attempts")
+	attemptsCollection.EnsureIndex(mgo.Index{Key: []string{"expires"}, ExpireAfter: time.Second})
+	store = &mongoDb{db: db, users: usersCollection, attempts: attemptsCollection}
 }
@@ -0,0 +1,72 @@
+package user
+
+import (
+	"fmt"
+	"github.com/iridiumdev/webwallet-core/config"
+	"strings"
+	"time"
+)
+
+// LoginAttempts counts the failed logins of a username or client ip, or the failed second factor codes of a user. The
+// key is prefixed accordingly.
+type LoginAttempts struct {
+	Key         string    `bson:"_id"`
+	Failures    int       `bson:"failures"`
+	LastFailure time.Time `bson:"lastFailure"`
+	LockedUntil time.Time `bson:"lockedUntil"`
+	Expires     time.Time `bson:"expires"`
+}
+
+// ThrottledError is returned by AuthenticateUser while the username or client ip has to wait before the next attempt,
+// and by the second factor checks while the user has to wait before the next code.
+type ThrottledError struct {
+	RetryAfter time.Duration
+	Locked     bool
+}
+
+func (e *ThrottledError) Error() string {
+	if e.Locked {
+		return "account temporarily locked, check your mails to unlock it"
+	}
+	return fmt.Sprintf("too many failed login attempts, retry after %s", e.RetryAfter)
+}
+
+func usernameKey(username string) string {
+	return "username:" + strings.ToLower(username)
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+func mfaKey(userId string) string {
+	return "mfa:" + userId
+}
+
+// retryAfter returns how long the next attempt has to wait. Once the free attempts are used up, the backoff doubles
+// with each failure.
+func retryAfter(attempts *LoginAttempts, freeAttempts int, settings config.Lockout, now time.Time) time.Duration {
+	if attempts == nil {
+		return 0
+	}
+	if attempts.LockedUntil.After(now) {
+		return attempts.LockedUntil.Sub(now)
+	}
+	if attempts.Failures <= freeAttempts {
+		return 0
+	}
+
+	backoff := settings.BackoffSeconds * time.Second
+	maxBackoff := settings.MaxBackoffSeconds * time.Second
+	for i := freeAttempts + 1; i < attempts.Failures && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+
+	if wait := attempts.LastFailure.Add(backoff).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
@@ -0,0 +1,70 @@
+package user
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the SHA1 test vectors of RFC 6238, truncated to 6 digits
+func TestTotpCodeMatchesRfcVectors(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, expected := range vectors {
+		code, err := totpCode(secret, totpStep(time.Unix(unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != expected {
+			t.Errorf("expected code %s at %d, got %s", expected, unix, code)
+		}
+	}
+}
+
+func TestMatchTotpToleratesSkewAndRejectsReuse(t *testing.T) {
+	secret, err := newTotpSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1546300800, 0)
+
+	previous, _ := totpCode(secret, totpStep(now)-1)
+	step, ok := matchTotp(secret, previous, now, 0)
+	if !ok || step != totpStep(now)-1 {
+		t.Errorf("expected code of the previous step to be accepted, got step %d", step)
+	}
+	if _, ok := matchTotp(secret, previous, now, step); ok {
+		t.Error("expected code to be rejected once used")
+	}
+
+	outdated, _ := totpCode(secret, totpStep(now)-2)
+	if _, ok := matchTotp(secret, outdated, now, 0); ok {
+		t.Error("expected code outside of the skew to be rejected")
+	}
+}
+
+func TestRecoveryCodesAreUnique(t *testing.T) {
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	for _, code := range codes {
+		if len(code) != 11 || strings.Index(code, "-") != 5 || seen[code] {
+			t.Errorf("unexpected recovery code %s", code)
+		}
+		seen[code] = true
+	}
+	if len(seen) != recoveryCodeCount {
+		t.Errorf("expected %d codes, got %d", recoveryCodeCount, len(seen))
+	}
+}
@@ -0,0 +1,50 @@
+package wallet
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+type AdminController struct {
+	adminRouter *gin.RouterGroup
+}
+
+func NewAdminController(adminRouter *gin.RouterGroup) AdminController {
+	return AdminController{adminRouter: adminRouter}
+}
+
+// Routes registers the operations on the wallets of all users in the adminRouter, which only admins may access.
+func (controller *AdminController) Routes() {
+	api := controller.adminRouter.Group("/wallets")
+	{
+		api.GET("", controller.getListHandler())
+		api.POST("/:id/stop", controller.postStopHandler())
+	}
+
+	controller.adminRouter.GET("/watcher", controller.getWatcherHandler())
+}
+
+func (controller *AdminController) getListHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		wallets, err := service.GetAllWallets()
+		if !handleWalletErrors(c, err) {
+			c.JSON(http.StatusOK, wallets)
+		}
+	}
+}
+
+// postStopHandler removes the satellite without saving the wallet, for wallets which can not be stopped by their owner.
+func (controller *AdminController) postStopHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		wallet, err := service.ForceStopWallet(c.Param("id"))
+		if !handleWalletErrors(c, err) {
+			c.JSON(http.StatusOK, wallet)
+		}
+	}
+}
+
+func (controller *AdminController) getWatcherHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, statusWatcher.State())
+	}
+}
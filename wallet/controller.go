@@ -3,8 +3,11 @@ package wallet
 import (
 	"github.com/gin-gonic/gin"
 	"github.com/iridiumdev/webwallet-core/auth"
+	"github.com/iridiumdev/webwallet-core/job"
+	"github.com/iridiumdev/webwallet-core/user"
 	"github.com/iridiumdev/webwallet-core/util"
 	"net/http"
+	"strconv"
 )
 
 type Controller struct {
@@ -16,16 +19,45 @@ func NewController(apiRouter *gin.RouterGroup) Controller {
 }
 
 // Routes registers this controllers sub-routing in the main apiRouter. It returns a RouterGroup containing only the
-// routes for the operations on the Wallet model.
+// routes for the operations on the Wallet model. The apiRouter accepts personal access tokens, so every route has to
+// require a scope.
 func (controller *Controller) Routes() {
 	api := controller.apiRouter.Group("/wallets")
 	{
-		api.POST("/", controller.postCreateHandler())
+		api.POST("/", auth.RequireScope(auth.ScopeWalletsWrite), auth.RequireUnrestricted(), controller.postCreateHandler())
 
-		api.GET("/", controller.getListHandler())
-		api.GET("/:id", controller.getHandler())
-		api.POST("/:id/instance", controller.postInstanceHandler())
-		api.DELETE("/:id/instance", controller.deleteInstanceHandler())
+		api.GET("/", auth.RequireScope(auth.ScopeWalletsRead), controller.getListHandler())
+		api.GET("/:id", auth.RequireScope(auth.ScopeWalletsRead), auth.RestrictWallet("id"), controller.getHandler())
+		api.POST("/:id/instance", auth.RequireScope(auth.ScopeWalletsWrite), auth.RestrictWallet("id"), controller.postInstanceHandler())
+		api.DELETE("/:id/instance", auth.RequireScope(auth.ScopeWalletsWrite), auth.RestrictWallet("id"), controller.deleteInstanceHandler())
+		api.POST("/:id/transactions", auth.RequireScope(auth.ScopeWalletsSend), auth.RestrictWallet("id"), controller.postTransactionHandler())
+
+		api.GET("/:id/members", auth.RequireScope(auth.ScopeWalletsRead), auth.RestrictWallet("id"), controller.getMembersHandler())
+		api.POST("/:id/members", auth.RequireScope(auth.ScopeWalletsWrite), auth.RestrictWallet("id"), controller.postMemberHandler())
+		api.PUT("/:id/members/:userId", auth.RequireScope(auth.ScopeWalletsWrite), auth.RestrictWallet("id"), controller.putMemberHandler())
+		api.DELETE("/:id/members/:userId", auth.RequireScope(auth.ScopeWalletsWrite), auth.RestrictWallet("id"), controller.deleteMemberHandler())
+
+		api.GET("/:id/policy", auth.RequireScope(auth.ScopeWalletsRead), auth.RestrictWallet("id"), controller.getPolicyHandler())
+		api.PUT("/:id/policy", auth.RequireScope(auth.ScopeWalletsWrite), auth.RestrictWallet("id"), controller.putPolicyHandler())
+		api.DELETE("/:id/policy", auth.RequireScope(auth.ScopeWalletsWrite), auth.RestrictWallet("id"), controller.deletePolicyHandler())
+
+		api.GET("/:id/limits", auth.RequireScope(auth.ScopeWalletsRead), auth.RestrictWallet("id"), controller.getLimitsHandler())
+		api.PUT("/:id/limits", auth.RequireScope(auth.ScopeWalletsWrite), auth.RestrictWallet("id"), controller.putLimitsHandler())
+		api.POST("/:id/allowlist", auth.RequireScope(auth.ScopeWalletsWrite), auth.RestrictWallet("id"), controller.postAllowlistHandler())
+		api.DELETE("/:id/allowlist/:address", auth.RequireScope(auth.ScopeWalletsWrite), auth.RestrictWallet("id"), controller.deleteAllowlistHandler())
+
+		api.GET("/:id/proposals", auth.RequireScope(auth.ScopeWalletsRead), auth.RestrictWallet("id"), controller.getProposalsHandler())
+		api.GET("/:id/proposals/:proposalId", auth.RequireScope(auth.ScopeWalletsRead), auth.RestrictWallet("id"), controller.getProposalHandler())
+		api.POST("/:id/proposals/:proposalId/approve", auth.RequireScope(auth.ScopeWalletsSend), auth.RestrictWallet("id"), controller.postDecisionHandler(true))
+		api.POST("/:id/proposals/:proposalId/reject", auth.RequireScope(auth.ScopeWalletsSend), auth.RestrictWallet("id"), controller.postDecisionHandler(false))
+	}
+
+	// invitations are addressed by the id of the wallet they are for
+	invitations := controller.apiRouter.Group("/invitations")
+	{
+		invitations.GET("", auth.RequireScope(auth.ScopeWalletsRead), auth.RequireUnrestricted(), controller.getInvitationsHandler())
+		invitations.POST("/:id/accept", auth.RequireScope(auth.ScopeWalletsWrite), auth.RestrictWallet("id"), controller.postAcceptInvitationHandler())
+		invitations.DELETE("/:id", auth.RequireScope(auth.ScopeWalletsWrite), auth.RestrictWallet("id"), controller.deleteInvitationHandler())
 	}
 }
 
@@ -33,9 +65,17 @@ func (controller *Controller) getListHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userId := auth.ExtractUserId(c)
 		wallets, err := service.GetWallets(userId)
-		if !handleWalletErrors(c, err) {
-			c.JSON(http.StatusOK, wallets)
+		if handleWalletErrors(c, err) {
+			return
 		}
+
+		permitted := []*Wallet{}
+		for _, wallet := range wallets {
+			if auth.PermitsWallet(c, wallet.Id.Hex()) {
+				permitted = append(permitted, wallet)
+			}
+		}
+		c.JSON(http.StatusOK, permitted)
 	}
 }
 
@@ -59,9 +99,9 @@ func (controller *Controller) postInstanceHandler() gin.HandlerFunc {
 		dto := PasswordDTO{}
 		util.BindAndHandleError(c, &dto, http.StatusBadRequest)
 
-		wallet, err := service.StartWallet(walletId, dto.Password, userId)
+		startJob, err := service.StartWallet(walletId, dto.Password, userId)
 		if !handleWalletErrors(c, err) {
-			c.JSON(http.StatusCreated, wallet)
+			c.JSON(http.StatusAccepted, startJob)
 		}
 	}
 }
@@ -78,6 +118,23 @@ func (controller *Controller) deleteInstanceHandler() gin.HandlerFunc {
 	}
 }
 
+func (controller *Controller) postTransactionHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userId := auth.ExtractUserId(c)
+		walletId := c.Param("id")
+
+		dto := TransactionDTO{}
+		if util.BindAndHandleError(c, &dto, http.StatusBadRequest) {
+			return
+		}
+
+		transaction, err := service.SendTransaction(walletId, dto, userId)
+		if !handleWalletErrors(c, err) {
+			c.JSON(http.StatusCreated, transaction)
+		}
+	}
+}
+
 func (controller *Controller) postCreateHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		imp := ImportDTO{}
@@ -85,31 +142,299 @@ func (controller *Controller) postCreateHandler() gin.HandlerFunc {
 
 		userId := auth.ExtractUserId(c)
 
-		var wallet *DetailedWallet
+		var createJob *job.Job
 		var err error
 		if imp.SpendSecretKey == "" || imp.ViewSecretKey == "" {
-			wallet, err = service.CreateWallet(imp.CreateDTO, userId)
+			createJob, err = service.CreateWallet(imp.CreateDTO, userId)
 		} else {
-			wallet, err = service.ImportWallet(imp, userId)
+			createJob, err = service.ImportWallet(imp, userId)
+		}
+
+		if !handleWalletErrors(c, err) {
+			c.JSON(http.StatusAccepted, createJob)
+		}
+	}
+}
+
+func (controller *Controller) getMembersHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		members, err := service.GetMembers(c.Param("id"), auth.ExtractUserId(c))
+		if !handleWalletErrors(c, err) {
+			c.JSON(http.StatusOK, members)
+		}
+	}
+}
+
+func (controller *Controller) postMemberHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dto := InvitationDTO{}
+		if util.BindAndHandleError(c, &dto, http.StatusBadRequest) {
+			return
+		}
+
+		membership, err := service.InviteMember(c.Param("id"), dto, auth.ExtractUserId(c))
+		if !handleWalletErrors(c, err) {
+			c.JSON(http.StatusCreated, membership)
+		}
+	}
+}
+
+func (controller *Controller) putMemberHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dto := PermissionDTO{}
+		if util.BindAndHandleError(c, &dto, http.StatusBadRequest) {
+			return
+		}
+
+		err := service.UpdateMember(c.Param("id"), c.Param("userId"), dto.Permission, auth.ExtractUserId(c))
+		if !handleWalletErrors(c, err) {
+			c.Status(http.StatusNoContent)
+		}
+	}
+}
+
+func (controller *Controller) deleteMemberHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := service.RemoveMember(c.Param("id"), c.Param("userId"), auth.ExtractUserId(c))
+		if !handleWalletErrors(c, err) {
+			c.Status(http.StatusNoContent)
+		}
+	}
+}
+
+func (controller *Controller) getInvitationsHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		invitations, err := service.GetInvitations(auth.ExtractUserId(c))
+		if handleWalletErrors(c, err) {
+			return
+		}
+
+		permitted := []*Membership{}
+		for _, invitation := range invitations {
+			if auth.PermitsWallet(c, invitation.WalletId.Hex()) {
+				permitted = append(permitted, invitation)
+			}
+		}
+		c.JSON(http.StatusOK, permitted)
+	}
+}
+
+func (controller *Controller) postAcceptInvitationHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := service.AcceptInvitation(c.Param("id"), auth.ExtractUserId(c))
+		if !handleWalletErrors(c, err) {
+			c.Status(http.StatusNoContent)
+		}
+	}
+}
+
+// deleteInvitationHandler declines the invitation, which is the same as leaving the wallet.
+func (controller *Controller) deleteInvitationHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userId := auth.ExtractUserId(c)
+		err := service.RemoveMember(c.Param("id"), userId, userId)
+		if err == ErrMemberNotFound {
+			err = ErrInvitationNotFound
+		}
+		if !handleWalletErrors(c, err) {
+			c.Status(http.StatusNoContent)
+		}
+	}
+}
+
+func (controller *Controller) getPolicyHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		policy, err := service.GetPolicy(c.Param("id"), auth.ExtractUserId(c))
+		if handleWalletErrors(c, err) {
+			return
+		}
+		if policy == nil {
+			util.HandleError(c, ErrPolicyNotFound, http.StatusNotFound)
+			return
+		}
+		c.JSON(http.StatusOK, policy)
+	}
+}
+
+func (controller *Controller) putPolicyHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		policy := Policy{}
+		if util.BindAndHandleError(c, &policy, http.StatusBadRequest) {
+			return
+		}
+
+		err := service.SetPolicy(c.Param("id"), &policy, auth.ExtractUserId(c))
+		if !handleWalletErrors(c, err) {
+			c.JSON(http.StatusOK, policy)
 		}
+	}
+}
+
+func (controller *Controller) deletePolicyHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := service.SetPolicy(c.Param("id"), nil, auth.ExtractUserId(c))
+		if !handleWalletErrors(c, err) {
+			c.Status(http.StatusNoContent)
+		}
+	}
+}
+
+func (controller *Controller) getLimitsHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limits, err := service.GetLimits(c.Param("id"), auth.ExtractUserId(c))
+		if !handleWalletErrors(c, err) {
+			c.JSON(http.StatusOK, limits)
+		}
+	}
+}
+
+func (controller *Controller) putLimitsHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dto := LimitsDTO{}
+		if util.BindAndHandleError(c, &dto, http.StatusBadRequest) {
+			return
+		}
+
+		userId := auth.ExtractUserId(c)
+		if handleWalletErrors(c, service.SetLimits(c.Param("id"), dto, userId)) {
+			return
+		}
+		limits, err := service.GetLimits(c.Param("id"), userId)
+		if !handleWalletErrors(c, err) {
+			c.JSON(http.StatusOK, limits)
+		}
+	}
+}
+
+func (controller *Controller) postAllowlistHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dto := AllowlistEntryDTO{}
+		if util.BindAndHandleError(c, &dto, http.StatusBadRequest) {
+			return
+		}
+
+		entry, err := service.AddAllowlistEntry(c.Param("id"), dto, auth.ExtractUserId(c))
+		if !handleWalletErrors(c, err) {
+			c.JSON(http.StatusCreated, entry)
+		}
+	}
+}
+
+func (controller *Controller) deleteAllowlistHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// the body only carries the second factor, RequireStepUp refuses its absence if the owner needs one
+		dto := StepUpDTO{}
+		c.ShouldBindJSON(&dto)
 
+		err := service.RemoveAllowlistEntry(c.Param("id"), c.Param("address"), dto, auth.ExtractUserId(c))
 		if !handleWalletErrors(c, err) {
-			c.JSON(http.StatusCreated, wallet)
+			c.Status(http.StatusNoContent)
+		}
+	}
+}
+
+func (controller *Controller) getProposalsHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		proposals, err := service.GetProposals(c.Param("id"), auth.ExtractUserId(c))
+		if !handleWalletErrors(c, err) {
+			c.JSON(http.StatusOK, proposals)
+		}
+	}
+}
+
+func (controller *Controller) getProposalHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		proposal, err := service.GetProposal(c.Param("id"), c.Param("proposalId"), auth.ExtractUserId(c))
+		if !handleWalletErrors(c, err) {
+			c.JSON(http.StatusOK, proposal)
+		}
+	}
+}
+
+func (controller *Controller) postDecisionHandler(approve bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dto := DecisionDTO{}
+		if util.BindAndHandleError(c, &dto, http.StatusBadRequest) {
+			return
+		}
+
+		decide := service.RejectProposal
+		if approve {
+			decide = service.ApproveProposal
+		}
+
+		proposal, err := decide(c.Param("id"), c.Param("proposalId"), dto, auth.ExtractUserId(c))
+		if !handleWalletErrors(c, err) {
+			c.JSON(http.StatusOK, proposal)
 		}
 	}
 }
 
 func handleWalletErrors(c *gin.Context, err error) bool {
+	if quotaErr, ok := err.(*QuotaError); ok {
+		return handleQuotaError(c, quotaErr)
+	}
+	if limitErr, ok := err.(*LimitError); ok {
+		return handleLimitError(c, limitErr)
+	}
+	// the transfer was not sent, but is waiting for approval
+	if approvalErr, ok := err.(*ApprovalRequiredError); ok {
+		c.JSON(http.StatusAccepted, approvalErr.Proposal)
+		return true
+	}
 	if err == ErrWalletNotFound {
 		return util.HandleError(c, err, http.StatusNotFound)
 	}
 	if err == ErrWalletNotRunning {
 		return util.HandleError(c, err, http.StatusFailedDependency)
 	}
+	if err == ErrMemberNotFound || err == ErrInvitationNotFound || err == user.ErrUserNotFound {
+		return util.HandleError(c, err, http.StatusNotFound)
+	}
+	if err == ErrPermissionDenied {
+		return util.HandleError(c, err, http.StatusForbidden)
+	}
+	if err == ErrAlreadyMember {
+		return util.HandleError(c, err, http.StatusConflict)
+	}
+	if err == ErrNotAllowlisted {
+		return util.HandleError(c, err, http.StatusNotFound)
+	}
+	if err == ErrAlreadyAllowlisted {
+		return util.HandleError(c, err, http.StatusConflict)
+	}
+	if err == ErrProposalNotFound {
+		return util.HandleError(c, err, http.StatusNotFound)
+	}
+	if err == ErrNotApprover {
+		return util.HandleError(c, err, http.StatusForbidden)
+	}
+	if err == ErrProposalNotPending || err == ErrAlreadyDecided {
+		return util.HandleError(c, err, http.StatusConflict)
+	}
 
 	if err == ErrWalletAlreadyRunning {
 		return util.HandleError(c, err, http.StatusBadRequest)
 	}
+	if err == ErrWalletBusy {
+		return util.HandleError(c, err, http.StatusConflict)
+	}
+	if err == ErrWalletNotSynced {
+		return util.HandleError(c, err, http.StatusConflict)
+	}
+	if err == ErrEmailNotVerified {
+		return util.HandleError(c, err, http.StatusForbidden)
+	}
+	if err == user.ErrTotpRequired || err == user.ErrInvalidTotp || err == user.ErrInvalidStepUp || err == user.ErrStepUpRequired {
+		return util.HandleError(c, err, http.StatusForbidden)
+	}
+	if throttledErr, ok := err.(*user.ThrottledError); ok {
+		c.Header("Retry-After", strconv.Itoa(int(throttledErr.RetryAfter.Seconds())+1))
+		return util.HandleError(c, err, http.StatusTooManyRequests)
+	}
+	if err == job.ErrQueueFull {
+		return util.HandleError(c, err, http.StatusServiceUnavailable)
+	}
 
 	if err == ErrCouldNotStartWallet {
 		return util.HandleError(c, err, http.StatusInternalServerError)
@@ -117,7 +442,44 @@ func handleWalletErrors(c *gin.Context, err error) bool {
 	if err == ErrCouldNotStopWallet {
 		return util.HandleError(c, err, http.StatusInternalServerError)
 	}
+	if err == ErrCouldNotSendTransaction {
+		return util.HandleError(c, err, http.StatusBadGateway)
+	}
 
 	return util.HandleError(c, err, http.StatusBadRequest)
 
 }
+
+// handleQuotaError responds with 429 and a Retry-After header for rate limits and with 403 for all other quotas.
+func handleQuotaError(c *gin.Context, err *QuotaError) bool {
+	status := http.StatusForbidden
+	if err.RetryAfter > 0 {
+		status = http.StatusTooManyRequests
+		c.Header("Retry-After", strconv.Itoa(int(err.RetryAfter.Seconds())+1))
+	}
+
+	c.JSON(status, gin.H{
+		"error": err.Error(),
+		"quota": err.Quota,
+		"limit": err.Limit,
+	})
+	return true
+}
+
+// handleLimitError responds with 403 and the rule which blocked the transfer.
+func handleLimitError(c *gin.Context, err *LimitError) bool {
+	body := gin.H{
+		"error": err.Error(),
+		"rule":  err.Rule,
+	}
+	if err.Limit > 0 {
+		body["limit"] = err.Limit
+		body["remaining"] = err.Remaining
+	}
+	if err.AvailableAt != nil {
+		body["availableAt"] = err.AvailableAt
+	}
+
+	c.JSON(http.StatusForbidden, body)
+	return true
+}
@@ -1,11 +1,12 @@
 package wallet
 
 import (
-	"github.com/docker/docker/client"
 	"github.com/gin-gonic/gin/json"
 	"github.com/iridiumdev/webwallet-core/config"
+	"github.com/iridiumdev/webwallet-core/daemon"
 	"github.com/iridiumdev/webwallet-core/event"
 	log "github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
 	"sync"
 	"time"
 )
@@ -13,10 +14,15 @@ import (
 type watcher struct {
 	events       chan *DetailedWallet
 	quit         chan struct{}
-	dockerClient *client.Client
 	eventService event.Service
+	daemons      daemon.Service
+
+	// height of the last network state broadcast to the clients
+	networkHeight uint64
 
 	running map[string]*LoadedWallet
+	health  *healthTracker
+	sync    *syncTracker
 }
 
 type StatusEvent struct {
@@ -24,23 +30,46 @@ type StatusEvent struct {
 	Status   InstanceStatus
 }
 
+// WatcherState is a snapshot of the status watcher for the operators.
+type WatcherState struct {
+	NetworkHeight uint64           `json:"networkHeight"`
+	Wallets       []*WatchedWallet `json:"wallets"`
+}
+
+type WatchedWallet struct {
+	WalletId    bson.ObjectId `json:"walletId"`
+	Owner       bson.ObjectId `json:"owner"`
+	Daemon      string        `json:"daemon,omitempty"`
+	Synced      bool          `json:"synced"`
+	Degraded    bool          `json:"degraded"`
+	Failures    int           `json:"failures"`
+	Restarts    int           `json:"restarts"`
+	Restarting  bool          `json:"restarting"`
+	NextRestart *time.Time    `json:"nextRestart,omitempty"`
+}
+
 type StatusWatcher interface {
 	Run() chan *DetailedWallet
 	Close()
 	AddWallet(wallet *LoadedWallet)
 	RemoveWallet(wallet *Wallet)
+	TrackSync(wallet *DetailedWallet)
+	IsSynced(walletId string) bool
+	State() *WatcherState
 }
 
 var lock = sync.RWMutex{}
 var statusWatcher StatusWatcher
 
-func InitWatcher(dockerClient *client.Client, eventService event.Service) StatusWatcher {
+func InitWatcher(eventService event.Service, daemons daemon.Service) StatusWatcher {
 	statusWatcher = &watcher{
 		events:       make(chan *DetailedWallet),
 		quit:         make(chan struct{}),
-		dockerClient: dockerClient,
 		eventService: eventService,
+		daemons:      daemons,
 		running:      make(map[string]*LoadedWallet),
+		health:       newHealthTracker(),
+		sync:         newSyncTracker(),
 	}
 	return statusWatcher
 }
@@ -55,12 +84,54 @@ func (w *watcher) RemoveWallet(wallet *Wallet) {
 	lock.Lock()
 	defer lock.Unlock()
 	delete(w.running, wallet.Id.Hex())
+	w.health.forget(wallet.Id.Hex())
+	w.sync.forget(wallet.Id.Hex())
+}
+
+func (w *watcher) TrackSync(wallet *DetailedWallet) {
+	w.sync.track(wallet)
 }
 
+// IsSynced reports whether the satellite of the wallet caught up with the network when it was checked the last time.
+func (w *watcher) IsSynced(walletId string) bool {
+	return w.sync.isSynced(walletId)
+}
+
+// GetWallets returns a snapshot of the running wallets, which may be iterated while wallets are added or removed.
 func (w *watcher) GetWallets() map[string]*LoadedWallet {
 	lock.RLock()
 	defer lock.RUnlock()
-	return w.running
+
+	wallets := make(map[string]*LoadedWallet, len(w.running))
+	for id, wallet := range w.running {
+		wallets[id] = wallet
+	}
+	return wallets
+}
+
+func (w *watcher) State() *WatcherState {
+	lock.RLock()
+	state := &WatcherState{NetworkHeight: w.networkHeight, Wallets: []*WatchedWallet{}}
+	lock.RUnlock()
+
+	for id, wallet := range w.GetWallets() {
+		health := w.health.snapshot(id)
+		watched := &WatchedWallet{
+			WalletId:   wallet.Id,
+			Owner:      wallet.Owner,
+			Daemon:     wallet.Daemon,
+			Synced:     w.sync.isSynced(id),
+			Degraded:   health.degraded,
+			Failures:   health.failures,
+			Restarts:   health.restarts,
+			Restarting: health.restarting,
+		}
+		if !health.nextRestart.IsZero() {
+			watched.NextRestart = &health.nextRestart
+		}
+		state.Wallets = append(state.Wallets, watched)
+	}
+	return state
 }
 
 func (w *watcher) Close() {
@@ -77,6 +148,7 @@ func (w *watcher) Run() chan *DetailedWallet {
 			case <-ticker.C:
 				w.shutdownOvertimeWallets()
 				w.propagateWalletDetails()
+				w.propagateNetwork()
 			}
 		}
 	}()
@@ -96,27 +168,49 @@ func (w *watcher) shutdownOvertimeWallets() {
 
 func (w *watcher) propagateWalletDetails() {
 	wallets := w.GetWallets()
+	recovery := config.Get().Webwallet.Watcher.Recovery
 
 	for id, wallet := range wallets {
-		dWallet := &DetailedWallet{}
-
-		dWallet.LoadedWallet = wallet
+		if w.health.isRestarting(id) {
+			continue
+		}
 
-		rpc, err := service.NewWalletdClient(id)
+		dWallet, err := w.checkHealth(wallet)
 		if err != nil {
-			log.Errorf("Could not create new RPC Client for wallet %s due to: %s", id, err.Error())
+			log.Errorf("Could not fetch details for wallet %s due to: %s", id, err.Error())
 			dWallet.Status = ERROR
+			w.recordFailure(wallet, err, recovery)
 		} else {
-			dWallet, err = service.FetchDetails(wallet, rpc)
-			if err != nil {
-				log.Errorf("Could fetch details for wallet %s due to: %s", id, err.Error())
-				dWallet.Status = ERROR
-			}
+			w.recordSuccess(wallet)
 		}
 
 		bytes, _ := json.Marshal(dWallet)
 		log.Trace(string(bytes))
-		w.eventService.SendToUser(dWallet.Owner.Hex(), dWallet)
+		// the details change with every tick, so they are not kept for the replay where they would evict the events
+		notifyMembers(w.eventService, dWallet.Wallet, WALLET_UPDATED, dWallet)
 		//w.events <- dWallet
 	}
 }
+
+// propagateNetwork refreshes the cached network state and broadcasts it to all clients once a new block was found.
+func (w *watcher) propagateNetwork() {
+	if w.daemons == nil {
+		return
+	}
+
+	network, err := w.daemons.RefreshNetwork()
+	if err != nil {
+		log.Debugf("Could not refresh network state: %s", err.Error())
+		return
+	}
+
+	lock.Lock()
+	changed := network.Height != w.networkHeight
+	w.networkHeight = network.Height
+	lock.Unlock()
+	if !changed {
+		return
+	}
+
+	w.eventService.Broadcast(daemon.NETWORK_UPDATED, &daemon.NetworkEvent{Type: daemon.NETWORK_UPDATED, Network: network})
+}
@@ -0,0 +1,645 @@
+package wallet
+
+import (
+	"errors"
+	"github.com/iridiumdev/webwallet-core/event"
+	"github.com/iridiumdev/webwallet-core/iridium"
+	"github.com/iridiumdev/webwallet-core/job"
+	"github.com/iridiumdev/webwallet-core/user"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var (
+	errInjected    = errors.New("injected failure")
+	errInterrupted = errors.New("interrupted")
+)
+
+// fakeRuntime keeps volumes and satellites in memory and fails at the step named by failAt.
+type fakeRuntime struct {
+	failAt     string
+	relocateTo string
+	volumes    map[string]bool
+	satellites map[string]bool
+	walletd    *fakeWalletd
+}
+
+func newFakeRuntime(failAt string) *fakeRuntime {
+	return &fakeRuntime{
+		failAt:     failAt,
+		volumes:    make(map[string]bool),
+		satellites: make(map[string]bool),
+		walletd:    &fakeWalletd{failAt: failAt},
+	}
+}
+
+func (r *fakeRuntime) CreateVolume(wallet *Wallet) error {
+	if r.failAt == "volume" {
+		return errInjected
+	}
+	r.volumes[wallet.volumeName()] = true
+	return nil
+}
+
+func (r *fakeRuntime) RemoveVolume(volume string) error {
+	if !r.volumes[volume] {
+		return errors.New("no such volume")
+	}
+	delete(r.volumes, volume)
+	return nil
+}
+
+func (r *fakeRuntime) StartSatellite(wallet *Wallet, password string) error {
+	if r.failAt == "satellite" {
+		return errInjected
+	}
+	if !r.volumes[wallet.volumeName()] {
+		return errors.New("no such volume")
+	}
+	if r.relocateTo != "" {
+		r.volumes[r.relocateTo] = true
+		wallet.Volume = r.relocateTo
+	}
+	r.satellites[wallet.Id.Hex()] = true
+	return nil
+}
+
+func (r *fakeRuntime) RemoveSatellite(walletId string) error {
+	if !r.satellites[walletId] {
+		return ErrWalletNotRunning
+	}
+	delete(r.satellites, walletId)
+	return nil
+}
+
+func (r *fakeRuntime) IsRunning(walletId string) (bool, error) {
+	return r.satellites[walletId], nil
+}
+
+func (r *fakeRuntime) CheckHealth(walletId string) error {
+	if !r.satellites[walletId] {
+		return ErrWalletNotRunning
+	}
+	return nil
+}
+
+func (r *fakeRuntime) Walletd(walletId string) (iridium.WalletdRPC, error) {
+	if r.failAt == "rpc" {
+		return nil, errInjected
+	}
+	return r.walletd, nil
+}
+
+type fakeWalletd struct {
+	failAt string
+	status iridium.GetStatusResponse
+	sent   []iridium.SendTransactionRequest
+}
+
+func (w *fakeWalletd) fail(step string) error {
+	if w.failAt == step {
+		return errInjected
+	}
+	return nil
+}
+
+func (w *fakeWalletd) Reset(viewSecretKey string) error {
+	return w.fail("keys")
+}
+
+func (w *fakeWalletd) Save() error {
+	return nil
+}
+
+func (w *fakeWalletd) CreateAddress(spendSecretKey string) (string, error) {
+	return "ir2imported", w.fail("keys")
+}
+
+func (w *fakeWalletd) GetAddresses() ([]string, error) {
+	return []string{"ir2created"}, w.fail("address")
+}
+
+func (w *fakeWalletd) GetStatus() (iridium.GetStatusResponse, error) {
+	return w.status, w.fail("details")
+}
+
+func (w *fakeWalletd) GetBalance() (iridium.GetBalanceResponse, error) {
+	return iridium.GetBalanceResponse{}, nil
+}
+
+func (w *fakeWalletd) SendTransaction(request iridium.SendTransactionRequest) (string, error) {
+	w.sent = append(w.sent, request)
+	return "txhash", w.fail("send")
+}
+
+type fakeStore struct {
+	failAt       string
+	wallets      map[bson.ObjectId]*Wallet
+	memberships  []*Membership
+	proposals    map[bson.ObjectId]*Proposal
+	transactions []*Transaction
+}
+
+func newFakeStore(failAt string) *fakeStore {
+	return &fakeStore{failAt: failAt, wallets: make(map[bson.ObjectId]*Wallet), proposals: make(map[bson.ObjectId]*Proposal)}
+}
+
+func (db *fakeStore) InsertWallet(wallet *Wallet) error {
+	if db.failAt == "store" {
+		return errInjected
+	}
+	stored := *wallet
+	db.wallets[wallet.Id] = &stored
+	return nil
+}
+
+func (db *fakeStore) FindWallets() ([]*Wallet, error) {
+	var results []*Wallet
+	for _, wallet := range db.wallets {
+		results = append(results, wallet)
+	}
+	return results, nil
+}
+
+func (db *fakeStore) FindWallet(walletId bson.ObjectId) (*Wallet, error) {
+	wallet, ok := db.wallets[walletId]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return wallet, nil
+}
+
+func (db *fakeStore) FindWalletsByOwner(userId bson.ObjectId) ([]*Wallet, error) {
+	var results []*Wallet
+	for _, wallet := range db.wallets {
+		if wallet.Owner == userId {
+			results = append(results, wallet)
+		}
+	}
+	return results, nil
+}
+
+func (db *fakeStore) FindWalletByOwner(walletId bson.ObjectId, userId bson.ObjectId) (*Wallet, error) {
+	wallet, ok := db.wallets[walletId]
+	if !ok || wallet.Owner != userId {
+		return nil, errors.New("not found")
+	}
+	return wallet, nil
+}
+
+func (db *fakeStore) UpdateVolume(walletId bson.ObjectId, volume string) error {
+	if db.failAt == "relocate" {
+		return errInjected
+	}
+	db.wallets[walletId].Volume = volume
+	return nil
+}
+
+func (db *fakeStore) UpdateLastError(walletId bson.ObjectId, lastError *InstanceError) error {
+	db.wallets[walletId].LastError = lastError
+	return nil
+}
+
+func (db *fakeStore) DeleteWallet(walletId bson.ObjectId) error {
+	delete(db.wallets, walletId)
+	return nil
+}
+
+func (db *fakeStore) FindWalletsByMember(userId bson.ObjectId) ([]*Wallet, error) {
+	var results []*Wallet
+	for _, wallet := range db.wallets {
+		if _, permission, _ := db.FindWalletByMember(wallet.Id, userId); permission != "" {
+			results = append(results, wallet)
+		}
+	}
+	return results, nil
+}
+
+func (db *fakeStore) FindWalletByMember(walletId bson.ObjectId, userId bson.ObjectId) (*Wallet, Permission, error) {
+	wallet, ok := db.wallets[walletId]
+	if !ok {
+		return nil, "", errors.New("not found")
+	}
+	if wallet.Owner == userId {
+		return wallet, OWNER, nil
+	}
+	if membership, _ := db.FindMembership(walletId, userId); membership != nil && membership.Accepted {
+		return wallet, membership.Permission, nil
+	}
+	return nil, "", errors.New("not found")
+}
+
+func (db *fakeStore) InsertMembership(membership *Membership) error {
+	if existing, _ := db.FindMembership(membership.WalletId, membership.UserId); existing != nil {
+		return &mgo.LastError{Code: 11000}
+	}
+	db.memberships = append(db.memberships, membership)
+	return nil
+}
+
+func (db *fakeStore) FindMembership(walletId bson.ObjectId, userId bson.ObjectId) (*Membership, error) {
+	for _, membership := range db.memberships {
+		if membership.WalletId == walletId && membership.UserId == userId {
+			return membership, nil
+		}
+	}
+	return nil, mgo.ErrNotFound
+}
+
+func (db *fakeStore) FindMembers(walletId bson.ObjectId) ([]*Membership, error) {
+	var results []*Membership
+	for _, membership := range db.memberships {
+		if membership.WalletId == walletId {
+			results = append(results, membership)
+		}
+	}
+	return results, nil
+}
+
+func (db *fakeStore) FindInvitations(userId bson.ObjectId) ([]*Membership, error) {
+	var results []*Membership
+	for _, membership := range db.memberships {
+		if membership.UserId == userId && !membership.Accepted {
+			results = append(results, membership)
+		}
+	}
+	return results, nil
+}
+
+func (db *fakeStore) AcceptMembership(walletId bson.ObjectId, userId bson.ObjectId) error {
+	membership, err := db.FindMembership(walletId, userId)
+	if err != nil {
+		return err
+	}
+	membership.Accepted = true
+	return nil
+}
+
+func (db *fakeStore) UpdatePermission(walletId bson.ObjectId, userId bson.ObjectId, permission Permission) error {
+	membership, err := db.FindMembership(walletId, userId)
+	if err != nil {
+		return err
+	}
+	membership.Permission = permission
+	return nil
+}
+
+func (db *fakeStore) DeleteMembership(walletId bson.ObjectId, userId bson.ObjectId) error {
+	return db.deleteMemberships(func(m *Membership) bool { return m.WalletId == walletId && m.UserId == userId })
+}
+
+func (db *fakeStore) DeleteMembershipsOfWallet(walletId bson.ObjectId) error {
+	db.deleteMemberships(func(m *Membership) bool { return m.WalletId == walletId })
+	return nil
+}
+
+func (db *fakeStore) DeleteMembershipsOfUser(userId bson.ObjectId) error {
+	db.deleteMemberships(func(m *Membership) bool { return m.UserId == userId })
+	return nil
+}
+
+func (db *fakeStore) deleteMemberships(matches func(m *Membership) bool) error {
+	var kept []*Membership
+	for _, membership := range db.memberships {
+		if !matches(membership) {
+			kept = append(kept, membership)
+		}
+	}
+	if len(kept) == len(db.memberships) {
+		return mgo.ErrNotFound
+	}
+	db.memberships = kept
+	return nil
+}
+
+func (db *fakeStore) UpdatePolicy(walletId bson.ObjectId, policy *Policy) error {
+	db.wallets[walletId].Policy = policy
+	return nil
+}
+
+func (db *fakeStore) InsertProposal(proposal *Proposal) error {
+	stored := *proposal
+	db.proposals[proposal.Id] = &stored
+	return nil
+}
+
+func (db *fakeStore) FindProposal(walletId bson.ObjectId, proposalId bson.ObjectId) (*Proposal, error) {
+	proposal, ok := db.proposals[proposalId]
+	if !ok || proposal.WalletId != walletId {
+		return nil, mgo.ErrNotFound
+	}
+	found := *proposal
+	found.Decisions = append([]*Decision{}, proposal.Decisions...)
+	return &found, nil
+}
+
+func (db *fakeStore) FindProposals(walletId bson.ObjectId) ([]*Proposal, error) {
+	var results []*Proposal
+	for _, proposal := range db.proposals {
+		if proposal.WalletId == walletId {
+			results = append(results, proposal)
+		}
+	}
+	return results, nil
+}
+
+func (db *fakeStore) AddDecision(proposalId bson.ObjectId, decision *Decision) error {
+	proposal, ok := db.proposals[proposalId]
+	if !ok || proposal.Status != PENDING {
+		return mgo.ErrNotFound
+	}
+	for _, d := range proposal.Decisions {
+		if d.UserId == decision.UserId {
+			return mgo.ErrNotFound
+		}
+	}
+	proposal.Decisions = append(proposal.Decisions, decision)
+	return nil
+}
+
+func (db *fakeStore) UpdateProposalStatus(proposalId bson.ObjectId, expected ProposalStatus, status ProposalStatus) error {
+	proposal, ok := db.proposals[proposalId]
+	if !ok || proposal.Status != expected {
+		return mgo.ErrNotFound
+	}
+	proposal.Status = status
+	return nil
+}
+
+func (db *fakeStore) UpdateProposal(proposal *Proposal) error {
+	return db.InsertProposal(proposal)
+}
+
+func (db *fakeStore) DeleteProposalsOfWallet(walletId bson.ObjectId) error {
+	for id, proposal := range db.proposals {
+		if proposal.WalletId == walletId {
+			delete(db.proposals, id)
+		}
+	}
+	return nil
+}
+
+func (db *fakeStore) InsertTransaction(transaction *Transaction) error {
+	db.transactions = append(db.transactions, transaction)
+	return nil
+}
+
+func (db *fakeStore) SumTransactions(walletId bson.ObjectId, since time.Time) (uint64, error) {
+	var total uint64
+	for _, transaction := range db.transactions {
+		if transaction.WalletId == walletId && !transaction.Sent.Before(since) {
+			total += transaction.Amount
+		}
+	}
+	return total, nil
+}
+
+func (db *fakeStore) UpdateLimits(walletId bson.ObjectId, limits LimitsDTO, pending *PendingLimits) error {
+	wallet := db.wallets[walletId]
+	if wallet.Limits == nil {
+		wallet.Limits = &Limits{}
+	}
+	wallet.Limits.MaxAmount = limits.MaxAmount
+	wallet.Limits.DailyLimit = limits.DailyLimit
+	wallet.Limits.WeeklyLimit = limits.WeeklyLimit
+	wallet.Limits.RequireAllowlist = limits.RequireAllowlist
+	wallet.Limits.Pending = pending
+	return nil
+}
+
+func (db *fakeStore) AddAllowlistEntry(walletId bson.ObjectId, entry *AllowlistEntry) error {
+	wallet := db.wallets[walletId]
+	if wallet.Limits == nil {
+		wallet.Limits = &Limits{}
+	}
+	for _, e := range wallet.Limits.Allowlist {
+		if e.Address == entry.Address {
+			return mgo.ErrNotFound
+		}
+	}
+	wallet.Limits.Allowlist = append(wallet.Limits.Allowlist, entry)
+	return nil
+}
+
+func (db *fakeStore) RemoveAllowlistEntry(walletId bson.ObjectId, address string) error {
+	wallet := db.wallets[walletId]
+	if wallet.Limits == nil {
+		return mgo.ErrNotFound
+	}
+	for i, e := range wallet.Limits.Allowlist {
+		if e.Address == address {
+			wallet.Limits.Allowlist = append(wallet.Limits.Allowlist[:i], wallet.Limits.Allowlist[i+1:]...)
+			return nil
+		}
+	}
+	return mgo.ErrNotFound
+}
+
+func (db *fakeStore) DeleteTransactionsOfWallet(walletId bson.ObjectId) error {
+	var kept []*Transaction
+	for _, transaction := range db.transactions {
+		if transaction.WalletId != walletId {
+			kept = append(kept, transaction)
+		}
+	}
+	db.transactions = kept
+	return nil
+}
+
+type fakeWatcher struct {
+	wallets map[string]*LoadedWallet
+	sync    *syncTracker
+}
+
+func (w *fakeWatcher) Run() chan *DetailedWallet {
+	return nil
+}
+
+func (w *fakeWatcher) Close() {
+}
+
+func (w *fakeWatcher) AddWallet(wallet *LoadedWallet) {
+	w.wallets[wallet.Id.Hex()] = wallet
+}
+
+func (w *fakeWatcher) RemoveWallet(wallet *Wallet) {
+	delete(w.wallets, wallet.Id.Hex())
+}
+
+func (w *fakeWatcher) TrackSync(wallet *DetailedWallet) {
+	w.sync.track(wallet)
+}
+
+func (w *fakeWatcher) IsSynced(walletId string) bool {
+	return w.sync.isSynced(walletId)
+}
+
+func (w *fakeWatcher) State() *WatcherState {
+	state := &WatcherState{}
+	for _, wallet := range w.wallets {
+		state.Wallets = append(state.Wallets, &WatchedWallet{WalletId: wallet.Id, Owner: wallet.Owner})
+	}
+	return state
+}
+
+// fakeEventService records the types of the events sent to users, all other methods panic.
+type fakeEventService struct {
+	event.Service
+	events []string
+}
+
+func (s *fakeEventService) SendToUsers(userIds []string, eventType string, walletId string, payload interface{}) {
+	s.events = append(s.events, eventType)
+}
+
+// fakeJobService runs the tasks right away. It panics once the step named by interruptAfter completed, as if the
+// server stopped.
+type fakeJobService struct {
+	steps          []string
+	interruptAfter string
+}
+
+func (s *fakeJobService) Submit(jobType job.Type, userId string, walletId string, task job.Task) (*job.Job, error) {
+	j := &job.Job{Id: bson.NewObjectId(), Type: jobType, Owner: bson.ObjectIdHex(userId)}
+	return j, task(j)
+}
+
+func (s *fakeJobService) Progress(j *job.Job, step string) {
+	s.steps = append(s.steps, step)
+}
+
+func (s *fakeJobService) Complete(j *job.Job, step job.Step) {
+	j.Completed = append(j.Completed, step)
+	if step.Name == s.interruptAfter {
+		panic(errInterrupted)
+	}
+}
+
+func (s *fakeJobService) OnInterrupted(jobType job.Type, rollback job.Rollback) {
+}
+
+func (s *fakeJobService) GetJob(jobId string, userId string) (*job.Job, error) {
+	return nil, job.ErrJobNotFound
+}
+
+func (s *fakeJobService) Recover() error {
+	return nil
+}
+
+func (s *fakeJobService) Close() {
+}
+
+// fakeUserService only implements the methods used by the wallet service, all others panic.
+type fakeUserService struct {
+	user.Service
+	totp    string
+	users   []*user.User
+	stepUps int
+}
+
+func (s *fakeUserService) GetUserByUsername(username string) (*user.User, error) {
+	for _, u := range s.users {
+		if u.Username == username {
+			return u, nil
+		}
+	}
+	return nil, user.ErrUserNotFound
+}
+
+func (s *fakeUserService) RequireTotp(userId string, code string) error {
+	if s.totp == "" {
+		return nil
+	}
+	if code == "" {
+		return user.ErrTotpRequired
+	}
+	if code != s.totp {
+		return user.ErrInvalidTotp
+	}
+	return nil
+}
+
+func (s *fakeUserService) RequireStepUp(userId string, code string, stepUpToken string) error {
+	if stepUpToken != "" {
+		if stepUpToken != "step-up" {
+			return user.ErrInvalidStepUp
+		}
+		s.stepUps++
+		return nil
+	}
+	return s.RequireTotp(userId, code)
+}
+
+type fixture struct {
+	service *serviceImpl
+	runtime *fakeRuntime
+	store   *fakeStore
+	watcher *fakeWatcher
+	jobs    *fakeJobService
+	users   *fakeUserService
+}
+
+func newFixture(failAt string) *fixture {
+	f := &fixture{
+		runtime: newFakeRuntime(failAt),
+		store:   newFakeStore(failAt),
+		watcher: &fakeWatcher{wallets: make(map[string]*LoadedWallet), sync: newSyncTracker()},
+		jobs:    &fakeJobService{},
+		users:   &fakeUserService{},
+	}
+	f.service = &serviceImpl{
+		runtime:     f.runtime,
+		userService: f.users,
+		jobService:  f.jobs,
+		creations:   newRateLimiter(),
+		pending:     make(map[string]*pendingWallets),
+		busy:        make(map[string]struct{}),
+
+		transferLocks: make(map[string]*transferLock),
+	}
+	store = f.store
+	statusWatcher = f.watcher
+	return f
+}
+
+// assertClean verifies that nothing but the given volumes is left behind.
+func (f *fixture) assertClean(t *testing.T, volumes ...string) {
+	expected := make(map[string]bool)
+	for _, volume := range volumes {
+		expected[volume] = true
+	}
+	if !reflect.DeepEqual(f.runtime.volumes, expected) {
+		t.Errorf("expected volumes %v, got %v", expected, f.runtime.volumes)
+	}
+	if len(f.runtime.satellites) > 0 {
+		t.Errorf("expected no satellites, got %v", f.runtime.satellites)
+	}
+	if len(f.watcher.wallets) > 0 {
+		t.Errorf("expected no watched wallets, got %v", f.watcher.wallets)
+	}
+}
+
+// storedWallet creates a stopped wallet.
+func storedWallet(f *fixture) *Wallet {
+	wallet := &Wallet{Id: bson.NewObjectId(), Name: "test", Owner: bson.NewObjectId()}
+	f.store.InsertWallet(wallet)
+	f.runtime.volumes[wallet.volumeName()] = true
+	return wallet
+}
+
+// syncedWallet creates a running and synced wallet with the given members.
+func syncedWallet(t *testing.T, f *fixture, members map[bson.ObjectId]Permission) *Wallet {
+	f.runtime.walletd.status = iridium.GetStatusResponse{BlockCount: 1000, KnownBlockCount: 1000}
+	dWallet, err := f.service.createWallet(CreateDTO{Name: "test"}, bson.NewObjectId().Hex(), &job.Job{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for userId, permission := range members {
+		f.store.InsertMembership(&Membership{Id: bson.NewObjectId(), WalletId: dWallet.Id, UserId: userId, Permission: permission, Accepted: true})
+	}
+	return dWallet.Wallet
+}
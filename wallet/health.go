@@ -0,0 +1,205 @@
+package wallet
+
+import (
+	"fmt"
+	"github.com/iridiumdev/webwallet-core/config"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+	"sync"
+	"time"
+)
+
+const (
+	// sent with the details of a wallet whenever the watcher refreshed them, it is neither numbered nor replayed
+	WALLET_UPDATED   = "wallet.updated"
+	WALLET_DEGRADED  = "wallet.degraded"
+	WALLET_RECOVERED = "wallet.recovered"
+)
+
+// HealthEvent notifies the owner of a wallet about its satellite becoming unhealthy or healthy again.
+type HealthEvent struct {
+	Type     string         `json:"type"`
+	WalletId bson.ObjectId  `json:"walletId"`
+	Error    *InstanceError `json:"error,omitempty"`
+}
+
+type walletHealth struct {
+	failures    int
+	restarts    int
+	degraded    bool
+	restarting  bool
+	nextRestart time.Time
+}
+
+type healthTracker struct {
+	mx      sync.Mutex
+	wallets map[string]*walletHealth
+}
+
+func newHealthTracker() *healthTracker {
+	return &healthTracker{wallets: make(map[string]*walletHealth)}
+}
+
+func (t *healthTracker) get(walletId string) *walletHealth {
+	h, ok := t.wallets[walletId]
+	if !ok {
+		h = &walletHealth{}
+		t.wallets[walletId] = h
+	}
+	return h
+}
+
+func (t *healthTracker) forget(walletId string) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	delete(t.wallets, walletId)
+}
+
+// snapshot returns a copy of the health of the wallet, which is healthy if it is not tracked.
+func (t *healthTracker) snapshot(walletId string) walletHealth {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	if h, ok := t.wallets[walletId]; ok {
+		return *h
+	}
+	return walletHealth{}
+}
+
+// isRestarting reports whether the satellite of the wallet is currently being replaced and should not be probed.
+func (t *healthTracker) isRestarting(walletId string) bool {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	h, ok := t.wallets[walletId]
+	return ok && h.restarting
+}
+
+// checkHealth probes the satellite of the wallet, first through the runtime and then through its RPC interface.
+func (w *watcher) checkHealth(wallet *LoadedWallet) (*DetailedWallet, error) {
+	id := wallet.Id.Hex()
+
+	if err := service.CheckHealth(id); err != nil {
+		return &DetailedWallet{LoadedWallet: wallet}, err
+	}
+
+	// a satellite connected to an unreachable daemon can not sync anymore, restarting it fails over to another node
+	if wallet.Daemon != "" && w.daemons != nil && !w.daemons.IsHealthy(wallet.Daemon) {
+		return &DetailedWallet{LoadedWallet: wallet}, fmt.Errorf("daemon %s is unreachable", wallet.Daemon)
+	}
+
+	rpc, err := service.NewWalletdClient(id)
+	if err != nil {
+		return &DetailedWallet{LoadedWallet: wallet}, err
+	}
+
+	return service.FetchDetails(wallet, rpc)
+}
+
+// recordSuccess resets the failure counters of the wallet, notifying its owner if it was degraded before.
+func (w *watcher) recordSuccess(wallet *LoadedWallet) {
+	w.health.mx.Lock()
+	h, ok := w.health.wallets[wallet.Id.Hex()]
+	if !ok || h.restarting {
+		w.health.mx.Unlock()
+		return
+	}
+	wasDegraded := h.degraded
+	delete(w.health.wallets, wallet.Id.Hex())
+	w.health.mx.Unlock()
+
+	if !wasDegraded {
+		return
+	}
+
+	log.Infof("Wallet %s recovered", wallet.Id.Hex())
+
+	lock.Lock()
+	wallet.LastError = nil
+	lock.Unlock()
+	if err := store.UpdateLastError(wallet.Id, nil); err != nil {
+		log.Warnf("Could not clear last error of wallet %s: %s", wallet.Id.Hex(), err.Error())
+	}
+	sendToMembers(w.eventService, wallet.Wallet, WALLET_RECOVERED, &HealthEvent{Type: WALLET_RECOVERED, WalletId: wallet.Id})
+}
+
+// recordFailure counts a failed probe of the wallet and persists the error. Once the configured number of consecutive
+// failures is reached, the satellite gets restarted with an exponential backoff until the restart limit is hit.
+func (w *watcher) recordFailure(wallet *LoadedWallet, cause error, recovery config.Recovery) {
+	id := wallet.Id.Hex()
+
+	w.health.mx.Lock()
+	h := w.health.get(id)
+	h.failures++
+	instanceErr := &InstanceError{
+		Message:  cause.Error(),
+		Time:     time.Now(),
+		Failures: h.failures,
+		Restarts: h.restarts,
+	}
+	notify := !h.degraded
+	h.degraded = true
+
+	restart := recovery.MaxFailures > 0 && h.failures >= recovery.MaxFailures && !h.restarting &&
+		!time.Now().Before(h.nextRestart)
+	giveUp := restart && recovery.MaxRestarts > 0 && h.restarts >= recovery.MaxRestarts
+	if restart && !giveUp {
+		h.restarting = true
+		h.restarts++
+		h.nextRestart = time.Now().Add(restartBackoff(recovery, h.restarts))
+	}
+	w.health.mx.Unlock()
+
+	log.Warnf("Health check of wallet %s failed (%d): %s", id, instanceErr.Failures, cause.Error())
+
+	// the wallet is shared with the service, which reads the error while the watcher is running
+	lock.Lock()
+	wallet.LastError = instanceErr
+	lock.Unlock()
+	if err := store.UpdateLastError(wallet.Id, instanceErr); err != nil {
+		log.Warnf("Could not persist last error of wallet %s: %s", id, err.Error())
+	}
+
+	if notify {
+		sendToMembers(w.eventService, wallet.Wallet, WALLET_DEGRADED, &HealthEvent{Type: WALLET_DEGRADED, WalletId: wallet.Id, Error: instanceErr})
+	}
+
+	if giveUp {
+		log.Errorf("Giving up on wallet %s after %d restarts", id, instanceErr.Restarts)
+		w.RemoveWallet(wallet.Wallet)
+		return
+	}
+
+	if restart {
+		go w.restart(wallet)
+	}
+}
+
+func (w *watcher) restart(wallet *LoadedWallet) {
+	err := service.RecoverWallet(wallet)
+
+	w.health.mx.Lock()
+	if h, ok := w.health.wallets[wallet.Id.Hex()]; ok {
+		h.restarting = false
+	}
+	w.health.mx.Unlock()
+
+	if err != nil {
+		log.Errorf("Could not restart wallet %s: %s", wallet.Id.Hex(), err.Error())
+	}
+}
+
+// restartBackoff doubles the configured backoff with every restart, capped at the configured maximum.
+func restartBackoff(recovery config.Recovery, restarts int) time.Duration {
+	backoff := recovery.BackoffSeconds * time.Second
+	maxBackoff := recovery.MaxBackoffSeconds * time.Second
+
+	for i := 1; i < restarts; i++ {
+		backoff *= 2
+		if maxBackoff > 0 && backoff >= maxBackoff {
+			return maxBackoff
+		}
+	}
+	if maxBackoff > 0 && backoff > maxBackoff {
+		return maxBackoff
+	}
+	return backoff
+}
@@ -0,0 +1,135 @@
+package wallet
+
+import (
+	"errors"
+	"github.com/iridiumdev/webwallet-core/config"
+	"github.com/iridiumdev/webwallet-core/job"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var errProbe = errors.New("probe failed")
+
+// watchedWallet starts a wallet of the fixture and returns it along with a watcher tracking its health, which restarts
+// it through the service of the fixture.
+func watchedWallet(t *testing.T, f *fixture) (*LoadedWallet, *watcher, *fakeEventService) {
+	dWallet, err := f.service.startWallet(storedWallet(f), "password", &job.Job{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service = f.service
+	events := &fakeEventService{}
+	w := &watcher{
+		eventService: events,
+		running:      make(map[string]*LoadedWallet),
+		health:       newHealthTracker(),
+		sync:         newSyncTracker(),
+	}
+	w.AddWallet(dWallet.LoadedWallet)
+	return dWallet.LoadedWallet, w, events
+}
+
+// awaitRestart waits for the restart of the satellite the watcher started in the background.
+func awaitRestart(t *testing.T, w *watcher, walletId string) {
+	deadline := time.Now().Add(time.Second)
+	for w.health.isRestarting(walletId) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected wallet %s to be restarted", walletId)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRestartBackoffDoublesUpToMaximum(t *testing.T) {
+	recovery := config.Recovery{BackoffSeconds: 5, MaxBackoffSeconds: 30}
+
+	expected := []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second, 30 * time.Second, 30 * time.Second}
+	for i, want := range expected {
+		if got := restartBackoff(recovery, i+1); got != want {
+			t.Errorf("restart %d: expected backoff %s, got %s", i+1, want, got)
+		}
+	}
+}
+
+func TestRestartBackoffWithoutMaximum(t *testing.T) {
+	recovery := config.Recovery{BackoffSeconds: 1}
+
+	if got := restartBackoff(recovery, 4); got != 8*time.Second {
+		t.Errorf("expected backoff 8s, got %s", got)
+	}
+}
+
+func TestRecordFailureRestartsAndGivesUp(t *testing.T) {
+	f := newFixture("")
+	wallet, w, events := watchedWallet(t, f)
+	id := wallet.Id.Hex()
+	recovery := config.Recovery{MaxFailures: 2, MaxRestarts: 1, BackoffSeconds: 60}
+
+	// the satellite crashed
+	delete(f.runtime.satellites, id)
+
+	w.recordFailure(wallet, errProbe, recovery)
+	if health := w.health.snapshot(id); health.failures != 1 || !health.degraded || health.restarting {
+		t.Errorf("expected a degraded wallet below the failure threshold, got %+v", health)
+	}
+	if stored := f.store.wallets[wallet.Id].LastError; stored == nil || stored.Message != errProbe.Error() || stored.Failures != 1 {
+		t.Errorf("expected the error to be persisted, got %+v", stored)
+	}
+
+	w.recordFailure(wallet, errProbe, recovery)
+	awaitRestart(t, w, id)
+	health := w.health.snapshot(id)
+	if health.restarts != 1 || !health.nextRestart.After(time.Now()) || !f.runtime.satellites[id] {
+		t.Errorf("expected the satellite to be restarted once the threshold was reached, got %+v", health)
+	}
+
+	// no further restart within the backoff
+	w.recordFailure(wallet, errProbe, recovery)
+	if health := w.health.snapshot(id); health.restarting || health.restarts != 1 {
+		t.Errorf("expected no restart within the backoff, got %+v", health)
+	}
+
+	w.health.mx.Lock()
+	w.health.wallets[id].nextRestart = time.Now().Add(-time.Second)
+	w.health.mx.Unlock()
+
+	w.recordFailure(wallet, errProbe, recovery)
+	if _, watched := w.GetWallets()[id]; watched {
+		t.Error("expected the watcher to give up on the wallet after the restart limit")
+	}
+	if health := w.health.snapshot(id); health.failures != 0 {
+		t.Errorf("expected the health of the wallet to be forgotten, got %+v", health)
+	}
+
+	// the owner is only notified once the wallet becomes degraded
+	if !reflect.DeepEqual(events.events, []string{WALLET_DEGRADED}) {
+		t.Errorf("expected a single degraded event, got %v", events.events)
+	}
+}
+
+func TestRecordSuccessNotifiesRecovery(t *testing.T) {
+	f := newFixture("")
+	wallet, w, events := watchedWallet(t, f)
+	id := wallet.Id.Hex()
+
+	// healthy wallets are not tracked
+	w.recordSuccess(wallet)
+	if len(events.events) != 0 {
+		t.Errorf("expected no events for a healthy wallet, got %v", events.events)
+	}
+
+	w.recordFailure(wallet, errProbe, config.Recovery{MaxFailures: 3})
+	w.recordSuccess(wallet)
+
+	if !reflect.DeepEqual(events.events, []string{WALLET_DEGRADED, WALLET_RECOVERED}) {
+		t.Errorf("expected degraded and recovered events, got %v", events.events)
+	}
+	if wallet.LastError != nil || f.store.wallets[wallet.Id].LastError != nil {
+		t.Errorf("expected the last error to be cleared, got %+v", wallet.LastError)
+	}
+	if health := w.health.snapshot(id); health.degraded || health.failures != 0 {
+		t.Errorf("expected the wallet to be healthy again, got %+v", health)
+	}
+}
@@ -0,0 +1,283 @@
+package wallet
+
+import (
+	"fmt"
+	"github.com/iridiumdev/webwallet-core/config"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2"
+	"time"
+)
+
+const (
+	RuleMaxAmount   = "maxAmount"
+	RuleDailyLimit  = "dailyLimit"
+	RuleWeeklyLimit = "weeklyLimit"
+	RuleAllowlist   = "allowlist"
+	RuleCoolingOff  = "coolingOff"
+)
+
+// Limits are hard safety rails of a wallet, transfers breaking one of them are refused regardless of any approvals.
+// The zero value of a limit disables it.
+type Limits struct {
+	MaxAmount   uint64 `json:"maxAmount" bson:"maxAmount"`
+	DailyLimit  uint64 `json:"dailyLimit" bson:"dailyLimit"`
+	WeeklyLimit uint64 `json:"weeklyLimit" bson:"weeklyLimit"`
+	// only transfers to addresses on the allowlist are permitted
+	RequireAllowlist bool              `json:"requireAllowlist" bson:"requireAllowlist"`
+	Allowlist        []*AllowlistEntry `json:"allowlist" bson:"allowlist"`
+	// relaxed limits requested by the owner, which replace the ones above once the cooling-off period is over
+	Pending *PendingLimits `json:"pending,omitempty" bson:"pending,omitempty"`
+}
+
+// PendingLimits are limits which are less strict than the current ones. Like new allowlist entries they only take
+// effect after the cooling-off period, so that someone who took over the account can not lift them right away.
+type PendingLimits struct {
+	MaxAmount        uint64    `json:"maxAmount" bson:"maxAmount"`
+	DailyLimit       uint64    `json:"dailyLimit" bson:"dailyLimit"`
+	WeeklyLimit      uint64    `json:"weeklyLimit" bson:"weeklyLimit"`
+	RequireAllowlist bool      `json:"requireAllowlist" bson:"requireAllowlist"`
+	Available        time.Time `json:"available" bson:"available"`
+}
+
+// AllowlistEntry is a permitted destination, which may only be sent to once its cooling-off period is over. The delay
+// gives the owner the chance to notice entries added by someone who took over the account.
+type AllowlistEntry struct {
+	Address   string    `json:"address" bson:"address"`
+	Label     string    `json:"label,omitempty" bson:"label,omitempty"`
+	Added     time.Time `json:"added" bson:"added"`
+	Available time.Time `json:"available" bson:"available"`
+}
+
+// StepUpDTO confirms a change of the limits with the second factor of the owner.
+type StepUpDTO struct {
+	// current code of the authenticator app, required if the user enabled totp
+	Totp string `json:"totp"`
+	// token issued for a passkey assertion, accepted instead of the totp code
+	StepUpToken string `json:"stepUpToken"`
+}
+
+type LimitsDTO struct {
+	StepUpDTO
+	MaxAmount        uint64 `json:"maxAmount"`
+	DailyLimit       uint64 `json:"dailyLimit"`
+	WeeklyLimit      uint64 `json:"weeklyLimit"`
+	RequireAllowlist bool   `json:"requireAllowlist"`
+}
+
+type AllowlistEntryDTO struct {
+	Address string `json:"address" binding:"required"`
+	Label   string `json:"label" binding:"max=255"`
+}
+
+// LimitError is returned whenever a transfer breaks one of the limits of the wallet. Remaining is the amount which may
+// still be sent within the window of a daily or weekly limit, AvailableAt the end of the cooling-off period of an
+// allowlisted address.
+type LimitError struct {
+	Rule        string
+	Limit       uint64
+	Remaining   uint64
+	AvailableAt *time.Time
+}
+
+func (e *LimitError) Error() string {
+	switch e.Rule {
+	case RuleMaxAmount:
+		return fmt.Sprintf("transfer exceeds the maximum amount of %d", e.Limit)
+	case RuleDailyLimit, RuleWeeklyLimit:
+		return fmt.Sprintf("transfer exceeds the %s of %d, %d remaining", e.Rule, e.Limit, e.Remaining)
+	case RuleAllowlist:
+		return "destination is not on the allowlist"
+	case RuleCoolingOff:
+		return fmt.Sprintf("destination can not be sent to before %s", e.AvailableAt.Format(time.RFC3339))
+	}
+	return "transfer exceeds the limits of the wallet"
+}
+
+var (
+	ErrAlreadyAllowlisted = errors.New("address is already on the allowlist")
+	ErrNotAllowlisted     = errors.New("address is not on the allowlist")
+)
+
+// effective returns the limits in force at the given time, which are the pending ones once they are available.
+func (l *Limits) effective(now time.Time) *Limits {
+	if l.Pending == nil || now.Before(l.Pending.Available) {
+		return l
+	}
+	limits := *l
+	limits.MaxAmount = l.Pending.MaxAmount
+	limits.DailyLimit = l.Pending.DailyLimit
+	limits.WeeklyLimit = l.Pending.WeeklyLimit
+	limits.RequireAllowlist = l.Pending.RequireAllowlist
+	limits.Pending = nil
+	return &limits
+}
+
+// stricterLimits returns the limits which may take effect right away: each requested limit which is at least as
+// strict as the current one, the current one otherwise. It reports whether any requested limit is less strict.
+func stricterLimits(current *Limits, dto LimitsDTO) (LimitsDTO, bool) {
+	result := LimitsDTO{RequireAllowlist: current.RequireAllowlist || dto.RequireAllowlist}
+	relaxed := current.RequireAllowlist && !dto.RequireAllowlist
+
+	var maxRelaxed, dailyRelaxed, weeklyRelaxed bool
+	result.MaxAmount, maxRelaxed = stricterLimit(current.MaxAmount, dto.MaxAmount)
+	result.DailyLimit, dailyRelaxed = stricterLimit(current.DailyLimit, dto.DailyLimit)
+	result.WeeklyLimit, weeklyRelaxed = stricterLimit(current.WeeklyLimit, dto.WeeklyLimit)
+
+	return result, relaxed || maxRelaxed || dailyRelaxed || weeklyRelaxed
+}
+
+// stricterLimit compares two amounts of which 0 disables the limit.
+func stricterLimit(current uint64, requested uint64) (uint64, bool) {
+	if current == 0 || (requested > 0 && requested <= current) {
+		return requested, false
+	}
+	return current, true
+}
+
+// checkLimits returns a LimitError if the transfer breaks one of the limits of the wallet.
+func checkLimits(wallet *Wallet, dto TransactionDTO) error {
+	if wallet.Limits == nil {
+		return nil
+	}
+	limits := wallet.Limits.effective(time.Now())
+
+	if limits.MaxAmount > 0 && dto.Amount > limits.MaxAmount {
+		return &LimitError{Rule: RuleMaxAmount, Limit: limits.MaxAmount}
+	}
+	if err := checkWindow(wallet, RuleDailyLimit, limits.DailyLimit, 24*time.Hour, dto.Amount); err != nil {
+		return err
+	}
+	if err := checkWindow(wallet, RuleWeeklyLimit, limits.WeeklyLimit, 7*24*time.Hour, dto.Amount); err != nil {
+		return err
+	}
+
+	if !limits.RequireAllowlist {
+		return nil
+	}
+	for _, entry := range limits.Allowlist {
+		if entry.Address != dto.Address {
+			continue
+		}
+		if time.Now().Before(entry.Available) {
+			return &LimitError{Rule: RuleCoolingOff, AvailableAt: &entry.Available}
+		}
+		return nil
+	}
+	return &LimitError{Rule: RuleAllowlist}
+}
+
+func checkWindow(wallet *Wallet, rule string, limit uint64, window time.Duration, amount uint64) error {
+	if limit == 0 {
+		return nil
+	}
+
+	sent, err := store.SumTransactions(wallet.Id, time.Now().Add(-window))
+	if err != nil {
+		log.Errorf("Could not sum transactions of wallet %s: %s", wallet.Id.Hex(), err.Error())
+		return err
+	}
+	if sent+amount <= limit {
+		return nil
+	}
+
+	limitErr := &LimitError{Rule: rule, Limit: limit}
+	if sent < limit {
+		limitErr.Remaining = limit - sent
+	}
+	return limitErr
+}
+
+func (s *serviceImpl) GetLimits(walletId string, userId string) (*Limits, error) {
+	wallet, err := findWallet(walletId, userId, VIEW)
+	if err != nil {
+		return nil, err
+	}
+	if wallet.Limits == nil {
+		return &Limits{Allowlist: []*AllowlistEntry{}}, nil
+	}
+	return wallet.Limits.effective(time.Now()), nil
+}
+
+// SetLimits applies stricter limits right away, while less strict ones are kept as pending until the cooling-off
+// period is over. A new request replaces the pending limits.
+func (s *serviceImpl) SetLimits(walletId string, dto LimitsDTO, userId string) error {
+	wallet, err := findWallet(walletId, userId, OWNER)
+	if err != nil {
+		return err
+	}
+	if err := s.userService.RequireStepUp(userId, dto.Totp, dto.StepUpToken); err != nil {
+		return err
+	}
+
+	current := &Limits{}
+	if wallet.Limits != nil {
+		current = wallet.Limits.effective(time.Now())
+	}
+	limits, relaxed := stricterLimits(current, dto)
+
+	var pending *PendingLimits
+	if relaxed {
+		pending = &PendingLimits{
+			MaxAmount:        dto.MaxAmount,
+			DailyLimit:       dto.DailyLimit,
+			WeeklyLimit:      dto.WeeklyLimit,
+			RequireAllowlist: dto.RequireAllowlist,
+			Available:        time.Now().Add(config.Get().Webwallet.Limits.CoolingOffHours * time.Hour),
+		}
+	}
+
+	if err := store.UpdateLimits(wallet.Id, limits, pending); err != nil {
+		log.Errorf("Could not update limits of wallet %s: %s", walletId, err.Error())
+		return err
+	}
+
+	if pending != nil {
+		log.Infof("Updated limits of wallet %s, relaxed limits available at %s", walletId, pending.Available)
+	} else {
+		log.Infof("Updated limits of wallet %s", walletId)
+	}
+	return nil
+}
+
+func (s *serviceImpl) AddAllowlistEntry(walletId string, dto AllowlistEntryDTO, userId string) (*AllowlistEntry, error) {
+	wallet, err := findWallet(walletId, userId, OWNER)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &AllowlistEntry{Address: dto.Address, Label: dto.Label, Added: time.Now()}
+	entry.Available = entry.Added.Add(config.Get().Webwallet.Limits.CoolingOffHours * time.Hour)
+
+	if err := store.AddAllowlistEntry(wallet.Id, entry); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, ErrAlreadyAllowlisted
+		}
+		log.Errorf("Could not add %s to the allowlist of wallet %s: %s", dto.Address, walletId, err.Error())
+		return nil, err
+	}
+
+	log.Infof("Added %s to the allowlist of wallet %s, available at %s", dto.Address, walletId, entry.Available)
+	return entry, nil
+}
+
+func (s *serviceImpl) RemoveAllowlistEntry(walletId string, address string, dto StepUpDTO, userId string) error {
+	wallet, err := findWallet(walletId, userId, OWNER)
+	if err != nil {
+		return err
+	}
+	if err := s.userService.RequireStepUp(userId, dto.Totp, dto.StepUpToken); err != nil {
+		return err
+	}
+
+	err = store.RemoveAllowlistEntry(wallet.Id, address)
+	if err == mgo.ErrNotFound {
+		return ErrNotAllowlisted
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Removed %s from the allowlist of wallet %s", address, walletId)
+	return nil
+}
@@ -0,0 +1,158 @@
+package wallet
+
+import (
+	"github.com/iridiumdev/webwallet-core/user"
+	"gopkg.in/mgo.v2/bson"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCheckLimits(t *testing.T) {
+	f := newFixture("")
+	wallet := storedWallet(f)
+	available := time.Now().Add(time.Hour)
+	wallet.Limits = &Limits{
+		MaxAmount:        1000,
+		DailyLimit:       1500,
+		WeeklyLimit:      3000,
+		RequireAllowlist: true,
+		Allowlist: []*AllowlistEntry{
+			{Address: "ir2known", Available: time.Now().Add(-time.Hour)},
+			{Address: "ir2new", Available: available},
+		},
+	}
+	f.store.InsertTransaction(&Transaction{WalletId: wallet.Id, Amount: 1000, Sent: time.Now().Add(-time.Hour)})
+	f.store.InsertTransaction(&Transaction{WalletId: wallet.Id, Amount: 1500, Sent: time.Now().Add(-48 * time.Hour)})
+
+	cases := []struct {
+		dto TransactionDTO
+		err error
+	}{
+		{TransactionDTO{Address: "ir2known", Amount: 400}, nil},
+		{TransactionDTO{Address: "ir2known", Amount: 1001}, &LimitError{Rule: RuleMaxAmount, Limit: 1000}},
+		{TransactionDTO{Address: "ir2known", Amount: 600}, &LimitError{Rule: RuleDailyLimit, Limit: 1500, Remaining: 500}},
+		{TransactionDTO{Address: "ir2other", Amount: 100}, &LimitError{Rule: RuleAllowlist}},
+		{TransactionDTO{Address: "ir2new", Amount: 100}, &LimitError{Rule: RuleCoolingOff, AvailableAt: &available}},
+	}
+	for _, tc := range cases {
+		if err := checkLimits(wallet, tc.dto); !reflect.DeepEqual(err, tc.err) {
+			t.Errorf("sending %d to %s: expected %v, got %v", tc.dto.Amount, tc.dto.Address, tc.err, err)
+		}
+	}
+
+	wallet.Limits.DailyLimit = 0
+	expected := &LimitError{Rule: RuleWeeklyLimit, Limit: 3000, Remaining: 500}
+	if err := checkLimits(wallet, TransactionDTO{Address: "ir2known", Amount: 600}); !reflect.DeepEqual(err, expected) {
+		t.Errorf("expected %v, got %v", expected, err)
+	}
+}
+
+func TestRelaxedLimitsWaitForCoolingOff(t *testing.T) {
+	current := &Limits{MaxAmount: 1000, DailyLimit: 1500, RequireAllowlist: true}
+
+	limits, relaxed := stricterLimits(current, LimitsDTO{MaxAmount: 500, DailyLimit: 1500, WeeklyLimit: 3000, RequireAllowlist: true})
+	if relaxed || limits.MaxAmount != 500 || limits.WeeklyLimit != 3000 {
+		t.Errorf("expected stricter limits to apply right away, got %+v %v", limits, relaxed)
+	}
+
+	cases := []LimitsDTO{
+		{MaxAmount: 2000, DailyLimit: 1500, RequireAllowlist: true},
+		{MaxAmount: 0, DailyLimit: 1500, RequireAllowlist: true},
+		{MaxAmount: 1000, DailyLimit: 1500, RequireAllowlist: false},
+	}
+	for _, dto := range cases {
+		limits, relaxed := stricterLimits(current, dto)
+		if !relaxed || limits.MaxAmount != 1000 || limits.DailyLimit != 1500 || !limits.RequireAllowlist {
+			t.Errorf("expected %+v to keep the current limits, got %+v %v", dto, limits, relaxed)
+		}
+	}
+
+	current.Pending = &PendingLimits{MaxAmount: 2000, Available: time.Now().Add(time.Hour)}
+	if limits := current.effective(time.Now()); limits.MaxAmount != 1000 || limits.Pending == nil {
+		t.Errorf("expected the pending limits to wait for the cooling-off period, got %+v", limits)
+	}
+	if limits := current.effective(time.Now().Add(2 * time.Hour)); limits.MaxAmount != 2000 || limits.RequireAllowlist || limits.Pending != nil {
+		t.Errorf("expected the pending limits to replace the current ones, got %+v", limits)
+	}
+}
+
+func TestChangingLimitsRequiresStepUp(t *testing.T) {
+	f := newFixture("")
+	f.users.totp = "123456"
+	wallet := storedWallet(f)
+	owner := wallet.Owner.Hex()
+	f.store.AddAllowlistEntry(wallet.Id, &AllowlistEntry{Address: "ir2known"})
+
+	if err := f.service.SetLimits(wallet.Id.Hex(), LimitsDTO{MaxAmount: 100}, owner); err != user.ErrTotpRequired {
+		t.Errorf("expected %v, got %v", user.ErrTotpRequired, err)
+	}
+	if err := f.service.RemoveAllowlistEntry(wallet.Id.Hex(), "ir2known", StepUpDTO{}, owner); err != user.ErrTotpRequired {
+		t.Errorf("expected %v, got %v", user.ErrTotpRequired, err)
+	}
+
+	stepUp := StepUpDTO{StepUpToken: "step-up"}
+	if err := f.service.SetLimits(wallet.Id.Hex(), LimitsDTO{StepUpDTO: stepUp, MaxAmount: 100}, owner); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.service.RemoveAllowlistEntry(wallet.Id.Hex(), "ir2known", stepUp, owner); err != nil {
+		t.Fatal(err)
+	}
+	if limits := f.store.wallets[wallet.Id].Limits; limits.MaxAmount != 100 || limits.Pending != nil || len(limits.Allowlist) != 0 {
+		t.Errorf("expected the stricter limits to apply right away, got %+v", limits)
+	}
+}
+
+func TestSendTransactionEnforcesLimits(t *testing.T) {
+	f := newFixture("")
+	member := bson.NewObjectId()
+	wallet := syncedWallet(t, f, map[bson.ObjectId]Permission{member: SEND})
+
+	if err := f.service.SetLimits(wallet.Id.Hex(), LimitsDTO{MaxAmount: 100}, member.Hex()); err != ErrPermissionDenied {
+		t.Errorf("expected %v, got %v", ErrPermissionDenied, err)
+	}
+	if err := f.service.SetLimits(wallet.Id.Hex(), LimitsDTO{MaxAmount: 100}, wallet.Owner.Hex()); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := f.service.SendTransaction(wallet.Id.Hex(), TransactionDTO{Address: "ir2other", Amount: 500, Fee: 10}, member.Hex())
+	if limitErr, ok := err.(*LimitError); !ok || limitErr.Rule != RuleMaxAmount {
+		t.Errorf("expected the max amount to block the transfer, got %v", err)
+	}
+	if len(f.runtime.walletd.sent) != 0 {
+		t.Errorf("expected nothing to be sent, got %v", f.runtime.walletd.sent)
+	}
+
+	if _, err := f.service.SendTransaction(wallet.Id.Hex(), TransactionDTO{Address: "ir2other", Amount: 50, Fee: 10}, member.Hex()); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.store.transactions) != 1 || f.store.transactions[0].SentBy != member {
+		t.Errorf("expected the transaction to be recorded, got %v", f.store.transactions)
+	}
+}
+
+func TestParallelTransfersRespectDailyLimit(t *testing.T) {
+	f := newFixture("")
+	wallet := syncedWallet(t, f, nil)
+	if err := f.service.SetLimits(wallet.Id.Hex(), LimitsDTO{DailyLimit: 100}, wallet.Owner.Hex()); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f.service.SendTransaction(wallet.Id.Hex(), TransactionDTO{Address: "ir2other", Amount: 50, Fee: 10}, wallet.Owner.Hex())
+		}()
+	}
+	wg.Wait()
+
+	if len(f.runtime.walletd.sent) != 2 || len(f.store.transactions) != 2 {
+		t.Errorf("expected only two transfers within the daily limit, got %d", len(f.runtime.walletd.sent))
+	}
+	if len(f.service.transferLocks) != 0 {
+		t.Errorf("expected the transfer locks to be dropped, got %v", f.service.transferLocks)
+	}
+}
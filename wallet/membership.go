@@ -0,0 +1,220 @@
+package wallet
+
+import (
+	"github.com/iridiumdev/webwallet-core/event"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+// Permission is the access a user has to a wallet. Each permission includes the ones before it, the owner of a wallet
+// has all permissions and is the only one who may manage its members.
+type Permission string
+
+const (
+	VIEW    Permission = "VIEW"
+	PROPOSE Permission = "PROPOSE"
+	SEND    Permission = "SEND"
+	OWNER   Permission = "OWNER"
+)
+
+var permissionRanks = map[Permission]int{VIEW: 1, PROPOSE: 2, SEND: 3, OWNER: 4}
+
+// Includes reports whether a user with this permission may do what requires the given permission.
+func (p Permission) Includes(required Permission) bool {
+	return permissionRanks[required] > 0 && permissionRanks[p] >= permissionRanks[required]
+}
+
+// isGrantable reports whether the permission may be granted to a member, ownership can not be shared.
+func (p Permission) isGrantable() bool {
+	return p == VIEW || p == PROPOSE || p == SEND
+}
+
+// Membership grants a user access to the wallet of another user. It is created as an invitation, which only grants
+// access once the invited user accepted it.
+type Membership struct {
+	Id         bson.ObjectId `json:"id" bson:"_id,omitempty"`
+	WalletId   bson.ObjectId `json:"walletId" bson:"walletId"`
+	WalletName string        `json:"walletName" bson:"walletName"`
+	UserId     bson.ObjectId `json:"userId" bson:"userId"`
+	Username   string        `json:"username" bson:"username"`
+	Permission Permission    `json:"permission" bson:"permission"`
+	InvitedBy  bson.ObjectId `json:"invitedBy" bson:"invitedBy"`
+	Created    time.Time     `json:"created" bson:"created"`
+	Accepted   bool          `json:"accepted" bson:"accepted"`
+}
+
+type InvitationDTO struct {
+	Username   string     `json:"username" binding:"required"`
+	Permission Permission `json:"permission" binding:"required"`
+}
+
+type PermissionDTO struct {
+	Permission Permission `json:"permission" binding:"required"`
+}
+
+// findWallet resolves the access of the user to the wallet through its owner and memberships. Users without any access
+// get ErrWalletNotFound, so they can not tell whether the wallet exists.
+func findWallet(walletId string, userId string, required Permission) (*Wallet, error) {
+	wallet, permission, err := resolveWallet(walletId, userId)
+	if err != nil {
+		return nil, err
+	}
+	if !permission.Includes(required) {
+		log.Warnf("User %s has no %s permission on wallet %s", userId, required, walletId)
+		return nil, ErrPermissionDenied
+	}
+	return wallet, nil
+}
+
+// resolveWallet returns the wallet along with the permission of the user, who is either its owner or an accepted
+// member.
+func resolveWallet(walletId string, userId string) (*Wallet, Permission, error) {
+	if !bson.IsObjectIdHex(walletId) || !bson.IsObjectIdHex(userId) {
+		return nil, "", ErrWalletNotFound
+	}
+
+	wallet, permission, err := store.FindWalletByMember(bson.ObjectIdHex(walletId), bson.ObjectIdHex(userId))
+	if err != nil || wallet == nil {
+		log.Warnf("Could not find wallet %s for user %s", walletId, userId)
+		return nil, "", ErrWalletNotFound
+	}
+	return wallet, permission, nil
+}
+
+// sendToMembers sends the event to the owner and all members of the wallet.
+func sendToMembers(eventService event.Service, wallet *Wallet, eventType string, payload interface{}) {
+	eventService.SendToUsers(memberIds(wallet), eventType, wallet.Id.Hex(), payload)
+}
+
+// notifyMembers sends the snapshot of the wallet to the owner and all members without logging it for the replay.
+func notifyMembers(eventService event.Service, wallet *Wallet, eventType string, payload interface{}) {
+	eventService.NotifyUsers(memberIds(wallet), eventType, wallet.Id.Hex(), payload)
+}
+
+// memberIds returns the ids of the owner and the accepted members of the wallet.
+func memberIds(wallet *Wallet) []string {
+	userIds := []string{wallet.Owner.Hex()}
+
+	members, err := store.FindMembers(wallet.Id)
+	if err != nil {
+		log.Warnf("Could not find members of wallet %s: %s", wallet.Id.Hex(), err.Error())
+	}
+	for _, member := range members {
+		if member.Accepted {
+			userIds = append(userIds, member.UserId.Hex())
+		}
+	}
+	return userIds
+}
+
+func (s *serviceImpl) GetMembers(walletId string, userId string) ([]*Membership, error) {
+	wallet, err := findWallet(walletId, userId, VIEW)
+	if err != nil {
+		return nil, err
+	}
+	return store.FindMembers(wallet.Id)
+}
+
+func (s *serviceImpl) InviteMember(walletId string, dto InvitationDTO, userId string) (*Membership, error) {
+	wallet, err := findWallet(walletId, userId, OWNER)
+	if err != nil {
+		return nil, err
+	}
+	if !dto.Permission.isGrantable() {
+		return nil, ErrInvalidPermission
+	}
+
+	invitee, err := s.userService.GetUserByUsername(dto.Username)
+	if err != nil {
+		return nil, err
+	}
+	if invitee.Id == wallet.Owner {
+		return nil, ErrAlreadyMember
+	}
+
+	membership := &Membership{
+		Id:         bson.NewObjectId(),
+		WalletId:   wallet.Id,
+		WalletName: wallet.Name,
+		UserId:     invitee.Id,
+		Username:   invitee.Username,
+		Permission: dto.Permission,
+		InvitedBy:  wallet.Owner,
+		Created:    time.Now(),
+	}
+	if err := store.InsertMembership(membership); err != nil {
+		if mgo.IsDup(err) {
+			return nil, ErrAlreadyMember
+		}
+		log.Errorf("Could not store membership of user %s in wallet %s: %s", invitee.Id.Hex(), walletId, err.Error())
+		return nil, err
+	}
+
+	log.Infof("Invited user %s to wallet %s with permission %s", invitee.Id.Hex(), walletId, dto.Permission)
+	return membership, nil
+}
+
+func (s *serviceImpl) UpdateMember(walletId string, memberId string, permission Permission, userId string) error {
+	wallet, err := findWallet(walletId, userId, OWNER)
+	if err != nil {
+		return err
+	}
+	if !permission.isGrantable() {
+		return ErrInvalidPermission
+	}
+	if !bson.IsObjectIdHex(memberId) {
+		return ErrMemberNotFound
+	}
+
+	err = store.UpdatePermission(wallet.Id, bson.ObjectIdHex(memberId), permission)
+	if err == mgo.ErrNotFound {
+		return ErrMemberNotFound
+	}
+	return err
+}
+
+func (s *serviceImpl) RemoveMember(walletId string, memberId string, userId string) error {
+	if !bson.IsObjectIdHex(walletId) || !bson.IsObjectIdHex(memberId) {
+		return ErrMemberNotFound
+	}
+	if memberId != userId {
+		if _, err := findWallet(walletId, userId, OWNER); err != nil {
+			return err
+		}
+	}
+
+	err := store.DeleteMembership(bson.ObjectIdHex(walletId), bson.ObjectIdHex(memberId))
+	if err == mgo.ErrNotFound {
+		return ErrMemberNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Removed user %s from wallet %s", memberId, walletId)
+	return nil
+}
+
+func (s *serviceImpl) GetInvitations(userId string) ([]*Membership, error) {
+	return store.FindInvitations(bson.ObjectIdHex(userId))
+}
+
+func (s *serviceImpl) AcceptInvitation(walletId string, userId string) error {
+	if !bson.IsObjectIdHex(walletId) {
+		return ErrInvitationNotFound
+	}
+
+	membership, err := store.FindMembership(bson.ObjectIdHex(walletId), bson.ObjectIdHex(userId))
+	if err != nil || membership == nil || membership.Accepted {
+		return ErrInvitationNotFound
+	}
+
+	if err := store.AcceptMembership(membership.WalletId, membership.UserId); err != nil {
+		return err
+	}
+
+	log.Infof("User %s joined wallet %s", userId, walletId)
+	return nil
+}
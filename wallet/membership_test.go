@@ -0,0 +1,100 @@
+package wallet
+
+import (
+	"github.com/iridiumdev/webwallet-core/user"
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+)
+
+func TestPermissionIncludes(t *testing.T) {
+	if !SEND.Includes(PROPOSE) || !OWNER.Includes(SEND) || PROPOSE.Includes(SEND) || VIEW.Includes(PROPOSE) {
+		t.Error("expected permissions to include all lower ranked ones")
+	}
+	if Permission("admin").Includes(VIEW) || VIEW.Includes(Permission("admin")) {
+		t.Error("expected unknown permissions to include nothing")
+	}
+}
+
+func TestInviteAndAcceptMember(t *testing.T) {
+	f := newFixture("")
+	wallet := storedWallet(f)
+	member := &user.User{Id: bson.NewObjectId(), Username: "member"}
+	f.users.users = []*user.User{member}
+
+	if _, err := f.service.InviteMember(wallet.Id.Hex(), InvitationDTO{Username: "member", Permission: OWNER}, wallet.Owner.Hex()); err != ErrInvalidPermission {
+		t.Errorf("expected %v, got %v", ErrInvalidPermission, err)
+	}
+	if _, err := f.service.InviteMember(wallet.Id.Hex(), InvitationDTO{Username: "unknown", Permission: VIEW}, wallet.Owner.Hex()); err != user.ErrUserNotFound {
+		t.Errorf("expected %v, got %v", user.ErrUserNotFound, err)
+	}
+	if _, err := f.service.InviteMember(wallet.Id.Hex(), InvitationDTO{Username: "member", Permission: VIEW}, member.Id.Hex()); err != ErrWalletNotFound {
+		t.Errorf("expected strangers not to see the wallet, got %v", err)
+	}
+
+	if _, err := f.service.InviteMember(wallet.Id.Hex(), InvitationDTO{Username: "member", Permission: VIEW}, wallet.Owner.Hex()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.service.InviteMember(wallet.Id.Hex(), InvitationDTO{Username: "member", Permission: SEND}, wallet.Owner.Hex()); err != ErrAlreadyMember {
+		t.Errorf("expected %v, got %v", ErrAlreadyMember, err)
+	}
+
+	// pending invitations do not grant access yet
+	if _, err := f.service.GetWallet(wallet.Id.Hex(), member.Id.Hex()); err != ErrWalletNotFound {
+		t.Errorf("expected %v before accepting, got %v", ErrWalletNotFound, err)
+	}
+	if invitations, _ := f.service.GetInvitations(member.Id.Hex()); len(invitations) != 1 {
+		t.Errorf("expected one invitation, got %v", invitations)
+	}
+
+	if err := f.service.AcceptInvitation(wallet.Id.Hex(), member.Id.Hex()); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.service.AcceptInvitation(wallet.Id.Hex(), member.Id.Hex()); err != ErrInvitationNotFound {
+		t.Errorf("expected %v, got %v", ErrInvitationNotFound, err)
+	}
+
+	f.runtime.satellites[wallet.Id.Hex()] = true
+	if _, err := f.service.GetWallet(wallet.Id.Hex(), member.Id.Hex()); err != nil {
+		t.Errorf("expected member to view the wallet, got %v", err)
+	}
+	if wallets, _ := f.service.GetWallets(member.Id.Hex()); len(wallets) != 1 {
+		t.Errorf("expected the shared wallet to be listed, got %v", wallets)
+	}
+	if _, err := f.service.SendTransaction(wallet.Id.Hex(), TransactionDTO{}, member.Id.Hex()); err != ErrPermissionDenied {
+		t.Errorf("expected %v, got %v", ErrPermissionDenied, err)
+	}
+	if _, err := f.service.StopWallet(wallet.Id.Hex(), member.Id.Hex()); err != ErrPermissionDenied {
+		t.Errorf("expected %v, got %v", ErrPermissionDenied, err)
+	}
+}
+
+func TestUpdateAndRemoveMember(t *testing.T) {
+	f := newFixture("")
+	wallet := storedWallet(f)
+	member := bson.NewObjectId()
+	f.store.InsertMembership(&Membership{Id: bson.NewObjectId(), WalletId: wallet.Id, UserId: member, Permission: VIEW, Accepted: true})
+
+	if err := f.service.UpdateMember(wallet.Id.Hex(), member.Hex(), SEND, member.Hex()); err != ErrPermissionDenied {
+		t.Errorf("expected members not to change permissions, got %v", err)
+	}
+	if err := f.service.UpdateMember(wallet.Id.Hex(), member.Hex(), SEND, wallet.Owner.Hex()); err != nil {
+		t.Fatal(err)
+	}
+	if _, permission, _ := f.store.FindWalletByMember(wallet.Id, member); permission != SEND {
+		t.Errorf("expected permission %s, got %s", SEND, permission)
+	}
+	if err := f.service.UpdateMember(wallet.Id.Hex(), bson.NewObjectId().Hex(), SEND, wallet.Owner.Hex()); err != ErrMemberNotFound {
+		t.Errorf("expected %v, got %v", ErrMemberNotFound, err)
+	}
+
+	// members may leave on their own
+	if err := f.service.RemoveMember(wallet.Id.Hex(), member.Hex(), member.Hex()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.service.GetWallet(wallet.Id.Hex(), member.Hex()); err != ErrWalletNotFound {
+		t.Errorf("expected %v after leaving, got %v", ErrWalletNotFound, err)
+	}
+	if err := f.service.RemoveMember(wallet.Id.Hex(), member.Hex(), wallet.Owner.Hex()); err != ErrMemberNotFound {
+		t.Errorf("expected %v, got %v", ErrMemberNotFound, err)
+	}
+}
@@ -1,6 +1,10 @@
 package wallet
 
-import "gopkg.in/mgo.v2/bson"
+import (
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
 
 type PasswordDTO struct {
 	Password string `json:"password" binding:"required,min=8"`
@@ -23,6 +27,8 @@ const (
 	STOPPED InstanceStatus = "STOPPED"
 	RUNNING InstanceStatus = "RUNNING"
 	ERROR   InstanceStatus = "ERROR"
+	SYNCING InstanceStatus = "SYNCING"
+	SYNCED  InstanceStatus = "SYNCED"
 )
 
 type Balance struct {
@@ -35,21 +41,91 @@ type BlockHeight struct {
 	Top     uint32 `json:"top"`
 }
 
+// SyncProgress describes how far the satellite of a wallet caught up with the network, based on the block counts the
+// status watcher collected recently. The ETA is omitted as long as no progress could be measured.
+type SyncProgress struct {
+	Percentage      float64 `json:"percentage"`
+	BlocksPerSecond float64 `json:"blocksPerSecond"`
+	EtaSeconds      *int64  `json:"etaSeconds,omitempty"`
+}
+
+type TransactionDTO struct {
+	Address   string `json:"address" binding:"required"`
+	Amount    uint64 `json:"amount" binding:"required,min=1"`
+	Fee       uint64 `json:"fee" binding:"required,min=1"`
+	Anonymity uint32 `json:"anonymity"`
+	PaymentId string `json:"paymentId"`
+	// current code of the authenticator app, required if the user enabled totp
+	Totp string `json:"totp"`
+	// token issued for a passkey assertion, accepted instead of the totp code
+	StepUpToken string `json:"stepUpToken"`
+}
+
+// Transaction is a transfer sent from a wallet. Sent transactions are recorded to enforce the daily limits of policies.
+type Transaction struct {
+	Id        bson.ObjectId `json:"-" bson:"_id,omitempty"`
+	WalletId  bson.ObjectId `json:"-" bson:"walletId"`
+	Hash      string        `json:"hash" bson:"hash"`
+	Address   string        `json:"address" bson:"address"`
+	Amount    uint64        `json:"amount" bson:"amount"`
+	Fee       uint64        `json:"fee" bson:"fee"`
+	PaymentId string        `json:"paymentId,omitempty" bson:"paymentId,omitempty"`
+	SentBy    bson.ObjectId `json:"sentBy" bson:"sentBy"`
+	Sent      time.Time     `json:"sent" bson:"sent"`
+}
+
 type Wallet struct {
-	Id      bson.ObjectId  `json:"id" bson:"_id,omitempty"`
-	Name    string         `json:"name" bson:"name"`
-	Address string         `json:"address" bson:"address"`
-	Owner   bson.ObjectId  `json:"owner" bson:"owner"`
-	Status  InstanceStatus `json:"status" bson:"-"`
+	Id        bson.ObjectId  `json:"id" bson:"_id,omitempty"`
+	Name      string         `json:"name" bson:"name"`
+	Address   string         `json:"address" bson:"address"`
+	Owner     bson.ObjectId  `json:"owner" bson:"owner"`
+	Status    InstanceStatus `json:"status" bson:"-"`
+	Volume    string         `json:"-" bson:"volume,omitempty"`
+	LastError *InstanceError `json:"lastError,omitempty" bson:"lastError,omitempty"`
+	Policy    *Policy        `json:"policy,omitempty" bson:"policy,omitempty"`
+	Limits    *Limits        `json:"limits,omitempty" bson:"limits,omitempty"`
+
+	// endpoint of the daemon node the satellite was started with, only known while the wallet is running
+	Daemon string `json:"-" bson:"-"`
+}
+
+// InstanceError describes the last problem the status watcher detected on the satellite of a wallet.
+type InstanceError struct {
+	Message  string    `json:"message" bson:"message"`
+	Time     time.Time `json:"time" bson:"time"`
+	Failures int       `json:"failures" bson:"failures"`
+	Restarts int       `json:"restarts" bson:"restarts"`
+}
+
+// volumeName returns the name of the volume holding the wallets data. Wallets which took over a volume of an idle
+// satellite keep its name, all others use the default one derived from the wallet id.
+func (w *Wallet) volumeName() string {
+	if w.Volume != "" {
+		return w.Volume
+	}
+	return fmt.Sprintf("%s.wallet", w.Id.Hex())
+}
+
+// InstanceState is a wallet of any user together with the state of its satellite, for the operators.
+type InstanceState struct {
+	*Wallet
+	// error of the health check through the runtime, only checked for running wallets
+	HealthError string `json:"healthError,omitempty"`
+	Watched     bool   `json:"watched"`
+	Busy        bool   `json:"busy"`
 }
 
 type LoadedWallet struct {
 	*Wallet
+
+	// the password is kept in memory while the wallet is running, so the watcher is able to restart its satellite
+	password string
 }
 
 type DetailedWallet struct {
 	*LoadedWallet
-	Balance     Balance     `json:"balance"`
-	BlockHeight BlockHeight `json:"blockHeight"`
-	PeerCount   uint8       `json:"peerCount"`
+	Balance     Balance      `json:"balance"`
+	BlockHeight BlockHeight  `json:"blockHeight"`
+	Sync        SyncProgress `json:"sync"`
+	PeerCount   uint8        `json:"peerCount"`
 }
@@ -0,0 +1,473 @@
+package wallet
+
+import (
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+// Policy decides which transfers of a wallet need the approval of other members before they are sent. A transfer
+// needs approval if any of the configured rules applies to it, the zero value of a rule disables it.
+type Policy struct {
+	// transfers above this amount need approval
+	Threshold uint64 `json:"threshold" bson:"threshold"`
+	// transfers which would raise the amount sent within the last 24 hours above this limit need approval
+	DailyLimit uint64 `json:"dailyLimit" bson:"dailyLimit"`
+	// transfers to addresses which are not on the list need approval
+	Allowlist []string `json:"allowlist" bson:"allowlist"`
+
+	// number of approvals a transfer needs to be sent
+	Approvals int `json:"approvals" bson:"approvals" binding:"min=1"`
+	// users who may approve transfers, all members with the SEND permission if empty
+	Approvers []bson.ObjectId `json:"approvers" bson:"approvers"`
+}
+
+type ProposalStatus string
+
+const (
+	PENDING   ProposalStatus = "PENDING"
+	EXECUTING ProposalStatus = "EXECUTING"
+	EXECUTED  ProposalStatus = "EXECUTED"
+	REJECTED  ProposalStatus = "REJECTED"
+	FAILED    ProposalStatus = "FAILED"
+)
+
+const (
+	ReasonProposer   = "proposer may not send"
+	ReasonThreshold  = "amount above threshold"
+	ReasonDailyLimit = "daily limit exceeded"
+	ReasonAllowlist  = "destination not allowlisted"
+	// the policy itself is changed, which needs the approvals of the current policy
+	ReasonPolicyChange = "policy change"
+)
+
+// Proposal is a transfer or a change of the policy waiting for the approval of the members of a wallet. It keeps every
+// decision, so it remains traceable who approved or rejected it.
+type Proposal struct {
+	Id        bson.ObjectId  `json:"id" bson:"_id,omitempty"`
+	WalletId  bson.ObjectId  `json:"walletId" bson:"walletId"`
+	Proposer  bson.ObjectId  `json:"proposer" bson:"proposer"`
+	Address   string         `json:"address" bson:"address"`
+	Amount    uint64         `json:"amount" bson:"amount"`
+	Fee       uint64         `json:"fee" bson:"fee"`
+	Anonymity uint32         `json:"anonymity" bson:"anonymity"`
+	PaymentId string         `json:"paymentId,omitempty" bson:"paymentId,omitempty"`
+	Reasons   []string       `json:"reasons" bson:"reasons"`
+	Required  int            `json:"required" bson:"required"`
+	Decisions []*Decision    `json:"decisions" bson:"decisions"`
+	Status    ProposalStatus `json:"status" bson:"status"`
+	Hash      string         `json:"hash,omitempty" bson:"hash,omitempty"`
+	Error     string         `json:"error,omitempty" bson:"error,omitempty"`
+	Created   time.Time      `json:"created" bson:"created"`
+
+	// whether the proposal replaces the policy instead of sending a transfer, a change without policy removes it
+	PolicyChange bool    `json:"policyChange,omitempty" bson:"policyChange,omitempty"`
+	Policy       *Policy `json:"policy,omitempty" bson:"policy,omitempty"`
+}
+
+type Decision struct {
+	UserId   bson.ObjectId `json:"userId" bson:"userId"`
+	Approved bool          `json:"approved" bson:"approved"`
+	Comment  string        `json:"comment,omitempty" bson:"comment,omitempty"`
+	Time     time.Time     `json:"time" bson:"time"`
+}
+
+type DecisionDTO struct {
+	Comment string `json:"comment" binding:"max=255"`
+	// current code of the authenticator app, required to approve if the user enabled totp
+	Totp string `json:"totp"`
+	// token issued for a passkey assertion, accepted instead of the totp code
+	StepUpToken string `json:"stepUpToken"`
+}
+
+// ApprovalRequiredError is returned instead of sending a transfer or changing the policy if the policy of the wallet
+// requires approval for it. The transfer or change is kept as the pending proposal.
+type ApprovalRequiredError struct {
+	Proposal *Proposal
+}
+
+func (e *ApprovalRequiredError) Error() string {
+	if e.Proposal.PolicyChange {
+		return "policy change requires approval"
+	}
+	return "transfer requires approval"
+}
+
+var (
+	ErrPolicyNotFound     = errors.New("wallet has no policy")
+	ErrInvalidPolicy      = errors.New("policy requires more approvals than it has approvers")
+	ErrInvalidApprover    = errors.New("approvers must be the owner or members with the SEND permission")
+	ErrProposalNotFound   = errors.New("proposal not found")
+	ErrProposalNotPending = errors.New("proposal is not pending")
+	ErrAlreadyDecided     = errors.New("user already decided on the proposal")
+	ErrNotApprover        = errors.New("user may not approve transfers of the wallet")
+)
+
+func (p *Proposal) approvals() int {
+	approvals := 0
+	for _, decision := range p.Decisions {
+		if decision.Approved {
+			approvals++
+		}
+	}
+	return approvals
+}
+
+func (p *Proposal) transactionDTO() TransactionDTO {
+	return TransactionDTO{
+		Address:   p.Address,
+		Amount:    p.Amount,
+		Fee:       p.Fee,
+		Anonymity: p.Anonymity,
+		PaymentId: p.PaymentId,
+	}
+}
+
+// isApprover reports whether a user with the given permission may approve transfers of the wallet.
+func isApprover(wallet *Wallet, userId bson.ObjectId, permission Permission) bool {
+	if !permission.Includes(SEND) {
+		return false
+	}
+	if wallet.Policy == nil || len(wallet.Policy.Approvers) == 0 {
+		return true
+	}
+	for _, approver := range wallet.Policy.Approvers {
+		if approver == userId {
+			return true
+		}
+	}
+	return false
+}
+
+// approvalReasons returns why the transfer needs approval, none if it may be sent right away.
+func approvalReasons(wallet *Wallet, permission Permission, dto TransactionDTO) ([]string, error) {
+	var reasons []string
+	if !permission.Includes(SEND) {
+		reasons = append(reasons, ReasonProposer)
+	}
+
+	policy := wallet.Policy
+	if policy == nil {
+		return reasons, nil
+	}
+	if policy.Threshold > 0 && dto.Amount > policy.Threshold {
+		reasons = append(reasons, ReasonThreshold)
+	}
+	if policy.DailyLimit > 0 {
+		sent, err := store.SumTransactions(wallet.Id, time.Now().Add(-24*time.Hour))
+		if err != nil {
+			log.Errorf("Could not sum transactions of wallet %s: %s", wallet.Id.Hex(), err.Error())
+			return nil, err
+		}
+		if sent+dto.Amount > policy.DailyLimit {
+			reasons = append(reasons, ReasonDailyLimit)
+		}
+	}
+	if len(policy.Allowlist) > 0 && !contains(policy.Allowlist, dto.Address) {
+		reasons = append(reasons, ReasonAllowlist)
+	}
+	return reasons, nil
+}
+
+// validatePolicy makes sure the policy can be satisfied. It may not require more approvals than there are users who
+// may approve: the listed approvers, or the owner and all members with the SEND permission if none are listed.
+func validatePolicy(wallet *Wallet, policy *Policy) error {
+	if policy == nil {
+		return nil
+	}
+
+	members, err := store.FindMembers(wallet.Id)
+	if err != nil {
+		log.Errorf("Could not find members of wallet %s: %s", wallet.Id.Hex(), err.Error())
+		return err
+	}
+	eligible := map[bson.ObjectId]bool{wallet.Owner: true}
+	for _, member := range members {
+		if member.Accepted && member.Permission.Includes(SEND) {
+			eligible[member.UserId] = true
+		}
+	}
+
+	approvers := len(eligible)
+	if len(policy.Approvers) > 0 {
+		listed := map[bson.ObjectId]bool{}
+		for _, approver := range policy.Approvers {
+			if !eligible[approver] {
+				return ErrInvalidApprover
+			}
+			listed[approver] = true
+		}
+		approvers = len(listed)
+	}
+	if policy.Approvals > approvers {
+		return ErrInvalidPolicy
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *serviceImpl) GetPolicy(walletId string, userId string) (*Policy, error) {
+	wallet, err := findWallet(walletId, userId, VIEW)
+	if err != nil {
+		return nil, err
+	}
+	return wallet.Policy, nil
+}
+
+func (s *serviceImpl) SetPolicy(walletId string, policy *Policy, userId string) error {
+	wallet, err := findWallet(walletId, userId, OWNER)
+	if err != nil {
+		return err
+	}
+	if err := validatePolicy(wallet, policy); err != nil {
+		return err
+	}
+	if wallet.Policy == nil {
+		return updatePolicy(wallet, policy)
+	}
+
+	// the policy guards its own changes, otherwise the owner could lift it to send transfers without approval
+	proposal := &Proposal{
+		Id:           bson.NewObjectId(),
+		WalletId:     wallet.Id,
+		Proposer:     bson.ObjectIdHex(userId),
+		Reasons:      []string{ReasonPolicyChange},
+		Required:     wallet.Policy.Approvals,
+		Decisions:    []*Decision{},
+		Status:       PENDING,
+		Created:      time.Now(),
+		PolicyChange: true,
+		Policy:       policy,
+	}
+	_, err = s.submit(wallet, proposal, OWNER)
+	return err
+}
+
+// updatePolicy replaces the policy of the wallet. It is validated again, as the members may have changed since the
+// change was proposed.
+func updatePolicy(wallet *Wallet, policy *Policy) error {
+	if err := validatePolicy(wallet, policy); err != nil {
+		return err
+	}
+	if err := store.UpdatePolicy(wallet.Id, policy); err != nil {
+		log.Errorf("Could not update policy of wallet %s: %s", wallet.Id.Hex(), err.Error())
+		return err
+	}
+
+	log.Infof("Updated policy of wallet %s", wallet.Id.Hex())
+	return nil
+}
+
+func (s *serviceImpl) GetProposals(walletId string, userId string) ([]*Proposal, error) {
+	wallet, err := findWallet(walletId, userId, VIEW)
+	if err != nil {
+		return nil, err
+	}
+	return store.FindProposals(wallet.Id)
+}
+
+func (s *serviceImpl) GetProposal(walletId string, proposalId string, userId string) (*Proposal, error) {
+	wallet, err := findWallet(walletId, userId, VIEW)
+	if err != nil {
+		return nil, err
+	}
+	return findProposal(wallet.Id, proposalId)
+}
+
+// propose stores the transfer as a proposal, which the proposer approves right away if allowed to. Once the proposal
+// has enough approvals, it is sent and the transaction is returned.
+func (s *serviceImpl) propose(wallet *Wallet, permission Permission, dto TransactionDTO, reasons []string, userId string) (*Transaction, error) {
+	proposal := &Proposal{
+		Id:        bson.NewObjectId(),
+		WalletId:  wallet.Id,
+		Proposer:  bson.ObjectIdHex(userId),
+		Address:   dto.Address,
+		Amount:    dto.Amount,
+		Fee:       dto.Fee,
+		Anonymity: dto.Anonymity,
+		PaymentId: dto.PaymentId,
+		Reasons:   reasons,
+		Required:  1,
+		Decisions: []*Decision{},
+		Status:    PENDING,
+		Created:   time.Now(),
+	}
+	if wallet.Policy != nil {
+		proposal.Required = wallet.Policy.Approvals
+	}
+	return s.submit(wallet, proposal, permission)
+}
+
+// submit stores the proposal and executes it right away if the approval of the proposer is enough.
+func (s *serviceImpl) submit(wallet *Wallet, proposal *Proposal, permission Permission) (*Transaction, error) {
+	if isApprover(wallet, proposal.Proposer, permission) {
+		proposal.Decisions = append(proposal.Decisions, &Decision{UserId: proposal.Proposer, Approved: true, Time: proposal.Created})
+	}
+
+	if err := store.InsertProposal(proposal); err != nil {
+		log.Errorf("Could not store proposal for wallet %s: %s", wallet.Id.Hex(), err.Error())
+		return nil, err
+	}
+	log.Infof("Proposed %s of wallet %s: %v", proposal.Id.Hex(), wallet.Id.Hex(), proposal.Reasons)
+
+	if proposal.approvals() < proposal.Required {
+		return nil, &ApprovalRequiredError{Proposal: proposal}
+	}
+	return s.execute(wallet, proposal)
+}
+
+func (s *serviceImpl) ApproveProposal(walletId string, proposalId string, dto DecisionDTO, userId string) (*Proposal, error) {
+	wallet, permission, err := resolveWallet(walletId, userId)
+	if err != nil {
+		return nil, err
+	}
+	if !isApprover(wallet, bson.ObjectIdHex(userId), permission) {
+		return nil, ErrNotApprover
+	}
+
+	unlock := s.lockTransfers(walletId)
+	defer unlock()
+
+	proposal, err := findProposal(wallet.Id, proposalId)
+	if err != nil {
+		return nil, err
+	}
+	// the approval is only recorded if the transfer could be sent, the approver has to try again later otherwise
+	if !proposal.PolicyChange && proposal.approvals()+1 >= proposal.Required {
+		if err := s.checkSendable(walletId); err != nil {
+			return nil, err
+		}
+		if err := checkLimits(wallet, proposal.transactionDTO()); err != nil {
+			return nil, err
+		}
+	}
+
+	// a step-up token is single use, so it is only redeemed once the approval would be accepted
+	if err := s.userService.RequireStepUp(userId, dto.Totp, dto.StepUpToken); err != nil {
+		return nil, err
+	}
+
+	proposal, err = s.decide(wallet, proposalId, &Decision{UserId: bson.ObjectIdHex(userId), Approved: true, Comment: dto.Comment})
+	if err != nil || proposal.approvals() < proposal.Required {
+		return proposal, err
+	}
+
+	_, err = s.execute(wallet, proposal)
+	return proposal, err
+}
+
+// RejectProposal rejects the proposal on behalf of an approver or withdraws it on behalf of its proposer. A single
+// rejection is final.
+func (s *serviceImpl) RejectProposal(walletId string, proposalId string, dto DecisionDTO, userId string) (*Proposal, error) {
+	wallet, permission, err := resolveWallet(walletId, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	proposal, err := findProposal(wallet.Id, proposalId)
+	if err != nil {
+		return nil, err
+	}
+	withdrawn := proposal.Proposer.Hex() == userId
+	if !withdrawn && !isApprover(wallet, bson.ObjectIdHex(userId), permission) {
+		return nil, ErrNotApprover
+	}
+
+	// the proposer may have approved the proposal already, so a withdrawal is not recorded as decision
+	if !withdrawn {
+		proposal, err = s.decide(wallet, proposalId, &Decision{UserId: bson.ObjectIdHex(userId), Approved: false, Comment: dto.Comment})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := store.UpdateProposalStatus(proposal.Id, PENDING, REJECTED); err != nil {
+		return nil, ErrProposalNotPending
+	}
+	proposal.Status = REJECTED
+
+	log.Infof("User %s rejected proposal %s of wallet %s", userId, proposalId, walletId)
+	return proposal, nil
+}
+
+// decide records the decision on the pending proposal, which every user may only make once.
+func (s *serviceImpl) decide(wallet *Wallet, proposalId string, decision *Decision) (*Proposal, error) {
+	proposal, err := findProposal(wallet.Id, proposalId)
+	if err != nil {
+		return nil, err
+	}
+	if proposal.Status != PENDING {
+		return nil, ErrProposalNotPending
+	}
+	for _, d := range proposal.Decisions {
+		if d.UserId == decision.UserId {
+			return nil, ErrAlreadyDecided
+		}
+	}
+
+	decision.Time = time.Now()
+	if err := store.AddDecision(proposal.Id, decision); err != nil {
+		// a concurrent decision came first
+		if err == mgo.ErrNotFound {
+			return nil, ErrProposalNotPending
+		}
+		return nil, err
+	}
+	proposal.Decisions = append(proposal.Decisions, decision)
+	return proposal, nil
+}
+
+// execute sends the transfer or changes the policy of an approved proposal. Only one of several concurrent approvals
+// gets to execute it.
+func (s *serviceImpl) execute(wallet *Wallet, proposal *Proposal) (*Transaction, error) {
+	if err := store.UpdateProposalStatus(proposal.Id, PENDING, EXECUTING); err != nil {
+		return nil, ErrProposalNotPending
+	}
+
+	var transaction *Transaction
+	var err error
+	if proposal.PolicyChange {
+		err = updatePolicy(wallet, proposal.Policy)
+	} else {
+		// the limits are checked again, as other transfers may have been sent since the proposal was made
+		err = checkLimits(wallet, proposal.transactionDTO())
+		if err == nil {
+			transaction, err = s.transfer(wallet, proposal.transactionDTO(), proposal.Proposer)
+		}
+	}
+	if err != nil {
+		proposal.Status = FAILED
+		proposal.Error = err.Error()
+	} else {
+		proposal.Status = EXECUTED
+		if transaction != nil {
+			proposal.Hash = transaction.Hash
+		}
+	}
+
+	if updateErr := store.UpdateProposal(proposal); updateErr != nil {
+		log.Errorf("Could not update proposal %s: %s", proposal.Id.Hex(), updateErr.Error())
+	}
+	return transaction, err
+}
+
+func findProposal(walletId bson.ObjectId, proposalId string) (*Proposal, error) {
+	if !bson.IsObjectIdHex(proposalId) {
+		return nil, ErrProposalNotFound
+	}
+	proposal, err := store.FindProposal(walletId, bson.ObjectIdHex(proposalId))
+	if err != nil || proposal == nil {
+		return nil, ErrProposalNotFound
+	}
+	return proposal, nil
+}
@@ -0,0 +1,202 @@
+package wallet
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestApprovalReasons(t *testing.T) {
+	f := newFixture("")
+	wallet := storedWallet(f)
+	wallet.Policy = &Policy{Threshold: 100, DailyLimit: 500, Allowlist: []string{"ir2known"}, Approvals: 1}
+	f.store.InsertTransaction(&Transaction{WalletId: wallet.Id, Amount: 400, Sent: time.Now().Add(-time.Hour)})
+	f.store.InsertTransaction(&Transaction{WalletId: wallet.Id, Amount: 1000, Sent: time.Now().Add(-25 * time.Hour)})
+
+	cases := []struct {
+		permission Permission
+		dto        TransactionDTO
+		reasons    []string
+	}{
+		{SEND, TransactionDTO{Address: "ir2known", Amount: 50}, nil},
+		{PROPOSE, TransactionDTO{Address: "ir2known", Amount: 50}, []string{ReasonProposer}},
+		{SEND, TransactionDTO{Address: "ir2known", Amount: 150}, []string{ReasonThreshold, ReasonDailyLimit}},
+		{SEND, TransactionDTO{Address: "ir2other", Amount: 50}, []string{ReasonAllowlist}},
+	}
+	for _, tc := range cases {
+		reasons, err := approvalReasons(wallet, tc.permission, tc.dto)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(reasons, tc.reasons) {
+			t.Errorf("%s sending %d to %s: expected %v, got %v", tc.permission, tc.dto.Amount, tc.dto.Address, tc.reasons, reasons)
+		}
+	}
+}
+
+func TestProposalNeedsApprovals(t *testing.T) {
+	f := newFixture("")
+	alice, bob, carol := bson.NewObjectId(), bson.NewObjectId(), bson.NewObjectId()
+	wallet := syncedWallet(t, f, map[bson.ObjectId]Permission{alice: SEND, bob: SEND, carol: PROPOSE})
+	if err := f.service.SetPolicy(wallet.Id.Hex(), &Policy{Threshold: 100, Approvals: 2}, wallet.Owner.Hex()); err != nil {
+		t.Fatal(err)
+	}
+
+	// small transfers are sent right away
+	if _, err := f.service.SendTransaction(wallet.Id.Hex(), TransactionDTO{Address: "ir2other", Amount: 50, Fee: 10}, alice.Hex()); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := f.service.SendTransaction(wallet.Id.Hex(), TransactionDTO{Address: "ir2other", Amount: 500, Fee: 10}, alice.Hex())
+	approvalErr, ok := err.(*ApprovalRequiredError)
+	if !ok {
+		t.Fatalf("expected approval to be required, got %v", err)
+	}
+	proposal := approvalErr.Proposal
+	if proposal.Status != PENDING || proposal.approvals() != 1 || len(f.runtime.walletd.sent) != 1 {
+		t.Errorf("expected a pending proposal approved by the proposer, got %+v", proposal)
+	}
+
+	if _, err := f.service.ApproveProposal(wallet.Id.Hex(), proposal.Id.Hex(), DecisionDTO{}, alice.Hex()); err != ErrAlreadyDecided {
+		t.Errorf("expected %v, got %v", ErrAlreadyDecided, err)
+	}
+	if _, err := f.service.ApproveProposal(wallet.Id.Hex(), proposal.Id.Hex(), DecisionDTO{}, carol.Hex()); err != ErrNotApprover {
+		t.Errorf("expected %v, got %v", ErrNotApprover, err)
+	}
+
+	approved, err := f.service.ApproveProposal(wallet.Id.Hex(), proposal.Id.Hex(), DecisionDTO{Comment: "ok"}, bob.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if approved.Status != EXECUTED || approved.Hash != "txhash" || len(f.runtime.walletd.sent) != 2 {
+		t.Errorf("expected proposal to be sent once approved, got %+v", approved)
+	}
+	if stored := f.store.proposals[proposal.Id]; stored.Status != EXECUTED || len(stored.Decisions) != 2 {
+		t.Errorf("expected executed proposal with both decisions to be stored, got %+v", stored)
+	}
+
+	if _, err := f.service.RejectProposal(wallet.Id.Hex(), proposal.Id.Hex(), DecisionDTO{}, wallet.Owner.Hex()); err != ErrProposalNotPending {
+		t.Errorf("expected %v, got %v", ErrProposalNotPending, err)
+	}
+}
+
+func TestApprovalKeepsStepUpOfUnsendableTransfer(t *testing.T) {
+	f := newFixture("")
+	alice := bson.NewObjectId()
+	wallet := syncedWallet(t, f, map[bson.ObjectId]Permission{alice: SEND})
+	if err := f.service.SetPolicy(wallet.Id.Hex(), &Policy{Threshold: 100, Approvals: 2}, wallet.Owner.Hex()); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := f.service.SendTransaction(wallet.Id.Hex(), TransactionDTO{Address: "ir2other", Amount: 500, Fee: 10}, alice.Hex())
+	approvalErr, ok := err.(*ApprovalRequiredError)
+	if !ok {
+		t.Fatalf("expected approval to be required, got %v", err)
+	}
+	delete(f.runtime.satellites, wallet.Id.Hex())
+
+	dto := DecisionDTO{StepUpToken: "step-up"}
+	if _, err := f.service.ApproveProposal(wallet.Id.Hex(), approvalErr.Proposal.Id.Hex(), dto, wallet.Owner.Hex()); err != ErrWalletNotRunning {
+		t.Errorf("expected %v, got %v", ErrWalletNotRunning, err)
+	}
+	if f.users.stepUps != 0 {
+		t.Errorf("expected the step-up not to be redeemed, got %d", f.users.stepUps)
+	}
+}
+
+func TestRejectProposal(t *testing.T) {
+	f := newFixture("")
+	carol := bson.NewObjectId()
+	wallet := syncedWallet(t, f, map[bson.ObjectId]Permission{carol: PROPOSE})
+
+	_, err := f.service.SendTransaction(wallet.Id.Hex(), TransactionDTO{Address: "ir2other", Amount: 50, Fee: 10}, carol.Hex())
+	approvalErr, ok := err.(*ApprovalRequiredError)
+	if !ok {
+		t.Fatalf("expected transfers of proposers to require approval, got %v", err)
+	}
+	if approvalErr.Proposal.approvals() != 0 {
+		t.Errorf("expected proposers not to approve their own transfers, got %+v", approvalErr.Proposal.Decisions)
+	}
+
+	rejected, err := f.service.RejectProposal(wallet.Id.Hex(), approvalErr.Proposal.Id.Hex(), DecisionDTO{Comment: "no"}, wallet.Owner.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rejected.Status != REJECTED || len(f.runtime.walletd.sent) != 0 {
+		t.Errorf("expected proposal to be rejected without sending, got %+v", rejected)
+	}
+	if _, err := f.service.ApproveProposal(wallet.Id.Hex(), approvalErr.Proposal.Id.Hex(), DecisionDTO{}, wallet.Owner.Hex()); err != ErrProposalNotPending {
+		t.Errorf("expected %v, got %v", ErrProposalNotPending, err)
+	}
+}
+
+func TestSetPolicyRequiresOwner(t *testing.T) {
+	f := newFixture("")
+	member := bson.NewObjectId()
+	wallet := syncedWallet(t, f, map[bson.ObjectId]Permission{member: SEND})
+
+	if err := f.service.SetPolicy(wallet.Id.Hex(), &Policy{Approvals: 1}, member.Hex()); err != ErrPermissionDenied {
+		t.Errorf("expected %v, got %v", ErrPermissionDenied, err)
+	}
+	if err := f.service.SetPolicy(wallet.Id.Hex(), &Policy{Approvals: 2, Approvers: []bson.ObjectId{member}}, wallet.Owner.Hex()); err != ErrInvalidPolicy {
+		t.Errorf("expected %v, got %v", ErrInvalidPolicy, err)
+	}
+}
+
+func TestSetPolicyValidatesApprovers(t *testing.T) {
+	f := newFixture("")
+	alice, carol, dave := bson.NewObjectId(), bson.NewObjectId(), bson.NewObjectId()
+	wallet := syncedWallet(t, f, map[bson.ObjectId]Permission{alice: SEND, carol: PROPOSE})
+	f.store.InsertMembership(&Membership{Id: bson.NewObjectId(), WalletId: wallet.Id, UserId: dave, Permission: SEND})
+
+	cases := []struct {
+		policy *Policy
+		err    error
+	}{
+		// only the owner and alice may approve, dave did not accept the invitation yet
+		{&Policy{Approvals: 3}, ErrInvalidPolicy},
+		{&Policy{Approvals: 2, Approvers: []bson.ObjectId{alice, alice}}, ErrInvalidPolicy},
+		{&Policy{Approvals: 1, Approvers: []bson.ObjectId{carol}}, ErrInvalidApprover},
+		{&Policy{Approvals: 1, Approvers: []bson.ObjectId{dave}}, ErrInvalidApprover},
+		{&Policy{Approvals: 2}, nil},
+	}
+	for _, tc := range cases {
+		if err := f.service.SetPolicy(wallet.Id.Hex(), tc.policy, wallet.Owner.Hex()); err != tc.err {
+			t.Errorf("setting %+v: expected %v, got %v", tc.policy, tc.err, err)
+		}
+	}
+}
+
+func TestPolicyChangeNeedsApprovals(t *testing.T) {
+	f := newFixture("")
+	alice, bob := bson.NewObjectId(), bson.NewObjectId()
+	wallet := syncedWallet(t, f, map[bson.ObjectId]Permission{alice: SEND, bob: SEND})
+	if err := f.service.SetPolicy(wallet.Id.Hex(), &Policy{Threshold: 100, Approvals: 2}, wallet.Owner.Hex()); err != nil {
+		t.Fatal(err)
+	}
+
+	err := f.service.SetPolicy(wallet.Id.Hex(), nil, wallet.Owner.Hex())
+	approvalErr, ok := err.(*ApprovalRequiredError)
+	if !ok {
+		t.Fatalf("expected removing the policy to require approval, got %v", err)
+	}
+	proposal := approvalErr.Proposal
+	if !proposal.PolicyChange || proposal.Required != 2 || proposal.approvals() != 1 {
+		t.Errorf("expected a policy change approved by the owner, got %+v", proposal)
+	}
+	if f.store.wallets[wallet.Id].Policy == nil {
+		t.Fatal("expected the policy to remain until the change is approved")
+	}
+
+	approved, err := f.service.ApproveProposal(wallet.Id.Hex(), proposal.Id.Hex(), DecisionDTO{}, alice.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if approved.Status != EXECUTED || f.store.wallets[wallet.Id].Policy != nil {
+		t.Errorf("expected the policy to be removed once approved, got %+v", approved)
+	}
+	if len(f.runtime.walletd.sent) != 0 {
+		t.Errorf("expected no transfer to be sent, got %v", f.runtime.walletd.sent)
+	}
+}
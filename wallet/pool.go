@@ -0,0 +1,303 @@
+package wallet
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	"github.com/iridiumdev/webwallet-core/config"
+	"github.com/iridiumdev/webwallet-core/daemon"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	poolContainerPrefix = "pool-"
+
+	handoverPasswordFile = "handover-password"
+	handoverReadyFile    = "handover-ready"
+
+	// handoverScript wraps the original entrypoint of the satellite image. It keeps the container idle until the core
+	// hands over the wallet password, removes the password file again and then replaces itself with the satellite.
+	handoverScript = `while [ ! -f /tmp/` + handoverReadyFile + ` ]; do sleep 0.1; done; ` +
+		`p="$(cat /tmp/` + handoverPasswordFile + `)"; rm -f /tmp/` + handoverPasswordFile + ` /tmp/` + handoverReadyFile + `; ` +
+		`exec "$@" --container-password="$p"`
+)
+
+var (
+	poolHits   = expvar.NewInt("satellite_pool_hits")
+	poolMisses = expvar.NewInt("satellite_pool_misses")
+	poolIdle   = expvar.NewInt("satellite_pool_idle")
+)
+
+type poolSlot struct {
+	id      bson.ObjectId
+	created time.Time
+	daemon  string
+}
+
+func (slot *poolSlot) containerName() string {
+	return poolContainerPrefix + slot.id.Hex()
+}
+
+func (slot *poolSlot) volumeName() string {
+	return fmt.Sprintf("%s.wallet", slot.id.Hex())
+}
+
+type pool struct {
+	dockerClient *client.Client
+	daemons      daemon.Service
+	quit         chan struct{}
+
+	mx   sync.Mutex
+	idle []*poolSlot
+
+	entrypoint []string
+}
+
+type SatellitePool interface {
+	Run()
+	Close()
+}
+
+var satellitePool *pool
+
+func InitPool(dockerClient *client.Client, daemons daemon.Service) SatellitePool {
+	satellitePool = &pool{
+		dockerClient: dockerClient,
+		daemons:      daemons,
+		quit:         make(chan struct{}),
+	}
+	return satellitePool
+}
+
+func (p *pool) Run() {
+	if config.Get().Webwallet.Satellite.Pool.Size <= 0 {
+		log.Info("Satellite pool is disabled")
+		return
+	}
+	if p.dockerClient == nil {
+		log.Warn("Satellite pool is only supported by the docker runtime, disabling it")
+		return
+	}
+
+	inspect, _, err := p.dockerClient.ImageInspectWithRaw(context.Background(), config.Get().Webwallet.Satellite.Image)
+	if err != nil {
+		log.Errorf("Could not inspect satellite image, disabling the satellite pool: %s", err.Error())
+		return
+	}
+	if inspect.Config != nil {
+		p.entrypoint = inspect.Config.Entrypoint
+	}
+
+	p.pruneOrphans()
+
+	interval := config.Get().Webwallet.Satellite.Pool.RefillSeconds * time.Second
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	go func() {
+		p.refill()
+		for {
+			select {
+			case <-p.quit:
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				p.expire()
+				p.refill()
+			}
+		}
+	}()
+}
+
+func (p *pool) Close() {
+	close(p.quit)
+}
+
+// acquire hands out the most recently started idle satellite or nil if the pool is empty or disabled. Idle satellites
+// connected to an unhealthy daemon node are discarded instead of being handed out.
+func (p *pool) acquire() *poolSlot {
+	if p == nil {
+		return nil
+	}
+
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	for len(p.idle) > 0 {
+		slot := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		poolIdle.Set(int64(len(p.idle)))
+
+		if !p.daemonHealthy(slot) {
+			go p.discard(slot)
+			continue
+		}
+
+		poolHits.Add(1)
+		return slot
+	}
+
+	poolMisses.Add(1)
+	return nil
+}
+
+func (p *pool) daemonHealthy(slot *poolSlot) bool {
+	return p.daemons == nil || slot.daemon == "" || p.daemons.IsHealthy(slot.daemon)
+}
+
+func (p *pool) refill() {
+	poolConfig := config.Get().Webwallet.Satellite.Pool
+
+	p.mx.Lock()
+	missing := poolConfig.Size - len(p.idle)
+	p.mx.Unlock()
+
+	if poolConfig.RefillRate > 0 && missing > poolConfig.RefillRate {
+		missing = poolConfig.RefillRate
+	}
+
+	for i := 0; i < missing; i++ {
+		slot, err := p.startSlot()
+		if err != nil {
+			log.Errorf("Could not start idle satellite: %s", err.Error())
+			return
+		}
+
+		p.mx.Lock()
+		p.idle = append(p.idle, slot)
+		poolIdle.Set(int64(len(p.idle)))
+		p.mx.Unlock()
+	}
+}
+
+// expire replaces idle satellites exceeding the maximum age or connected to a daemon node which became unhealthy.
+func (p *pool) expire() {
+	maxAge := config.Get().Webwallet.Satellite.Pool.MaxAgeMinutes * time.Minute
+
+	p.mx.Lock()
+	var fresh, expired []*poolSlot
+	for _, slot := range p.idle {
+		if (maxAge > 0 && time.Since(slot.created) > maxAge) || !p.daemonHealthy(slot) {
+			expired = append(expired, slot)
+		} else {
+			fresh = append(fresh, slot)
+		}
+	}
+	p.idle = fresh
+	poolIdle.Set(int64(len(p.idle)))
+	p.mx.Unlock()
+
+	for _, slot := range expired {
+		log.Debugf("Replacing expired idle satellite %s", slot.containerName())
+		p.discard(slot)
+	}
+}
+
+func (p *pool) startSlot() (*poolSlot, error) {
+	ctx := context.Background()
+	satellite := config.Get().Webwallet.Satellite
+
+	slot := &poolSlot{id: bson.NewObjectId(), created: time.Now()}
+
+	_, err := p.dockerClient.VolumeCreate(ctx, volume.VolumesCreateBody{
+		Name:   slot.volumeName(),
+		Labels: satellite.Labels,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	command, daemonEndpoint := satelliteCommand(p.daemons, satellite.Command)
+	command = append(append([]string{}, p.entrypoint...), command...)
+	slot.daemon = daemonEndpoint
+
+	_, err = p.dockerClient.ContainerCreate(ctx, &container.Config{
+		Image:       satellite.Image,
+		Entrypoint:  []string{"/bin/sh", "-c", handoverScript, "satellite"},
+		Cmd:         command,
+		Labels:      satellite.Labels,
+		Healthcheck: healthConfig(),
+	}, &container.HostConfig{
+		Mounts: []mount.Mount{
+			{
+				Type:   mount.TypeVolume,
+				Source: slot.volumeName(),
+				Target: "/data",
+			},
+		},
+	}, nil, slot.containerName())
+	if err != nil {
+		p.discard(slot)
+		return nil, err
+	}
+
+	if err := p.dockerClient.NetworkConnect(ctx, config.Get().Webwallet.Network, slot.containerName(), nil); err != nil {
+		p.discard(slot)
+		return nil, err
+	}
+
+	if err := p.dockerClient.ContainerStart(ctx, slot.containerName(), types.ContainerStartOptions{}); err != nil {
+		p.discard(slot)
+		return nil, err
+	}
+
+	log.Debugf("Started idle satellite %s", slot.containerName())
+
+	return slot, nil
+}
+
+// discard removes the container and the volume of a slot which will not be handed over anymore.
+func (p *pool) discard(slot *poolSlot) {
+	ctx := context.Background()
+
+	err := p.dockerClient.ContainerRemove(ctx, slot.containerName(), types.ContainerRemoveOptions{Force: true})
+	if err != nil {
+		log.Debugf("Could not remove idle satellite %s: %s", slot.containerName(), err.Error())
+	}
+
+	if err := p.dockerClient.VolumeRemove(ctx, slot.volumeName(), true); err != nil {
+		log.Warnf("Could not remove volume of idle satellite %s: %s", slot.containerName(), err.Error())
+	}
+}
+
+// pruneOrphans removes idle satellites left behind by a previous run, as they can not be tracked anymore.
+func (p *pool) pruneOrphans() {
+	ctx := context.Background()
+
+	listFilters := filters.NewArgs()
+	listFilters.Add("name", poolContainerPrefix)
+	for k, v := range config.Get().Webwallet.Satellite.Labels {
+		listFilters.Add("label", fmt.Sprintf("%s=%s", k, v))
+	}
+
+	cList, err := p.dockerClient.ContainerList(ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: listFilters,
+	})
+	if err != nil {
+		log.Errorf("Could not list orphaned idle satellites: %s", err.Error())
+		return
+	}
+
+	for _, c := range cList {
+		for _, name := range c.Names {
+			name = strings.TrimPrefix(name, "/")
+			if strings.HasPrefix(name, poolContainerPrefix) && bson.IsObjectIdHex(strings.TrimPrefix(name, poolContainerPrefix)) {
+				log.Infof("Removing orphaned idle satellite %s", name)
+				p.discard(&poolSlot{id: bson.ObjectIdHex(strings.TrimPrefix(name, poolContainerPrefix))})
+			}
+		}
+	}
+}
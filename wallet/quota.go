@@ -0,0 +1,233 @@
+package wallet
+
+import (
+	"fmt"
+	"github.com/iridiumdev/webwallet-core/config"
+	"github.com/iridiumdev/webwallet-core/user"
+	"gopkg.in/mgo.v2/bson"
+	"sync"
+	"time"
+)
+
+const (
+	QuotaMaxWallets        = "maxWallets"
+	QuotaMaxRunningWallets = "maxRunningWallets"
+	QuotaCreationRate      = "creationRate"
+)
+
+// QuotaError is returned whenever an operation would exceed one of the users quotas. A non-zero RetryAfter marks a
+// temporary (rate) limit, all other quota errors are permanent until the user frees up resources.
+type QuotaError struct {
+	Quota      string
+	Limit      int
+	RetryAfter time.Duration
+}
+
+func (e *QuotaError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("quota exceeded: %s=%d, retry after %s", e.Quota, e.Limit, e.RetryAfter)
+	}
+	return fmt.Sprintf("quota exceeded: %s=%d", e.Quota, e.Limit)
+}
+
+// defaultCreationWindow applies if the creation rate is limited without configuring the window.
+const defaultCreationWindow = 60 * time.Minute
+
+// rateLimiter is a simple in-memory sliding window limiter keyed by user id.
+type rateLimiter struct {
+	mx     sync.Mutex
+	events map[string][]time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{events: make(map[string][]time.Time)}
+}
+
+// take records a new event for the given key if less than limit events happened within the window. Otherwise it
+// returns the duration until the oldest event leaves the window.
+func (r *rateLimiter) take(key string, limit int, window time.Duration) (bool, time.Duration) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	now := time.Now()
+	r.prune(now, window)
+	recent := r.events[key]
+
+	if len(recent) >= limit {
+		return false, window - now.Sub(recent[0])
+	}
+
+	r.events[key] = append(recent, now)
+	return true, 0
+}
+
+// prune drops the events which left the window, along with the keys without any recent events, so that the limiter
+// does not keep every user who ever created a wallet.
+func (r *rateLimiter) prune(now time.Time, window time.Duration) {
+	for key, events := range r.events {
+		var recent []time.Time
+		for _, t := range events {
+			if now.Sub(t) < window {
+				recent = append(recent, t)
+			}
+		}
+
+		if len(recent) == 0 {
+			delete(r.events, key)
+		} else {
+			r.events[key] = recent
+		}
+	}
+}
+
+func effectiveQuota(owner *user.User) config.Quota {
+	quota := config.Get().Webwallet.Quota
+	if owner.Quota == nil {
+		return quota
+	}
+
+	if owner.Quota.MaxWallets != nil {
+		quota.MaxWallets = *owner.Quota.MaxWallets
+	}
+	if owner.Quota.MaxRunningWallets != nil {
+		quota.MaxRunningWallets = *owner.Quota.MaxRunningWallets
+	}
+	if owner.Quota.CreationRate != nil {
+		quota.CreationRate = *owner.Quota.CreationRate
+	}
+	return quota
+}
+
+// pendingWallets are the wallets of an owner which are being created or started by a job. They count against the
+// quotas from the moment the job is submitted, otherwise concurrent requests could all pass the checks before the
+// first job stored or started its wallet.
+type pendingWallets struct {
+	created map[bson.ObjectId]struct{}
+	started map[bson.ObjectId]struct{}
+}
+
+// reserveCreation verifies that the user may create (or import) one more wallet and reserves the quotas for the new
+// wallet. As a new wallet is started right away, the running wallets quota is checked as well. The returned func
+// releases the reservation once the job is done.
+func (s *serviceImpl) reserveCreation(userId string, walletId bson.ObjectId) (func(), error) {
+	owner, err := s.userService.GetUser(userId)
+	if err != nil {
+		return nil, err
+	}
+	if config.Get().Webwallet.RequireVerifiedEmail && !owner.EmailVerified {
+		return nil, ErrEmailNotVerified
+	}
+	return s.reserve(owner.Id, walletId, effectiveQuota(owner), true)
+}
+
+// reserveStart verifies that the owner of the wallet may run one more wallet and reserves the quota for it.
+func (s *serviceImpl) reserveStart(wallet *Wallet) (func(), error) {
+	owner, err := s.userService.GetUser(wallet.Owner.Hex())
+	if err != nil {
+		return nil, err
+	}
+	return s.reserve(owner.Id, wallet.Id, effectiveQuota(owner), false)
+}
+
+// reserve checks the quotas against the wallets of the owner including the pending ones and adds the wallet to them,
+// both while holding the lock so that concurrent reservations see each other. Asking the runtime which wallets are
+// running may take a while, so it is done before taking the lock.
+func (s *serviceImpl) reserve(ownerId bson.ObjectId, walletId bson.ObjectId, quota config.Quota, create bool) (func(), error) {
+	var running map[bson.ObjectId]bool
+	if quota.MaxRunningWallets > 0 {
+		var err error
+		if running, err = s.runningWallets(ownerId); err != nil {
+			return nil, err
+		}
+	}
+
+	s.quotaMx.Lock()
+	defer s.quotaMx.Unlock()
+
+	pending, ok := s.pending[ownerId.Hex()]
+	if !ok {
+		pending = &pendingWallets{created: make(map[bson.ObjectId]struct{}), started: make(map[bson.ObjectId]struct{})}
+	}
+
+	wallets, err := store.FindWalletsByOwner(ownerId)
+	if err != nil {
+		return nil, err
+	}
+	owned := make(map[bson.ObjectId]struct{}, len(wallets)+len(pending.created))
+	for _, wallet := range wallets {
+		owned[wallet.Id] = struct{}{}
+	}
+	for id := range pending.created {
+		owned[id] = struct{}{}
+	}
+
+	if create && quota.MaxWallets > 0 && len(owned) >= quota.MaxWallets {
+		return nil, &QuotaError{Quota: QuotaMaxWallets, Limit: quota.MaxWallets}
+	}
+
+	if quota.MaxRunningWallets > 0 {
+		count := 0
+		for id := range owned {
+			_, created := pending.created[id]
+			_, started := pending.started[id]
+			// a wallet stored after the running wallets were collected was created, and thereby started, since
+			isRunning, known := running[id]
+			if created || started || isRunning || !known {
+				count++
+			}
+		}
+		if count >= quota.MaxRunningWallets {
+			return nil, &QuotaError{Quota: QuotaMaxRunningWallets, Limit: quota.MaxRunningWallets}
+		}
+	}
+
+	if create && quota.CreationRate > 0 {
+		window := quota.CreationWindowMinutes * time.Minute
+		if window <= 0 {
+			window = defaultCreationWindow
+		}
+		if ok, retryAfter := s.creations.take(ownerId.Hex(), quota.CreationRate, window); !ok {
+			return nil, &QuotaError{Quota: QuotaCreationRate, Limit: quota.CreationRate, RetryAfter: retryAfter}
+		}
+	}
+
+	if create {
+		pending.created[walletId] = struct{}{}
+	} else {
+		pending.started[walletId] = struct{}{}
+	}
+	s.pending[ownerId.Hex()] = pending
+
+	return func() {
+		s.release(ownerId.Hex(), walletId)
+	}, nil
+}
+
+// runningWallets returns whether each of the stored wallets of the owner is running.
+func (s *serviceImpl) runningWallets(ownerId bson.ObjectId) (map[bson.ObjectId]bool, error) {
+	wallets, err := store.FindWalletsByOwner(ownerId)
+	if err != nil {
+		return nil, err
+	}
+
+	running := make(map[bson.ObjectId]bool, len(wallets))
+	for _, wallet := range wallets {
+		running[wallet.Id], _ = s.runtime.IsRunning(wallet.Id.Hex())
+	}
+	return running, nil
+}
+
+func (s *serviceImpl) release(ownerId string, walletId bson.ObjectId) {
+	s.quotaMx.Lock()
+	defer s.quotaMx.Unlock()
+
+	pending, ok := s.pending[ownerId]
+	if !ok {
+		return
+	}
+	delete(pending.created, walletId)
+	delete(pending.started, walletId)
+	if len(pending.created) == 0 && len(pending.started) == 0 {
+		delete(s.pending, ownerId)
+	}
+}
@@ -0,0 +1,97 @@
+package wallet
+
+import (
+	"github.com/iridiumdev/webwallet-core/config"
+	"github.com/iridiumdev/webwallet-core/job"
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+	"time"
+)
+
+func assertQuotaError(t *testing.T, err error, quota string) {
+	quotaErr, ok := err.(*QuotaError)
+	if !ok || quotaErr.Quota != quota {
+		t.Errorf("expected %s to be exceeded, got %v", quota, err)
+	}
+}
+
+func TestReservationsCountPendingWallets(t *testing.T) {
+	f := newFixture("")
+	owner := bson.NewObjectId()
+	quota := config.Quota{MaxWallets: 2, MaxRunningWallets: 1}
+
+	release, err := f.service.reserve(owner, bson.NewObjectId(), quota, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the wallet of the pending job is neither stored nor running yet, but counts against the quotas already
+	_, err = f.service.reserve(owner, bson.NewObjectId(), quota, true)
+	assertQuotaError(t, err, QuotaMaxRunningWallets)
+
+	stopped := &Wallet{Id: bson.NewObjectId(), Name: "stopped", Owner: owner}
+	f.store.InsertWallet(stopped)
+	_, err = f.service.reserve(owner, stopped.Id, quota, false)
+	assertQuotaError(t, err, QuotaMaxRunningWallets)
+
+	release()
+	releaseStart, err := f.service.reserve(owner, stopped.Id, quota, false)
+	if err != nil {
+		t.Fatalf("expected the released slot to be free again, got %v", err)
+	}
+	_, err = f.service.reserve(owner, stopped.Id, quota, false)
+	assertQuotaError(t, err, QuotaMaxRunningWallets)
+	releaseStart()
+
+	quota = config.Quota{MaxWallets: 2}
+	releaseCreation, err := f.service.reserve(owner, bson.NewObjectId(), quota, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.service.reserve(owner, bson.NewObjectId(), quota, true)
+	assertQuotaError(t, err, QuotaMaxWallets)
+	releaseCreation()
+
+	if len(f.service.pending) != 0 {
+		t.Errorf("expected no reservations left, got %v", f.service.pending)
+	}
+}
+
+func TestCreatedWalletKeepsReservedId(t *testing.T) {
+	f := newFixture("")
+	walletId := bson.NewObjectId()
+	dWallet, err := f.service.createWallet(CreateDTO{Name: "test"}, bson.NewObjectId().Hex(), &job.Job{WalletId: walletId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dWallet.Id != walletId {
+		t.Errorf("expected the wallet to be created with the id of the job %s, got %s", walletId.Hex(), dWallet.Id.Hex())
+	}
+}
+
+func TestCreationRateDefaultsWindow(t *testing.T) {
+	f := newFixture("")
+	owner := bson.NewObjectId()
+	quota := config.Quota{CreationRate: 1}
+
+	release, err := f.service.reserve(owner, bson.NewObjectId(), quota, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+
+	_, err = f.service.reserve(owner, bson.NewObjectId(), quota, true)
+	assertQuotaError(t, err, QuotaCreationRate)
+}
+
+func TestRateLimiterDropsStaleKeys(t *testing.T) {
+	limiter := newRateLimiter()
+	limiter.take("stale", 1, time.Minute)
+	limiter.events["stale"][0] = time.Now().Add(-2 * time.Minute)
+
+	if ok, _ := limiter.take("recent", 1, time.Minute); !ok {
+		t.Fatal("expected the event to be taken")
+	}
+	if _, ok := limiter.events["stale"]; ok {
+		t.Errorf("expected the stale key to be dropped, got %v", limiter.events)
+	}
+}
@@ -0,0 +1,40 @@
+package wallet
+
+import (
+	"github.com/iridiumdev/webwallet-core/daemon"
+	"github.com/iridiumdev/webwallet-core/iridium"
+)
+
+// Runtime abstracts the platform the satellites (one walletd instance per running wallet) are running on.
+type Runtime interface {
+	// CreateVolume creates the volume holding the data of a new wallet. A runtime may assign an already existing
+	// volume to the wallet by setting Wallet.Volume.
+	CreateVolume(wallet *Wallet) error
+	RemoveVolume(volume string) error
+
+	// StartSatellite starts the satellite of the wallet using its volume. A runtime may move the wallets data to
+	// another volume by changing Wallet.Volume, in which case the previous volume is left for the caller to remove.
+	StartSatellite(wallet *Wallet, password string) error
+	RemoveSatellite(walletId string) error
+	IsRunning(walletId string) (bool, error)
+	// CheckHealth returns an error describing the problem if the platform considers the satellite to be unhealthy.
+	CheckHealth(walletId string) error
+
+	// Walletd returns a client for the RPC api of a running satellite.
+	Walletd(walletId string) (iridium.WalletdRPC, error)
+}
+
+// satelliteCommand appends the arguments of the healthiest daemon node to the given satellite command. The endpoint of
+// the selected node is returned as well, it is empty if no daemon nodes are managed by the core.
+func satelliteCommand(daemons daemon.Service, command []string) ([]string, string) {
+	command = append([]string{}, command...)
+	if daemons == nil {
+		return command, ""
+	}
+
+	node := daemons.Select()
+	if node == nil {
+		return command, ""
+	}
+	return append(command, node.SatelliteArgs()...), node.Endpoint()
+}
@@ -0,0 +1,379 @@
+package wallet
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	"github.com/iridiumdev/webwallet-core/config"
+	"github.com/iridiumdev/webwallet-core/daemon"
+	"github.com/iridiumdev/webwallet-core/iridium"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+type containerStatus string
+
+const (
+	DOCKER_EXITED  containerStatus = "exited"
+	DOCKER_RUNNING containerStatus = "running"
+)
+
+type dockerRuntime struct {
+	dockerClient *client.Client
+	daemons      daemon.Service
+
+	// idle satellites reserved for new wallets by their volume name
+	reservedMx sync.Mutex
+	reserved   map[string]*poolSlot
+}
+
+func NewDockerRuntime(dockerClient *client.Client, daemons daemon.Service) Runtime {
+	return &dockerRuntime{
+		dockerClient: dockerClient,
+		daemons:      daemons,
+		reserved:     make(map[string]*poolSlot),
+	}
+}
+
+// CreateVolume reserves an idle satellite from the pool for the wallet and assigns its volume. Only if the pool is
+// empty, a new volume is created.
+func (r *dockerRuntime) CreateVolume(wallet *Wallet) error {
+	if slot := satellitePool.acquire(); slot != nil {
+		r.reservedMx.Lock()
+		r.reserved[slot.volumeName()] = slot
+		r.reservedMx.Unlock()
+
+		wallet.Volume = slot.volumeName()
+		log.Debugf("Reserved idle satellite %s for wallet with id '%s'", slot.containerName(), wallet.Id.Hex())
+		return nil
+	}
+
+	ctx := context.Background()
+
+	log.Infof("Creating new volume for wallet with id '%s'", wallet.Id.Hex())
+	_, err := r.dockerClient.VolumeCreate(ctx, volume.VolumesCreateBody{
+		Name:   wallet.volumeName(),
+		Labels: config.Get().Webwallet.Satellite.Labels,
+	})
+	if err != nil {
+		return err
+	}
+	log.Debugf("Created new volume for wallet with id '%s' successfully!", wallet.Id.Hex())
+	return nil
+}
+
+func (r *dockerRuntime) RemoveVolume(volumeName string) error {
+	if slot := r.release(volumeName); slot != nil {
+		satellitePool.discard(slot)
+		return nil
+	}
+
+	log.Infof("Removing volume '%s'", volumeName)
+	return r.dockerClient.VolumeRemove(context.Background(), volumeName, true)
+}
+
+// StartSatellite hands over an idle satellite to the wallet if possible. For new wallets the satellite reserved by
+// CreateVolume is used, existing wallets get their data copied to the volume of an idle satellite.
+func (r *dockerRuntime) StartSatellite(wallet *Wallet, password string) error {
+	if slot := r.release(wallet.volumeName()); slot != nil {
+		err := r.handover(slot, wallet, password, false)
+		if err == nil {
+			return nil
+		}
+
+		// the volume stays with the wallet, only the container is replaced
+		log.Warnf("Could not hand over idle satellite %s, falling back to a new one: %s", slot.containerName(), err.Error())
+		r.removeContainers(slot.containerName(), wallet.Id.Hex())
+		return r.instantiateContainer(wallet, password)
+	}
+
+	if slot := satellitePool.acquire(); slot != nil {
+		err := r.handover(slot, wallet, password, true)
+		if err == nil {
+			return nil
+		}
+
+		log.Warnf("Could not hand over idle satellite %s, falling back to a new one: %s", slot.containerName(), err.Error())
+		r.removeContainers(wallet.Id.Hex())
+		satellitePool.discard(slot)
+	}
+
+	return r.instantiateContainer(wallet, password)
+}
+
+func (r *dockerRuntime) RemoveSatellite(walletId string) error {
+	ctx := context.Background()
+
+	cList, err := r.getContainer(walletId, DOCKER_RUNNING)
+	if err != nil {
+		log.Error(err)
+	}
+	if len(cList) == 0 {
+		cList, err = r.getContainer(walletId, DOCKER_EXITED)
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+	}
+
+	if len(cList) == 0 {
+		log.Errorf("Could not find container for wallet %s!", walletId)
+		return ErrWalletNotRunning
+	}
+
+	return r.dockerClient.ContainerRemove(ctx, cList[0].ID, types.ContainerRemoveOptions{
+		Force: true,
+	})
+}
+
+func (r *dockerRuntime) IsRunning(walletId string) (bool, error) {
+	cList, err := r.getContainer(walletId, DOCKER_RUNNING)
+	if err != nil {
+		log.Errorf("Could not check status of wallet %s: %s", walletId, err.Error())
+		return false, err
+	}
+	return len(cList) > 0, nil
+}
+
+func (r *dockerRuntime) CheckHealth(walletId string) error {
+	inspect, err := r.dockerClient.ContainerInspect(context.Background(), walletId)
+	if err != nil {
+		return err
+	}
+
+	if inspect.ContainerJSONBase == nil || inspect.State == nil || !inspect.State.Running {
+		return ErrWalletNotRunning
+	}
+
+	if health := inspect.State.Health; health != nil && health.Status == "unhealthy" {
+		if len(health.Log) > 0 {
+			return fmt.Errorf("container unhealthy: %s", strings.TrimSpace(health.Log[len(health.Log)-1].Output))
+		}
+		return errors.New("container unhealthy")
+	}
+
+	return nil
+}
+
+func (r *dockerRuntime) Walletd(walletId string) (iridium.WalletdRPC, error) {
+	containerEndpoint, err := r.resolveContainerEndpoint(walletId)
+	if err != nil {
+		return nil, err
+	}
+	rpcHost := net.JoinHostPort(containerEndpoint, config.Get().Webwallet.Satellite.RpcPort)
+	rpcAddress := fmt.Sprintf("http://%s/json_rpc", rpcHost)
+
+	return iridium.Walletd(rpcAddress)
+}
+
+func (r *dockerRuntime) release(volumeName string) *poolSlot {
+	r.reservedMx.Lock()
+	defer r.reservedMx.Unlock()
+
+	slot, ok := r.reserved[volumeName]
+	if !ok {
+		return nil
+	}
+	delete(r.reserved, volumeName)
+	return slot
+}
+
+func (r *dockerRuntime) removeContainers(names ...string) {
+	for _, name := range names {
+		err := r.dockerClient.ContainerRemove(context.Background(), name, types.ContainerRemoveOptions{Force: true})
+		if err != nil {
+			log.Debugf("Could not remove container %s: %s", name, err.Error())
+		}
+	}
+}
+
+func (r *dockerRuntime) getContainer(walletId string, status containerStatus) ([]types.Container, error) {
+	ctx := context.Background()
+
+	listFilters := filters.NewArgs()
+	listFilters.Add("name", walletId)
+	listFilters.Add("status", string(status))
+
+	for k, v := range config.Get().Webwallet.Satellite.Labels {
+		listFilters.Add("label", fmt.Sprintf("%s=%s", k, v))
+	}
+
+	return r.dockerClient.ContainerList(ctx, types.ContainerListOptions{
+		Limit:   1,
+		Filters: listFilters,
+	})
+}
+
+func (r *dockerRuntime) instantiateContainer(wallet *Wallet, password string) error {
+	ctx := context.Background()
+
+	command, daemonEndpoint := satelliteCommand(r.daemons, config.Get().Webwallet.Satellite.Command)
+	command = append(command, fmt.Sprintf("--container-password=%s", password))
+
+	volumeName := wallet.volumeName()
+	_, err := r.dockerClient.ContainerCreate(ctx, &container.Config{
+		Image:       config.Get().Webwallet.Satellite.Image,
+		Cmd:         command,
+		Labels:      config.Get().Webwallet.Satellite.Labels,
+		Healthcheck: healthConfig(),
+	}, &container.HostConfig{
+		Mounts: []mount.Mount{
+			{
+				Type:   mount.TypeVolume,
+				Source: volumeName,
+				Target: "/data",
+			},
+		},
+	}, nil, wallet.Id.Hex())
+
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Attaching network '%s' to container for wallet with id '%s'", config.Get().Webwallet.Network, wallet.Id.Hex())
+
+	if err := r.dockerClient.NetworkConnect(ctx, config.Get().Webwallet.Network, wallet.Id.Hex(), nil); err != nil {
+		r.removeContainers(wallet.Id.Hex())
+		return err
+	}
+
+	log.Infof("Starting container for wallet with id '%s'", wallet.Id.Hex())
+
+	if err := r.dockerClient.ContainerStart(ctx, wallet.Id.Hex(), types.ContainerStartOptions{}); err != nil {
+		r.removeContainers(wallet.Id.Hex())
+		return err
+	}
+
+	log.Debugf("Started container for wallet with id '%s'", wallet.Id.Hex())
+
+	wallet.Daemon = daemonEndpoint
+	return nil
+}
+
+// healthConfig builds the docker HEALTHCHECK of the satellite containers from the config.
+func healthConfig() *container.HealthConfig {
+	healthCheck := config.Get().Webwallet.Satellite.HealthCheck
+	if len(healthCheck.Command) == 0 {
+		return nil
+	}
+
+	return &container.HealthConfig{
+		Test:     healthCheck.Command,
+		Interval: healthCheck.IntervalSeconds * time.Second,
+		Timeout:  healthCheck.TimeoutSeconds * time.Second,
+		Retries:  healthCheck.Retries,
+	}
+}
+
+func (r *dockerRuntime) resolveContainerEndpoint(containerId string) (string, error) {
+	ctx := context.Background()
+
+	if config.Get().Webwallet.InternalResolver {
+		return containerId, nil
+	} else {
+		log.Debugf("Using 'ip' resolver to get the satellites endpoint address")
+		inspect, err := r.dockerClient.ContainerInspect(ctx, containerId)
+		if err != nil {
+			return "", err
+		}
+
+		return inspect.NetworkSettings.Networks[config.Get().Webwallet.Network].IPAddress, nil
+	}
+
+}
+
+// handover turns an idle satellite into the satellite of the given wallet. With copyData set, the data of the wallets
+// current volume is copied into the volume of the slot, which becomes the wallets volume.
+func (r *dockerRuntime) handover(slot *poolSlot, wallet *Wallet, password string, copyData bool) error {
+	ctx := context.Background()
+
+	if copyData {
+		helperName := fmt.Sprintf("%s-handover", wallet.Id.Hex())
+		if err := r.copyVolumeData(wallet.volumeName(), slot.containerName(), helperName); err != nil {
+			return err
+		}
+		// remove leftovers (e.g. an exited container) which would block the rename
+		r.removeContainers(wallet.Id.Hex())
+	}
+
+	if err := r.dockerClient.ContainerRename(ctx, slot.containerName(), wallet.Id.Hex()); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	files := []struct {
+		name    string
+		content string
+	}{
+		{handoverPasswordFile, password},
+		{handoverReadyFile, ""},
+	}
+	for _, file := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: file.name, Mode: 0400, Size: int64(len(file.content))}); err != nil {
+			return err
+		}
+		if _, err := tw.Write([]byte(file.content)); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	if err := r.dockerClient.CopyToContainer(ctx, wallet.Id.Hex(), "/tmp", &buf, types.CopyToContainerOptions{}); err != nil {
+		return err
+	}
+
+	if copyData {
+		wallet.Volume = slot.volumeName()
+	}
+	wallet.Daemon = slot.daemon
+
+	log.Debugf("Handed over idle satellite %s to wallet %s", slot.containerName(), wallet.Id.Hex())
+
+	return nil
+}
+
+// copyVolumeData copies the content of the given volume into the /data directory of the target container, using a
+// never started helper container to access the volume.
+func (r *dockerRuntime) copyVolumeData(volumeName string, target string, helperName string) error {
+	ctx := context.Background()
+
+	_, err := r.dockerClient.ContainerCreate(ctx, &container.Config{
+		Image:      config.Get().Webwallet.Satellite.Image,
+		Entrypoint: []string{"/bin/true"},
+		Labels:     config.Get().Webwallet.Satellite.Labels,
+	}, &container.HostConfig{
+		Mounts: []mount.Mount{
+			{
+				Type:   mount.TypeVolume,
+				Source: volumeName,
+				Target: "/data",
+			},
+		},
+	}, nil, helperName)
+	if err != nil {
+		return err
+	}
+	defer r.removeContainers(helperName)
+
+	content, _, err := r.dockerClient.CopyFromContainer(ctx, helperName, "/data")
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	return r.dockerClient.CopyToContainer(ctx, target, "/", content, types.CopyToContainerOptions{})
+}
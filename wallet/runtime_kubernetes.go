@@ -0,0 +1,327 @@
+package wallet
+
+import (
+	"fmt"
+	"github.com/iridiumdev/webwallet-core/config"
+	"github.com/iridiumdev/webwallet-core/daemon"
+	"github.com/iridiumdev/webwallet-core/iridium"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	satelliteContainerName = "satellite"
+	satellitePasswordKey   = "password"
+	walletIdLabel          = "webwallet.iridiumdev.io/wallet"
+
+	defaultStorageSize = "100Mi"
+	podPollInterval    = 500 * time.Millisecond
+)
+
+// kubernetesRuntime runs each satellite in a pod, keeping the wallet data in a persistent volume claim named after
+// the wallets volume. The wallet password is handed over through a secret, which lives as long as the pod.
+type kubernetesRuntime struct {
+	clientset kubernetes.Interface
+	daemons   daemon.Service
+	satellite config.Satellite
+	settings  config.Kubernetes
+}
+
+func NewKubernetesRuntime(clientset kubernetes.Interface, daemons daemon.Service, satellite config.Satellite, settings config.Kubernetes) Runtime {
+	return &kubernetesRuntime{
+		clientset: clientset,
+		daemons:   daemons,
+		satellite: satellite,
+		settings:  settings,
+	}
+}
+
+func (r *kubernetesRuntime) CreateVolume(wallet *Wallet) error {
+	size := r.settings.StorageSize
+	if size == "" {
+		size = defaultStorageSize
+	}
+	quantity, err := resource.ParseQuantity(size)
+	if err != nil {
+		return err
+	}
+
+	claim := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   wallet.volumeName(),
+			Labels: r.labels(wallet.Id.Hex()),
+		},
+		Spec: v1.PersistentVolumeClaimSpec{
+			AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{v1.ResourceStorage: quantity},
+			},
+		},
+	}
+	if r.settings.StorageClass != "" {
+		claim.Spec.StorageClassName = &r.settings.StorageClass
+	}
+
+	log.Infof("Creating new volume claim for wallet with id '%s'", wallet.Id.Hex())
+	_, err = r.clientset.CoreV1().PersistentVolumeClaims(r.settings.Namespace).Create(claim)
+	return err
+}
+
+func (r *kubernetesRuntime) RemoveVolume(volumeName string) error {
+	log.Infof("Removing volume claim '%s'", volumeName)
+	return r.clientset.CoreV1().PersistentVolumeClaims(r.settings.Namespace).Delete(volumeName, &metav1.DeleteOptions{})
+}
+
+func (r *kubernetesRuntime) StartSatellite(wallet *Wallet, password string) error {
+	name := podName(wallet.Id.Hex())
+
+	rpcPort, err := strconv.Atoi(r.satellite.RpcPort)
+	if err != nil {
+		return errors.Wrap(err, "invalid satellite rpc port")
+	}
+
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: r.labels(wallet.Id.Hex()),
+		},
+		Type:       v1.SecretTypeOpaque,
+		StringData: map[string]string{satellitePasswordKey: password},
+	}
+	if _, err := r.clientset.CoreV1().Secrets(r.settings.Namespace).Create(secret); err != nil {
+		if !k8serrors.IsAlreadyExists(err) {
+			return err
+		}
+		if _, err := r.clientset.CoreV1().Secrets(r.settings.Namespace).Update(secret); err != nil {
+			return err
+		}
+	}
+
+	// kubernetes expands $(VAR) references in the args, so the password never shows up in the pod spec
+	args, daemonEndpoint := satelliteCommand(r.daemons, r.satellite.Command)
+	args = append(args, "--container-password=$(WALLET_PASSWORD)")
+
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: r.labels(wallet.Id.Hex()),
+		},
+		Spec: v1.PodSpec{
+			RestartPolicy: v1.RestartPolicyAlways,
+			Containers: []v1.Container{
+				{
+					Name:  satelliteContainerName,
+					Image: r.satellite.Image,
+					Args:  args,
+					Env: []v1.EnvVar{
+						{
+							Name: "WALLET_PASSWORD",
+							ValueFrom: &v1.EnvVarSource{
+								SecretKeyRef: &v1.SecretKeySelector{
+									LocalObjectReference: v1.LocalObjectReference{Name: name},
+									Key:                  satellitePasswordKey,
+								},
+							},
+						},
+					},
+					Ports: []v1.ContainerPort{
+						{Name: "rpc", ContainerPort: int32(rpcPort)},
+					},
+					VolumeMounts: []v1.VolumeMount{
+						{Name: "data", MountPath: "/data"},
+					},
+					ReadinessProbe: r.readinessProbe(),
+				},
+			},
+			Volumes: []v1.Volume{
+				{
+					Name: "data",
+					VolumeSource: v1.VolumeSource{
+						PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: wallet.volumeName()},
+					},
+				},
+			},
+		},
+	}
+
+	log.Infof("Starting pod for wallet with id '%s'", wallet.Id.Hex())
+
+	if _, err := r.clientset.CoreV1().Pods(r.settings.Namespace).Create(pod); err != nil {
+		r.removeSecret(name)
+		return err
+	}
+
+	log.Debugf("Started pod for wallet with id '%s'", wallet.Id.Hex())
+
+	wallet.Daemon = daemonEndpoint
+	return nil
+}
+
+func (r *kubernetesRuntime) RemoveSatellite(walletId string) error {
+	name := podName(walletId)
+	pods := r.clientset.CoreV1().Pods(r.settings.Namespace)
+
+	gracePeriod := int64(0)
+	err := pods.Delete(name, &metav1.DeleteOptions{GracePeriodSeconds: &gracePeriod})
+	r.removeSecret(name)
+	if k8serrors.IsNotFound(err) {
+		log.Errorf("Could not find pod for wallet %s!", walletId)
+		return ErrWalletNotRunning
+	}
+	if err != nil {
+		return err
+	}
+
+	// the pod name is blocked until the pod is gone, which would let a subsequent start fail
+	return wait.PollImmediate(podPollInterval, r.startTimeout(), func() (bool, error) {
+		_, err := pods.Get(name, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	})
+}
+
+func (r *kubernetesRuntime) IsRunning(walletId string) (bool, error) {
+	pod, err := r.clientset.CoreV1().Pods(r.settings.Namespace).Get(podName(walletId), metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		log.Errorf("Could not check status of wallet %s: %s", walletId, err.Error())
+		return false, err
+	}
+
+	if pod.DeletionTimestamp != nil {
+		return false, nil
+	}
+	return pod.Status.Phase == v1.PodPending || pod.Status.Phase == v1.PodRunning, nil
+}
+
+func (r *kubernetesRuntime) CheckHealth(walletId string) error {
+	pod, err := r.clientset.CoreV1().Pods(r.settings.Namespace).Get(podName(walletId), metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return ErrWalletNotRunning
+	}
+	if err != nil {
+		return err
+	}
+
+	if pod.Status.Phase != v1.PodRunning {
+		return fmt.Errorf("pod %s", pod.Status.Phase)
+	}
+
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name != satelliteContainerName {
+			continue
+		}
+		if status.State.Waiting != nil {
+			return fmt.Errorf("container waiting: %s", status.State.Waiting.Reason)
+		}
+		if !status.Ready {
+			return errors.New("container not ready")
+		}
+	}
+
+	return nil
+}
+
+func (r *kubernetesRuntime) Walletd(walletId string) (iridium.WalletdRPC, error) {
+	podIP, err := r.podIP(walletId)
+	if err != nil {
+		return nil, err
+	}
+	rpcHost := net.JoinHostPort(podIP, r.satellite.RpcPort)
+	rpcAddress := fmt.Sprintf("http://%s/json_rpc", rpcHost)
+
+	return iridium.Walletd(rpcAddress)
+}
+
+// podIP waits for the pod of the wallet to get scheduled and returns its ip address.
+func (r *kubernetesRuntime) podIP(walletId string) (string, error) {
+	var podIP string
+
+	err := wait.PollImmediate(podPollInterval, r.startTimeout(), func() (bool, error) {
+		pod, err := r.clientset.CoreV1().Pods(r.settings.Namespace).Get(podName(walletId), metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			return false, ErrWalletNotRunning
+		}
+		if err != nil {
+			return false, err
+		}
+		if pod.Status.Phase == v1.PodFailed || pod.Status.Phase == v1.PodSucceeded {
+			return false, fmt.Errorf("pod %s", pod.Status.Phase)
+		}
+		podIP = pod.Status.PodIP
+		return podIP != "", nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return "", errors.Errorf("pod of wallet %s did not get an ip address in time", walletId)
+	}
+
+	return podIP, err
+}
+
+func (r *kubernetesRuntime) removeSecret(name string) {
+	err := r.clientset.CoreV1().Secrets(r.settings.Namespace).Delete(name, &metav1.DeleteOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		log.Warnf("Could not remove secret %s: %s", name, err.Error())
+	}
+}
+
+// readinessProbe translates the docker health check of the config into an exec probe.
+func (r *kubernetesRuntime) readinessProbe() *v1.Probe {
+	healthCheck := r.satellite.HealthCheck
+	if len(healthCheck.Command) == 0 {
+		return nil
+	}
+
+	var command []string
+	switch healthCheck.Command[0] {
+	case "CMD-SHELL":
+		command = append([]string{"/bin/sh", "-c"}, healthCheck.Command[1:]...)
+	case "CMD":
+		command = healthCheck.Command[1:]
+	case "NONE":
+		return nil
+	default:
+		command = healthCheck.Command
+	}
+
+	return &v1.Probe{
+		Handler: v1.Handler{
+			Exec: &v1.ExecAction{Command: command},
+		},
+		PeriodSeconds:    int32(healthCheck.IntervalSeconds),
+		TimeoutSeconds:   int32(healthCheck.TimeoutSeconds),
+		FailureThreshold: int32(healthCheck.Retries),
+	}
+}
+
+func (r *kubernetesRuntime) labels(walletId string) map[string]string {
+	labels := map[string]string{walletIdLabel: walletId}
+	for k, v := range r.satellite.Labels {
+		labels[k] = v
+	}
+	return labels
+}
+
+func (r *kubernetesRuntime) startTimeout() time.Duration {
+	if r.settings.StartTimeoutSeconds <= 0 {
+		return 60 * time.Second
+	}
+	return r.settings.StartTimeoutSeconds * time.Second
+}
+
+func podName(walletId string) string {
+	return "wallet-" + walletId
+}
@@ -0,0 +1,182 @@
+package wallet
+
+import (
+	"github.com/iridiumdev/webwallet-core/config"
+	"gopkg.in/mgo.v2/bson"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"reflect"
+	"testing"
+)
+
+const testNamespace = "webwallet"
+
+func newTestKubernetesRuntime() (*kubernetesRuntime, *fake.Clientset) {
+	clientset := fake.NewSimpleClientset()
+	runtime := NewKubernetesRuntime(clientset, nil, config.Satellite{
+		Image:   "satellite:test",
+		Command: []string{"--data-dir=/data"},
+		RpcPort: "14007",
+		Labels:  map[string]string{"tag": "satellite"},
+		HealthCheck: config.HealthCheck{
+			Command: []string{"CMD-SHELL", "nc -z localhost 14007 || exit 1"},
+			Retries: 3,
+		},
+	}, config.Kubernetes{
+		Namespace:           testNamespace,
+		StorageClass:        "fast",
+		StorageSize:         "1Gi",
+		StartTimeoutSeconds: 1,
+	})
+	return runtime.(*kubernetesRuntime), clientset
+}
+
+func TestKubernetesRuntimeCreatesVolumeClaim(t *testing.T) {
+	runtime, clientset := newTestKubernetesRuntime()
+	wallet := &Wallet{Id: bson.NewObjectId()}
+
+	if err := runtime.CreateVolume(wallet); err != nil {
+		t.Fatal(err)
+	}
+
+	claim, err := clientset.CoreV1().PersistentVolumeClaims(testNamespace).Get(wallet.volumeName(), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *claim.Spec.StorageClassName != "fast" {
+		t.Errorf("expected storage class fast, got %s", *claim.Spec.StorageClassName)
+	}
+	if size := claim.Spec.Resources.Requests[v1.ResourceStorage]; size.String() != "1Gi" {
+		t.Errorf("expected 1Gi of storage, got %s", size.String())
+	}
+	if claim.Labels["tag"] != "satellite" || claim.Labels[walletIdLabel] != wallet.Id.Hex() {
+		t.Errorf("expected satellite labels, got %v", claim.Labels)
+	}
+
+	if err := runtime.RemoveVolume(wallet.volumeName()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clientset.CoreV1().PersistentVolumeClaims(testNamespace).Get(wallet.volumeName(), metav1.GetOptions{}); err == nil {
+		t.Error("expected volume claim to be removed")
+	}
+}
+
+func TestKubernetesRuntimeStartsSatellitePod(t *testing.T) {
+	runtime, clientset := newTestKubernetesRuntime()
+	wallet := &Wallet{Id: bson.NewObjectId()}
+	name := podName(wallet.Id.Hex())
+
+	if err := runtime.StartSatellite(wallet, "s3cr3t"); err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := clientset.CoreV1().Secrets(testNamespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret.StringData[satellitePasswordKey] != "s3cr3t" {
+		t.Errorf("expected password in secret, got %v", secret.StringData)
+	}
+
+	pod, err := clientset.CoreV1().Pods(testNamespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	container := pod.Spec.Containers[0]
+	expectedArgs := []string{"--data-dir=/data", "--container-password=$(WALLET_PASSWORD)"}
+	if !reflect.DeepEqual(container.Args, expectedArgs) {
+		t.Errorf("expected args %v, got %v", expectedArgs, container.Args)
+	}
+	if container.Image != "satellite:test" || container.Ports[0].ContainerPort != 14007 {
+		t.Errorf("unexpected container %v", container)
+	}
+	if container.Env[0].ValueFrom.SecretKeyRef.Name != name {
+		t.Errorf("expected password to be read from secret %s", name)
+	}
+	if pod.Spec.Volumes[0].PersistentVolumeClaim.ClaimName != wallet.volumeName() {
+		t.Errorf("expected volume claim %s to be mounted", wallet.volumeName())
+	}
+	expectedProbe := []string{"/bin/sh", "-c", "nc -z localhost 14007 || exit 1"}
+	if !reflect.DeepEqual(container.ReadinessProbe.Exec.Command, expectedProbe) {
+		t.Errorf("expected readiness probe %v, got %v", expectedProbe, container.ReadinessProbe.Exec.Command)
+	}
+}
+
+func TestKubernetesRuntimeResolvesPodIP(t *testing.T) {
+	runtime, clientset := newTestKubernetesRuntime()
+	wallet := &Wallet{Id: bson.NewObjectId()}
+
+	if err := runtime.StartSatellite(wallet, "s3cr3t"); err != nil {
+		t.Fatal(err)
+	}
+
+	if running, _ := runtime.IsRunning(wallet.Id.Hex()); !running {
+		t.Error("expected pending pod to be running")
+	}
+	if _, err := runtime.podIP(wallet.Id.Hex()); err == nil {
+		t.Error("expected timeout for unscheduled pod")
+	}
+
+	pod, _ := clientset.CoreV1().Pods(testNamespace).Get(podName(wallet.Id.Hex()), metav1.GetOptions{})
+	pod.Status.Phase = v1.PodRunning
+	pod.Status.PodIP = "10.0.0.7"
+	pod.Status.ContainerStatuses = []v1.ContainerStatus{{Name: satelliteContainerName, Ready: true}}
+	if _, err := clientset.CoreV1().Pods(testNamespace).UpdateStatus(pod); err != nil {
+		t.Fatal(err)
+	}
+
+	podIP, err := runtime.podIP(wallet.Id.Hex())
+	if err != nil || podIP != "10.0.0.7" {
+		t.Errorf("expected pod ip 10.0.0.7, got %s (%v)", podIP, err)
+	}
+	if err := runtime.CheckHealth(wallet.Id.Hex()); err != nil {
+		t.Errorf("expected healthy pod, got %v", err)
+	}
+}
+
+func TestKubernetesRuntimeReportsUnhealthyPod(t *testing.T) {
+	runtime, clientset := newTestKubernetesRuntime()
+	wallet := &Wallet{Id: bson.NewObjectId()}
+
+	if err := runtime.StartSatellite(wallet, "s3cr3t"); err != nil {
+		t.Fatal(err)
+	}
+
+	pod, _ := clientset.CoreV1().Pods(testNamespace).Get(podName(wallet.Id.Hex()), metav1.GetOptions{})
+	pod.Status.Phase = v1.PodRunning
+	pod.Status.ContainerStatuses = []v1.ContainerStatus{{
+		Name:  satelliteContainerName,
+		State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}},
+	}}
+	if _, err := clientset.CoreV1().Pods(testNamespace).UpdateStatus(pod); err != nil {
+		t.Fatal(err)
+	}
+
+	err := runtime.CheckHealth(wallet.Id.Hex())
+	if err == nil || err.Error() != "container waiting: CrashLoopBackOff" {
+		t.Errorf("expected crash loop to be reported, got %v", err)
+	}
+}
+
+func TestKubernetesRuntimeRemovesSatellite(t *testing.T) {
+	runtime, clientset := newTestKubernetesRuntime()
+	wallet := &Wallet{Id: bson.NewObjectId()}
+
+	if err := runtime.StartSatellite(wallet, "s3cr3t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := runtime.RemoveSatellite(wallet.Id.Hex()); err != nil {
+		t.Fatal(err)
+	}
+
+	if running, _ := runtime.IsRunning(wallet.Id.Hex()); running {
+		t.Error("expected satellite to be removed")
+	}
+	if _, err := clientset.CoreV1().Secrets(testNamespace).Get(podName(wallet.Id.Hex()), metav1.GetOptions{}); err == nil {
+		t.Error("expected password secret to be removed")
+	}
+	if err := runtime.RemoveSatellite(wallet.Id.Hex()); err != ErrWalletNotRunning {
+		t.Errorf("expected %v, got %v", ErrWalletNotRunning, err)
+	}
+}
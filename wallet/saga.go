@@ -0,0 +1,83 @@
+package wallet
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+)
+
+// sagaStep is a single step of a saga. The compensation reverts the effects of the action and is only executed if
+// the action completed successfully and a later step failed. It may be nil for steps without side effects.
+type sagaStep struct {
+	name       string
+	action     func() error
+	compensate func() error
+}
+
+// saga runs a sequence of steps. If a step fails, the compensations of all steps completed before are executed in
+// reverse order. Each completed step is reported to the completed func, so that it can be recorded and rolled back
+// if the process stops before the saga finished.
+type saga struct {
+	name      string
+	steps     []sagaStep
+	progress  func(step string)
+	completed func(step string)
+}
+
+// StepError is returned by a failed saga, containing the step which failed and any errors of the compensations.
+type StepError struct {
+	Step           string
+	Err            error
+	RollbackErrors []error
+}
+
+func (e *StepError) Error() string {
+	if len(e.RollbackErrors) > 0 {
+		return fmt.Sprintf("%s failed: %s (rollback incomplete: %v)", e.Step, e.Err.Error(), e.RollbackErrors)
+	}
+	return fmt.Sprintf("%s failed: %s", e.Step, e.Err.Error())
+}
+
+func newSaga(name string, progress func(step string), completed func(step string)) *saga {
+	return &saga{name: name, progress: progress, completed: completed}
+}
+
+func (s *saga) step(name string, action func() error, compensate func() error) *saga {
+	s.steps = append(s.steps, sagaStep{name: name, action: action, compensate: compensate})
+	return s
+}
+
+func (s *saga) run() error {
+	for i, step := range s.steps {
+		if s.progress != nil {
+			s.progress(step.name)
+		}
+
+		if err := step.action(); err != nil {
+			log.Warnf("Saga %s failed at step %s: %s", s.name, step.name, err.Error())
+			return &StepError{Step: step.name, Err: err, RollbackErrors: s.rollback(s.steps[:i])}
+		}
+
+		log.Tracef("Saga %s completed step %s", s.name, step.name)
+		if s.completed != nil {
+			s.completed(step.name)
+		}
+	}
+	return nil
+}
+
+func (s *saga) rollback(completed []sagaStep) []error {
+	var errs []error
+	for i := len(completed) - 1; i >= 0; i-- {
+		step := completed[i]
+		if step.compensate == nil {
+			continue
+		}
+
+		log.Debugf("Saga %s compensating step %s", s.name, step.name)
+		if err := step.compensate(); err != nil {
+			log.Errorf("Saga %s could not compensate step %s: %s", s.name, step.name, err.Error())
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
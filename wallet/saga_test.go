@@ -0,0 +1,217 @@
+package wallet
+
+import (
+	"github.com/iridiumdev/webwallet-core/job"
+	"gopkg.in/mgo.v2/bson"
+	"reflect"
+	"testing"
+)
+
+func assertFailedAt(t *testing.T, err error, step string) {
+	stepErr, ok := err.(*StepError)
+	if !ok {
+		t.Fatalf("expected a StepError for step %s, got %v", step, err)
+	}
+	expected := errInjected
+	if step == "store" {
+		// the store error is logged, the client only gets to know that the wallet could not be saved
+		expected = ErrCouldNotSaveWallet
+	}
+	if stepErr.Step != step || stepErr.Err != expected {
+		t.Errorf("expected injected failure at step %s, got %s", step, stepErr.Error())
+	}
+	if len(stepErr.RollbackErrors) > 0 {
+		t.Errorf("expected a clean rollback, got %v", stepErr.RollbackErrors)
+	}
+}
+
+func TestSagaCompensatesCompletedStepsInReverse(t *testing.T) {
+	var calls []string
+	record := func(call string, err error) func() error {
+		return func() error {
+			calls = append(calls, call)
+			return err
+		}
+	}
+
+	tx := newSaga("test", nil, nil)
+	tx.step("first", record("do first", nil), record("undo first", nil))
+	tx.step("second", record("do second", nil), nil)
+	tx.step("third", record("do third", nil), record("undo third", nil))
+	tx.step("fourth", record("do fourth", errInjected), record("undo fourth", nil))
+	tx.step("fifth", record("do fifth", nil), record("undo fifth", nil))
+
+	assertFailedAt(t, tx.run(), "fourth")
+
+	expected := []string{"do first", "do second", "do third", "do fourth", "undo third", "undo first"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected calls %v, got %v", expected, calls)
+	}
+}
+
+func TestCreateWalletRollsBackOnFailure(t *testing.T) {
+	for _, step := range []string{"volume", "satellite", "rpc", "address", "store", "details"} {
+		t.Run(step, func(t *testing.T) {
+			f := newFixture(step)
+
+			_, err := f.service.createWallet(CreateDTO{Name: "test"}, bson.NewObjectId().Hex(), &job.Job{})
+
+			assertFailedAt(t, err, step)
+			f.assertClean(t)
+			if len(f.store.wallets) > 0 {
+				t.Errorf("expected no stored wallets, got %v", f.store.wallets)
+			}
+		})
+	}
+}
+
+func TestCreateWallet(t *testing.T) {
+	f := newFixture("")
+
+	dWallet, err := f.service.createWallet(CreateDTO{Name: "test"}, bson.NewObjectId().Hex(), &job.Job{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if dWallet.Address != "ir2created" || f.store.wallets[dWallet.Id] == nil {
+		t.Errorf("expected wallet to be stored with its address, got %v", f.store.wallets)
+	}
+	if !f.runtime.satellites[dWallet.Id.Hex()] || !f.runtime.volumes[dWallet.volumeName()] {
+		t.Errorf("expected satellite and volume of wallet %s", dWallet.Id.Hex())
+	}
+	if f.watcher.wallets[dWallet.Id.Hex()] == nil {
+		t.Errorf("expected wallet %s to be watched", dWallet.Id.Hex())
+	}
+
+	expected := []string{"volume", "satellite", "rpc", "address", "store", "details"}
+	if !reflect.DeepEqual(f.jobs.steps, expected) {
+		t.Errorf("expected job progress %v, got %v", expected, f.jobs.steps)
+	}
+}
+
+func TestImportWalletRollsBackOnFailure(t *testing.T) {
+	for _, step := range []string{"volume", "satellite", "rpc", "keys", "store", "details"} {
+		t.Run(step, func(t *testing.T) {
+			f := newFixture(step)
+
+			dto := ImportDTO{ViewSecretKey: "view", SpendSecretKey: "spend"}
+			_, err := f.service.importWallet(dto, bson.NewObjectId().Hex(), &job.Job{})
+
+			assertFailedAt(t, err, step)
+			f.assertClean(t)
+			if len(f.store.wallets) > 0 {
+				t.Errorf("expected no stored wallets, got %v", f.store.wallets)
+			}
+		})
+	}
+}
+
+func TestStartWalletRollsBackOnFailure(t *testing.T) {
+	for _, step := range []string{"satellite", "relocate", "rpc", "details"} {
+		t.Run(step, func(t *testing.T) {
+			f := newFixture(step)
+			f.runtime.relocateTo = "relocated.wallet"
+			wallet := storedWallet(f)
+			volume := wallet.volumeName()
+
+			_, err := f.service.startWallet(wallet, "password", &job.Job{})
+
+			assertFailedAt(t, err, step)
+			f.assertClean(t, volume)
+			if stored := f.store.wallets[wallet.Id]; stored.volumeName() != volume {
+				t.Errorf("expected stored volume %s, got %s", volume, stored.volumeName())
+			}
+		})
+	}
+}
+
+func TestStartWalletRelocatesVolume(t *testing.T) {
+	f := newFixture("")
+	f.runtime.relocateTo = "relocated.wallet"
+	wallet := storedWallet(f)
+
+	if _, err := f.service.startWallet(wallet, "password", &job.Job{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if stored := f.store.wallets[wallet.Id]; stored.Volume != "relocated.wallet" {
+		t.Errorf("expected stored volume relocated.wallet, got %s", stored.Volume)
+	}
+	if !reflect.DeepEqual(f.runtime.volumes, map[string]bool{"relocated.wallet": true}) {
+		t.Errorf("expected only the relocated volume to be left, got %v", f.runtime.volumes)
+	}
+}
+
+// interrupt runs the task until the given step completed, as if the server stopped right after it.
+func interrupt(f *fixture, step string, task func(j *job.Job)) (j *job.Job) {
+	j = &job.Job{Id: bson.NewObjectId()}
+	f.jobs.interruptAfter = step
+	defer func() {
+		f.jobs.interruptAfter = ""
+		if r := recover(); r != errInterrupted {
+			panic(r)
+		}
+	}()
+	task(j)
+	return
+}
+
+func TestRollbackInterruptedCreateWallet(t *testing.T) {
+	for _, step := range []string{"volume", "satellite", "rpc", "address", "store"} {
+		t.Run(step, func(t *testing.T) {
+			f := newFixture("")
+			f.runtime.relocateTo = "relocated.wallet"
+
+			j := interrupt(f, step, func(j *job.Job) {
+				f.service.createWallet(CreateDTO{Name: "test"}, bson.NewObjectId().Hex(), j)
+			})
+
+			if err := f.service.rollbackJob(j); err != nil {
+				t.Fatal(err)
+			}
+			f.assertClean(t)
+			if len(f.store.wallets) > 0 {
+				t.Errorf("expected no stored wallets, got %v", f.store.wallets)
+			}
+		})
+	}
+}
+
+func TestRollbackInterruptedStartWallet(t *testing.T) {
+	for _, step := range []string{"satellite", "relocate", "rpc"} {
+		t.Run(step, func(t *testing.T) {
+			f := newFixture("")
+			f.runtime.relocateTo = "relocated.wallet"
+			wallet := storedWallet(f)
+			volume := wallet.volumeName()
+
+			j := interrupt(f, step, func(j *job.Job) {
+				j.WalletId = wallet.Id
+				f.service.startWallet(wallet, "password", j)
+			})
+
+			if err := f.service.rollbackJob(j); err != nil {
+				t.Fatal(err)
+			}
+			f.assertClean(t, volume)
+			if stored := f.store.wallets[wallet.Id]; stored.volumeName() != volume {
+				t.Errorf("expected stored volume %s, got %s", volume, stored.volumeName())
+			}
+		})
+	}
+}
+
+func TestRollbackSkipsCompletedJobs(t *testing.T) {
+	f := newFixture("")
+
+	j := interrupt(f, "details", func(j *job.Job) {
+		f.service.createWallet(CreateDTO{Name: "test"}, bson.NewObjectId().Hex(), j)
+	})
+
+	if err := f.service.rollbackJob(j); err != nil {
+		t.Fatal(err)
+	}
+	if f.store.wallets[j.WalletId] == nil || !f.runtime.satellites[j.WalletId.Hex()] {
+		t.Errorf("expected wallet %s to be left running", j.WalletId.Hex())
+	}
+}
@@ -1,180 +1,276 @@
 package wallet
 
 import (
-	"context"
-	"fmt"
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/api/types/filters"
-	"github.com/docker/docker/api/types/mount"
-	"github.com/docker/docker/api/types/volume"
-	"github.com/docker/docker/client"
-	"github.com/iridiumdev/webwallet-core/config"
 	"github.com/iridiumdev/webwallet-core/iridium"
+	"github.com/iridiumdev/webwallet-core/job"
+	"github.com/iridiumdev/webwallet-core/user"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/mgo.v2/bson"
-	"net"
+	"sync"
+	"time"
 )
 
 type Service interface {
-	CreateWallet(dto CreateDTO, userId string) (*DetailedWallet, error)
-	ImportWallet(dto ImportDTO, userId string) (*DetailedWallet, error)
+	CreateWallet(dto CreateDTO, userId string) (*job.Job, error)
+	ImportWallet(dto ImportDTO, userId string) (*job.Job, error)
 
 	GetWallets(userId string) ([]*Wallet, error)
 	GetWallet(walletId string, userId string) (*DetailedWallet, error)
 
-	StartWallet(walletId string, password string, userId string) (*DetailedWallet, error)
+	StartWallet(walletId string, password string, userId string) (*job.Job, error)
 	StopWallet(walletId string, userId string) (*Wallet, error)
+	// DeleteWallets stops and removes all wallets of the user including their data, e.g. when the account is deleted.
+	DeleteWallets(userId string) error
+
+	GetMembers(walletId string, userId string) ([]*Membership, error)
+	// InviteMember invites the user with the given username to the wallet, only the owner may invite members.
+	InviteMember(walletId string, dto InvitationDTO, userId string) (*Membership, error)
+	UpdateMember(walletId string, memberId string, permission Permission, userId string) error
+	// RemoveMember removes a member or declines an invitation, which the owner and the member may do.
+	RemoveMember(walletId string, memberId string, userId string) error
+	GetInvitations(userId string) ([]*Membership, error)
+	AcceptInvitation(walletId string, userId string) error
+
+	// GetAllWallets returns the wallets of all users with the state of their satellites.
+	GetAllWallets() ([]*InstanceState, error)
+	// ForceStopWallet removes the satellite of the wallet of any user without saving the wallet.
+	ForceStopWallet(walletId string) (*Wallet, error)
+	RecoverWallet(wallet *LoadedWallet) error
+
+	SendTransaction(walletId string, dto TransactionDTO, userId string) (*Transaction, error)
+
+	GetPolicy(walletId string, userId string) (*Policy, error)
+	// SetPolicy replaces the policy of the wallet, nil removes it. Only the owner may change the policy, which needs the
+	// approvals of the current policy and returns an ApprovalRequiredError until it has them.
+	SetPolicy(walletId string, policy *Policy, userId string) error
+	GetProposals(walletId string, userId string) ([]*Proposal, error)
+	GetProposal(walletId string, proposalId string, userId string) (*Proposal, error)
+	// ApproveProposal records the approval and sends the transfer once the proposal has enough approvals.
+	ApproveProposal(walletId string, proposalId string, dto DecisionDTO, userId string) (*Proposal, error)
+	RejectProposal(walletId string, proposalId string, dto DecisionDTO, userId string) (*Proposal, error)
+
+	GetLimits(walletId string, userId string) (*Limits, error)
+	SetLimits(walletId string, dto LimitsDTO, userId string) error
+	AddAllowlistEntry(walletId string, dto AllowlistEntryDTO, userId string) (*AllowlistEntry, error)
+	RemoveAllowlistEntry(walletId string, address string, dto StepUpDTO, userId string) error
 
 	FetchDetails(wallet *LoadedWallet, rpc iridium.WalletdRPC) (*DetailedWallet, error)
 	NewWalletdClient(walletId string) (iridium.WalletdRPC, error)
+	CheckHealth(walletId string) error
 }
 
-type containerStatus string
-
-const (
-	DOCKER_EXITED  containerStatus = "exited"
-	DOCKER_RUNNING containerStatus = "running"
-)
-
 var (
 	ErrWalletNotFound   = errors.New("wallet not found")
 	ErrWalletNotRunning = errors.New("wallet not running")
 
 	ErrWalletAlreadyRunning = errors.New("wallet already running")
+	ErrWalletBusy           = errors.New("wallet is busy")
+
+	ErrCouldNotStopWallet   = errors.New("wallet could not be stopped")
+	ErrCouldNotStartWallet  = errors.New("wallet could not be started")
+	ErrCouldNotSaveWallet   = errors.New("wallet could not be saved")
+	ErrCouldNotCreateWallet = errors.New("wallet could not be created")
+	ErrCouldNotImportWallet = errors.New("wallet could not be imported")
+
+	ErrWalletNotSynced         = errors.New("wallet not synced")
+	ErrCouldNotSendTransaction = errors.New("transaction could not be sent")
 
-	ErrCouldNotStopWallet  = errors.New("wallet could not be stopped")
-	ErrCouldNotStartWallet = errors.New("wallet could not be started")
-	ErrCouldNotSaveWallet  = errors.New("wallet could not be saved")
-	ErrCouldNotKillWallet  = errors.New("wallet could not be killed")
+	ErrEmailNotVerified = errors.New("email address not verified")
+
+	ErrPermissionDenied   = errors.New("insufficient permission on wallet")
+	ErrInvalidPermission  = errors.New("invalid permission")
+	ErrAlreadyMember      = errors.New("user is already a member of the wallet")
+	ErrMemberNotFound     = errors.New("member not found")
+	ErrInvitationNotFound = errors.New("invitation not found")
 )
 
 var service Service
 
 type serviceImpl struct {
-	dockerClient *client.Client
-}
+	runtime     Runtime
+	userService user.Service
+	jobService  job.Service
+	creations   *rateLimiter
 
-func InitService(dockerClient *client.Client) Service {
-	service = &serviceImpl{dockerClient: dockerClient}
-	return service
+	quotaMx sync.Mutex
+	pending map[string]*pendingWallets
+
+	busyMx sync.Mutex
+	busy   map[string]struct{}
+
+	transferMx    sync.Mutex
+	transferLocks map[string]*transferLock
 }
 
-func (s *serviceImpl) CreateWallet(dto CreateDTO, userId string) (*DetailedWallet, error) {
+func InitService(runtime Runtime, userService user.Service, jobService job.Service) Service {
+	s := &serviceImpl{
+		runtime:     runtime,
+		userService: userService,
+		jobService:  jobService,
+		creations:   newRateLimiter(),
+		pending:     make(map[string]*pendingWallets),
+		busy:        make(map[string]struct{}),
 
-	wallet := &Wallet{
-		Id:    bson.NewObjectId(),
-		Name:  dto.Name,
-		Owner: bson.ObjectIdHex(userId),
+		transferLocks: make(map[string]*transferLock),
 	}
 
-	if err := s.createNewVolume(wallet); err != nil {
-		return nil, err
-	}
-	if _, err := s.instantiateContainer(wallet, dto.Password); err != nil {
-		return nil, err
+	for _, jobType := range []job.Type{job.CREATE_WALLET, job.IMPORT_WALLET, job.START_WALLET} {
+		jobService.OnInterrupted(jobType, s.rollbackJob)
 	}
 
-	walletd, err := s.NewWalletdClient(wallet.Id.Hex())
-	if err != nil {
-		if err := s.killWallet(wallet.Id.Hex(), userId); err != nil {
-			return nil, err
-		}
-		return nil, err
-	}
+	service = s
+	return service
+}
 
-	addresses, err := walletd.GetAddresses()
+func (s *serviceImpl) CreateWallet(dto CreateDTO, userId string) (*job.Job, error) {
+
+	// the id is known up front, so that the quota can be reserved for the wallet until the job is done
+	walletId := bson.NewObjectId()
+	release, err := s.reserveCreation(userId, walletId)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(addresses) > 0 {
-		wallet.Address = addresses[0]
-	} else {
-		return nil, errors.New("could not fetch wallet address!")
-	}
-
-	err = store.InsertWallet(wallet)
-
-	lWallet := &LoadedWallet{Wallet: wallet}
-
-	dWallet, err := s.FetchDetails(lWallet, walletd)
-
+	createJob, err := s.jobService.Submit(job.CREATE_WALLET, userId, walletId.Hex(), func(j *job.Job) error {
+		defer release()
+		_, err := s.createWallet(dto, userId, j)
+		return publicError(j, err, ErrCouldNotCreateWallet)
+	})
 	if err != nil {
-		log.Errorf("Could not fetch wallet %s details!", walletd)
-		if err := s.killWallet(dWallet.Id.Hex(), userId); err != nil {
-			return nil, err
-		}
-	} else {
-		statusWatcher.AddWallet(dWallet.LoadedWallet)
+		release()
 	}
-
-	return dWallet, err
+	return createJob, err
 }
 
-func (s *serviceImpl) ImportWallet(dto ImportDTO, userId string) (*DetailedWallet, error) {
+func (s *serviceImpl) ImportWallet(dto ImportDTO, userId string) (*job.Job, error) {
 
-	wallet := &Wallet{
-		Id:    bson.NewObjectId(),
-		Name:  dto.Name,
-		Owner: bson.ObjectIdHex(userId),
-	}
-
-	if err := s.createNewVolume(wallet); err != nil {
-		return nil, err
-	}
-	if _, err := s.instantiateContainer(wallet, dto.Password); err != nil {
+	walletId := bson.NewObjectId()
+	release, err := s.reserveCreation(userId, walletId)
+	if err != nil {
 		return nil, err
 	}
 
-	walletd, err := s.NewWalletdClient(wallet.Id.Hex())
+	importJob, err := s.jobService.Submit(job.IMPORT_WALLET, userId, walletId.Hex(), func(j *job.Job) error {
+		defer release()
+		_, err := s.importWallet(dto, userId, j)
+		return publicError(j, err, ErrCouldNotImportWallet)
+	})
 	if err != nil {
-		if err := s.killWallet(wallet.Id.Hex(), userId); err != nil {
-			return nil, err
-		}
-		return nil, err
+		release()
 	}
+	return importJob, err
+}
 
-	if err := walletd.Reset(dto.ViewSecretKey); err != nil {
-		return nil, err
+// newWallet returns the wallet created by the job, with the id it was submitted with if any.
+func newWallet(name string, userId string, j *job.Job) *Wallet {
+	if j.WalletId == "" {
+		j.WalletId = bson.NewObjectId()
 	}
-	address, err := walletd.CreateAddress(dto.SpendSecretKey)
-	if err != nil {
-		return nil, err
+	return &Wallet{
+		Id:    j.WalletId,
+		Name:  name,
+		Owner: bson.ObjectIdHex(userId),
 	}
+}
 
-	err = walletd.Save()
-	if err != nil {
+func (s *serviceImpl) createWallet(dto CreateDTO, userId string, j *job.Job) (*DetailedWallet, error) {
+
+	wallet := newWallet(dto.Name, userId, j)
+
+	var walletd iridium.WalletdRPC
+	var dWallet *DetailedWallet
+
+	tx := newSaga("create wallet "+wallet.Id.Hex(), s.progress(j), s.record(j, wallet))
+	tx.step("volume", func() error {
+		return s.runtime.CreateVolume(wallet)
+	}, func() error {
+		return s.runtime.RemoveVolume(wallet.volumeName())
+	})
+	cleanup := s.satelliteSteps(tx, wallet, dto.Password, false)
+	tx.step("rpc", func() (err error) {
+		walletd, err = s.runtime.Walletd(wallet.Id.Hex())
+		return
+	}, nil)
+	tx.step("address", func() error {
+		addresses, err := walletd.GetAddresses()
+		if err != nil {
+			return err
+		}
+		if len(addresses) == 0 {
+			return errors.New("could not fetch wallet address!")
+		}
+		wallet.Address = addresses[0]
+		return nil
+	}, nil)
+	s.storeStep(tx, wallet)
+	tx.step("details", func() (err error) {
+		dWallet, err = s.loadWallet(wallet, dto.Password, walletd)
+		return
+	}, nil)
+
+	if err := tx.run(); err != nil {
 		return nil, err
 	}
+	cleanup()
 
-	wallet.Address = address
-	err = store.InsertWallet(wallet)
+	return dWallet, nil
+}
 
-	lWallet := &LoadedWallet{Wallet: wallet}
+func (s *serviceImpl) importWallet(dto ImportDTO, userId string, j *job.Job) (*DetailedWallet, error) {
 
-	dWallet, err := s.FetchDetails(lWallet, walletd)
+	wallet := newWallet(dto.Name, userId, j)
 
-	if err != nil {
-		log.Errorf("Could not fetch wallet %s details!", walletd)
-		if err := s.killWallet(dWallet.Id.Hex(), userId); err != nil {
-			return nil, err
+	var walletd iridium.WalletdRPC
+	var dWallet *DetailedWallet
+
+	tx := newSaga("import wallet "+wallet.Id.Hex(), s.progress(j), s.record(j, wallet))
+	tx.step("volume", func() error {
+		return s.runtime.CreateVolume(wallet)
+	}, func() error {
+		return s.runtime.RemoveVolume(wallet.volumeName())
+	})
+	cleanup := s.satelliteSteps(tx, wallet, dto.Password, false)
+	tx.step("rpc", func() (err error) {
+		walletd, err = s.runtime.Walletd(wallet.Id.Hex())
+		return
+	}, nil)
+	tx.step("keys", func() error {
+		if err := walletd.Reset(dto.ViewSecretKey); err != nil {
+			return err
+		}
+		address, err := walletd.CreateAddress(dto.SpendSecretKey)
+		if err != nil {
+			return err
 		}
-	} else {
-		statusWatcher.AddWallet(dWallet.LoadedWallet)
+		if err := walletd.Save(); err != nil {
+			return err
+		}
+		wallet.Address = address
+		return nil
+	}, nil)
+	s.storeStep(tx, wallet)
+	tx.step("details", func() (err error) {
+		dWallet, err = s.loadWallet(wallet, dto.Password, walletd)
+		return
+	}, nil)
+
+	if err := tx.run(); err != nil {
+		return nil, err
 	}
+	cleanup()
 
-	return dWallet, err
+	return dWallet, nil
 }
 
+// GetWallets returns the wallets the user owns or is a member of.
 func (s *serviceImpl) GetWallets(userId string) ([]*Wallet, error) {
-	wallets, e := store.FindWalletsByOwner(bson.ObjectIdHex(userId))
+	wallets, e := store.FindWalletsByMember(bson.ObjectIdHex(userId))
 	for k, wallet := range wallets {
-		if _, err := s.checkContainerRunning(wallet); err != nil {
-			wallets[k].Status = STOPPED
-		} else {
+		if running, _ := s.runtime.IsRunning(wallet.Id.Hex()); running {
 			wallets[k].Status = RUNNING
+		} else {
+			wallets[k].Status = STOPPED
 		}
 	}
 	return wallets, e
@@ -182,17 +278,21 @@ func (s *serviceImpl) GetWallets(userId string) ([]*Wallet, error) {
 
 func (s *serviceImpl) GetWallet(walletId string, userId string) (*DetailedWallet, error) {
 
-	wallet, err := store.FindWalletByOwner(bson.ObjectIdHex(walletId), bson.ObjectIdHex(userId))
-	if err != nil || wallet == nil {
-		log.Warnf("Could not find wallet %s for user %s, err: %s", walletId, userId, err.Error())
-		return nil, ErrWalletNotFound
+	wallet, err := findWallet(walletId, userId, VIEW)
+	if err != nil {
+		return nil, err
 	}
 
 	lWallet := &LoadedWallet{Wallet: wallet}
 	dWallet := &DetailedWallet{LoadedWallet: lWallet}
 
-	if _, err := s.checkContainerRunning(wallet); err != nil {
-		return nil, err
+	if running, _ := s.runtime.IsRunning(wallet.Id.Hex()); !running {
+		// a wallet which crashed is reported with the error the watcher detected
+		if wallet.LastError != nil {
+			dWallet.Status = ERROR
+			return dWallet, nil
+		}
+		return nil, ErrWalletNotRunning
 	}
 
 	walletd, err := s.NewWalletdClient(wallet.Id.Hex())
@@ -206,75 +306,268 @@ func (s *serviceImpl) GetWallet(walletId string, userId string) (*DetailedWallet
 	return dWallet, err
 }
 
-func (s *serviceImpl) StartWallet(walletId string, password string, userId string) (*DetailedWallet, error) {
+func (s *serviceImpl) StartWallet(walletId string, password string, userId string) (*job.Job, error) {
 
-	wallet, err := store.FindWalletByOwner(bson.ObjectIdHex(walletId), bson.ObjectIdHex(userId))
-	if err != nil || wallet == nil {
-		log.Warnf("Could not find wallet %s for user %s, err: %s", walletId, userId, err.Error())
-		return nil, ErrWalletNotFound
+	wallet, err := findWallet(walletId, userId, SEND)
+	if err != nil {
+		return nil, err
 	}
 
-	walletContainer, _ := s.checkContainerRunning(wallet)
-	if walletContainer != nil {
+	if running, _ := s.runtime.IsRunning(walletId); running {
 		return nil, ErrWalletAlreadyRunning
 	}
 
-	loadedWallet, err := s.instantiateContainer(wallet, password)
+	if !s.markBusy(walletId) {
+		return nil, ErrWalletBusy
+	}
+
+	// a shared wallet counts against the quota of its owner, no matter which member starts it
+	release, err := s.reserveStart(wallet)
 	if err != nil {
-		log.Debugf("Could not start wallet %s due to: %s", walletId, err.Error())
-		return nil, ErrCouldNotStartWallet
+		s.unmarkBusy(walletId)
+		return nil, err
 	}
 
-	walletd, err := s.NewWalletdClient(walletId)
+	startJob, err := s.jobService.Submit(job.START_WALLET, userId, walletId, func(j *job.Job) error {
+		defer s.unmarkBusy(walletId)
+		defer release()
+		_, err := s.startWallet(wallet, password, j)
+		return publicError(j, err, ErrCouldNotStartWallet)
+	})
 	if err != nil {
-		log.Debugf("Could not start wallet %s due to: %s", walletId, err.Error())
-		if err := s.killWallet(walletId, userId); err != nil {
-			return nil, err
+		s.unmarkBusy(walletId)
+		release()
+	}
+	return startJob, err
+}
+
+func (s *serviceImpl) startWallet(wallet *Wallet, password string, j *job.Job) (*DetailedWallet, error) {
+
+	var walletd iridium.WalletdRPC
+	var dWallet *DetailedWallet
+
+	tx := newSaga("start wallet "+wallet.Id.Hex(), s.progress(j), s.record(j, wallet))
+	cleanup := s.satelliteSteps(tx, wallet, password, true)
+	tx.step("rpc", func() (err error) {
+		walletd, err = s.runtime.Walletd(wallet.Id.Hex())
+		return
+	}, nil)
+	tx.step("details", func() (err error) {
+		dWallet, err = s.loadWallet(wallet, password, walletd)
+		return
+	}, nil)
+
+	if err := tx.run(); err != nil {
+		log.Debugf("Could not start wallet %s due to: %s", wallet.Id.Hex(), err.Error())
+		return nil, err
+	}
+	cleanup()
+
+	if wallet.LastError != nil {
+		if err := store.UpdateLastError(wallet.Id, nil); err != nil {
+			log.Warnf("Could not clear last error of wallet %s: %s", wallet.Id.Hex(), err.Error())
+		}
+		wallet.LastError = nil
+	}
+
+	return dWallet, nil
+}
+
+// satelliteSteps adds the steps starting the satellite of the wallet to the saga. As the runtime may move the wallet
+// to another volume while starting the satellite, the new volume is persisted for already stored wallets and rolled
+// back on failure. The returned func removes the superseded volume and must be called once the saga succeeded.
+func (s *serviceImpl) satelliteSteps(tx *saga, wallet *Wallet, password string, persisted bool) func() {
+	var previousVolume string
+	var previousVolumeName string
+
+	tx.step("satellite", func() error {
+		previousVolume = wallet.Volume
+		previousVolumeName = wallet.volumeName()
+		return s.runtime.StartSatellite(wallet, password)
+	}, func() error {
+		err := s.runtime.RemoveSatellite(wallet.Id.Hex())
+		if wallet.volumeName() != previousVolumeName {
+			if vErr := s.runtime.RemoveVolume(wallet.volumeName()); vErr != nil && err == nil {
+				err = vErr
+			}
+			wallet.Volume = previousVolume
+		}
+		return err
+	})
+
+	if persisted {
+		tx.step("relocate", func() error {
+			if wallet.volumeName() == previousVolumeName {
+				return nil
+			}
+			return store.UpdateVolume(wallet.Id, wallet.Volume)
+		}, func() error {
+			if wallet.volumeName() == previousVolumeName {
+				return nil
+			}
+			return store.UpdateVolume(wallet.Id, previousVolume)
+		})
+	}
+
+	return func() {
+		if wallet.volumeName() == previousVolumeName {
+			return
+		}
+		if err := s.runtime.RemoveVolume(previousVolumeName); err != nil {
+			log.Warnf("Could not remove previous volume %s of wallet %s: %s", previousVolumeName, wallet.Id.Hex(), err.Error())
 		}
-		return nil, ErrCouldNotStartWallet
 	}
+}
+
+func (s *serviceImpl) storeStep(tx *saga, wallet *Wallet) {
+	tx.step("store", func() error {
+		if err := store.InsertWallet(wallet); err != nil {
+			log.Errorf("Could not store wallet %s: %s", wallet.Id.Hex(), err.Error())
+			return ErrCouldNotSaveWallet
+		}
+		return nil
+	}, func() error {
+		return store.DeleteWallet(wallet.Id)
+	})
+}
 
-	detailedWallet, err := s.FetchDetails(loadedWallet, walletd)
+// loadWallet fetches the details of a freshly started wallet and hands it over to the status watcher.
+func (s *serviceImpl) loadWallet(wallet *Wallet, password string, walletd iridium.WalletdRPC) (*DetailedWallet, error) {
+	dWallet, err := s.FetchDetails(&LoadedWallet{Wallet: wallet, password: password}, walletd)
 	if err != nil {
-		log.Errorf("Could not fetch wallet %s details!", walletd)
-		if err := s.killWallet(walletId, userId); err != nil {
-			return nil, err
+		log.Errorf("Could not fetch wallet %s details!", wallet.Id.Hex())
+		return nil, err
+	}
+
+	statusWatcher.AddWallet(dWallet.LoadedWallet)
+	return dWallet, nil
+}
+
+// publicError returns the error the job is failed with, which is shown to its owner along with the failed step. Failed
+// steps may carry the errors of the runtime, so they are only logged and replaced by the given public error.
+func publicError(j *job.Job, err error, public error) error {
+	stepErr, ok := err.(*StepError)
+	if !ok {
+		return err
+	}
+
+	log.Errorf("Job %s failed: %s", j.Id.Hex(), stepErr.Error())
+	if stepErr.Err == ErrCouldNotSaveWallet {
+		return stepErr.Err
+	}
+	return public
+}
+
+func (s *serviceImpl) progress(j *job.Job) func(step string) {
+	return func(step string) {
+		s.jobService.Progress(j, step)
+	}
+}
+
+// record returns the func recording the completed steps of the saga run by the job, along with the volume of the
+// wallet before the saga and after each step, which rollbackJob needs to compensate the step.
+func (s *serviceImpl) record(j *job.Job, wallet *Wallet) func(step string) {
+	previousVolume := wallet.volumeName()
+	return func(step string) {
+		s.jobService.Complete(j, job.Step{Name: step, Volume: wallet.volumeName(), PreviousVolume: previousVolume})
+	}
+}
+
+// rollbackJob runs the compensations of the steps a job completed before it was interrupted by a server restart, so
+// that no satellite, volume or wallet document of a half provisioned wallet is left behind. A job which completed all
+// of its steps provisioned the wallet already, so there is nothing to roll back.
+func (s *serviceImpl) rollbackJob(j *job.Job) error {
+	walletId := j.WalletId.Hex()
+	if j.Completed[len(j.Completed)-1].Name == "details" {
+		return nil
+	}
+
+	log.Infof("Rolling back interrupted job %s of wallet %s", j.Id.Hex(), walletId)
+
+	var errs []error
+	for i := len(j.Completed) - 1; i >= 0; i-- {
+		step := j.Completed[i]
+
+		var err error
+		switch step.Name {
+		case "volume":
+			err = s.runtime.RemoveVolume(step.Volume)
+		case "satellite":
+			if err = s.runtime.RemoveSatellite(walletId); err == ErrWalletNotRunning {
+				err = nil
+			}
+			if step.Volume != step.PreviousVolume {
+				if vErr := s.runtime.RemoveVolume(step.Volume); vErr != nil && err == nil {
+					err = vErr
+				}
+			}
+		case "relocate":
+			if step.Volume != step.PreviousVolume {
+				err = store.UpdateVolume(j.WalletId, step.PreviousVolume)
+			}
+		case "store":
+			err = store.DeleteWallet(j.WalletId)
+		}
+
+		if err != nil {
+			log.Errorf("Could not compensate step %s of job %s: %s", step.Name, j.Id.Hex(), err.Error())
+			errs = append(errs, err)
 		}
-	} else {
-		statusWatcher.AddWallet(detailedWallet.LoadedWallet)
 	}
 
-	return detailedWallet, err
+	if len(errs) > 0 {
+		return errors.Errorf("rollback incomplete: %v", errs)
+	}
+	return nil
 }
 
-func (s *serviceImpl) StopWallet(walletId string, userId string) (*Wallet, error) {
+// markBusy flags a wallet as being provisioned, returning false if another job is already working on it.
+func (s *serviceImpl) markBusy(walletId string) bool {
+	s.busyMx.Lock()
+	defer s.busyMx.Unlock()
 
-	ctx := context.Background()
+	if _, ok := s.busy[walletId]; ok {
+		return false
+	}
+	s.busy[walletId] = struct{}{}
+	return true
+}
 
-	wallet, err := store.FindWalletByOwner(bson.ObjectIdHex(walletId), bson.ObjectIdHex(userId))
-	if err != nil || wallet == nil {
-		log.Warnf("Could not find wallet %s for user %s, err: %s", walletId, userId, err.Error())
-		return nil, ErrWalletNotFound
+func (s *serviceImpl) isBusy(walletId string) bool {
+	s.busyMx.Lock()
+	defer s.busyMx.Unlock()
+	_, ok := s.busy[walletId]
+	return ok
+}
+
+func (s *serviceImpl) unmarkBusy(walletId string) {
+	s.busyMx.Lock()
+	defer s.busyMx.Unlock()
+	delete(s.busy, walletId)
+}
+
+func (s *serviceImpl) StopWallet(walletId string, userId string) (*Wallet, error) {
+
+	wallet, err := findWallet(walletId, userId, SEND)
+	if err != nil {
+		return nil, err
 	}
 
-	walletContainer, err := s.checkContainerRunning(wallet)
+	running, err := s.runtime.IsRunning(walletId)
 	if err != nil {
-		if err == ErrWalletNotRunning {
-			wallet.Status = STOPPED
-			return wallet, nil
-		} else {
-			log.Errorf("Could not stop wallet %s due to: %s", walletId, err.Error())
-			return nil, ErrCouldNotStopWallet
-		}
+		log.Errorf("Could not stop wallet %s due to: %s", walletId, err.Error())
+		return nil, ErrCouldNotStopWallet
+	}
+	if !running {
+		wallet.Status = STOPPED
+		return wallet, nil
 	}
 	wallet.Status = RUNNING
 
-	walletd, err := s.NewWalletdClient(walletId)
+	walletd, err := s.runtime.Walletd(walletId)
 	if err != nil {
 		log.Debugf("Could not save wallet %s due to: %s", walletId, err.Error())
-		if err := s.killWallet(walletId, userId); err != nil {
-			return nil, err
-		}
+		s.killWallet(wallet)
 		return nil, ErrCouldNotSaveWallet
 	}
 
@@ -283,10 +576,7 @@ func (s *serviceImpl) StopWallet(walletId string, userId string) (*Wallet, error
 		return nil, ErrCouldNotSaveWallet
 	}
 
-	err = s.dockerClient.ContainerRemove(ctx, walletContainer.ID, types.ContainerRemoveOptions{
-		Force: true,
-	})
-	if err != nil {
+	if err := s.runtime.RemoveSatellite(walletId); err != nil {
 		log.Errorf("Could not stop wallet %s due to: %s", walletId, err.Error())
 		return nil, ErrCouldNotStopWallet
 	}
@@ -298,140 +588,305 @@ func (s *serviceImpl) StopWallet(walletId string, userId string) (*Wallet, error
 	return wallet, nil
 }
 
-func (s *serviceImpl) killWallet(walletId string, userId string) error {
-
-	ctx := context.Background()
-
-	wallet, err := store.FindWalletByOwner(bson.ObjectIdHex(walletId), bson.ObjectIdHex(userId))
-	if err != nil || wallet == nil {
-		log.Warnf("Could not find wallet %s for user %s, err: %s", walletId, userId, err.Error())
-		return ErrWalletNotFound
-	}
-
-	statusWatcher.RemoveWallet(wallet)
-
-	cList, err := s.getContainer(wallet, DOCKER_RUNNING)
+func (s *serviceImpl) DeleteWallets(userId string) error {
+	wallets, err := store.FindWalletsByOwner(bson.ObjectIdHex(userId))
 	if err != nil {
-		log.Error(err)
+		log.Errorf("Could not find wallets of user %s: %s", userId, err.Error())
+		return err
 	}
-	if len(cList) == 0 {
-		cList, err = s.getContainer(wallet, DOCKER_EXITED)
+
+	for _, wallet := range wallets {
+		if !s.markBusy(wallet.Id.Hex()) {
+			return ErrWalletBusy
+		}
+		err := s.deleteWallet(wallet)
+		s.unmarkBusy(wallet.Id.Hex())
 		if err != nil {
-			log.Error(err)
 			return err
 		}
 	}
 
-	if len(cList) == 0 {
-		log.Errorf("Could not find container for wallet %s!", walletId)
-		return ErrCouldNotKillWallet
+	if err := store.DeleteMembershipsOfUser(bson.ObjectIdHex(userId)); err != nil {
+		log.Errorf("Could not delete memberships of user %s: %s", userId, err.Error())
+		return err
 	}
 
-	walletContainer := cList[0]
+	log.Infof("Deleted %d wallets of user %s", len(wallets), userId)
+	return nil
+}
 
-	err = s.dockerClient.ContainerRemove(ctx, walletContainer.ID, types.ContainerRemoveOptions{
-		Force: true,
-	})
+// deleteWallet removes the satellite without saving the wallet, as its volume is removed anyway.
+func (s *serviceImpl) deleteWallet(wallet *Wallet) error {
+	walletId := wallet.Id.Hex()
+
+	running, err := s.runtime.IsRunning(walletId)
 	if err != nil {
 		log.Errorf("Could not stop wallet %s due to: %s", walletId, err.Error())
 		return ErrCouldNotStopWallet
 	}
+	if running {
+		statusWatcher.RemoveWallet(wallet)
+		if err := s.runtime.RemoveSatellite(walletId); err != nil {
+			log.Errorf("Could not stop wallet %s due to: %s", walletId, err.Error())
+			return ErrCouldNotStopWallet
+		}
+	}
 
+	if err := s.runtime.RemoveVolume(wallet.volumeName()); err != nil {
+		log.Warnf("Could not remove volume %s of wallet %s: %s", wallet.volumeName(), walletId, err.Error())
+	}
+
+	if err := store.DeleteMembershipsOfWallet(wallet.Id); err != nil {
+		log.Errorf("Could not delete members of wallet %s: %s", walletId, err.Error())
+		return err
+	}
+	if err := store.DeleteProposalsOfWallet(wallet.Id); err != nil {
+		log.Errorf("Could not delete proposals of wallet %s: %s", walletId, err.Error())
+		return err
+	}
+	if err := store.DeleteTransactionsOfWallet(wallet.Id); err != nil {
+		log.Errorf("Could not delete transactions of wallet %s: %s", walletId, err.Error())
+		return err
+	}
+	if err := store.DeleteWallet(wallet.Id); err != nil {
+		log.Errorf("Could not delete wallet %s: %s", walletId, err.Error())
+		return err
+	}
 	return nil
 }
 
-func (s *serviceImpl) checkContainerRunning(wallet *Wallet) (*types.Container, error) {
-	cList, err := s.getContainer(wallet, DOCKER_RUNNING)
+func (s *serviceImpl) GetAllWallets() ([]*InstanceState, error) {
+	wallets, err := store.FindWallets()
+	if err != nil {
+		log.Errorf("Could not find wallets: %s", err.Error())
+		return nil, err
+	}
 
+	watched := make(map[bson.ObjectId]bool)
+	for _, wallet := range statusWatcher.State().Wallets {
+		watched[wallet.WalletId] = true
+	}
+
+	states := make([]*InstanceState, 0, len(wallets))
+	for _, wallet := range wallets {
+		walletId := wallet.Id.Hex()
+		state := &InstanceState{Wallet: wallet, Watched: watched[wallet.Id], Busy: s.isBusy(walletId)}
+
+		wallet.Status = STOPPED
+		if running, _ := s.runtime.IsRunning(walletId); running {
+			wallet.Status = RUNNING
+			if err := s.runtime.CheckHealth(walletId); err != nil {
+				state.HealthError = err.Error()
+			}
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+func (s *serviceImpl) ForceStopWallet(walletId string) (*Wallet, error) {
+	if !bson.IsObjectIdHex(walletId) {
+		return nil, ErrWalletNotFound
+	}
+	wallet, err := store.FindWallet(bson.ObjectIdHex(walletId))
+	if err != nil || wallet == nil {
+		return nil, ErrWalletNotFound
+	}
+
+	if !s.markBusy(walletId) {
+		return nil, ErrWalletBusy
+	}
+	defer s.unmarkBusy(walletId)
+
+	running, err := s.runtime.IsRunning(walletId)
 	if err != nil {
-		log.Errorf("Could not check status of wallet %s: %s", wallet.Id.Hex(), err.Error())
+		log.Errorf("Could not stop wallet %s due to: %s", walletId, err.Error())
+		return nil, ErrCouldNotStopWallet
+	}
+	if !running {
 		return nil, ErrWalletNotRunning
 	}
 
-	if len(cList) == 0 {
-		return nil, ErrWalletNotRunning
-	} else {
-		return &cList[0], nil
+	statusWatcher.RemoveWallet(wallet)
+	if err := s.runtime.RemoveSatellite(walletId); err != nil {
+		log.Errorf("Could not stop wallet %s due to: %s", walletId, err.Error())
+		return nil, ErrCouldNotStopWallet
 	}
+
+	log.Warnf("Force stopped wallet %s of user %s", walletId, wallet.Owner.Hex())
+	wallet.Status = STOPPED
+	return wallet, nil
 }
 
-func (s *serviceImpl) getContainer(wallet *Wallet, status containerStatus) ([]types.Container, error) {
-	ctx := context.Background()
+// RecoverWallet replaces the satellite of a running but unhealthy wallet with a fresh one, using the password kept by
+// the status watcher. The wallet stays registered at the watcher.
+func (s *serviceImpl) RecoverWallet(wallet *LoadedWallet) error {
+	walletId := wallet.Id.Hex()
 
-	listFilters := filters.NewArgs()
-	listFilters.Add("name", wallet.Id.Hex())
-	listFilters.Add("status", string(status))
+	if !s.markBusy(walletId) {
+		return ErrWalletBusy
+	}
+	defer s.unmarkBusy(walletId)
+
+	log.Infof("Restarting satellite of wallet %s", walletId)
 
-	for k, v := range config.Get().Webwallet.Satellite.Labels {
-		listFilters.Add("label", fmt.Sprintf("%s=%s", k, v))
+	if err := s.runtime.RemoveSatellite(walletId); err != nil && err != ErrWalletNotRunning {
+		return err
 	}
 
-	return s.dockerClient.ContainerList(ctx, types.ContainerListOptions{
-		Limit:   1,
-		Filters: listFilters,
-	})
-}
+	var walletd iridium.WalletdRPC
 
-func (s *serviceImpl) createNewVolume(wallet *Wallet) error {
-	ctx := context.Background()
+	tx := newSaga("recover wallet "+walletId, nil, nil)
+	cleanup := s.satelliteSteps(tx, wallet.Wallet, wallet.password, true)
+	tx.step("rpc", func() (err error) {
+		walletd, err = s.runtime.Walletd(walletId)
+		return
+	}, nil)
+	tx.step("details", func() error {
+		_, err := s.FetchDetails(wallet, walletd)
+		return err
+	}, nil)
 
-	log.Infof("Creating new volume for wallet with id '%s'", wallet.Id.Hex())
-	_, err := s.dockerClient.VolumeCreate(ctx, volume.VolumesCreateBody{
-		Name:   fmt.Sprintf("%s.wallet", wallet.Id.Hex()),
-		Labels: config.Get().Webwallet.Satellite.Labels,
-	})
-	if err != nil {
+	if err := tx.run(); err != nil {
+		log.Warnf("Could not restart satellite of wallet %s due to: %s", walletId, err.Error())
 		return err
 	}
-	log.Debugf("Created new volume for wallet with id '%s' successfully!", wallet.Id.Hex())
+	cleanup()
+
 	return nil
 }
 
-func (s *serviceImpl) instantiateContainer(wallet *Wallet, password string) (*LoadedWallet, error) {
-	ctx := context.Background()
-
-	command := append(config.Get().Webwallet.Satellite.Command,
-		fmt.Sprintf("--container-password=%s", password),
-	)
-
-	volumeName := fmt.Sprintf("%s.wallet", wallet.Id.Hex())
-	_, err := s.dockerClient.ContainerCreate(ctx, &container.Config{
-		Image:  config.Get().Webwallet.Satellite.Image,
-		Cmd:    command,
-		Labels: config.Get().Webwallet.Satellite.Labels,
-	}, &container.HostConfig{
-		Mounts: []mount.Mount{
-			{
-				Type:   mount.TypeVolume,
-				Source: volumeName,
-				Target: "/data",
-			},
-		},
-	}, nil, wallet.Id.Hex())
+// killWallet removes the satellite of an unresponsive wallet without saving it.
+func (s *serviceImpl) killWallet(wallet *Wallet) {
+	statusWatcher.RemoveWallet(wallet)
+
+	if err := s.runtime.RemoveSatellite(wallet.Id.Hex()); err != nil {
+		log.Errorf("Could not kill wallet %s due to: %s", wallet.Id.Hex(), err.Error())
+	}
+}
 
+// SendTransaction transfers the given amount from the wallet to another address. Sending is only possible once the
+// satellite caught up with the network, as the balance may be outdated before. Transfers the policy of the wallet
+// requires approval for are not sent, but kept as proposal which is returned with an ApprovalRequiredError.
+func (s *serviceImpl) SendTransaction(walletId string, dto TransactionDTO, userId string) (*Transaction, error) {
+
+	if err := s.userService.RequireStepUp(userId, dto.Totp, dto.StepUpToken); err != nil {
+		return nil, err
+	}
+
+	wallet, permission, err := resolveWallet(walletId, userId)
 	if err != nil {
 		return nil, err
 	}
+	if !permission.Includes(PROPOSE) {
+		return nil, ErrPermissionDenied
+	}
+
+	unlock := s.lockTransfers(walletId)
+	defer unlock()
 
-	log.Infof("Attaching network '%s' to container for wallet with id '%s'", config.Get().Webwallet.Network, wallet.Id.Hex())
+	if err := s.checkSendable(walletId); err != nil {
+		return nil, err
+	}
+	if err := checkLimits(wallet, dto); err != nil {
+		return nil, err
+	}
 
-	if err := s.dockerClient.NetworkConnect(ctx, config.Get().Webwallet.Network, wallet.Id.Hex(), nil); err != nil {
+	reasons, err := approvalReasons(wallet, permission, dto)
+	if err != nil {
 		return nil, err
 	}
+	if len(reasons) > 0 {
+		return s.propose(wallet, permission, dto, reasons, userId)
+	}
 
-	log.Infof("Starting container for wallet with id '%s'", wallet.Id.Hex())
+	return s.transfer(wallet, dto, bson.ObjectIdHex(userId))
+}
+
+func (s *serviceImpl) checkSendable(walletId string) error {
+	if running, _ := s.runtime.IsRunning(walletId); !running {
+		return ErrWalletNotRunning
+	}
+
+	if !statusWatcher.IsSynced(walletId) {
+		return ErrWalletNotSynced
+	}
+	return nil
+}
+
+// transferLock serializes the transfers of a wallet, it is dropped once nobody waits for it anymore.
+type transferLock struct {
+	mx      sync.Mutex
+	waiting int
+}
+
+// lockTransfers locks the transfers of the wallet and returns the func unlocking them. The lock has to be held from
+// checking the limits until the transfer is recorded, otherwise parallel transfers could all pass the same check.
+func (s *serviceImpl) lockTransfers(walletId string) func() {
+	s.transferMx.Lock()
+	l, ok := s.transferLocks[walletId]
+	if !ok {
+		l = &transferLock{}
+		s.transferLocks[walletId] = l
+	}
+	l.waiting++
+	s.transferMx.Unlock()
+
+	l.mx.Lock()
+	return func() {
+		l.mx.Unlock()
+
+		s.transferMx.Lock()
+		defer s.transferMx.Unlock()
+		l.waiting--
+		if l.waiting == 0 {
+			delete(s.transferLocks, walletId)
+		}
+	}
+}
 
-	if err := s.dockerClient.ContainerStart(ctx, wallet.Id.Hex(), types.ContainerStartOptions{}); err != nil {
+// transfer sends the transaction and records it for the daily limits of the policy and the limits of the wallet. The
+// caller has to hold the lock of the transfers of the wallet.
+func (s *serviceImpl) transfer(wallet *Wallet, dto TransactionDTO, sentBy bson.ObjectId) (*Transaction, error) {
+	walletId := wallet.Id.Hex()
+	if err := s.checkSendable(walletId); err != nil {
 		return nil, err
 	}
 
-	log.Debugf("Started container for wallet with id '%s'", wallet.Id.Hex())
+	walletd, err := s.runtime.Walletd(walletId)
+	if err != nil {
+		log.Errorf("Could not connect to wallet %s: %s", walletId, err.Error())
+		return nil, ErrCouldNotSendTransaction
+	}
 
-	loadedWallet := &LoadedWallet{
-		Wallet: wallet,
+	hash, err := walletd.SendTransaction(iridium.SendTransactionRequest{
+		Transfers: []iridium.Transfer{{Address: dto.Address, Amount: dto.Amount}},
+		Fee:       dto.Fee,
+		Anonymity: dto.Anonymity,
+		PaymentId: dto.PaymentId,
+	})
+	if err != nil {
+		log.Warnf("Could not send transaction from wallet %s: %s", walletId, err.Error())
+		return nil, ErrCouldNotSendTransaction
 	}
 
-	return loadedWallet, nil
+	log.Infof("Sent transaction %s from wallet %s", hash, walletId)
+
+	transaction := &Transaction{
+		Id:        bson.NewObjectId(),
+		WalletId:  wallet.Id,
+		Hash:      hash,
+		Address:   dto.Address,
+		Amount:    dto.Amount,
+		Fee:       dto.Fee,
+		PaymentId: dto.PaymentId,
+		SentBy:    sentBy,
+		Sent:      time.Now(),
+	}
+	if err := store.InsertTransaction(transaction); err != nil {
+		log.Errorf("Could not record transaction %s of wallet %s: %s", hash, walletId, err.Error())
+	}
+	return transaction, nil
 }
 
 func (s *serviceImpl) FetchDetails(wallet *LoadedWallet, rpc iridium.WalletdRPC) (*DetailedWallet, error) {
@@ -449,6 +904,7 @@ func (s *serviceImpl) FetchDetails(wallet *LoadedWallet, rpc iridium.WalletdRPC)
 		Top:     sRes.KnownBlockCount,
 	}
 	dWallet.PeerCount = sRes.PeerCount
+	statusWatcher.TrackSync(dWallet)
 
 	bRes, err := rpc.GetBalance()
 	if err != nil {
@@ -465,29 +921,9 @@ func (s *serviceImpl) FetchDetails(wallet *LoadedWallet, rpc iridium.WalletdRPC)
 }
 
 func (s *serviceImpl) NewWalletdClient(walletId string) (iridium.WalletdRPC, error) {
-	containerEndpoint, err := s.resolveContainerEndpoint(walletId)
-	if err != nil {
-		return nil, err
-	}
-	rpcHost := net.JoinHostPort(containerEndpoint, config.Get().Webwallet.Satellite.RpcPort)
-	rpcAddress := fmt.Sprintf("http://%s/json_rpc", rpcHost)
-
-	return iridium.Walletd(rpcAddress)
+	return s.runtime.Walletd(walletId)
 }
 
-func (s *serviceImpl) resolveContainerEndpoint(containerId string) (string, error) {
-	ctx := context.Background()
-
-	if config.Get().Webwallet.InternalResolver {
-		return containerId, nil
-	} else {
-		log.Debugf("Using 'ip' resolver to get the satellites endpoint address")
-		inspect, err := s.dockerClient.ContainerInspect(ctx, containerId)
-		if err != nil {
-			return "", err
-		}
-
-		return inspect.NetworkSettings.Networks[config.Get().Webwallet.Network].IPAddress, nil
-	}
-
+func (s *serviceImpl) CheckHealth(walletId string) error {
+	return s.runtime.CheckHealth(walletId)
 }
@@ -0,0 +1,127 @@
+package wallet
+
+import (
+	"github.com/iridiumdev/webwallet-core/iridium"
+	"github.com/iridiumdev/webwallet-core/job"
+	"github.com/iridiumdev/webwallet-core/user"
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+)
+
+func TestDeleteWallets(t *testing.T) {
+	f := newFixture("")
+	running := storedWallet(f)
+	if _, err := f.service.startWallet(running, "password", &job.Job{}); err != nil {
+		t.Fatal(err)
+	}
+	stopped := storedWallet(f)
+	f.store.wallets[stopped.Id].Owner = running.Owner
+	other := storedWallet(f)
+
+	if err := f.service.DeleteWallets(running.Owner.Hex()); err != nil {
+		t.Fatal(err)
+	}
+
+	f.assertClean(t, other.volumeName())
+	if len(f.store.wallets) != 1 || f.store.wallets[other.Id] == nil {
+		t.Errorf("expected only the wallet of the other user to be left, got %v", f.store.wallets)
+	}
+}
+
+func TestDeleteWalletsAbortsOnBusyWallet(t *testing.T) {
+	f := newFixture("")
+	wallet := storedWallet(f)
+	f.service.markBusy(wallet.Id.Hex())
+
+	if err := f.service.DeleteWallets(wallet.Owner.Hex()); err != ErrWalletBusy {
+		t.Errorf("expected %v, got %v", ErrWalletBusy, err)
+	}
+	if f.store.wallets[wallet.Id] == nil {
+		t.Error("expected busy wallet to be kept")
+	}
+}
+
+func TestForceStopWallet(t *testing.T) {
+	f := newFixture("")
+	wallet := storedWallet(f)
+	if _, err := f.service.startWallet(wallet, "password", &job.Job{}); err != nil {
+		t.Fatal(err)
+	}
+
+	states, err := f.service.GetAllWallets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 1 || states[0].Status != RUNNING || !states[0].Watched {
+		t.Errorf("expected the running wallet to be watched, got %+v", states)
+	}
+
+	stopped, err := f.service.ForceStopWallet(wallet.Id.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stopped.Status != STOPPED {
+		t.Errorf("expected wallet to be stopped, got %s", stopped.Status)
+	}
+	f.assertClean(t, wallet.volumeName())
+
+	if _, err := f.service.ForceStopWallet(wallet.Id.Hex()); err != ErrWalletNotRunning {
+		t.Errorf("expected %v, got %v", ErrWalletNotRunning, err)
+	}
+}
+
+func TestSendTransactionRequiresTotp(t *testing.T) {
+	f := newFixture("")
+	userId := bson.NewObjectId().Hex()
+	f.users.totp = "123456"
+
+	f.runtime.walletd.status = iridium.GetStatusResponse{BlockCount: 1000, KnownBlockCount: 1000}
+	dWallet, err := f.service.createWallet(CreateDTO{Name: "test"}, userId, &job.Job{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dto := TransactionDTO{Address: "ir2other", Amount: 1000, Fee: 10}
+	if _, err := f.service.SendTransaction(dWallet.Id.Hex(), dto, userId); err != user.ErrTotpRequired {
+		t.Errorf("expected %v, got %v", user.ErrTotpRequired, err)
+	}
+
+	dto.Totp = "654321"
+	if _, err := f.service.SendTransaction(dWallet.Id.Hex(), dto, userId); err != user.ErrInvalidTotp {
+		t.Errorf("expected %v, got %v", user.ErrInvalidTotp, err)
+	}
+	if len(f.runtime.walletd.sent) != 0 {
+		t.Errorf("expected nothing to be sent, got %v", f.runtime.walletd.sent)
+	}
+
+	dto.Totp = "123456"
+	if _, err := f.service.SendTransaction(dWallet.Id.Hex(), dto, userId); err != nil {
+		t.Fatal(err)
+	}
+
+	// a passkey step-up replaces the code
+	dto.Totp, dto.StepUpToken = "", "step-up"
+	if _, err := f.service.SendTransaction(dWallet.Id.Hex(), dto, userId); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPublicErrorHidesRuntimeErrors(t *testing.T) {
+	j := &job.Job{Id: bson.NewObjectId()}
+
+	f := newFixture("satellite")
+	_, err := f.service.startWallet(storedWallet(f), "password", j)
+	if public := publicError(j, err, ErrCouldNotStartWallet); public != ErrCouldNotStartWallet {
+		t.Errorf("expected %v, got %v", ErrCouldNotStartWallet, public)
+	}
+
+	f = newFixture("store")
+	_, err = f.service.createWallet(CreateDTO{Name: "test"}, bson.NewObjectId().Hex(), j)
+	if public := publicError(j, err, ErrCouldNotCreateWallet); public != ErrCouldNotSaveWallet {
+		t.Errorf("expected %v, got %v", ErrCouldNotSaveWallet, public)
+	}
+
+	if public := publicError(j, ErrWalletBusy, ErrCouldNotStartWallet); public != ErrWalletBusy {
+		t.Errorf("expected %v, got %v", ErrWalletBusy, public)
+	}
+}
@@ -3,17 +3,67 @@ package wallet
 import (
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
+	"time"
 )
 
 type mongoDb struct {
-	db      *mgo.Database
-	wallets *mgo.Collection
+	db           *mgo.Database
+	wallets      *mgo.Collection
+	memberships  *mgo.Collection
+	proposals    *mgo.Collection
+	transactions *mgo.Collection
 }
 
 type Store interface {
 	InsertWallet(wallet *Wallet) error
+	FindWallets() ([]*Wallet, error)
+	FindWallet(walletId bson.ObjectId) (*Wallet, error)
 	FindWalletsByOwner(userId bson.ObjectId) ([]*Wallet, error)
 	FindWalletByOwner(walletId bson.ObjectId, userId bson.ObjectId) (*Wallet, error)
+	UpdateVolume(walletId bson.ObjectId, volume string) error
+	UpdateLastError(walletId bson.ObjectId, lastError *InstanceError) error
+	DeleteWallet(walletId bson.ObjectId) error
+
+	// FindWalletsByMember returns the wallets the user owns or is an accepted member of.
+	FindWalletsByMember(userId bson.ObjectId) ([]*Wallet, error)
+	// FindWalletByMember returns the wallet along with the permission of the user, who is either its owner or an
+	// accepted member.
+	FindWalletByMember(walletId bson.ObjectId, userId bson.ObjectId) (*Wallet, Permission, error)
+
+	InsertMembership(membership *Membership) error
+	FindMembership(walletId bson.ObjectId, userId bson.ObjectId) (*Membership, error)
+	FindMembers(walletId bson.ObjectId) ([]*Membership, error)
+	// FindInvitations returns the memberships of the user which have not been accepted yet.
+	FindInvitations(userId bson.ObjectId) ([]*Membership, error)
+	AcceptMembership(walletId bson.ObjectId, userId bson.ObjectId) error
+	UpdatePermission(walletId bson.ObjectId, userId bson.ObjectId, permission Permission) error
+	DeleteMembership(walletId bson.ObjectId, userId bson.ObjectId) error
+	DeleteMembershipsOfWallet(walletId bson.ObjectId) error
+	DeleteMembershipsOfUser(userId bson.ObjectId) error
+
+	UpdatePolicy(walletId bson.ObjectId, policy *Policy) error
+	InsertProposal(proposal *Proposal) error
+	FindProposal(walletId bson.ObjectId, proposalId bson.ObjectId) (*Proposal, error)
+	FindProposals(walletId bson.ObjectId) ([]*Proposal, error)
+	// AddDecision adds the decision to the proposal if it is still pending and the user did not decide yet, otherwise
+	// it returns mgo.ErrNotFound.
+	AddDecision(proposalId bson.ObjectId, decision *Decision) error
+	// UpdateProposalStatus changes the status of the proposal if it still has the expected one, otherwise it returns
+	// mgo.ErrNotFound.
+	UpdateProposalStatus(proposalId bson.ObjectId, expected ProposalStatus, status ProposalStatus) error
+	UpdateProposal(proposal *Proposal) error
+	DeleteProposalsOfWallet(walletId bson.ObjectId) error
+
+	InsertTransaction(transaction *Transaction) error
+	// SumTransactions returns the amount sent from the wallet since the given time.
+	SumTransactions(walletId bson.ObjectId, since time.Time) (uint64, error)
+	DeleteTransactionsOfWallet(walletId bson.ObjectId) error
+
+	// UpdateLimits sets the limits in force and replaces the pending ones, nil removes them.
+	UpdateLimits(walletId bson.ObjectId, limits LimitsDTO, pending *PendingLimits) error
+	// AddAllowlistEntry adds the entry unless its address is already allowlisted, otherwise it returns mgo.ErrNotFound.
+	AddAllowlistEntry(walletId bson.ObjectId, entry *AllowlistEntry) error
+	RemoveAllowlistEntry(walletId bson.ObjectId, address string) error
 }
 
 var store Store
@@ -23,6 +73,18 @@ func (db *mongoDb) InsertWallet(wallet *Wallet) error {
 	return err
 }
 
+func (db *mongoDb) FindWallets() ([]*Wallet, error) {
+	var results []*Wallet
+	err := db.wallets.Find(nil).All(&results)
+	return results, err
+}
+
+func (db *mongoDb) FindWallet(walletId bson.ObjectId) (*Wallet, error) {
+	var result *Wallet
+	err := db.wallets.FindId(walletId).One(&result)
+	return result, err
+}
+
 func (db *mongoDb) FindWalletsByOwner(userId bson.ObjectId) ([]*Wallet, error) {
 	var results []*Wallet
 	err := db.wallets.Find(bson.M{"owner": userId}).All(&results)
@@ -35,6 +97,212 @@ func (db *mongoDb) FindWalletByOwner(walletId bson.ObjectId, userId bson.ObjectI
 	return result, err
 }
 
+func (db *mongoDb) UpdateVolume(walletId bson.ObjectId, volume string) error {
+	return db.wallets.UpdateId(walletId, bson.M{"$set": bson.M{"volume": volume}})
+}
+
+func (db *mongoDb) UpdateLastError(walletId bson.ObjectId, lastError *InstanceError) error {
+	if lastError == nil {
+		return db.wallets.UpdateId(walletId, bson.M{"$unset": bson.M{"lastError": ""}})
+	}
+	return db.wallets.UpdateId(walletId, bson.M{"$set": bson.M{"lastError": lastError}})
+}
+
+func (db *mongoDb) DeleteWallet(walletId bson.ObjectId) error {
+	return db.wallets.RemoveId(walletId)
+}
+
+func (db *mongoDb) FindWalletsByMember(userId bson.ObjectId) ([]*Wallet, error) {
+	var memberships []*Membership
+	if err := db.memberships.Find(bson.M{"userId": userId, "accepted": true}).All(&memberships); err != nil {
+		return nil, err
+	}
+	walletIds := make([]bson.ObjectId, 0, len(memberships))
+	for _, membership := range memberships {
+		walletIds = append(walletIds, membership.WalletId)
+	}
+
+	var results []*Wallet
+	err := db.wallets.Find(bson.M{"$or": []bson.M{
+		{"owner": userId},
+		{"_id": bson.M{"$in": walletIds}},
+	}}).All(&results)
+	return results, err
+}
+
+func (db *mongoDb) FindWalletByMember(walletId bson.ObjectId, userId bson.ObjectId) (*Wallet, Permission, error) {
+	var wallet *Wallet
+	if err := db.wallets.FindId(walletId).One(&wallet); err != nil {
+		return nil, "", err
+	}
+	if wallet.Owner == userId {
+		return wallet, OWNER, nil
+	}
+
+	var membership *Membership
+	err := db.memberships.Find(bson.M{"walletId": walletId, "userId": userId, "accepted": true}).One(&membership)
+	if err != nil {
+		return nil, "", err
+	}
+	return wallet, membership.Permission, nil
+}
+
+func (db *mongoDb) InsertMembership(membership *Membership) error {
+	return db.memberships.Insert(membership)
+}
+
+func (db *mongoDb) FindMembership(walletId bson.ObjectId, userId bson.ObjectId) (*Membership, error) {
+	var result *Membership
+	err := db.memberships.Find(bson.M{"walletId": walletId, "userId": userId}).One(&result)
+	return result, err
+}
+
+func (db *mongoDb) FindMembers(walletId bson.ObjectId) ([]*Membership, error) {
+	results := []*Membership{}
+	err := db.memberships.Find(bson.M{"walletId": walletId}).Sort("created").All(&results)
+	return results, err
+}
+
+func (db *mongoDb) FindInvitations(userId bson.ObjectId) ([]*Membership, error) {
+	results := []*Membership{}
+	err := db.memberships.Find(bson.M{"userId": userId, "accepted": false}).Sort("created").All(&results)
+	return results, err
+}
+
+func (db *mongoDb) AcceptMembership(walletId bson.ObjectId, userId bson.ObjectId) error {
+	return db.memberships.Update(bson.M{"walletId": walletId, "userId": userId}, bson.M{"$set": bson.M{"accepted": true}})
+}
+
+func (db *mongoDb) UpdatePermission(walletId bson.ObjectId, userId bson.ObjectId, permission Permission) error {
+	return db.memberships.Update(bson.M{"walletId": walletId, "userId": userId}, bson.M{"$set": bson.M{"permission": permission}})
+}
+
+func (db *mongoDb) DeleteMembership(walletId bson.ObjectId, userId bson.ObjectId) error {
+	return db.memberships.Remove(bson.M{"walletId": walletId, "userId": userId})
+}
+
+func (db *mongoDb) DeleteMembershipsOfWallet(walletId bson.ObjectId) error {
+	_, err := db.memberships.RemoveAll(bson.M{"walletId": walletId})
+	return err
+}
+
+func (db *mongoDb) DeleteMembershipsOfUser(userId bson.ObjectId) error {
+	_, err := db.memberships.RemoveAll(bson.M{"userId": userId})
+	return err
+}
+
+func (db *mongoDb) UpdatePolicy(walletId bson.ObjectId, policy *Policy) error {
+	if policy == nil {
+		return db.wallets.UpdateId(walletId, bson.M{"$unset": bson.M{"policy": ""}})
+	}
+	return db.wallets.UpdateId(walletId, bson.M{"$set": bson.M{"policy": policy}})
+}
+
+func (db *mongoDb) InsertProposal(proposal *Proposal) error {
+	return db.proposals.Insert(proposal)
+}
+
+func (db *mongoDb) FindProposal(walletId bson.ObjectId, proposalId bson.ObjectId) (*Proposal, error) {
+	var result *Proposal
+	err := db.proposals.Find(bson.M{"_id": proposalId, "walletId": walletId}).One(&result)
+	return result, err
+}
+
+func (db *mongoDb) FindProposals(walletId bson.ObjectId) ([]*Proposal, error) {
+	results := []*Proposal{}
+	err := db.proposals.Find(bson.M{"walletId": walletId}).Sort("-created").All(&results)
+	return results, err
+}
+
+func (db *mongoDb) AddDecision(proposalId bson.ObjectId, decision *Decision) error {
+	return db.proposals.Update(
+		bson.M{"_id": proposalId, "status": PENDING, "decisions.userId": bson.M{"$ne": decision.UserId}},
+		bson.M{"$push": bson.M{"decisions": decision}},
+	)
+}
+
+func (db *mongoDb) UpdateProposalStatus(proposalId bson.ObjectId, expected ProposalStatus, status ProposalStatus) error {
+	return db.proposals.Update(bson.M{"_id": proposalId, "status": expected}, bson.M{"$set": bson.M{"status": status}})
+}
+
+func (db *mongoDb) UpdateProposal(proposal *Proposal) error {
+	return db.proposals.UpdateId(proposal.Id, proposal)
+}
+
+func (db *mongoDb) DeleteProposalsOfWallet(walletId bson.ObjectId) error {
+	_, err := db.proposals.RemoveAll(bson.M{"walletId": walletId})
+	return err
+}
+
+func (db *mongoDb) InsertTransaction(transaction *Transaction) error {
+	return db.transactions.Insert(transaction)
+}
+
+func (db *mongoDb) SumTransactions(walletId bson.ObjectId, since time.Time) (uint64, error) {
+	var result struct {
+		Total int64 `bson:"total"`
+	}
+	err := db.transactions.Pipe([]bson.M{
+		{"$match": bson.M{"walletId": walletId, "sent": bson.M{"$gte": since}}},
+		{"$group": bson.M{"_id": nil, "total": bson.M{"$sum": "$amount"}}},
+	}).One(&result)
+	if err == mgo.ErrNotFound {
+		return 0, nil
+	}
+	return uint64(result.Total), err
+}
+
+func (db *mongoDb) DeleteTransactionsOfWallet(walletId bson.ObjectId) error {
+	_, err := db.transactions.RemoveAll(bson.M{"walletId": walletId})
+	return err
+}
+
+func (db *mongoDb) UpdateLimits(walletId bson.ObjectId, limits LimitsDTO, pending *PendingLimits) error {
+	set := bson.M{
+		"limits.maxAmount":        limits.MaxAmount,
+		"limits.dailyLimit":       limits.DailyLimit,
+		"limits.weeklyLimit":      limits.WeeklyLimit,
+		"limits.requireAllowlist": limits.RequireAllowlist,
+	}
+	update := bson.M{"$set": set}
+	if pending != nil {
+		set["limits.pending"] = pending
+	} else {
+		update["$unset"] = bson.M{"limits.pending": ""}
+	}
+	return db.wallets.UpdateId(walletId, update)
+}
+
+func (db *mongoDb) AddAllowlistEntry(walletId bson.ObjectId, entry *AllowlistEntry) error {
+	return db.wallets.Update(
+		bson.M{"_id": walletId, "limits.allowlist.address": bson.M{"$ne": entry.Address}},
+		bson.M{"$push": bson.M{"limits.allowlist": entry}},
+	)
+}
+
+func (db *mongoDb) RemoveAllowlistEntry(walletId bson.ObjectId, address string) error {
+	return db.wallets.Update(
+		bson.M{"_id": walletId, "limits.allowlist.address": address},
+		bson.M{"$pull": bson.M{"limits.allowlist": bson.M{"address": address}}},
+	)
+}
+
 func InitStore(db *mgo.Database) {
-	store = &mongoDb{db: db, wallets: db.C("wallets")}
+	membershipsCollection := db.C("memberships")
+	membershipsCollection.EnsureIndex(mgo.Index{Key: []string{"walletId", "userId"}, Unique: true})
+	membershipsCollection.EnsureIndex(mgo.Index{Key: []string{"userId"}})
+
+	proposalsCollection := db.C("proposals")
+	proposalsCollection.EnsureIndex(mgo.Index{Key: []string{"walletId", "-created"}})
+
+	transactionsCollection := db.C("transactions")
+	transactionsCollection.EnsureIndex(mgo.Index{Key: []string{"walletId", "sent"}})
+
+	store = &mongoDb{
+		db:           db,
+		wallets:      db.C("wallets"),
+		memberships:  membershipsCollection,
+		proposals:    proposalsCollection,
+		transactions: transactionsCollection,
+	}
 }
@@ -0,0 +1,102 @@
+package wallet
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// number of block count samples kept per wallet to compute the sync rate
+	syncHistorySize = 12
+	// a wallet lagging at most this many blocks behind the network is considered to be synced
+	syncTolerance = 1
+)
+
+type syncSample struct {
+	time   time.Time
+	blocks uint32
+}
+
+// syncTracker keeps a rolling history of the block counts of the running wallets.
+type syncTracker struct {
+	mx      sync.Mutex
+	history map[string][]syncSample
+	synced  map[string]bool
+}
+
+func newSyncTracker() *syncTracker {
+	return &syncTracker{
+		history: make(map[string][]syncSample),
+		synced:  make(map[string]bool),
+	}
+}
+
+// track records the current block height of the wallet and updates its sync progress and status accordingly.
+func (t *syncTracker) track(dWallet *DetailedWallet) {
+	height := dWallet.BlockHeight
+	dWallet.Sync = t.record(dWallet.Id.Hex(), height, time.Now())
+
+	if isSynced(height) {
+		dWallet.Status = SYNCED
+	} else {
+		dWallet.Status = SYNCING
+	}
+}
+
+func (t *syncTracker) record(walletId string, height BlockHeight, now time.Time) SyncProgress {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	history := t.history[walletId]
+	// the satellite started over (e.g. a rescan after a reset), previous samples are meaningless
+	if len(history) > 0 && height.Current < history[len(history)-1].blocks {
+		history = nil
+	}
+	history = append(history, syncSample{time: now, blocks: height.Current})
+	if len(history) > syncHistorySize {
+		history = history[len(history)-syncHistorySize:]
+	}
+	t.history[walletId] = history
+	t.synced[walletId] = isSynced(height)
+
+	progress := SyncProgress{}
+	if height.Top > 0 {
+		progress.Percentage = float64(height.Current) * 100 / float64(height.Top)
+		if progress.Percentage > 100 {
+			progress.Percentage = 100
+		}
+	}
+
+	first, last := history[0], history[len(history)-1]
+	if elapsed := last.time.Sub(first.time).Seconds(); elapsed > 0 {
+		progress.BlocksPerSecond = float64(last.blocks-first.blocks) / elapsed
+	}
+
+	if isSynced(height) {
+		eta := int64(0)
+		progress.EtaSeconds = &eta
+	} else if progress.BlocksPerSecond > 0 && height.Top > height.Current {
+		// the top block is unknown (0) until the satellite found peers, so there is no ETA before
+		eta := int64(float64(height.Top-height.Current) / progress.BlocksPerSecond)
+		progress.EtaSeconds = &eta
+	}
+
+	return progress
+}
+
+func (t *syncTracker) isSynced(walletId string) bool {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	return t.synced[walletId]
+}
+
+func (t *syncTracker) forget(walletId string) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	delete(t.history, walletId)
+	delete(t.synced, walletId)
+}
+
+func isSynced(height BlockHeight) bool {
+	return height.Top > 0 && height.Current+syncTolerance >= height.Top
+}
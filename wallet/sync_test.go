@@ -0,0 +1,113 @@
+package wallet
+
+import (
+	"github.com/iridiumdev/webwallet-core/iridium"
+	"github.com/iridiumdev/webwallet-core/job"
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+	"time"
+)
+
+func TestSyncTrackerComputesRateAndEta(t *testing.T) {
+	tracker := newSyncTracker()
+	start := time.Now()
+
+	tracker.record("w", BlockHeight{Current: 100, Top: 1100}, start)
+	progress := tracker.record("w", BlockHeight{Current: 200, Top: 1100}, start.Add(10*time.Second))
+
+	if progress.BlocksPerSecond != 10 {
+		t.Errorf("expected 10 blocks/s, got %f", progress.BlocksPerSecond)
+	}
+	if progress.EtaSeconds == nil || *progress.EtaSeconds != 90 {
+		t.Errorf("expected an ETA of 90s, got %v", progress.EtaSeconds)
+	}
+	if progress.Percentage < 18.18 || progress.Percentage > 18.19 {
+		t.Errorf("expected 18.18%%, got %f", progress.Percentage)
+	}
+	if tracker.isSynced("w") {
+		t.Error("expected wallet to be syncing")
+	}
+}
+
+func TestSyncTrackerWithoutProgressHasNoEta(t *testing.T) {
+	tracker := newSyncTracker()
+
+	progress := tracker.record("w", BlockHeight{Current: 100, Top: 1100}, time.Now())
+
+	if progress.EtaSeconds != nil {
+		t.Errorf("expected no ETA, got %d", *progress.EtaSeconds)
+	}
+}
+
+func TestSyncTrackerWithoutTopHasNoEta(t *testing.T) {
+	tracker := newSyncTracker()
+	start := time.Now()
+
+	tracker.record("w", BlockHeight{Current: 100}, start)
+	progress := tracker.record("w", BlockHeight{Current: 200}, start.Add(10*time.Second))
+
+	if progress.EtaSeconds != nil {
+		t.Errorf("expected no ETA, got %d", *progress.EtaSeconds)
+	}
+}
+
+func TestSyncTrackerDropsHistoryOnRescan(t *testing.T) {
+	tracker := newSyncTracker()
+	start := time.Now()
+
+	tracker.record("w", BlockHeight{Current: 500, Top: 1000}, start)
+	progress := tracker.record("w", BlockHeight{Current: 10, Top: 1000}, start.Add(time.Second))
+
+	if progress.BlocksPerSecond != 0 {
+		t.Errorf("expected rate to be reset, got %f", progress.BlocksPerSecond)
+	}
+}
+
+func TestSyncTrackerKeepsBoundedHistory(t *testing.T) {
+	tracker := newSyncTracker()
+	start := time.Now()
+
+	for i := 0; i < syncHistorySize*2; i++ {
+		tracker.record("w", BlockHeight{Current: uint32(i), Top: 1000}, start.Add(time.Duration(i)*time.Second))
+	}
+
+	if len(tracker.history["w"]) != syncHistorySize {
+		t.Errorf("expected %d samples, got %d", syncHistorySize, len(tracker.history["w"]))
+	}
+}
+
+func TestSendTransactionRequiresSyncedWallet(t *testing.T) {
+	f := newFixture("")
+	userId := bson.NewObjectId().Hex()
+
+	f.runtime.walletd.status = iridium.GetStatusResponse{BlockCount: 10, KnownBlockCount: 1000}
+	dWallet, err := f.service.createWallet(CreateDTO{Name: "test"}, userId, &job.Job{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dWallet.Status != SYNCING {
+		t.Errorf("expected status %s, got %s", SYNCING, dWallet.Status)
+	}
+
+	dto := TransactionDTO{Address: "ir2other", Amount: 1000, Fee: 10}
+	if _, err := f.service.SendTransaction(dWallet.Id.Hex(), dto, userId); err != ErrWalletNotSynced {
+		t.Errorf("expected %v, got %v", ErrWalletNotSynced, err)
+	}
+
+	f.runtime.walletd.status = iridium.GetStatusResponse{BlockCount: 1000, KnownBlockCount: 1000}
+	dWallet, err = f.service.FetchDetails(&LoadedWallet{Wallet: dWallet.Wallet}, f.runtime.walletd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dWallet.Status != SYNCED {
+		t.Errorf("expected status %s, got %s", SYNCED, dWallet.Status)
+	}
+
+	transaction, err := f.service.SendTransaction(dWallet.Id.Hex(), dto, userId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transaction.Hash != "txhash" || len(f.runtime.walletd.sent) != 1 {
+		t.Errorf("expected transaction to be sent, got %v", transaction)
+	}
+}
@@ -6,6 +6,12 @@ export interface BlockHeight {
   top: number;
 }
 
+export interface SyncProgress {
+  percentage: number;
+  blocksPerSecond: number;
+  etaSeconds?: number;
+}
+
 export interface Balance {
   total: number;
   locked: number;
@@ -15,5 +21,6 @@ export interface DetailedWallet extends Wallet{
 
   balance: Balance;
   blockHeight: BlockHeight;
+  sync: SyncProgress;
   peerCount: number;
 }
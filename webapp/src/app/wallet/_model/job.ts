@@ -0,0 +1,20 @@
+export enum JobState {
+  PENDING = "PENDING",
+  RUNNING = "RUNNING",
+  SUCCEEDED = "SUCCEEDED",
+  FAILED = "FAILED"
+}
+
+export interface Job {
+
+  id: string;
+  type: string;
+  owner: string;
+  walletId?: string;
+  state: JobState;
+  step?: string;
+  error?: string;
+  created: string;
+  updated: string;
+
+}
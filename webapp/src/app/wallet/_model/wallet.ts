@@ -3,7 +3,9 @@ import {PasswordDto} from "./password-dto";
 export enum InstanceStatus {
   STOPPED = "STOPPED",
   RUNNING = "RUNNING",
-  ERROR = "ERROR"
+  ERROR = "ERROR",
+  SYNCING = "SYNCING",
+  SYNCED = "SYNCED"
 }
 
 export interface Wallet extends PasswordDto {
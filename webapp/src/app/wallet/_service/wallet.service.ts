@@ -1,12 +1,14 @@
 import {Injectable} from '@angular/core';
 import {WalletModule} from "../wallet.module";
 import {HttpClient} from "@angular/common/http";
-import {Observable} from "rxjs";
+import {Observable, throwError, timer} from "rxjs";
+import {filter, first, mergeMap, switchMap} from "rxjs/operators";
 import {DetailedWallet} from "../_model/detailed-wallet";
 import {PasswordDto} from "../_model/password-dto";
 import {Wallet} from "../_model/wallet";
 import {ImportDto} from "../_model/import-dto";
 import {CreateDto} from "../_model/create-dto";
+import {Job, JobState} from "../_model/job";
 
 @Injectable({
   providedIn: WalletModule
@@ -17,11 +19,15 @@ export class WalletService {
   }
 
   createWallet(dto: CreateDto): Observable<DetailedWallet> {
-    return this.http.post<DetailedWallet>('/api/v1/wallets', dto)
+    return this.http.post<Job>('/api/v1/wallets', dto).pipe(
+      mergeMap(job => this.awaitJob(job))
+    )
   }
 
   importWallet(dto: ImportDto): Observable<DetailedWallet> {
-    return this.http.post<DetailedWallet>('/api/v1/wallets', dto)
+    return this.http.post<Job>('/api/v1/wallets', dto).pipe(
+      mergeMap(job => this.awaitJob(job))
+    )
   }
 
   getWalletList(): Observable<Wallet[]> {
@@ -29,7 +35,9 @@ export class WalletService {
   }
 
   loadWallet(id: string, pw: PasswordDto): Observable<DetailedWallet> {
-    return this.http.post<DetailedWallet>(`/api/v1/wallets/${id}/instance`, pw)
+    return this.http.post<Job>(`/api/v1/wallets/${id}/instance`, pw).pipe(
+      mergeMap(job => this.awaitJob(job))
+    )
   }
 
   lockWallet(id: string): Observable<Wallet> {
@@ -40,4 +48,22 @@ export class WalletService {
     return this.http.get<DetailedWallet>(`/api/v1/wallets/${id}`)
   }
 
+  getJob(id: string): Observable<Job> {
+    return this.http.get<Job>(`/api/v1/jobs/${id}`)
+  }
+
+  /**
+   * Polls the given provisioning job until it is finished and emits the provisioned wallet.
+   */
+  private awaitJob(job: Job): Observable<DetailedWallet> {
+    return timer(0, 1000).pipe(
+      switchMap(() => this.getJob(job.id)),
+      filter(j => j.state === JobState.SUCCEEDED || j.state === JobState.FAILED),
+      first(),
+      mergeMap(j => j.state === JobState.SUCCEEDED
+        ? this.getDetailedWallet(j.walletId)
+        : throwError(j.error))
+    )
+  }
+
 }